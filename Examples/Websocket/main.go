@@ -1,13 +1,14 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
 	"log"
 	"net/http"
-	"strings"
-	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/weeback/grpc-project-template/pkg"
 	"github.com/weeback/grpc-project-template/pkg/net"
@@ -17,9 +18,15 @@ func main() {
 
 	pkg.Import()
 
+	// Register the handlers of the message types sent by the clients
+	hub := net.NewHub()
+	router := newRouter(hub)
+
 	// Set up HTTP routes
 	http.HandleFunc("/", serveHome)
-	http.HandleFunc("/ws", serveWS)
+	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		serveWS(hub, router, w, r)
+	})
 
 	// Start the server
 	port := ":8080"
@@ -29,11 +36,115 @@ func main() {
 	log.Fatal(http.ListenAndServe(port, nil))
 }
 
+// chatMessage is the payload of a "chat.message" sent to the clients, and of the chat requests.
+type chatMessage struct {
+	From    string `json:"from,omitempty"`
+	To      string `json:"to,omitempty"`
+	Room    string `json:"room,omitempty"`
+	Content string `json:"content"`
+}
+
+// roomRequest is the payload of the "room.*" requests.
+type roomRequest struct {
+	Room string `json:"room"`
+}
+
+// newRouter registers the message types of the example:
+//
+//	chat.echo      {content}        -> response {content}
+//	chat.broadcast {content}        -> ack, chat.message to every client
+//	chat.direct    {to, content}    -> ack, chat.message to the client "to"
+//	room.join      {room}           -> ack
+//	room.leave     {room}           -> ack
+//	room.members   {room}           -> response {room, members}
+//	room.publish   {room, content}  -> ack, chat.message to the members of the room
+func newRouter(hub *net.Hub) *net.WSRouter {
+	router := net.NewWSRouter()
+
+	router.Handle("chat.echo", func(ctx context.Context, client net.MessageChannel, msg *net.Envelope) (any, error) {
+		var req chatMessage
+		if err := msg.Decode(&req); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		return chatMessage{From: client.ID(), Content: req.Content}, nil
+	})
+
+	router.Handle("chat.broadcast", func(ctx context.Context, client net.MessageChannel, msg *net.Envelope) (any, error) {
+		var req chatMessage
+		if err := msg.Decode(&req); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		out, err := net.MarshalEnvelope("chat.message", chatMessage{From: client.ID(), Content: req.Content})
+		if err != nil {
+			return nil, err
+		}
+		return nil, hub.BroadcastMessage(out)
+	})
+
+	router.Handle("chat.direct", func(ctx context.Context, client net.MessageChannel, msg *net.Envelope) (any, error) {
+		var req chatMessage
+		if err := msg.Decode(&req); err != nil || req.To == "" {
+			return nil, status.Error(codes.InvalidArgument, "a receiver \"to\" is required")
+		}
+		out, err := net.MarshalEnvelope("chat.message", chatMessage{From: client.ID(), To: req.To, Content: req.Content})
+		if err != nil {
+			return nil, err
+		}
+		if err := hub.SendTo(req.To, websocket.TextMessage, out); err != nil {
+			return nil, status.Errorf(codes.NotFound, "receiver %s is not connected: %v", req.To, err)
+		}
+		return nil, nil
+	})
+
+	router.Handle("room.join", func(ctx context.Context, client net.MessageChannel, msg *net.Envelope) (any, error) {
+		var req roomRequest
+		if err := msg.Decode(&req); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		return nil, hub.Join(client.ID(), req.Room)
+	})
+
+	router.Handle("room.leave", func(ctx context.Context, client net.MessageChannel, msg *net.Envelope) (any, error) {
+		var req roomRequest
+		if err := msg.Decode(&req); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		return nil, hub.Leave(client.ID(), req.Room)
+	})
+
+	router.Handle("room.members", func(ctx context.Context, client net.MessageChannel, msg *net.Envelope) (any, error) {
+		var req roomRequest
+		if err := msg.Decode(&req); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		members, err := hub.RoomMembers(req.Room)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"room": req.Room, "members": members}, nil
+	})
+
+	router.Handle("room.publish", func(ctx context.Context, client net.MessageChannel, msg *net.Envelope) (any, error) {
+		var req chatMessage
+		if err := msg.Decode(&req); err != nil || req.Room == "" {
+			return nil, status.Error(codes.InvalidArgument, "a room is required")
+		}
+		// Publish the message to the clients of the room only, the sender included if a member
+		out, err := net.MarshalEnvelope("chat.message", chatMessage{From: client.ID(), Room: req.Room, Content: req.Content})
+		if err != nil {
+			return nil, err
+		}
+		return nil, hub.PublishToRoom(req.Room, out)
+	})
+
+	return router
+}
+
 // serveWS handles WebSocket requests from clients
-func serveWS(w http.ResponseWriter, r *http.Request) {
+func serveWS(hub *net.Hub, router *net.WSRouter, w http.ResponseWriter, r *http.Request) {
 	// Upgrade HTTP connection to WebSocket
 
-	ch, mh, err := net.UpgradeToWebSocket(w, r)
+	_, mh, err := net.UpgradeToWebSocketCustom(hub, w, r)
 	if err != nil {
 		log.Printf("Failed to upgrade to WebSocket: %v", err)
 		return
@@ -44,99 +155,23 @@ func serveWS(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Send welcome message to the new client
-	welcomeMessage, _ := json.Marshal(map[string]any{
-		"type":      "welcome",
-		"message":   fmt.Sprintf("Welcome to the WebSocket server! You are connected as %s", mh.ID()),
-		"timestamp": time.Now().Format(time.RFC3339),
-	}) // fmt.Sprintf("Welcome to the WebSocket server! You are connected as %s\n", mh.ID())
-	if err := mh.SendMessage(welcomeMessage); err != nil {
-		log.Printf("Failed to send welcome message: %v", err)
-		return
-	}
-	welcomeMessage, _ = json.Marshal(map[string]any{
-		"type":      "message",
-		"from":      "admin",
-		"content":   "[!] Use /ALL <message> to broadcast a message to all clients",
-		"timestamp": time.Now().Format(time.RFC3339),
+	welcome, err := net.NewEnvelope("welcome", map[string]any{
+		"clientId": mh.ID(),
+		"message":  fmt.Sprintf("Welcome to the WebSocket server! You are connected as %s", mh.ID()),
 	})
-	if err := mh.SendMessage(welcomeMessage); err != nil {
-		log.Printf("Failed to send welcome message: %v", err)
-		return
+	if err == nil {
+		err = net.SendEnvelope(mh, welcome)
 	}
-	welcomeMessage, _ = json.Marshal(map[string]any{
-		"type":      "message",
-		"from":      "admin",
-		"content":   "[!] Use /CID-<client_id> <message> to send a message to a specific client",
-		"timestamp": time.Now().Format(time.RFC3339),
-	})
-	if err := mh.SendMessage(welcomeMessage); err != nil {
+	if err != nil {
 		log.Printf("Failed to send welcome message: %v", err)
 		return
 	}
 
 	log.Printf("New client connected: %s", mh.ID())
 
-	// Start reading messages from the client
-	for {
-		message, err := mh.ReceiveMessage()
-		if err != nil {
-			log.Printf("Error receiving message from client %s: %v", mh.ID(), err)
-			break
-		}
-
-		// Process the received message
-		// | | |
-		// v v v
-
-		if strings.HasPrefix(string(message), "/ALL") || strings.HasPrefix(string(message), "/all") {
-			parts := bytes.SplitN(message, []byte(" "), 2) // Split the message into command and content
-			if len(parts) < 2 {
-				parts = [][]byte{[]byte("/ALL"), []byte("{{nothing}}")} // Default content if not provided
-			}
-			// Broadcast the received message to all clients
-			msg, _ := json.Marshal(map[string]any{
-				"type":      "message",
-				"from":      mh.ID(),
-				"content":   string(parts[1]),
-				"timestamp": time.Now().Format(time.RFC3339),
-			})
-			if err := ch.BroadcastMessage(msg); err != nil {
-				log.Printf("Error broadcasting message from client %s: %v", mh.ID(), err)
-				break
-			}
-			// Skip echoing the message back to the client
-			continue
-		}
-
-		if strings.HasPrefix(string(message), "/CID-") {
-			parts := bytes.SplitN(message, []byte(" "), 2) // Split the message into command and content
-			receive := strings.Replace(string(parts[0]), "/", "", 1)
-			content := bytes.Replace(message, parts[0], []byte{}, 1)
-			content = bytes.Replace(content, []byte(" "), []byte{}, 1)
-			if len(content) == 0 {
-				content = []byte("{{nothing}}")
-			}
-			log.Printf("From %s to %s: %s", mh.ID(), receive, string(content))
-			// Send the message to the specified client
-			msg, _ := json.Marshal(map[string]any{
-				"type":      "message",
-				"from":      mh.ID(),
-				"content":   string(content),
-				"timestamp": time.Now().Format(time.RFC3339),
-			})
-			if err := ch.SendTo(receive, 1, msg); err != nil {
-				log.Printf("Error sending message to client %s: %v", receive, err)
-
-				// Feedback to the sender
-				message = fmt.Appendf(message, " - Failed to send message to client %s because receiver is not connected (detail: %s)", receive, err.Error())
-			}
-		}
-
-		// Echo the message back to the client
-		if err := mh.SendMessage(fmt.Appendf([]byte("You: "), "%s", message)); err != nil {
-			log.Printf("Error sending message to client %s: %v", mh.ID(), err)
-			break
-		}
+	// Dispatch the messages of the client to the handlers until it disconnects
+	if err := router.Serve(r.Context(), mh); err != nil {
+		log.Printf("Error receiving message from client %s: %v", mh.ID(), err)
 	}
 	log.Printf("Client %s disconnected", mh.ID())
 	// Clean up resources if needed
@@ -168,6 +203,7 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
         .message { margin: 5px 0; }
         .welcome { color: green; }
         .system { color: blue; }
+        .error { color: red; }
     </style>
 </head>
 <body>
@@ -179,6 +215,7 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
 
     <script>
         let ws;
+        const pending = {};
         const messages = document.getElementById('messages');
         const messageInput = document.getElementById('messageInput');
 
@@ -190,20 +227,37 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
             };
             
             ws.onmessage = function(event) {
+                let env;
                 try {
-                    const data = JSON.parse(event.data);
-                    let className = data.type === 'welcome' ? 'welcome' : 'message';
-                    let displayMsg = '';
-                    
-                    if (data.type === 'welcome') {
-                        displayMsg = data.message;
-                    } else if (data.type === 'message') {
-                        displayMsg = '[' + data.timestamp + '] ' + data.from + ': ' + data.content;
-                    }
-                    
-                    addMessage(displayMsg, className);
+                    env = JSON.parse(event.data);
                 } catch (e) {
                     addMessage(event.data, 'message');
+                    return;
+                }
+                const p = env.payload || {};
+                const request = pending[env.correlationId];
+                delete pending[env.correlationId];
+                switch (env.type) {
+                    case 'welcome':
+                        addMessage(p.message, 'welcome');
+                        addMessage('[!] Use /ALL <message>, /CID-<client_id> <message>, /JOIN <room>, /LEAVE <room>, /MEMBERS <room> and /ROOM <room> <message>', 'system');
+                        break;
+                    case 'chat.message':
+                        addMessage('[' + env.ts + '] ' + p.from + (p.room ? '@' + p.room : '') + ': ' + p.content, 'message');
+                        break;
+                    case 'response':
+                        if (p.members) {
+                            addMessage('members of room ' + p.room + ': ' + p.members.join(', '), 'system');
+                        } else {
+                            addMessage('You: ' + p.content, 'message');
+                        }
+                        break;
+                    case 'ack':
+                        addMessage((request || 'request') + ' done', 'system');
+                        break;
+                    case 'error':
+                        addMessage((request || 'request') + ' failed: ' + env.error.status + ' ' + env.error.message, 'error');
+                        break;
                 }
             };
             
@@ -224,11 +278,40 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
             messages.scrollTop = messages.scrollHeight;
         }
 
+        // request wraps the payload into a versioned envelope, the reply carries its id as correlationId
+        function request(type, payload, label) {
+            const id = (crypto.randomUUID && crypto.randomUUID()) || String(Date.now() + Math.random());
+            pending[id] = label || type;
+            ws.send(JSON.stringify({v: 1, type: type, id: id, payload: payload, ts: new Date().toISOString()}));
+        }
+
+        // command translates the text commands into message types
+        function command(text) {
+            const [cmd, ...rest] = text.split(' ');
+            const arg = rest.join(' ');
+            switch (cmd.toUpperCase()) {
+                case '/ALL':
+                    return request('chat.broadcast', {content: arg});
+                case '/JOIN':
+                    return request('room.join', {room: arg}, 'join ' + arg);
+                case '/LEAVE':
+                    return request('room.leave', {room: arg}, 'leave ' + arg);
+                case '/MEMBERS':
+                    return request('room.members', {room: arg});
+                case '/ROOM':
+                    return request('room.publish', {room: rest[0], content: rest.slice(1).join(' ')}, 'publish to ' + rest[0]);
+            }
+            if (cmd.startsWith('/CID-')) {
+                return request('chat.direct', {to: cmd.substring(1), content: arg}, 'send to ' + cmd.substring(1));
+            }
+            return request('chat.echo', {content: text});
+        }
+
         function sendMessage() {
             if (ws && ws.readyState === WebSocket.OPEN) {
                 const message = messageInput.value.trim();
                 if (message) {
-                    ws.send(message);
+                    command(message);
                     messageInput.value = '';
                 }
             } else {
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
 	"fmt"
 	"os"
 	"time"
@@ -9,10 +10,14 @@ import (
 	"github.com/weeback/grpc-project-template/internal/application/hello"
 	"github.com/weeback/grpc-project-template/internal/auth"
 	"github.com/weeback/grpc-project-template/internal/config"
+	"github.com/weeback/grpc-project-template/internal/infrastructure/firebase"
 	"github.com/weeback/grpc-project-template/internal/infrastructure/mongodb"
 	"github.com/weeback/grpc-project-template/internal/infrastructure/transport/grpc"
 	"github.com/weeback/grpc-project-template/internal/infrastructure/transport/http"
 	"github.com/weeback/grpc-project-template/pkg"
+	"github.com/weeback/grpc-project-template/pkg/jwt"
+	"github.com/weeback/grpc-project-template/pkg/logger"
+	"github.com/weeback/grpc-project-template/pkg/metric"
 	"github.com/weeback/grpc-project-template/pkg/net"
 
 	hellopb "github.com/weeback/grpc-project-template/pb/hello"
@@ -45,6 +50,50 @@ func init() {
 		os.Exit(1)
 	}
 
+	// Load TLS options, serve cleartext h2c when no certificate is configured
+	if _, err := config.LoadTLS(); err != nil {
+		fmt.Printf("failed to load TLS options: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Load CORS options, preset for the deployment environment
+	if _, err := config.LoadCORS(); err != nil {
+		fmt.Printf("failed to load CORS options: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Load the rate limit options, TRUSTED_PROXIES counts the proxies setting X-Forwarded-For
+	if _, err := config.LoadRateLimit(); err != nil {
+		fmt.Printf("failed to load rate limit options: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Load the request deadlines, REQUEST_TIMEOUT_METHODS sets them per gRPC method or REST route
+	if _, err := config.LoadDeadline(); err != nil {
+		fmt.Printf("failed to load request deadline options: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Load the client public keys of the signed requests
+	if _, err := config.LoadSignedRequest(); err != nil {
+		fmt.Printf("failed to load signed request options: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Load the authorization policy options, AUTHZ_POLICY_FILE sets the rules per method
+	if _, err := config.LoadAuthz(); err != nil {
+		fmt.Printf("failed to load authorization policy options: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Load logging options, the keys of LOG_REDACTED_KEYS are redacted with the defaults
+	if opt, err := config.LoadLogging(); err != nil {
+		fmt.Printf("failed to load logging options: %v\n", err)
+		os.Exit(1)
+	} else {
+		logger.SetRedactedKeys(opt.RedactedKeys...)
+	}
+
 }
 
 func main() {
@@ -55,6 +104,28 @@ func main() {
 	// Init connection
 	databaseInter := mongodb.NewMongoDB(ctx, mongoURL)
 
+	// Send the metrics to GCP Monitoring with the service account of the project,
+	// the cached metrics are flushed by the lifecycle on shutdown
+	firebaseOpt := config.GetOptionFirebaseAdmin()
+	monitoring, err := metric.NewMonitoringMetric(firebaseOpt.ProjectId, firebaseOpt.CertificateJson)
+	if err != nil {
+		fmt.Printf("Failed to create the monitoring client: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Probe the dependencies for the grpc.health.v1.Health service, a failed check
+	// of a dependency sets NOT_SERVING the services depending on it.
+	healthRegistry := net.NewHealthRegistry(net.WithHealthInterval(15 * time.Second))
+	healthRegistry.Register("mongodb-primary", databaseInter.Conn.PingPrimary)
+	if databaseInter.Conn.ReplicaSet() {
+		healthRegistry.Register("mongodb-secondary", databaseInter.Conn.PingSecondary)
+	}
+	healthRegistry.Register("firebase", firebase.Init(firebaseOpt.ProjectId,
+		firebaseOpt.DatabaseURL, firebaseOpt.CertificateJson).Ping)
+	healthRegistry.Register("metric", monitoring.Ping)
+	// Count the recovered panics of the gRPC calls, the HTTP routes and the websocket clients
+	net.SetPanicMetrics(monitoring.NewTable("recovery", map[string]string{"service": "HelloService"}))
+
 	// captchaService := cloudflare.NewCaptchaService(captchaSecretKey, cloudflare.DefaultTurnstileVerifyURL)
 
 	// Use mock-up service for testing
@@ -88,13 +159,108 @@ func main() {
 	//
 	// router.HandleFunc("/<path-to-entrypoint>", <handler-function-name>).Methods(<http-method(s)>)
 
-	auth := auth.New()
+	// Require the requests to be signed by the clients (JWT bound to the method, body hash,
+	// timestamp and nonce, see jwt.SignRequest) when their public keys are configured
+	var (
+		authOpts   []auth.Option
+		publicKeys func(keyId string) (ed25519.PublicKey, error)
+	)
+	if signedOpt := config.GetOptionSignedRequest(); signedOpt.Enabled() {
+		if publicKeys, err = auth.PublicKeys(signedOpt.PublicKeys); err != nil {
+			fmt.Printf("Failed to load the client public keys: %v\n", err)
+			os.Exit(1)
+		}
+		nonceStore, err := net.NewMongoNonceStore(ctx, databaseInter.Conn)
+		if err != nil {
+			fmt.Printf("Failed to configure the request nonces: %v\n", err)
+			os.Exit(1)
+		}
+		authOpts = append(authOpts, auth.WithRequestVerifier(&jwt.RequestVerifier{
+			PublicKey: publicKeys,
+			Nonces:    nonceStore,
+			ClockSkew: signedOpt.ClockSkew,
+		}))
+	}
+	auth := auth.New(authOpts...)
+
+	// The JWTs of the users are signed by the pre-shared key
+	keyPair, err := jwt.KeyPairFromSecret(config.GetPreSharedKey())
+	if err != nil {
+		fmt.Printf("Failed to load the key of the JWTs: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Limit the request rate of each client (verified JWT user, service account or IP),
+	// for REST routes and gRPC calls. Use net.NewMongoRateLimitStore to share
+	// the limits between instances.
+	limiter := net.NewRateLimiter(net.RateLimit{Requests: 120, Window: time.Minute, Burst: 30},
+		net.WithRateKeys(net.KeyByJWTUser(keyPair.PublicKey), net.KeyByPeerServiceAccount(),
+			net.KeyByIP(config.GetOptionRateLimit().TrustedProxies)),
+		net.WithMethodLimit("GET /healthcheck", net.RateLimit{}),
+	)
+	net.Use(router, limiter.Stage())
+
+	// Set the deadline of the REST routes and the gRPC calls: the timeout asked by the client
+	// (X-Request-Timeout, grpc-timeout) up to the max, otherwise the default of the method.
+	// Pass the context to the Mongo operations and outbound calls to stop them in time.
+	deadlineOpt := config.GetOptionDeadline()
+	deadlineOpts := []net.DeadlineOption{net.WithMaxDeadline(deadlineOpt.Max)}
+	for method, d := range deadlineOpt.Methods {
+		deadlineOpts = append(deadlineOpts, net.WithMethodDeadline(method, d))
+	}
+	deadlines := net.NewDeadlinePolicy(deadlineOpt.Default, deadlineOpts...)
+	net.Use(router, deadlines.Stage())
+
+	// Authorize the REST routes with the hash of their raw body, as the gRPC calls
+	net.Use(router, net.AuthStage(auth.AuthFunc))
 
 	// This is listed Google service accounts defined to allow accepting requests from Cloud Run.
 	// If empty, it will allow every request.
 	altsOpt := config.GetOptionALTS()
 	expectedServiceAccounts := altsOpt.TargetServiceAccounts
 
+	// Authorize each gRPC method and REST route with the rules of the policy file: public access,
+	// JWT scopes and roles, allowed service accounts. The scopes and roles are read from the same
+	// Authorization header as the authentication: a signed request (jwt.SignRequest) is verified
+	// with the public key of its client, another JWT with the pre-shared key. The enforced policy
+	// replaces the global service accounts, it allows every method when no file is configured.
+	authzPolicy, err := net.NewAuthzPolicy(nil, net.WithAuthzDefaultAllow())
+	if err != nil {
+		fmt.Printf("Failed to create the authorization policy: %v\n", err)
+		os.Exit(1)
+	}
+	if authzOpt := config.GetOptionAuthz(); authzOpt.Enabled() {
+		authzOpts := []net.AuthzOption{net.WithAuthzPublicKey(keyPair.PublicKey)}
+		if publicKeys != nil {
+			authzOpts = append(authzOpts, net.WithAuthzKeyLookup(publicKeys))
+		}
+		if authzOpt.DryRun {
+			authzOpts = append(authzOpts, net.WithAuthzDryRun())
+		}
+		if authzPolicy, err = net.LoadAuthzPolicy(authzOpt.PolicyFile, authzOpts...); err != nil {
+			fmt.Printf("Failed to load the authorization policy: %v\n", err)
+			os.Exit(1)
+		}
+		// A policy in dry-run (AUTHZ_DRY_RUN or its file) enforces nothing, keep the global service accounts
+		if !authzPolicy.DryRun() {
+			expectedServiceAccounts = nil
+		}
+	}
+	net.Use(router, authzPolicy.Stage())
+
+	// Replay the response of the mutating calls retried with the same Idempotency-Key,
+	// the keys of each caller (verified JWT user, service account or IP) are shared by
+	// the instances through MongoDB
+	idempotencyStore, err := net.NewMongoIdempotencyStore(ctx, databaseInter.Conn)
+	if err != nil {
+		fmt.Printf("Failed to configure idempotency keys: %v\n", err)
+		os.Exit(1)
+	}
+	idempotency := net.NewIdempotency(idempotencyStore, net.WithIdempotencyTTL(24*time.Hour),
+		net.WithIdempotencyScope(net.KeyByJWTUser(keyPair.PublicKey), net.KeyByPeerServiceAccount(),
+			net.KeyByIP(config.GetOptionRateLimit().TrustedProxies)))
+	net.Use(router, idempotency.Stage())
+
 	// gRPC servers can use ALTS credentials to allow clients to connect to them,
 	// as illustrated next:
 	grpcOpt := config.GetOptionGRPC()
@@ -112,25 +278,82 @@ func main() {
 			PermitWithoutStream: true,
 		}),
 		googlegrpc.ConnectionTimeout(grpcOpt.ConnectionTimeout),
-		googlegrpc.StreamInterceptor(net.StreamInterceptor()),
-		googlegrpc.UnaryInterceptor(net.UnaryServerAuthInterceptor(expectedServiceAccounts, auth.AuthFunc)),
+		googlegrpc.ChainStreamInterceptor(grpc.StreamErrorInterceptor(),
+			net.StreamServerRecoveryInterceptor(),
+			deadlines.StreamServerInterceptor(),
+			limiter.StreamServerInterceptor(),
+			net.StreamServerAuthInterceptor(expectedServiceAccounts, auth.TokenFunc, auth.AuthFunc),
+			authzPolicy.StreamServerInterceptor()),
+		googlegrpc.ChainUnaryInterceptor(grpc.UnaryErrorInterceptor(),
+			net.UnaryServerRecoveryInterceptor(),
+			deadlines.UnaryServerInterceptor(),
+			limiter.UnaryServerInterceptor(),
+			net.UnaryServerAuthInterceptor(expectedServiceAccounts, auth.AuthFunc),
+			authzPolicy.UnaryServerInterceptor(),
+			idempotency.UnaryServerInterceptor()),
 	)
 	//
-	defer inst.Stop()
-	//
 	hellopb.RegisterHelloServiceServer(inst, grpc.NewHelloServiceHandler(helloRepo))
 
+	// Expose the unary gRPC methods as REST routes: POST /{package.Service}/{Method}
+	// with a JSON body, and the routes of their google.api.http annotations
+	if err := net.Transcode(router, inst); err != nil {
+		fmt.Printf("Failed to register REST transcoding routes: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Register grpc.health.v1.Health and the server reflection (grpcurl) after the services,
+	// they are served to gRPC clients only
+	net.RegisterHealthAndReflection(inst, healthRegistry)
+
 	/** Apply middleware to the router HTTP/1 (RESTful API)
 	- Logging API request
 	- Config CORS option (fix/access cors-domain problem)
 	- Add middleware functions
 	*/
-	httpServer := net.Middleware(router, true)
+	corsOpt := config.GetOptionCORS()
+	corsPolicy, err := net.NewCORSPolicy(net.CORSOption{
+		AllowedOrigins:        corsOpt.AllowedOrigins,
+		AllowedOriginPatterns: corsOpt.AllowedOriginPatterns,
+		AllowCredentials:      corsOpt.AllowCredentials,
+	})
+	if err != nil {
+		fmt.Printf("Failed to configure CORS: %v\n", err)
+		os.Exit(1)
+	}
+	httpServer := net.MiddlewareWithCORS(router, corsPolicy)
 	grpcServer := net.Walk(inst)
-	mixed := net.MixHttp2(httpServer, grpcServer)
+	mixed := net.MixHttp2(httpServer, grpcServer, corsPolicy)
 
-	// Open and listen port (:8080)
-	if err := net.HttpServerWithConfig(":8080", mixed).ListenAndServe(); err != nil {
+	// Open and listen port (:8080), REST routes, gRPC calls and websocket connections
+	// have their own timeout budgets so that long-lived streams are not killed
+	serverOpts := []net.ServerOption{
+		net.WithAddrs(":8080"),
+		net.WithRESTTimeout(5*time.Second, 10*time.Second),
+		net.WithMaxHeaderBytes(1 << 20),
+		net.WithMaxConcurrentStreams(250),
+	}
+	if tlsOpt := config.GetOptionTLS(); tlsOpt.Enabled() {
+		serverOpts = append(serverOpts, net.WithServerTLS(net.TLSOption{
+			CertFile:     tlsOpt.CertFile,
+			KeyFile:      tlsOpt.KeyFile,
+			ClientCAFile: tlsOpt.ClientCAFile,
+		}))
+	}
+	server, err := net.NewServer(mixed, serverOpts...)
+	if err != nil {
+		fmt.Printf("Failed to configure server: %v\n", err)
+		os.Exit(1)
+	}
+	// On SIGINT/SIGTERM drain in-flight requests and stop the gRPC server gracefully before exiting
+	lifecycle := server.Lifecycle(
+		net.WithGRPCServer(inst),
+		net.WithHealth(healthRegistry),
+		net.WithMonitoring(monitoring),
+		net.WithShutdownTimeout(8*time.Second),
+	)
+	go healthRegistry.Run(context.Background())
+	if err := lifecycle.ListenAndServe(); err != nil {
 		fmt.Printf("Failed to start server: %v\n", err)
 	}
 }
@@ -8,9 +8,6 @@ import (
 
 	common "github.com/weeback/grpc-project-template/pb/common"
 	pb "github.com/weeback/grpc-project-template/pb/hello"
-
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
 )
 
 func NewHelloServiceRepo(exDb db.ExampleDB) hello.Repository {
@@ -30,7 +27,7 @@ func (ins *controller) SayHello(ctx context.Context, request *pb.HelloRequest) (
 
 	// Validate request
 	if err := validateSayRequest(request); err != nil {
-		return &pb.HelloReply{Message: err.Error()}, status.Errorf(codes.OK, "%#v", err)
+		return nil, err
 	}
 	// TODO implement me
 	// ...
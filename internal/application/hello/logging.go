@@ -17,11 +17,11 @@ func (ins *logging) SayHello(ctx context.Context, request *pb.HelloRequest) (res
 	defer func(entry *zap.Logger) {
 		if err != nil {
 			entry.Error("Failed to say hello",
-				zap.String("name", request.GetName()),
+				logger.Redact("request", request),
 				zap.Error(err))
 		} else {
 			entry.Debug("Successfully said hello",
-				zap.String("result", result.String()))
+				logger.Redact("result", result))
 		}
 	}(logger.GetLoggerFromContext(ctx).With(zap.String(logger.KeyFunctionName, "SayHello")))
 	// Call the next service
@@ -32,11 +32,11 @@ func (ins *logging) UseStandardResponse(ctx context.Context, request *pb.Payload
 	defer func(entry *zap.Logger) {
 		if err != nil {
 			entry.Error("Failed to use standard response",
-				zap.String("name", request.GetName()),
+				logger.Redact("request", request),
 				zap.Error(err))
 		} else {
 			entry.Debug("Successfully used standard response",
-				zap.String("result", result.String()))
+				logger.Redact("result", result))
 		}
 	}(logger.GetLoggerFromContext(ctx).With(zap.String(logger.KeyFunctionName, "UseStandardResponse")))
 	// Call the next service
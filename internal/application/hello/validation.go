@@ -1,14 +1,14 @@
 package hello
 
 import (
-	"fmt"
-
+	"github.com/weeback/grpc-project-template/internal/model/errors"
 	pb "github.com/weeback/grpc-project-template/pb/hello"
 )
 
 func validateSayRequest(request *pb.HelloRequest) error {
 	if request.GetName() == "" {
-		return fmt.Errorf("name is required")
+		return errors.New(errors.InvalidArgumentCode, "name is required").
+			WithField("name", "must not be empty")
 	}
 	return nil
 }
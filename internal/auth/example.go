@@ -1,25 +1,103 @@
 package auth
 
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"time"
+
+	"github.com/weeback/grpc-project-template/pkg/jwt"
+)
+
 type Inter interface {
 	AuthFunc(fullMethod string, bodyHash string, jwtStr string) error
+	// TokenFunc checks the JWT of a stream when it starts, before its first message
+	TokenFunc(fullMethod string, jwtStr string) error
 }
 
-func New() Inter {
-	return &ins{}
+// Option configures the authorization.
+type Option func(i *ins)
+
+// WithRequestVerifier requires the methods of AuthFunc to be called with a JWT bound to the
+// request, signed by the key of the client (see jwt.SignRequest).
+func WithRequestVerifier(verifier *jwt.RequestVerifier) Option {
+	return func(i *ins) {
+		i.verifier = verifier
+	}
 }
 
-type ins struct{}
+func New(opts ...Option) Inter {
+	i := &ins{}
+	for _, opt := range opts {
+		opt(i)
+	}
+	return i
+}
+
+type ins struct {
+	verifier *jwt.RequestVerifier
+}
 
 func (i *ins) AuthFunc(fullMethod string, bodyHash string, jwtStr string) error {
 	// Implement your authorization logic here
-	// You can use the fullMethod, bodyHash, and jwtStr parameters as needed
+	// You can use the fullMethod, bodyHash, and jwtStr parameters as needed.
+	// The access of the methods (public, scopes, roles, service accounts) is declared
+	// in the authorization policy file instead, see net.LoadAuthzPolicy
 
 	switch fullMethod {
-	case "/hello.HelloService/SayHello":
+	case "/hello.HelloService/SayHello",
+		// REST route and transcoded route of the method, see net.AuthStage
+		"POST /say-hello", "POST /hello.HelloService/SayHello":
 		// Check if the request is authorized
 
+		return i.verifyRequest(fullMethod, bodyHash, jwtStr)
+	default:
 		return nil
+	}
+}
+
+func (i *ins) TokenFunc(fullMethod string, jwtStr string) error {
+	// Check the JWT of the methods checked by AuthFunc, the body hash is checked
+	// by AuthFunc with the first message
+	switch fullMethod {
+	case "/hello.HelloService/SayHello":
+		if i.verifier == nil {
+			return nil
+		}
+		_, err := i.verifier.VerifyToken(fullMethod, jwtStr)
+		return err
 	default:
 		return nil
 	}
 }
+
+// verifyRequest checks the JWT is signed by the client for this request: the method,
+// the body hash, the clock skew and the nonce. It passes when no verifier is set.
+func (i *ins) verifyRequest(fullMethod string, bodyHash string, jwtStr string) error {
+	if i.verifier == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := i.verifier.Verify(ctx, fullMethod, bodyHash, jwtStr)
+	return err
+}
+
+// PublicKeys returns the lookup of the client public keys of jwt.RequestVerifier, from
+// their base64 PKIX encoding (see jwt.KeyPair.PKIXPublicKey) by key id.
+func PublicKeys(pkix map[string]string) (func(keyId string) (ed25519.PublicKey, error), error) {
+	keys := make(map[string]ed25519.PublicKey, len(pkix))
+	for keyId, public := range pkix {
+		key, err := jwt.ParsePKIXPublicKey(public)
+		if err != nil {
+			return nil, fmt.Errorf("public key %q: %w", keyId, err)
+		}
+		keys[keyId] = key
+	}
+	return func(keyId string) (ed25519.PublicKey, error) {
+		if key, ok := keys[keyId]; ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("no public key for %q", keyId)
+	}, nil
+}
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+var sharedAuthz = OptionAuthz{}
+
+type OptionAuthz struct {
+	// PolicyFile is the YAML or JSON file of the per-method authorization rules,
+	// the global service accounts of ALTS apply when empty.
+	PolicyFile string
+	// DryRun logs the decisions of the policy without enforcing them.
+	DryRun bool
+}
+
+// Enabled reports whether the methods are authorized by a policy file.
+func (opt OptionAuthz) Enabled() bool {
+	return opt.PolicyFile != ""
+}
+
+// LoadAuthz loads the authorization policy options: AUTHZ_POLICY_FILE is the path of
+// the policy, AUTHZ_DRY_RUN a boolean turning on the dry-run mode of the policy.
+func LoadAuthz() (*OptionAuthz, error) {
+	opt := OptionAuthz{
+		PolicyFile: os.Getenv("AUTHZ_POLICY_FILE"),
+	}
+	if val := os.Getenv("AUTHZ_DRY_RUN"); val != "" {
+		dryRun, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AUTHZ_DRY_RUN: %w", err)
+		}
+		opt.DryRun = dryRun
+	}
+	sharedAuthz = opt
+	return &sharedAuthz, nil
+}
+
+// GetOptionAuthz returns the authorization policy options.
+func GetOptionAuthz() OptionAuthz {
+	return sharedAuthz
+}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"os"
+	"strings"
+)
+
+var sharedCORS = OptionCORS{}
+
+type OptionCORS struct {
+	// AllowedOrigins are exact origins, "*" or wildcard origins (https://*.example.com).
+	AllowedOrigins []string
+	// AllowedOriginPatterns are regular expressions matched against the origin.
+	AllowedOriginPatterns []string
+	// AllowCredentials lets the browsers send cookies and Authorization header.
+	AllowCredentials bool
+}
+
+// LoadCORS loads the CORS options preset for the deployment environment:
+// any origin without credentials in development, only the origins of CORS_ALLOWED_ORIGINS
+// in production. CORS_ALLOWED_ORIGINS and CORS_ALLOWED_ORIGIN_PATTERNS are comma-separated
+// lists, the credentials are allowed for the configured origins only.
+func LoadCORS() (*OptionCORS, error) {
+	sharedCORS = OptionCORS{
+		AllowedOrigins:        splitList(os.Getenv("CORS_ALLOWED_ORIGINS")),
+		AllowedOriginPatterns: splitList(os.Getenv("CORS_ALLOWED_ORIGIN_PATTERNS")),
+		AllowCredentials:      true,
+	}
+	for _, origin := range sharedCORS.AllowedOrigins {
+		if origin == "*" {
+			sharedCORS.AllowCredentials = false
+		}
+	}
+	if GetDeploymentEnvironment() == Development && len(sharedCORS.AllowedOrigins) == 0 {
+		// Any site may call the API, never with the cookies or credentials of the user
+		sharedCORS.AllowedOrigins = []string{"*"}
+		sharedCORS.AllowCredentials = false
+	}
+	return &sharedCORS, nil
+}
+
+// GetOptionCORS returns the CORS options.
+func GetOptionCORS() OptionCORS {
+	return sharedCORS
+}
+
+func splitList(val string) []string {
+	var list []string
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,66 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// defaultDeadline is the default deadline options.
+	defaultDeadline = OptionDeadline{
+		Default: 10 * time.Second,
+		Max:     60 * time.Second,
+	}
+
+	sharedDeadline = defaultDeadline
+)
+
+type OptionDeadline struct {
+	// Default is the deadline of the REST routes and unary gRPC methods without their own.
+	Default time.Duration
+	// Max caps the timeouts asked by the clients (grpc-timeout, X-Request-Timeout).
+	Max time.Duration
+	// Methods are the deadlines of the gRPC methods ("/hello.HelloService/SayHello")
+	// and the REST routes ("POST /say-hello").
+	Methods map[string]time.Duration
+}
+
+// LoadDeadline loads the request deadlines: REQUEST_TIMEOUT and REQUEST_TIMEOUT_MAX are
+// durations (e.g. "10s"), REQUEST_TIMEOUT_METHODS is a comma-separated list of method=duration
+// (e.g. "/hello.HelloService/SayHello=3s,POST /say-hello=3s").
+func LoadDeadline() (*OptionDeadline, error) {
+	opt := defaultDeadline
+	opt.Methods = make(map[string]time.Duration)
+	for env, d := range map[string]*time.Duration{
+		"REQUEST_TIMEOUT":     &opt.Default,
+		"REQUEST_TIMEOUT_MAX": &opt.Max,
+	} {
+		if val := os.Getenv(env); val != "" {
+			parsed, err := time.ParseDuration(val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", env, err)
+			}
+			*d = parsed
+		}
+	}
+	for _, item := range splitList(os.Getenv("REQUEST_TIMEOUT_METHODS")) {
+		method, val, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid REQUEST_TIMEOUT_METHODS item %q, expected method=duration", item)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(val))
+		if err != nil {
+			return nil, fmt.Errorf("invalid REQUEST_TIMEOUT_METHODS item %q: %w", item, err)
+		}
+		opt.Methods[strings.TrimSpace(method)] = d
+	}
+	sharedDeadline = opt
+	return &sharedDeadline, nil
+}
+
+// GetOptionDeadline returns the request deadline options.
+func GetOptionDeadline() OptionDeadline {
+	return sharedDeadline
+}
@@ -0,0 +1,29 @@
+package config
+
+import (
+	"os"
+
+	"github.com/weeback/grpc-project-template/pkg/logger"
+)
+
+var sharedLogging = OptionLogging{}
+
+type OptionLogging struct {
+	// RedactedKeys are the headers, gRPC metadata and form keys whose values are not logged.
+	RedactedKeys []string
+}
+
+// LoadLogging loads the logging options: the default redacted keys of pkg/logger and
+// the keys of LOG_REDACTED_KEYS, a comma-separated list (e.g. "x-device-id,x-otp").
+func LoadLogging() (*OptionLogging, error) {
+	sharedLogging = OptionLogging{
+		RedactedKeys: append(append([]string(nil), logger.DefaultRedactedKeys...),
+			splitList(os.Getenv("LOG_REDACTED_KEYS"))...),
+	}
+	return &sharedLogging, nil
+}
+
+// GetOptionLogging returns the logging options.
+func GetOptionLogging() OptionLogging {
+	return sharedLogging
+}
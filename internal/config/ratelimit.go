@@ -0,0 +1,38 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+var sharedRateLimit = OptionRateLimit{}
+
+type OptionRateLimit struct {
+	// TrustedProxies is the number of proxies appending the address of their peer
+	// to X-Forwarded-For in front of the service, the client address is the entry
+	// appended by the first of them.
+	TrustedProxies int
+}
+
+// LoadRateLimit loads the rate limit options: TRUSTED_PROXIES is the number of trusted
+// proxies, default 1 (the Cloud Run front end) in production and 0 in development.
+func LoadRateLimit() (*OptionRateLimit, error) {
+	sharedRateLimit = OptionRateLimit{TrustedProxies: 1}
+	if GetDeploymentEnvironment() == Development {
+		sharedRateLimit.TrustedProxies = 0
+	}
+	if val := os.Getenv("TRUSTED_PROXIES"); val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid TRUSTED_PROXIES %q", val)
+		}
+		sharedRateLimit.TrustedProxies = n
+	}
+	return &sharedRateLimit, nil
+}
+
+// GetOptionRateLimit returns the rate limit options.
+func GetOptionRateLimit() OptionRateLimit {
+	return sharedRateLimit
+}
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+var sharedSignedRequest = OptionSignedRequest{}
+
+type OptionSignedRequest struct {
+	// PublicKeys are the base64 PKIX public keys of the clients by key id,
+	// the requests are not required to be signed when empty.
+	PublicKeys map[string]string
+	// ClockSkew is the allowed difference between the request timestamp and the server clock.
+	ClockSkew time.Duration
+}
+
+// Enabled reports whether the requests must be signed by the clients.
+func (opt OptionSignedRequest) Enabled() bool {
+	return len(opt.PublicKeys) > 0
+}
+
+// LoadSignedRequest loads the keys of the signed requests: SIGNED_REQUEST_KEYS is a
+// comma-separated list of keyId=publicKey, SIGNED_REQUEST_CLOCK_SKEW a duration (default 30s).
+func LoadSignedRequest() (*OptionSignedRequest, error) {
+	opt := OptionSignedRequest{
+		PublicKeys: make(map[string]string),
+		ClockSkew:  30 * time.Second,
+	}
+	for _, item := range splitList(os.Getenv("SIGNED_REQUEST_KEYS")) {
+		keyId, public, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(keyId) == "" {
+			return nil, fmt.Errorf("invalid SIGNED_REQUEST_KEYS item, expected keyId=publicKey")
+		}
+		// The base64 padding is kept, only the first "=" separates the key id
+		opt.PublicKeys[strings.TrimSpace(keyId)] = strings.TrimSpace(public)
+	}
+	if val := os.Getenv("SIGNED_REQUEST_CLOCK_SKEW"); val != "" {
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SIGNED_REQUEST_CLOCK_SKEW: %w", err)
+		}
+		opt.ClockSkew = d
+	}
+	sharedSignedRequest = opt
+	return &sharedSignedRequest, nil
+}
+
+// GetOptionSignedRequest returns the signed request options.
+func GetOptionSignedRequest() OptionSignedRequest {
+	return sharedSignedRequest
+}
@@ -0,0 +1,33 @@
+package config
+
+import "os"
+
+var sharedTLS = OptionTLS{}
+
+type OptionTLS struct {
+	// CertFile and KeyFile are the PEM files of the server certificate.
+	CertFile string
+	KeyFile  string
+	// ClientCAFile is an optional PEM bundle to verify client certificates (mTLS).
+	ClientCAFile string
+}
+
+// Enabled reports whether the server should serve TLS itself,
+// instead of relying on a TLS-terminating front end (e.g. Cloud Run).
+func (opt OptionTLS) Enabled() bool {
+	return opt.CertFile != "" && opt.KeyFile != ""
+}
+
+func LoadTLS() (*OptionTLS, error) {
+	sharedTLS = OptionTLS{
+		CertFile:     os.Getenv("TLS_CERT_FILE"),
+		KeyFile:      os.Getenv("TLS_KEY_FILE"),
+		ClientCAFile: os.Getenv("TLS_CLIENT_CA_FILE"),
+	}
+	return &sharedTLS, nil
+}
+
+// GetOptionTLS returns the TLS options.
+func GetOptionTLS() OptionTLS {
+	return sharedTLS
+}
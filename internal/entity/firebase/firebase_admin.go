@@ -9,4 +9,6 @@ import (
 type GoogleFirebaseAdmin interface {
 	GenerateCustomToken(ctx context.Context, sessionId string) (string, error)
 	GetDatabaseClient(ctx context.Context) (*db.Client, error)
+	// Ping checks the Firebase auth and database clients are initialized, e.g. as a health check
+	Ping(ctx context.Context) error
 }
@@ -11,18 +11,26 @@ import (
 
 	"github.com/weeback/grpc-project-template/internal/entity/cloudflare"
 	"github.com/weeback/grpc-project-template/internal/model"
+	"github.com/weeback/grpc-project-template/pkg/logger"
+	"github.com/weeback/grpc-project-template/pkg/net"
+
+	"go.uber.org/zap"
 )
 
 func NewCaptchaService(secretKey, url string) cloudflare.CaptchaService {
 	return &CaptchaService{
 		Url:       url,
 		SecretKey: secretKey,
+		client:    net.NewOutboundClient(nil, DefaultVerifyTimeout),
 	}
 }
 
 type CaptchaService struct {
 	Url       string
 	SecretKey string
+
+	// client sends the verification with the remaining budget of the request
+	client *http.Client
 }
 
 func (ins *CaptchaService) VerifyToken(ctx context.Context, remoteIP, token string) (*model.TurnstileResult, error) {
@@ -58,23 +66,24 @@ func (ins *CaptchaService) VerifyToken(ctx context.Context, remoteIP, token stri
 	if remoteIP != "" {
 		request.Header.Set("X-Forwarded-For", remoteIP)
 	}
-	// Send the request
-	resp, err := http.DefaultClient.Do(request)
+	// Send the request, within the deadline of the context
+	client := ins.client
+	if client == nil {
+		client = net.NewOutboundClient(nil, DefaultVerifyTimeout)
+	}
+	resp, err := client.Do(request)
 	if err != nil {
 		return nil, err
 	}
 	defer func(Body io.ReadCloser) {
-		fmt.Printf("%+v\n", map[string]any{
-			"func":       "VerifyToken",
-			"status":     resp.Status,
-			"statusCode": resp.StatusCode,
-			"remoteIP":   remoteIP,
-			"token":      token,
-			"url":        ins.Url,
-			"form":       form,
-			"error":      err,
-			"response":   result,
-		})
+		// The form is not logged, it has the secret key; the token is masked
+		logger.GetLoggerFromContext(ctx).Debug("Turnstile token verified",
+			zap.String(logger.KeyFunctionName, "VerifyToken"),
+			zap.String("status", resp.Status),
+			zap.String("remote_ip", remoteIP),
+			zap.String("token", logger.MaskToken(token)),
+			zap.String("url", ins.Url),
+			zap.Any("response", result))
 		if err := Body.Close(); err != nil {
 			// Log the error if needed, but do not return it
 			// as we are already handling the response.
@@ -1,10 +1,14 @@
 package cloudflare
 
+import "time"
+
 const (
 	TurnstileCaptcha CaptchaType = "turnstile"
 
 	DefaultTurnstileVerifyURL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
 	DefaultContentType        = "application/x-www-form-urlencoded"
+	// DefaultVerifyTimeout is the timeout of the verification when the context has no deadline
+	DefaultVerifyTimeout = 10 * time.Second
 
 	formKeySecret   = "secret"
 	formKeyToken    = "response"
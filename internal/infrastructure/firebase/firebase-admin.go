@@ -83,6 +83,19 @@ func (admin *firebaseAdmin) GetDatabaseClient(ctx context.Context) (*db.Client,
 	return admin.database, initErr
 }
 
+func (admin *firebaseAdmin) Ping(ctx context.Context) error {
+	if _, err := admin.GetAuthClient(ctx); err != nil {
+		return fmt.Errorf("firebase auth client: %w", err)
+	}
+	if admin.databaseURL == "" {
+		return nil
+	}
+	if _, err := admin.GetDatabaseClient(ctx); err != nil {
+		return fmt.Errorf("firebase database client: %w", err)
+	}
+	return nil
+}
+
 func (admin *firebaseAdmin) GenerateCustomToken(ctx context.Context, sessionId string) (string, error) {
 	client, err := admin.GetAuthClient(ctx)
 	if err != nil {
@@ -9,12 +9,15 @@ import (
 )
 
 type DB struct {
+	// Conn is the connection of the repositories, its pings back the health checks
+	Conn *mongodb.Connection
+
 	ExampleDB db.ExampleDB
 }
 
 func NewMongoDB(ctx context.Context, withURI string) *DB {
 
-	_, err := mongodb.NewConnection(ctx, withURI)
+	conn, err := mongodb.NewConnection(ctx, withURI)
 	if err != nil {
 		fmt.Printf("mongodb.NewConnection err: %v\n", err)
 		os.Exit(1)
@@ -22,6 +25,7 @@ func NewMongoDB(ctx context.Context, withURI string) *DB {
 	// dbc := conn.Database()
 
 	return &DB{
+		Conn: conn,
 		// TODO: Add more repositories as needed
 		// Example:
 		// ExampleDB: NewExampleRepository(dbc),
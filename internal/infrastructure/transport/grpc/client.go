@@ -0,0 +1,54 @@
+package grpc
+
+import (
+	"google.golang.org/grpc"
+
+	"github.com/weeback/grpc-project-template/internal/config"
+	"github.com/weeback/grpc-project-template/pkg/net"
+)
+
+// NewClient creates a client connection to another service built on this template, with
+// the credentials, keepalive and message sizes of the configuration (see net.NewGRPCClient):
+//   - ALTS when target service accounts are configured (Google Cloud),
+//   - cleartext in the development environment,
+//   - TLS otherwise, mutual when this service serves mTLS itself: the peers share the client CA.
+//
+// The options are applied after the configuration, to override it.
+//
+// Example usage:
+//
+//	conn, err := grpc.NewClient("hello.internal:443", net.WithClientToken(net.ForwardAuthorization()))
+//	if err != nil {
+//		return err
+//	}
+//	defer conn.Close()
+//	client := hellopb.NewHelloServiceClient(conn)
+func NewClient(target string, opts ...net.ClientOption) (*grpc.ClientConn, error) {
+	var (
+		altsOpt = config.GetOptionALTS()
+		tlsOpt  = config.GetOptionTLS()
+		grpcOpt = config.GetOptionGRPC()
+
+		clientOpts []net.ClientOption
+	)
+	switch {
+	case len(altsOpt.TargetServiceAccounts) > 0:
+		clientOpts = append(clientOpts, net.WithClientALTS(altsOpt.TargetServiceAccounts, altsOpt.HandshakerServiceAddress))
+	case config.GetDeploymentEnvironment() == config.Development:
+		clientOpts = append(clientOpts, net.WithClientInsecure())
+	case tlsOpt.Enabled() && tlsOpt.ClientCAFile != "":
+		clientOpts = append(clientOpts, net.WithClientTLS(net.ClientTLSOption{
+			CAFile:   tlsOpt.ClientCAFile,
+			CertFile: tlsOpt.CertFile,
+			KeyFile:  tlsOpt.KeyFile,
+		}))
+	default:
+		clientOpts = append(clientOpts, net.WithClientTLS(net.ClientTLSOption{}))
+	}
+	clientOpts = append(clientOpts,
+		net.WithClientKeepalive(grpcOpt.KeepaliveTime, grpcOpt.KeepaliveTimeout),
+		net.WithClientMessageSize(grpcOpt.MaxRecvMsgSize, grpcOpt.MaxSendMsgSize),
+		net.WithClientConnectTimeout(grpcOpt.MinConnectionTimeout),
+	)
+	return net.NewGRPCClient(target, append(clientOpts, opts...)...)
+}
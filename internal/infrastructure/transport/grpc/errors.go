@@ -0,0 +1,33 @@
+package grpc
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+
+	"github.com/weeback/grpc-project-template/internal/model/errors"
+)
+
+// UnaryErrorInterceptor converts the errors of the handlers to errors.Error, so every
+// status sent to the clients has a registered code and the ErrorInfo details. It is
+// the first interceptor of the chain, before the recovery interceptor, to convert the
+// INTERNAL status of the recovered panics and the errors of the other interceptors too.
+func UnaryErrorInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		resp, err := handler(ctx, req)
+		if err != nil {
+			return nil, errors.FromError(err)
+		}
+		return resp, nil
+	}
+}
+
+// StreamErrorInterceptor is UnaryErrorInterceptor for the streams.
+func StreamErrorInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := handler(srv, ss); err != nil {
+			return errors.FromError(err)
+		}
+		return nil
+	}
+}
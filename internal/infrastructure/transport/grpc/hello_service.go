@@ -5,13 +5,11 @@ import (
 	"google.golang.org/protobuf/proto"
 
 	"github.com/weeback/grpc-project-template/internal/entity/hello"
+	"github.com/weeback/grpc-project-template/internal/model/errors"
 	"github.com/weeback/grpc-project-template/pkg/jwt"
 
 	common "github.com/weeback/grpc-project-template/pb/common"
 	hellopb "github.com/weeback/grpc-project-template/pb/hello"
-
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
 )
 
 // NewHelloServiceHandler creates a new HelloServiceHandler
@@ -36,10 +34,10 @@ func NewHelloServiceHandler(svc hello.Repository) hellopb.HelloServiceServer {
 				// This is just a placeholder implementation.
 			}
 			if claims == nil {
-				return ctx, status.Errorf(codes.Unauthenticated, "invalid JWT token, error %#v", err)
+				return ctx, errors.New(errors.UnauthenticatedCode, "invalid JWT token").Wrap(err)
 			}
 			if err := claims.ParsePayload(v); err != nil {
-				return ctx, status.Errorf(codes.Unauthenticated, "invalid JWT token, error %#v", err)
+				return ctx, errors.New(errors.UnauthenticatedCode, "invalid JWT token").Wrap(err)
 			}
 			// If the JWT is valid, return the claims and apply them to the context
 			return claims.ApplyContext(ctx, c.ReqId), nil
@@ -74,7 +72,7 @@ func (h *HelloServiceHandler) UseStandardResponse(ctx context.Context, in *commo
 	// or remove this comment if not needed.
 	jwtCtx, err := h.validateAuthenticationFunc(ctx, in, &request)
 	if err != nil {
-		return nil, status.Errorf(codes.Unauthenticated, "failed to validate JWT token: %v", err)
+		return nil, err
 	}
 
 	// Apply the claims to the context, and forward the request to the service
@@ -0,0 +1,53 @@
+package http
+
+import (
+	stderrors "errors"
+	"net/http"
+
+	"go.uber.org/zap"
+
+	"github.com/weeback/grpc-project-template/internal/model/errors"
+	"github.com/weeback/grpc-project-template/pkg/logger"
+	"github.com/weeback/grpc-project-template/pkg/net"
+)
+
+// writeError writes err as errors.Error: the HTTP status of its code, and the
+// common.StandardResponse body with the google.rpc.Status as payload.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	e := fromError(err)
+	logger.GetLoggerFromContext(r.Context()).Warn("Request failed",
+		zap.String("uri", r.RequestURI),
+		zap.Int("code", int(e.Code())),
+		zap.Error(err))
+	// A zero HTTP status is mapped from the gRPC code by net.WriteStatus
+	net.WriteStatus(w, r, e.HTTPStatus(), e.GRPCStatus())
+}
+
+// fromError is errors.FromError with the errors of net.Bind: a *net.BindError becomes
+// InvalidArgumentCode (or PayloadTooLargeCode, UnsupportedMediaTypeCode) with its fields.
+func fromError(err error) errors.Error {
+	var be *net.BindError
+	if !stderrors.As(err, &be) {
+		return errors.FromError(err)
+	}
+	code := errors.InvalidArgumentCode
+	switch be.Status {
+	case http.StatusRequestEntityTooLarge:
+		code = errors.PayloadTooLargeCode
+	case http.StatusUnsupportedMediaType:
+		code = errors.UnsupportedMediaTypeCode
+	}
+	e := errors.New(code, be.Message).Wrap(err)
+	for _, f := range be.Fields {
+		e = e.WithField(f.Field, f.Description)
+	}
+	return e
+}
+
+// writeResponse writes the reply with the representation negotiated by the request.
+func writeResponse(w http.ResponseWriter, r *http.Request, resp any) {
+	if err := net.Write(w, r, http.StatusOK, resp); err != nil {
+		logger.GetLoggerFromContext(r.Context()).Warn("Failed to write response",
+			zap.String("uri", r.RequestURI), zap.Error(err))
+	}
+}
@@ -3,14 +3,12 @@ package http
 import (
 	"bytes"
 	"context"
-	"fmt"
 	"net/http"
 
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 
 	"github.com/weeback/grpc-project-template/internal/entity/hello"
+	"github.com/weeback/grpc-project-template/internal/model/errors"
 	"github.com/weeback/grpc-project-template/pkg"
 	"github.com/weeback/grpc-project-template/pkg/jwt"
 	"github.com/weeback/grpc-project-template/pkg/net"
@@ -40,10 +38,10 @@ func NewHelloServiceHandler(svc hello.Repository) *HelloServiceHandler {
 				// This is just a placeholder implementation.
 			}
 			if claims == nil {
-				return ctx, fmt.Errorf("invalid JWT token")
+				return ctx, errors.New(errors.UnauthenticatedCode, "invalid JWT token").Wrap(err)
 			}
 			if err := claims.ParsePayload(v); err != nil {
-				return ctx, status.Errorf(codes.Unauthenticated, "invalid JWT token, error %#v", err)
+				return ctx, errors.New(errors.UnauthenticatedCode, "invalid JWT token").Wrap(err)
 			}
 			// If the JWT is valid, return the claims and apply them to the context
 			return claims.ApplyContext(ctx, c.ReqId), nil
@@ -60,21 +58,19 @@ func (h *HelloServiceHandler) SayHello(w http.ResponseWriter, r *http.Request) {
 	var (
 		request hellopb.HelloRequest
 	)
-	// Read the request body from http
-	if raw, err := net.ShouldBindJSON(r, &request); err != nil {
-		net.WriteError(w, http.StatusBadRequest,
-			fmt.Errorf("failed to parse request: %v.\r\n%s", err, string(raw)))
+	// Read the request from http (body, query params and path variables)
+	if err := net.Bind(r, &request); err != nil {
+		writeError(w, r, err)
 		return
 	}
 	// Redirect sends request to login service
 	resp, err := h.service.SayHello(r.Context(), &request)
 	if err != nil {
-		fmt.Printf("api-%s :%s\n", r.RequestURI, err.Error())
+		writeError(w, r, err)
+		return
 	}
 	// Write response to http
-	if err := net.WriteJSONbyError(w, http.StatusOK, err, resp); err != nil {
-		net.WriteError(w, http.StatusServiceUnavailable, err)
-	}
+	writeResponse(w, r, resp)
 }
 
 func (h *HelloServiceHandler) UseStandardResponse(w http.ResponseWriter, r *http.Request) {
@@ -84,10 +80,9 @@ func (h *HelloServiceHandler) UseStandardResponse(w http.ResponseWriter, r *http
 
 		request hellopb.PayloadRequest
 	)
-	// Read the request body from http
-	if raw, err := net.ShouldBindJSON(r, &in); err != nil {
-		net.WriteError(w, http.StatusBadRequest,
-			fmt.Errorf("failed to parse request: %v.\r\n%s", err, string(raw)))
+	// Read the request from http (body, query params and path variables)
+	if err := net.Bind(r, &in); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
@@ -102,19 +97,17 @@ func (h *HelloServiceHandler) UseStandardResponse(w http.ResponseWriter, r *http
 	// or remove this comment if not needed.
 	jwtCtx, err := h.validateAuthenticationFunc(ctx, &in, &request)
 	if err != nil {
-		net.WriteError(w, http.StatusUnauthorized,
-			fmt.Errorf("failed to validate JWT token: %v", err))
+		writeError(w, r, err)
 		return
 	}
 	// Redirect sends request to login service
 	resp, err := h.service.UseStandardResponse(jwtCtx, &request)
 	if err != nil {
-		fmt.Printf("api-%s :%s\n", r.RequestURI, err.Error())
+		writeError(w, r, err)
+		return
 	}
 	// Write response to http
-	if err := net.WriteJSONbyError(w, http.StatusOK, err, resp); err != nil {
-		net.WriteError(w, http.StatusServiceUnavailable, err)
-	}
+	writeResponse(w, r, resp)
 }
 
 func (h *HelloServiceHandler) HealthCheck(w http.ResponseWriter, r *http.Request) {
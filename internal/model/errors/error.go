@@ -1,11 +1,28 @@
 package errors
 
 import (
+	"context"
+	stderrors "errors"
 	"fmt"
+	"strconv"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
 
 	commonpb "github.com/weeback/grpc-project-template/pb/common"
 )
 
+// Domain is the domain of the google.rpc.ErrorInfo details, the error code
+// is set in its metadata with the key MetadataCode.
+const (
+	Domain       = "grpc-project-template"
+	MetadataCode = "code"
+)
+
 func Errorf(code int, format string, a ...any) Error {
 	return Error{
 		code:    ErrorCode(code),
@@ -20,28 +37,204 @@ func New(code ErrorCode, message string) Error {
 	}
 }
 
+// FieldViolation is the error of one field of the request, sent as google.rpc.BadRequest.
+type FieldViolation struct {
+	Field       string
+	Description string
+}
+
+// Error is the error of the services: it is converted to a gRPC status by GRPCStatus
+// (so the gRPC server and status.FromError use it as is), and to an HTTP reply
+// with the HTTP status of its code, see Register.
 type Error struct {
-	code    ErrorCode
-	message string
+	code       ErrorCode
+	message    string
+	fields     []FieldViolation
+	retryAfter time.Duration
+	metadata   map[string]string
+	cause      error
 }
 
 func (err Error) Error() string {
+	if err.cause != nil {
+		return fmt.Sprintf("code (%d) - %s: %v", err.code, err.message, err.cause)
+	}
 	return fmt.Sprintf("code (%d) - %s", err.code, err.message)
 }
 
+// Code returns the error code.
+func (err Error) Code() ErrorCode {
+	return err.code
+}
+
+// Message returns the error message, without the code and the cause.
+func (err Error) Message() string {
+	return err.message
+}
+
+// Fields returns the field violations of the error.
+func (err Error) Fields() []FieldViolation {
+	return err.fields
+}
+
+// RetryAfter returns the delay before retrying, zero when not set.
+func (err Error) RetryAfter() time.Duration {
+	return err.retryAfter
+}
+
+// WithField returns a copy of the error with a field violation (google.rpc.BadRequest).
+func (err Error) WithField(field, description string) Error {
+	err.fields = append(append([]FieldViolation(nil), err.fields...), FieldViolation{Field: field, Description: description})
+	return err
+}
+
+// WithRetryAfter returns a copy of the error with the delay before retrying (google.rpc.RetryInfo).
+func (err Error) WithRetryAfter(d time.Duration) Error {
+	err.retryAfter = d
+	return err
+}
+
+// WithMetadata returns a copy of the error with a metadata of its google.rpc.ErrorInfo.
+func (err Error) WithMetadata(key, value string) Error {
+	md := make(map[string]string, len(err.metadata)+1)
+	for k, v := range err.metadata {
+		md[k] = v
+	}
+	md[key] = value
+	err.metadata = md
+	return err
+}
+
+// Wrap returns a copy of the error caused by cause, the cause is logged but not sent to the client.
+func (err Error) Wrap(cause error) Error {
+	err.cause = cause
+	return err
+}
+
+func (err Error) Unwrap() error {
+	return err.cause
+}
+
+// Is reports whether target is an Error with the same code, e.g. errors.Is(err, ToMapFailed).
+func (err Error) Is(target error) bool {
+	t, ok := target.(Error)
+	return ok && t.code == err.code
+}
+
+// HTTPStatus returns the HTTP status registered with the error code, see RegisterWithHTTPStatus.
+// It is zero when the HTTP transport maps the gRPC code of GRPCStatus.
+func (err Error) HTTPStatus() int {
+	return lookup(err.code).httpStatus
+}
+
+// GRPCStatus converts the error to a gRPC status with the details google.rpc.ErrorInfo
+// (reason, domain and code), google.rpc.BadRequest and google.rpc.RetryInfo.
+func (err Error) GRPCStatus() *status.Status {
+	info := lookup(err.code)
+	md := map[string]string{MetadataCode: strconv.Itoa(int(err.code))}
+	for k, v := range err.metadata {
+		md[k] = v
+	}
+	st := status.New(info.grpcCode, err.message)
+
+	details := []protoadapt.MessageV1{&errdetails.ErrorInfo{Reason: info.reason, Domain: Domain, Metadata: md}}
+	if len(err.fields) > 0 {
+		br := &errdetails.BadRequest{}
+		for _, f := range err.fields {
+			br.FieldViolations = append(br.FieldViolations,
+				&errdetails.BadRequest_FieldViolation{Field: f.Field, Description: f.Description})
+		}
+		details = append(details, br)
+	}
+	if err.retryAfter > 0 {
+		details = append(details, &errdetails.RetryInfo{RetryDelay: durationpb.New(err.retryAfter)})
+	}
+	if withDetails, e := st.WithDetails(details...); e == nil {
+		return withDetails
+	}
+	return st
+}
+
+// ToStandardResponse converts the error to the JSON error body of the services,
+// the payload is the google.rpc.Status of GRPCStatus.
 func (err Error) ToStandardResponse() *commonpb.StandardResponse {
-	return &commonpb.StandardResponse{
+	resp := &commonpb.StandardResponse{
 		Code:    int32(err.code),
 		Message: err.message,
 	}
+	if payload, e := anypb.New(err.GRPCStatus().Proto()); e == nil {
+		resp.Payload = payload
+	}
+	return resp
+}
+
+// FromError converts err to an Error: an Error is returned as is, a gRPC status
+// keeps its code, message and details, the context errors become CanceledCode and
+// DeadlineExceededCode, other errors InternalCode. The errors of the transports
+// are converted by their adapters. err must not be nil.
+func FromError(err error) Error {
+	var e Error
+	if stderrors.As(err, &e) {
+		return e
+	}
+	switch {
+	case stderrors.Is(err, context.Canceled):
+		return New(CanceledCode, "request canceled").Wrap(err)
+	case stderrors.Is(err, context.DeadlineExceeded):
+		return New(DeadlineExceededCode, "deadline exceeded").Wrap(err)
+	}
+	if st, ok := status.FromError(err); ok {
+		return FromStatus(st)
+	}
+	return New(InternalCode, "internal error").Wrap(err)
+}
+
+// FromStatus converts a gRPC status to an Error, the code is read from the ErrorInfo
+// details of Domain, or mapped from the gRPC code.
+func FromStatus(st *status.Status) Error {
+	e := New(codeOfGRPC(st.Code()), st.Message())
+	for _, d := range st.Details() {
+		switch detail := d.(type) {
+		case *errdetails.ErrorInfo:
+			if detail.GetDomain() != Domain {
+				continue
+			}
+			for k, v := range detail.GetMetadata() {
+				if k != MetadataCode {
+					e = e.WithMetadata(k, v)
+				} else if code, err := strconv.Atoi(v); err == nil {
+					e.code = ErrorCode(code)
+				}
+			}
+		case *errdetails.BadRequest:
+			for _, f := range detail.GetFieldViolations() {
+				e = e.WithField(f.GetField(), f.GetDescription())
+			}
+		case *errdetails.RetryInfo:
+			e = e.WithRetryAfter(detail.GetRetryDelay().AsDuration())
+		}
+	}
+	return e
 }
 
 type ErrorCode int
 
 // Common Error Code (0 - 99)
 const (
-	UnmarshalFailedCode ErrorCode = iota + 1 // 1
-	ToMapFailedCode                          // 2
+	UnmarshalFailedCode      ErrorCode = iota + 1 // 1
+	ToMapFailedCode                               // 2
+	InvalidArgumentCode                           // 3
+	UnauthenticatedCode                           // 4
+	PermissionDeniedCode                          // 5
+	NotFoundCode                                  // 6
+	AlreadyExistsCode                             // 7
+	RateLimitedCode                               // 8
+	CanceledCode                                  // 9
+	DeadlineExceededCode                          // 10
+	UnavailableCode                               // 11
+	InternalCode                                  // 12
+	PayloadTooLargeCode                           // 13
+	UnsupportedMediaTypeCode                      // 14
 )
 
 // Realtime Database Error Code (100 - 199)
@@ -0,0 +1,93 @@
+package errors
+
+import (
+	"net/http"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+)
+
+type codeInfo struct {
+	grpcCode   codes.Code
+	httpStatus int // zero to map the gRPC code, by the HTTP transport
+	reason     string
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[ErrorCode]codeInfo{
+		UnmarshalFailedCode:      {grpcCode: codes.InvalidArgument, reason: "UNMARSHAL_FAILED"},
+		ToMapFailedCode:          {grpcCode: codes.Internal, reason: "TO_MAP_FAILED"},
+		InvalidArgumentCode:      {grpcCode: codes.InvalidArgument, reason: "INVALID_ARGUMENT"},
+		UnauthenticatedCode:      {grpcCode: codes.Unauthenticated, reason: "UNAUTHENTICATED"},
+		PermissionDeniedCode:     {grpcCode: codes.PermissionDenied, reason: "PERMISSION_DENIED"},
+		NotFoundCode:             {grpcCode: codes.NotFound, reason: "NOT_FOUND"},
+		AlreadyExistsCode:        {grpcCode: codes.AlreadyExists, reason: "ALREADY_EXISTS"},
+		RateLimitedCode:          {grpcCode: codes.ResourceExhausted, reason: "RATE_LIMITED"},
+		CanceledCode:             {grpcCode: codes.Canceled, reason: "CANCELED"},
+		DeadlineExceededCode:     {grpcCode: codes.DeadlineExceeded, reason: "DEADLINE_EXCEEDED"},
+		UnavailableCode:          {grpcCode: codes.Unavailable, reason: "UNAVAILABLE"},
+		InternalCode:             {grpcCode: codes.Internal, reason: "INTERNAL"},
+		PayloadTooLargeCode:      {grpcCode: codes.InvalidArgument, httpStatus: http.StatusRequestEntityTooLarge, reason: "PAYLOAD_TOO_LARGE"},
+		UnsupportedMediaTypeCode: {grpcCode: codes.InvalidArgument, httpStatus: http.StatusUnsupportedMediaType, reason: "UNSUPPORTED_MEDIA_TYPE"},
+
+		RealtimeDBSetFailedCode:    {grpcCode: codes.Internal, reason: "REALTIMEDB_SET_FAILED"},
+		RealtimeDBUpdateFailedCode: {grpcCode: codes.Internal, reason: "REALTIMEDB_UPDATE_FAILED"},
+	}
+
+	// grpcCodes is the error code of a gRPC status without ErrorInfo, see FromStatus
+	grpcCodes = map[codes.Code]ErrorCode{
+		codes.InvalidArgument:    InvalidArgumentCode,
+		codes.OutOfRange:         InvalidArgumentCode,
+		codes.FailedPrecondition: InvalidArgumentCode,
+		codes.Unauthenticated:    UnauthenticatedCode,
+		codes.PermissionDenied:   PermissionDeniedCode,
+		codes.NotFound:           NotFoundCode,
+		codes.AlreadyExists:      AlreadyExistsCode,
+		codes.Aborted:            AlreadyExistsCode,
+		codes.ResourceExhausted:  RateLimitedCode,
+		codes.Canceled:           CanceledCode,
+		codes.DeadlineExceeded:   DeadlineExceededCode,
+		codes.Unavailable:        UnavailableCode,
+	}
+)
+
+// Register registers the gRPC code and the reason (google.rpc.ErrorInfo, UPPER_SNAKE_CASE)
+// of an error code, its HTTP status is mapped from the gRPC code. It is meant to be called
+// from the init functions of the packages declaring their codes, e.g. 200 - 299 for a service.
+//
+// Example usage:
+//
+//	const OrderNotPaidCode errors.ErrorCode = 200
+//
+//	func init() {
+//		errors.Register(OrderNotPaidCode, codes.FailedPrecondition, "ORDER_NOT_PAID")
+//	}
+func Register(code ErrorCode, grpcCode codes.Code, reason string) {
+	RegisterWithHTTPStatus(code, grpcCode, 0, reason)
+}
+
+// RegisterWithHTTPStatus is Register with the HTTP status of the code, when the status
+// mapped from the gRPC code does not fit (e.g. 413 for codes.InvalidArgument).
+func RegisterWithHTTPStatus(code ErrorCode, grpcCode codes.Code, httpStatus int, reason string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[code] = codeInfo{grpcCode: grpcCode, httpStatus: httpStatus, reason: reason}
+}
+
+// lookup returns the registered info of the code, an unknown code is an internal error.
+func lookup(code ErrorCode) codeInfo {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	if info, ok := registry[code]; ok {
+		return info
+	}
+	return codeInfo{grpcCode: codes.Internal, reason: "UNKNOWN"}
+}
+
+func codeOfGRPC(c codes.Code) ErrorCode {
+	if code, ok := grpcCodes[c]; ok {
+		return code
+	}
+	return InternalCode
+}
@@ -0,0 +1,88 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.10
+// 	protoc        v5.29.3
+// source: common/options.proto
+
+// package name will be call by other package,
+// this same proto/path/to/package/file.proto -> path.to.package
+
+package commonpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	descriptorpb "google.golang.org/protobuf/types/descriptorpb"
+	reflect "reflect"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+var file_common_options_proto_extTypes = []protoimpl.ExtensionInfo{
+	{
+		ExtendedType:  (*descriptorpb.FieldOptions)(nil),
+		ExtensionType: (*bool)(nil),
+		Field:         50001,
+		Name:          "common.sensitive",
+		Tag:           "varint,50001,opt,name=sensitive",
+		Filename:      "common/options.proto",
+	},
+}
+
+// Extension fields to descriptorpb.FieldOptions.
+var (
+	// Sensitive fields are redacted when the messages are logged
+	// (e.g. string jwt = 2 [(common.sensitive) = true];)
+	//
+	// optional bool sensitive = 50001;
+	E_Sensitive = &file_common_options_proto_extTypes[0]
+)
+
+var File_common_options_proto protoreflect.FileDescriptor
+
+const file_common_options_proto_rawDesc = "" +
+	"\n" +
+	"\x14common/options.proto\x12\x06common\x1a google/protobuf/descriptor.proto:=\n" +
+	"\tsensitive\x12\x1d.google.protobuf.FieldOptions\x18ц\x03 \x01(\bR\tsensitiveB=Z;github.com/weeback/grpc-project-template/pb/common;commonpbb\x06proto3"
+
+var file_common_options_proto_goTypes = []any{
+	(*descriptorpb.FieldOptions)(nil), // 0: google.protobuf.FieldOptions
+}
+var file_common_options_proto_depIdxs = []int32{
+	0, // 0: common.sensitive:extendee -> google.protobuf.FieldOptions
+	1, // [1:1] is the sub-list for method output_type
+	1, // [1:1] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	0, // [0:1] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_common_options_proto_init() }
+func file_common_options_proto_init() {
+	if File_common_options_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_common_options_proto_rawDesc), len(file_common_options_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   0,
+			NumExtensions: 1,
+			NumServices:   0,
+		},
+		GoTypes:           file_common_options_proto_goTypes,
+		DependencyIndexes: file_common_options_proto_depIdxs,
+		ExtensionInfos:    file_common_options_proto_extTypes,
+	}.Build()
+	File_common_options_proto = out.File
+	file_common_options_proto_goTypes = nil
+	file_common_options_proto_depIdxs = nil
+}
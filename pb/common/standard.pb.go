@@ -1,6 +1,6 @@
 // Code generated by protoc-gen-go. DO NOT EDIT.
 // versions:
-// 	protoc-gen-go v1.36.6
+// 	protoc-gen-go v1.36.10
 // 	protoc        v5.29.3
 // source: common/standard.proto
 
@@ -143,10 +143,10 @@ var File_common_standard_proto protoreflect.FileDescriptor
 
 const file_common_standard_proto_rawDesc = "" +
 	"\n" +
-	"\x15common/standard.proto\x12\x06common\x1a\x19google/protobuf/any.proto\"4\n" +
+	"\x15common/standard.proto\x12\x06common\x1a\x19google/protobuf/any.proto\x1a\x14common/options.proto\":\n" +
 	"\tClientJwt\x12\x15\n" +
-	"\x06req_id\x18\x01 \x01(\tR\x05reqId\x12\x10\n" +
-	"\x03jwt\x18\x02 \x01(\tR\x03jwt\"p\n" +
+	"\x06req_id\x18\x01 \x01(\tR\x05reqId\x12\x16\n" +
+	"\x03jwt\x18\x02 \x01(\tB\x04\x88\xb5\x18\x01R\x03jwt\"p\n" +
 	"\x10StandardResponse\x12\x12\n" +
 	"\x04code\x18\x01 \x01(\x05R\x04code\x12\x18\n" +
 	"\amessage\x18\x02 \x01(\tR\amessage\x12.\n" +
@@ -184,6 +184,7 @@ func file_common_standard_proto_init() {
 	if File_common_standard_proto != nil {
 		return
 	}
+	file_common_options_proto_init()
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
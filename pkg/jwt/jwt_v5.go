@@ -5,6 +5,7 @@ import (
 	"crypto/ed25519"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -29,6 +30,12 @@ func SignWithClaims(key interface{}, payload any, opts ...*Option) (string, erro
 		if i == 0 && op.userId != "" {
 			opt = opt.SetUserId(op.userId)
 		}
+		if i == 0 && op.request != nil {
+			opt.request = op.request
+		}
+		if i == 0 {
+			opt.scopes, opt.roles = op.scopes, op.roles
+		}
 	}
 
 	claims := MapClaims{
@@ -43,6 +50,9 @@ func SignWithClaims(key interface{}, payload any, opts ...*Option) (string, erro
 		},
 		SessionId: opt.SessionId(),
 		UserId:    opt.UserId(),
+		Scope:     strings.Join(opt.Scopes(), " "),
+		Roles:     opt.Roles(),
+		Request:   opt.Request(),
 		Payload:   payload,
 	}
 
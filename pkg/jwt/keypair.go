@@ -42,6 +42,24 @@ func KeyPairFromSecret(secret string) (*KeyPair, error) {
 	}, nil
 }
 
+// ParsePKIXPublicKey parses the base64 PKIX public key of KeyPair.PKIXPublicKey,
+// e.g. the key of a client verifying its signed requests.
+func ParsePKIXPublicKey(public string) (ed25519.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(public)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode public key: %w", err)
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("invalid public key")
+	}
+	return publicKey, nil
+}
+
 type KeyPair struct {
 	PublicKey  ed25519.PublicKey
 	PrivateKey ed25519.PrivateKey
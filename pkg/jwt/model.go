@@ -3,6 +3,8 @@ package jwt
 import (
 	"context"
 	"encoding/json"
+	"strings"
+
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
 
@@ -11,9 +13,17 @@ import (
 
 type MapClaims struct {
 	jwt.RegisteredClaims
-	SessionId string `json:"sessionId"`
-	UserId    string `json:"userId"`
-	Payload   any    `json:"payload"`
+	SessionId string        `json:"sessionId"`
+	UserId    string        `json:"userId"`
+	Scope     string        `json:"scope,omitempty"`
+	Roles     []string      `json:"roles,omitempty"`
+	Request   *RequestClaim `json:"req,omitempty"`
+	Payload   any           `json:"payload"`
+}
+
+// Scopes returns the space-delimited scopes of the scope claim.
+func (claims *MapClaims) Scopes() []string {
+	return strings.Fields(claims.Scope)
 }
 
 func (claims *MapClaims) ParsePayload(v proto.Message) error {
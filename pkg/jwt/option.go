@@ -15,6 +15,8 @@ func NewOption() *Option {
 type Option struct {
 	sessionId, userId string
 	liveTime          time.Duration
+	scopes, roles     []string
+	request           *RequestClaim
 }
 
 func (src *Option) SetLiveTime(d time.Duration) *Option {
@@ -46,3 +48,44 @@ func (src *Option) SetUserId(userId string) *Option {
 func (src *Option) UserId() string {
 	return src.userId
 }
+
+// SetRequest binds the token to a request: the method ("/package.Service/Method" or
+// "POST /say-hello") and the hex SHA-256 of its body, see BodyHash. The timestamp
+// and a nonce are generated, keyId identifies the signing key of the client.
+func (src *Option) SetRequest(keyId, method, bodyHash string) *Option {
+	dst := *src
+	dst.request = &RequestClaim{
+		KeyId:     keyId,
+		Method:    method,
+		BodyHash:  bodyHash,
+		Timestamp: time.Now().Unix(),
+		Nonce:     uuid.NewString(),
+	}
+	return &dst
+}
+
+func (src *Option) Request() *RequestClaim {
+	return src.request
+}
+
+// SetScopes grants the scopes to the token, see MapClaims.Scopes.
+func (src *Option) SetScopes(scopes ...string) *Option {
+	dst := *src
+	dst.scopes = scopes
+	return &dst
+}
+
+func (src *Option) Scopes() []string {
+	return src.scopes
+}
+
+// SetRoles grants the roles to the token.
+func (src *Option) SetRoles(roles ...string) *Option {
+	dst := *src
+	dst.roles = roles
+	return &dst
+}
+
+func (src *Option) Roles() []string {
+	return src.roles
+}
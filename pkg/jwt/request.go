@@ -0,0 +1,216 @@
+package jwt
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	defaultClockSkew   = 30 * time.Second
+	nonceSweepInterval = time.Minute
+)
+
+var (
+	ErrRequestClaimMissing  = errors.New("token is not bound to a request")
+	ErrRequestMethodInvalid = errors.New("token is bound to another method")
+	ErrRequestBodyInvalid   = errors.New("token is bound to another body")
+	ErrRequestClockSkew     = errors.New("request timestamp out of the allowed clock skew")
+	ErrRequestNonceReused   = errors.New("request nonce already used")
+	ErrRequestKeyUnknown    = errors.New("unknown signing key")
+)
+
+// RequestClaim binds a token to one request, it is signed with the token by the key
+// of the client, so that a captured token cannot be replayed with another body.
+type RequestClaim struct {
+	KeyId     string `json:"kid"`
+	Method    string `json:"method"`
+	BodyHash  string `json:"bodyHash"`
+	Timestamp int64  `json:"ts"`
+	Nonce     string `json:"nonce"`
+}
+
+// BodyHash returns the hex SHA-256 of the body: the raw body of a REST request,
+// the proto.Marshal bytes of a gRPC request.
+func BodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// SignRequest signs a token bound to the request with the key of the client, see SignWithClaims.
+//
+// Example usage:
+//
+//	body, _ := proto.Marshal(req)
+//	token, err := jwt.SignRequest(keyPair.PrivateKey, "device-1", "/hello.HelloService/SayHello", body, nil)
+//	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+func SignRequest(key interface{}, keyId, method string, body []byte, payload any, opts ...*Option) (string, error) {
+	opt := NewOption()
+	if len(opts) > 0 && opts[0] != nil {
+		opt = opts[0]
+	}
+	opts = append([]*Option{opt.SetRequest(keyId, method, BodyHash(body))}, opts...)
+	return SignWithClaims(key, payload, opts...)
+}
+
+// KeyIdWithoutVerification returns the key id of the request claim, to resolve the
+// public key verifying the token.
+func KeyIdWithoutVerification(str string) (string, error) {
+	var claims MapClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(str, &claims); err != nil {
+		return "", err
+	}
+	if claims.Request == nil {
+		return "", ErrRequestClaimMissing
+	}
+	return claims.Request.KeyId, nil
+}
+
+// VerifyRequest checks the request claim matches the method and the body hash of the
+// request, and its timestamp is within the clock skew.
+func (claims *MapClaims) VerifyRequest(method, bodyHash string, now time.Time, skew time.Duration) error {
+	if err := claims.verifyRequestMethod(method, now, skew); err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Request.BodyHash), []byte(bodyHash)) != 1 {
+		return ErrRequestBodyInvalid
+	}
+	return nil
+}
+
+// verifyRequestMethod checks the request claim matches the method, and its timestamp
+// is within the clock skew.
+func (claims *MapClaims) verifyRequestMethod(method string, now time.Time, skew time.Duration) error {
+	req := claims.Request
+	if req == nil {
+		return ErrRequestClaimMissing
+	}
+	if req.Method != method {
+		return ErrRequestMethodInvalid
+	}
+	if ts := time.Unix(req.Timestamp, 0); ts.Before(now.Add(-skew)) || ts.After(now.Add(skew)) {
+		return ErrRequestClockSkew
+	}
+	if req.Nonce == "" {
+		return fmt.Errorf("%w: empty nonce", ErrRequestClaimMissing)
+	}
+	return nil
+}
+
+// NonceStore remembers the nonces of the signed requests until they expire.
+type NonceStore interface {
+	// Use records the nonce of the key, and reports false if it was already used.
+	Use(ctx context.Context, keyId, nonce string, expireAt time.Time) (bool, error)
+}
+
+// NewMemoryNonceStore creates a store keeping the nonces in memory, the replays are
+// detected per instance of the service.
+func NewMemoryNonceStore() *MemoryNonceStore {
+	return &MemoryNonceStore{nonces: make(map[string]time.Time)}
+}
+
+// MemoryNonceStore is the in-memory NonceStore.
+type MemoryNonceStore struct {
+	mu        sync.Mutex
+	nonces    map[string]time.Time
+	lastSweep time.Time
+}
+
+func (s *MemoryNonceStore) Use(_ context.Context, keyId, nonce string, expireAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.lastSweep) >= nonceSweepInterval {
+		s.lastSweep = now
+		for k, exp := range s.nonces {
+			if now.After(exp) {
+				delete(s.nonces, k)
+			}
+		}
+	}
+	key := keyId + "|" + nonce
+	if exp, ok := s.nonces[key]; ok && now.Before(exp) {
+		return false, nil
+	}
+	s.nonces[key] = expireAt
+	return true, nil
+}
+
+// RequestVerifier verifies the signed requests: the token signature with the public key
+// of the client, the method and body hash of the request, the clock skew and the nonce.
+type RequestVerifier struct {
+	// PublicKey returns the public key of the key id of the request claim.
+	PublicKey func(keyId string) (ed25519.PublicKey, error)
+	// Nonces remembers the nonces used, default is in memory.
+	Nonces NonceStore
+	// ClockSkew is the allowed difference between the request timestamp and the
+	// server clock, default is 30 seconds.
+	ClockSkew time.Duration
+
+	once sync.Once
+}
+
+// VerifyToken verifies the token signature, its method and its timestamp, before the body
+// of the request is known (a stream before its first message). It does not use the nonce,
+// Verify must follow with the body hash.
+func (v *RequestVerifier) VerifyToken(method, token string) (*MapClaims, error) {
+	v.once.Do(func() {
+		if v.Nonces == nil {
+			v.Nonces = NewMemoryNonceStore()
+		}
+		if v.ClockSkew <= 0 {
+			v.ClockSkew = defaultClockSkew
+		}
+	})
+	keyId, err := KeyIdWithoutVerification(token)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := v.PublicKey(keyId)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q: %v", ErrRequestKeyUnknown, keyId, err)
+	}
+	claims, err := ParseClaims(pub, token)
+	if err != nil {
+		return nil, err
+	}
+	if err := claims.verifyRequestMethod(method, time.Now(), v.ClockSkew); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// Verify verifies the token bound to the request, and returns its claims.
+//
+// Example usage:
+//
+//	verifier := &jwt.RequestVerifier{PublicKey: keys.Lookup, Nonces: nonceStore}
+//	claims, err := verifier.Verify(ctx, fullMethod, bodyHash, jwtStr)
+func (v *RequestVerifier) Verify(ctx context.Context, method, bodyHash, token string) (*MapClaims, error) {
+	claims, err := v.VerifyToken(method, token)
+	if err != nil {
+		return nil, err
+	}
+	if err := claims.VerifyRequest(method, bodyHash, time.Now(), v.ClockSkew); err != nil {
+		return nil, err
+	}
+	// The nonce is kept while its timestamp is accepted
+	keyId := claims.Request.KeyId
+	expireAt := time.Unix(claims.Request.Timestamp, 0).Add(v.ClockSkew)
+	ok, err := v.Nonces.Use(ctx, keyId, claims.Request.Nonce, expireAt)
+	if err != nil {
+		return nil, fmt.Errorf("nonce store: %w", err)
+	}
+	if !ok {
+		return nil, ErrRequestNonceReused
+	}
+	return claims, nil
+}
@@ -0,0 +1,116 @@
+package jwt
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func Test_RequestVerifier(t *testing.T) {
+	const method = "/hello.HelloService/SayHello"
+	body := []byte(`{"name":"gopher"}`)
+
+	kp, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair err: %v", err)
+	}
+	other, _ := GenerateKeyPair()
+	keys := map[string]ed25519.PublicKey{"device-1": kp.PublicKey}
+
+	// sign signs the request with the key of the client, shifting its timestamp
+	sign := func(key ed25519.PrivateKey, keyId string, shift time.Duration) string {
+		opt := NewOption().SetRequest(keyId, method, BodyHash(body))
+		opt.request.Timestamp += int64(shift.Seconds())
+		token, err := SignWithClaims(key, nil, opt)
+		if err != nil {
+			t.Fatalf("SignWithClaims err: %v", err)
+		}
+		return token
+	}
+	signed, _ := SignRequest(kp.PrivateKey, "device-1", method, body, nil)
+	reused, _ := SignRequest(kp.PrivateKey, "device-1", method, body, nil)
+
+	verifier := &RequestVerifier{
+		PublicKey: func(keyId string) (ed25519.PublicKey, error) {
+			if pub, ok := keys[keyId]; ok {
+				return pub, nil
+			}
+			return nil, fmt.Errorf("no key %q", keyId)
+		},
+		ClockSkew: 30 * time.Second,
+	}
+	// The nonce of reused is used once before the tests
+	if _, err := verifier.Verify(context.Background(), method, BodyHash(body), reused); err != nil {
+		t.Fatalf("Verify err: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		body    []byte
+		token   string
+		wantErr error
+	}{
+		{name: "signed request", method: method, body: body, token: signed},
+		{name: "wrong method", method: "/hello.HelloService/Other", body: body, token: sign(kp.PrivateKey, "device-1", 0), wantErr: ErrRequestMethodInvalid},
+		{name: "wrong body", method: method, body: []byte(`{"name":"other"}`), token: sign(kp.PrivateKey, "device-1", 0), wantErr: ErrRequestBodyInvalid},
+		{name: "timestamp too old", method: method, body: body, token: sign(kp.PrivateKey, "device-1", -time.Minute), wantErr: ErrRequestClockSkew},
+		{name: "timestamp in the future", method: method, body: body, token: sign(kp.PrivateKey, "device-1", time.Minute), wantErr: ErrRequestClockSkew},
+		{name: "nonce reused", method: method, body: body, token: reused, wantErr: ErrRequestNonceReused},
+		{name: "unknown kid", method: method, body: body, token: sign(kp.PrivateKey, "device-2", 0), wantErr: ErrRequestKeyUnknown},
+		{name: "signed by another key", method: method, body: body, token: sign(other.PrivateKey, "device-1", 0), wantErr: errAny},
+		{name: "not bound to a request", method: method, body: body, token: mustSign(t, kp.PrivateKey), wantErr: ErrRequestClaimMissing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := verifier.Verify(context.Background(), tt.method, BodyHash(tt.body), tt.token)
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("Verify err: %v", err)
+			case tt.wantErr == nil && claims.Request.KeyId != "device-1":
+				t.Fatalf("Verify claims: %+v", claims.Request)
+			case tt.wantErr == errAny && err == nil:
+				t.Fatalf("Verify err: nil, want an error")
+			case tt.wantErr != nil && tt.wantErr != errAny && !errors.Is(err, tt.wantErr):
+				t.Fatalf("Verify err: %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_RequestVerifierVerifyToken(t *testing.T) {
+	const method = "/hello.HelloService/Chat"
+	kp, _ := GenerateKeyPair()
+	verifier := &RequestVerifier{PublicKey: func(string) (ed25519.PublicKey, error) {
+		return kp.PublicKey, nil
+	}}
+	token, _ := SignRequest(kp.PrivateKey, "device-1", method, []byte("first message"), nil)
+
+	// The token is checked before the body is known, its nonce is not used
+	for range 2 {
+		if _, err := verifier.VerifyToken(method, token); err != nil {
+			t.Fatalf("VerifyToken err: %v", err)
+		}
+	}
+	if _, err := verifier.VerifyToken("/hello.HelloService/Other", token); !errors.Is(err, ErrRequestMethodInvalid) {
+		t.Fatalf("VerifyToken err: %v, want %v", err, ErrRequestMethodInvalid)
+	}
+	if _, err := verifier.Verify(context.Background(), method, BodyHash([]byte("first message")), token); err != nil {
+		t.Fatalf("Verify err: %v", err)
+	}
+}
+
+// errAny matches any error of the verification.
+var errAny = errors.New("any error")
+
+func mustSign(t *testing.T, key ed25519.PrivateKey) string {
+	t.Helper()
+	token, err := SignWithClaims(key, nil, NewOption())
+	if err != nil {
+		t.Fatalf("SignWithClaims err: %v", err)
+	}
+	return token
+}
@@ -86,3 +86,12 @@ func NewEntry() *zap.Logger {
 		zap.Time("timestamp", time.Now()),
 		zap.String("environment", os.Getenv("DEPLOYMENT_ENVIRONMENT")))
 }
+
+// Sync flushes any buffered log entries of the shared logger.
+// It is safe to call when the logger has not been initialized yet.
+func Sync() error {
+	if logger == nil {
+		return nil
+	}
+	return logger.Sync()
+}
@@ -0,0 +1,207 @@
+package logger
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+
+	commonpb "github.com/weeback/grpc-project-template/pb/common"
+
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// RedactedValue replaces the values of the sensitive fields, headers and metadata.
+const RedactedValue = "[REDACTED]"
+
+// DefaultRedactedKeys are the headers, metadata and form keys redacted by default.
+var DefaultRedactedKeys = []string{
+	"authorization",
+	"proxy-authorization",
+	"cookie",
+	"set-cookie",
+	"x-api-key",
+	"x-goog-iap-jwt-assertion",
+	"secret",
+	"password",
+	"token",
+	"access_token",
+}
+
+var (
+	valuesType = reflect.TypeOf(map[string][]string(nil))
+
+	redactMu     sync.RWMutex
+	redactedKeys = toKeySet(DefaultRedactedKeys)
+)
+
+// SetRedactedKeys replaces the deny-list of the headers, metadata and form keys whose
+// values are redacted by Redact, the keys are case-insensitive.
+func SetRedactedKeys(keys ...string) {
+	set := toKeySet(keys)
+	redactMu.Lock()
+	defer redactMu.Unlock()
+	redactedKeys = set
+}
+
+// AddRedactedKeys adds the keys to the deny-list of Redact, e.g. the query parameter
+// carrying a token.
+func AddRedactedKeys(keys ...string) {
+	redactMu.Lock()
+	defer redactMu.Unlock()
+	set := make(map[string]struct{}, len(redactedKeys)+len(keys))
+	for key := range redactedKeys {
+		set[key] = struct{}{}
+	}
+	for key := range toKeySet(keys) {
+		set[key] = struct{}{}
+	}
+	redactedKeys = set
+}
+
+func toKeySet(keys []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		set[strings.ToLower(strings.TrimSpace(key))] = struct{}{}
+	}
+	return set
+}
+
+func isRedactedKey(key string) bool {
+	redactMu.RLock()
+	defer redactMu.RUnlock()
+	_, ok := redactedKeys[strings.ToLower(key)]
+	return ok
+}
+
+// Redact is the zap field of a value to log without its secrets: the fields of the proto
+// messages with the option (common.sensitive) = true, and the values of the headers,
+// gRPC metadata or form keys of the deny-list (see SetRedactedKeys) are replaced.
+// Other values are logged as zap.Any.
+//
+// Example usage:
+//
+//	md, _ := metadata.FromIncomingContext(ctx)
+//	entry.Info("gRPC request started",
+//		logger.Redact("metadata", md),
+//		logger.Redact("request", req))
+func Redact(key string, v any) zap.Field {
+	if msg, ok := v.(proto.Message); ok {
+		return redactMessage(key, msg)
+	}
+	// metadata.MD, http.Header and url.Values are maps of values
+	if rv := reflect.ValueOf(v); rv.IsValid() && rv.Type().ConvertibleTo(valuesType) {
+		return zap.Any(key, redactValues(rv.Convert(valuesType).Interface().(map[string][]string)))
+	}
+	return zap.Any(key, v)
+}
+
+// JWT is the zap field of a masked JWT, see MaskToken.
+func JWT(key, token string) zap.Field {
+	return zap.String(key, MaskToken(token))
+}
+
+// MaskToken masks a JWT or any other token, keeping its first and last characters
+// to tell the tokens apart in the logs.
+func MaskToken(token string) string {
+	token = strings.TrimSpace(strings.TrimPrefix(token, "Bearer "))
+	if token == "" {
+		return ""
+	}
+	if len(token) < 24 {
+		return RedactedValue
+	}
+	return token[:6] + "..." + token[len(token)-4:]
+}
+
+// RedactURL returns the URL with the values of the query keys of the deny-list redacted.
+func RedactURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	if u.RawQuery == "" {
+		return u.String()
+	}
+	query := u.Query()
+	for k := range query {
+		if isRedactedKey(k) {
+			query[k] = []string{RedactedValue}
+		}
+	}
+	redacted := *u
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
+}
+
+func redactMessage(key string, msg proto.Message) zap.Field {
+	if msg == nil || !msg.ProtoReflect().IsValid() {
+		return zap.Any(key, nil)
+	}
+	clone := proto.Clone(msg)
+	redactFields(clone.ProtoReflect())
+	b, err := protojson.Marshal(clone)
+	if err != nil {
+		return zap.String(key, RedactedValue)
+	}
+	return zap.Reflect(key, json.RawMessage(b))
+}
+
+// redactFields clears the sensitive fields of the message and its nested messages,
+// the strings are replaced by RedactedValue.
+func redactFields(msg protoreflect.Message) {
+	if a, ok := msg.Interface().(*anypb.Any); ok {
+		// The payloads of Any, e.g. common.StandardResponse, are redacted with their type
+		if inner, err := a.UnmarshalNew(); err == nil {
+			redactFields(inner.ProtoReflect())
+			_ = a.MarshalFrom(inner)
+		}
+		return
+	}
+	var sensitive []protoreflect.FieldDescriptor
+	msg.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if proto.GetExtension(fd.Options(), commonpb.E_Sensitive).(bool) {
+			sensitive = append(sensitive, fd)
+			return true
+		}
+		switch {
+		case fd.IsList() && fd.Message() != nil:
+			list := v.List()
+			for i := 0; i < list.Len(); i++ {
+				redactFields(list.Get(i).Message())
+			}
+		case fd.IsMap() && fd.MapValue().Message() != nil:
+			v.Map().Range(func(_ protoreflect.MapKey, mv protoreflect.Value) bool {
+				redactFields(mv.Message())
+				return true
+			})
+		case !fd.IsList() && !fd.IsMap() && fd.Message() != nil:
+			redactFields(v.Message())
+		}
+		return true
+	})
+	// The message is not modified while ranging over its fields
+	for _, fd := range sensitive {
+		if fd.Kind() == protoreflect.StringKind && !fd.IsList() && !fd.IsMap() {
+			msg.Set(fd, protoreflect.ValueOfString(RedactedValue))
+		} else {
+			msg.Clear(fd)
+		}
+	}
+}
+
+func redactValues(values map[string][]string) map[string][]string {
+	out := make(map[string][]string, len(values))
+	for k, vv := range values {
+		if isRedactedKey(k) {
+			out[k] = []string{RedactedValue}
+			continue
+		}
+		out[k] = vv
+	}
+	return out
+}
@@ -21,6 +21,9 @@ const (
 	defaultServiceName = "default"
 
 	defaultCustomPath = "custom.googleapis.com"
+
+	// maxSendTimeout is the longest time to send a batch of metrics
+	maxSendTimeout = 30 * time.Second
 )
 
 var (
@@ -189,8 +192,9 @@ func (m *metrics) sendToGCP(ctx context.Context, timeSeries []*monitoringpb.Time
 			return
 		}
 
-		// create a context with timeout for sending metrics
-		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		// create a context with its own budget for sending the batch, it may continue in background:
+		// neither the deadline nor the cancellation of the request triggering the flush apply
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), maxSendTimeout)
 		defer func() {
 			m.lastTime = time.Now()
 			cancel()
@@ -70,6 +70,21 @@ func (m *metrics) Close() (err error) {
 	return err
 }
 
+// Ping checks the GCP Monitoring API is reachable with the credentials of the client,
+// by reading the descriptor of the monitored resource, e.g. as a health check.
+func (m *metrics) Ping(ctx context.Context) error {
+	if m.projectID == "" {
+		return fmt.Errorf("projectID is required to send metrics to GCP")
+	}
+	if m.client == nil {
+		return fmt.Errorf("GCP MetricClient is not initialized")
+	}
+	_, err := m.client.GetMonitoredResourceDescriptor(ctx, &monitoringpb.GetMonitoredResourceDescriptorRequest{
+		Name: fmt.Sprintf("projects/%s/monitoredResourceDescriptors/%s", m.projectID, m.getResourceType()),
+	})
+	return err
+}
+
 func (m *metrics) SendTimeSeries(ctx context.Context, timeSeries []*monitoringpb.TimeSeries) error {
 	if len(timeSeries) == 0 {
 		return nil
@@ -18,6 +18,11 @@ func (n *NoopTable) Close() (err error) {
 	return nil
 }
 
+func (n *NoopTable) Ping(ctx context.Context) error {
+	// no-op implementation
+	return nil
+}
+
 func (n *NoopTable) SendTimeSeries(ctx context.Context, timeSeries []*monitoringpb.TimeSeries) error {
 	// no-op implementation
 	return nil
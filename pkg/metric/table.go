@@ -9,11 +9,14 @@ import (
 type Monitoring interface {
 	NewTable(name string, labels map[string]string) Table
 	Close() (err error)
+	// Ping checks the GCP Monitoring API is reachable, e.g. as a health check.
+	Ping(ctx context.Context) error
 }
 
 type Table interface {
 	NewTable(name string, labels map[string]string) Table
 	Close() (err error)
+	Ping(ctx context.Context) error
 	SendTimeSeries(ctx context.Context, timeSeries []*monitoringpb.TimeSeries) error
 	SendMetrics(ctx context.Context, method string, metrics map[string]*monitoringpb.TypedValue) error
 }
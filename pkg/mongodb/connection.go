@@ -111,9 +111,34 @@ func (c *Connection) Database() *mongo.Database {
 	return c.client.Database(c.dbName)
 }
 
+// ReplicaSet reports whether the connection is to a replica set, which has secondary nodes.
+func (c *Connection) ReplicaSet() bool {
+	return c.replicaSet
+}
+
+// PingPrimary checks the primary node is reachable, e.g. as a health check.
+func (c *Connection) PingPrimary(ctx context.Context) error {
+	return c.client.Ping(ctx, readpref.Primary())
+}
+
+// PingSecondary checks a secondary node is reachable, e.g. as a health check.
+// The primary is pinged when the connection is not to a replica set.
+func (c *Connection) PingSecondary(ctx context.Context) error {
+	if !c.replicaSet {
+		return c.PingPrimary(ctx)
+	}
+	return c.client.Ping(ctx, readpref.Secondary())
+}
+
+// Read runs readFn on a secondary node, or on the primary if the secondary is unavailable.
+// readFn should run its operations with ctx, so that they stop at the deadline of the request.
 func (c *Connection) Read(ctx context.Context, readFn func(*mongo.Database) error) error {
 	// by default with readpref.Secondary
 	if err := c.ReadSecondary(ctx, readFn); err != nil {
+		if ctx.Err() != nil {
+			// The budget of the request is spent, the primary would fail as well
+			return err
+		}
 		log.Printf("Secondary node is unavailable, try reading with mode readpref.Primary")
 		return c.ReadPrimary(ctx, readFn)
 	}
@@ -0,0 +1,392 @@
+package net
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/weeback/grpc-project-template/pkg/jwt"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/alts"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+)
+
+type authorizedContextKey struct{}
+
+// AuthzRule is the access of the methods: gRPC full methods ("/hello.HelloService/SayHello"),
+// REST routes with their path template ("POST /say-hello"), a prefix ending with "*"
+// ("/hello.HelloService/*") or "*" for every method. The most specific rule applies.
+//
+// A public rule allows the anonymous calls. Otherwise the caller must run as one of the
+// service accounts (ALTS peer or mTLS identity) when set, and a valid JWT is required with
+// all the scopes and one of the roles when set. A rule with service accounts only requires no JWT.
+type AuthzRule struct {
+	Methods         []string `json:"methods" yaml:"methods"`
+	Public          bool     `json:"public,omitempty" yaml:"public,omitempty"`
+	Scopes          []string `json:"scopes,omitempty" yaml:"scopes,omitempty"`
+	Roles           []string `json:"roles,omitempty" yaml:"roles,omitempty"`
+	ServiceAccounts []string `json:"serviceAccounts,omitempty" yaml:"serviceAccounts,omitempty"`
+}
+
+// AuthzPolicyFile is the content of a policy file, in YAML or JSON.
+//
+//	dryRun: false
+//	defaultAllow: false
+//	rules:
+//	  - methods: ["/grpc.health.v1.Health/*"]
+//	    public: true
+//	  - methods: ["/hello.HelloService/SayHello", "POST /say-hello"]
+//	    scopes: ["hello:write"]
+//	    serviceAccounts: ["caller@project.iam.gserviceaccount.com"]
+type AuthzPolicyFile struct {
+	// DryRun logs the decisions without enforcing them.
+	DryRun bool `json:"dryRun,omitempty" yaml:"dryRun,omitempty"`
+	// DefaultAllow allows the methods without rule, they are denied by default.
+	DefaultAllow bool        `json:"defaultAllow,omitempty" yaml:"defaultAllow,omitempty"`
+	Rules        []AuthzRule `json:"rules" yaml:"rules"`
+}
+
+// AuthzDecision is the result of the evaluation of a call.
+type AuthzDecision struct {
+	Allowed bool
+	// Rule is the method pattern of the rule applied, empty for the default
+	Rule   string
+	Reason string
+	// Code is the status of a denied call: Unauthenticated or PermissionDenied
+	Code codes.Code
+}
+
+// AuthzOption configures the AuthzPolicy.
+type AuthzOption func(p *AuthzPolicy)
+
+// WithAuthzPublicKey verifies the JWTs with the public key, the methods requiring
+// a JWT are denied without it.
+func WithAuthzPublicKey(pub ed25519.PublicKey) AuthzOption {
+	return func(p *AuthzPolicy) {
+		p.publicKey = pub
+	}
+}
+
+// WithAuthzKeyLookup verifies the JWTs bound to a request (see jwt.SignRequest) with the public
+// key of their key id, as the jwt.RequestVerifier of the authentication does, so that one
+// Authorization header satisfies both. The scopes and roles of these tokens are trusted as
+// much as the keys of the lookup. The other JWTs are verified with WithAuthzPublicKey.
+func WithAuthzKeyLookup(lookup func(keyId string) (ed25519.PublicKey, error)) AuthzOption {
+	return func(p *AuthzPolicy) {
+		p.keyLookup = lookup
+	}
+}
+
+// WithAuthzDryRun logs the decisions without enforcing them (audit mode).
+func WithAuthzDryRun() AuthzOption {
+	return func(p *AuthzPolicy) {
+		p.dryRun = true
+	}
+}
+
+// WithAuthzDefaultAllow allows the methods without rule.
+func WithAuthzDefaultAllow() AuthzOption {
+	return func(p *AuthzPolicy) {
+		p.defaultAllow = true
+	}
+}
+
+// AuthzPolicy authorizes the REST requests and the gRPC calls with the rules of their method.
+type AuthzPolicy struct {
+	exact        map[string]*AuthzRule
+	prefixes     []authzPrefix // longest prefix first
+	publicKey    ed25519.PublicKey
+	keyLookup    func(keyId string) (ed25519.PublicKey, error)
+	dryRun       bool
+	defaultAllow bool
+}
+
+type authzPrefix struct {
+	prefix string
+	rule   *AuthzRule
+}
+
+// NewAuthzPolicy creates the policy of the rules, a method matching several patterns of
+// the same specificity gets the first rule.
+func NewAuthzPolicy(rules []AuthzRule, opts ...AuthzOption) (*AuthzPolicy, error) {
+	p := &AuthzPolicy{exact: make(map[string]*AuthzRule)}
+	for i := range rules {
+		rule := &rules[i]
+		if len(rule.Methods) == 0 {
+			return nil, fmt.Errorf("authz rule %d has no method", i)
+		}
+		for _, method := range rule.Methods {
+			method = strings.TrimSpace(method)
+			if prefix, ok := strings.CutSuffix(method, "*"); ok {
+				if !slices.ContainsFunc(p.prefixes, func(e authzPrefix) bool { return e.prefix == prefix }) {
+					p.prefixes = append(p.prefixes, authzPrefix{prefix: prefix, rule: rule})
+				}
+			} else if _, ok := p.exact[method]; !ok {
+				p.exact[method] = rule
+			}
+		}
+	}
+	sort.SliceStable(p.prefixes, func(i, j int) bool {
+		return len(p.prefixes[i].prefix) > len(p.prefixes[j].prefix)
+	})
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p, nil
+}
+
+// LoadAuthzPolicy creates the policy of a YAML (.yaml, .yml) or JSON file, see AuthzPolicyFile.
+// The options are applied after the file.
+//
+// Example usage:
+//
+//	policy, err := net.LoadAuthzPolicy("authz.yaml", net.WithAuthzPublicKey(keyPair.PublicKey))
+//	net.Use(router, policy.Stage())
+func LoadAuthzPolicy(path string, opts ...AuthzOption) (*AuthzPolicy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read authz policy: %w", err)
+	}
+	var file AuthzPolicyFile
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &file)
+	default:
+		err = json.Unmarshal(b, &file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse authz policy %s: %w", path, err)
+	}
+	var fileOpts []AuthzOption
+	if file.DryRun {
+		fileOpts = append(fileOpts, WithAuthzDryRun())
+	}
+	if file.DefaultAllow {
+		fileOpts = append(fileOpts, WithAuthzDefaultAllow())
+	}
+	return NewAuthzPolicy(file.Rules, append(fileOpts, opts...)...)
+}
+
+// DryRun reports whether the decisions are logged without being enforced.
+func (p *AuthzPolicy) DryRun() bool {
+	return p.dryRun
+}
+
+// rule returns the most specific rule of the first method matched, and its pattern.
+func (p *AuthzPolicy) rule(methods ...string) (*AuthzRule, string) {
+	for _, method := range methods {
+		if rule, ok := p.exact[method]; ok {
+			return rule, method
+		}
+	}
+	for _, method := range methods {
+		for _, e := range p.prefixes {
+			if strings.HasPrefix(method, e.prefix) {
+				return e.rule, e.prefix + "*"
+			}
+		}
+	}
+	return nil, ""
+}
+
+// Evaluate decides the access of a call of the methods (the REST route, then the gRPC
+// method it is transcoded to), with its bearer JWT.
+func (p *AuthzPolicy) Evaluate(ctx context.Context, token string, methods ...string) AuthzDecision {
+	decision := p.evaluate(ctx, token, methods...)
+	if decision.Allowed {
+		decision.Code = codes.OK
+	}
+	return decision
+}
+
+func (p *AuthzPolicy) evaluate(ctx context.Context, token string, methods ...string) AuthzDecision {
+	rule, pattern := p.rule(methods...)
+	if rule == nil {
+		if p.defaultAllow {
+			return AuthzDecision{Allowed: true, Reason: "no rule, allowed by default"}
+		}
+		return AuthzDecision{Reason: "no rule, denied by default", Code: codes.PermissionDenied}
+	}
+	decision := AuthzDecision{Rule: pattern, Code: codes.PermissionDenied}
+	if rule.Public {
+		decision.Allowed, decision.Reason = true, "public"
+		return decision
+	}
+	if len(rule.ServiceAccounts) > 0 {
+		sa := peerServiceAccount(ctx)
+		if !slices.ContainsFunc(rule.ServiceAccounts, func(s string) bool { return strings.EqualFold(s, sa) }) {
+			decision.Reason = fmt.Sprintf("service account %q is not allowed", sa)
+			return decision
+		}
+	}
+	if len(rule.ServiceAccounts) > 0 && len(rule.Scopes) == 0 && len(rule.Roles) == 0 {
+		decision.Allowed, decision.Reason = true, "service account"
+		return decision
+	}
+	if token == "" {
+		decision.Reason, decision.Code = "missing bearer token", codes.Unauthenticated
+		return decision
+	}
+	pub, err := p.verifyingKey(token)
+	if err != nil {
+		decision.Reason, decision.Code = err.Error(), codes.Unauthenticated
+		return decision
+	}
+	claims, err := jwt.ParseClaims(pub, token)
+	if err != nil {
+		decision.Reason, decision.Code = fmt.Sprintf("invalid bearer token: %v", err), codes.Unauthenticated
+		return decision
+	}
+	scopes := claims.Scopes()
+	for _, scope := range rule.Scopes {
+		if !slices.Contains(scopes, scope) {
+			decision.Reason = fmt.Sprintf("missing scope %q", scope)
+			return decision
+		}
+	}
+	if len(rule.Roles) > 0 && !slices.ContainsFunc(rule.Roles, func(r string) bool { return slices.Contains(claims.Roles, r) }) {
+		decision.Reason = fmt.Sprintf("none of the roles %v", rule.Roles)
+		return decision
+	}
+	decision.Allowed, decision.Reason = true, "granted"
+	return decision
+}
+
+// verifyingKey returns the key verifying the token: the key of its key id when it is bound
+// to a request and a key lookup is set, otherwise the public key.
+func (p *AuthzPolicy) verifyingKey(token string) (ed25519.PublicKey, error) {
+	if p.keyLookup != nil {
+		if keyId, err := jwt.KeyIdWithoutVerification(token); err == nil {
+			pub, err := p.keyLookup(keyId)
+			if err != nil {
+				return nil, fmt.Errorf("unknown key %q of the bearer token", keyId)
+			}
+			return pub, nil
+		}
+	}
+	if p.publicKey == nil {
+		return nil, fmt.Errorf("no key to verify the bearer token")
+	}
+	return p.publicKey, nil
+}
+
+// authorize evaluates the call and logs the decision, it reports whether the call
+// goes on: always in dry-run mode.
+func (p *AuthzPolicy) authorize(ctx context.Context, token string, methods ...string) (AuthzDecision, bool) {
+	decision := p.Evaluate(ctx, token, methods...)
+	fields := []zap.Field{
+		zap.Strings("method", methods),
+		zap.String("rule", decision.Rule),
+		zap.Bool("allowed", decision.Allowed),
+		zap.String("reason", decision.Reason),
+		zap.Bool("dry_run", p.dryRun),
+	}
+	entry := getLoggerFromContext(ctx)
+	switch {
+	case p.dryRun:
+		// Audit mode, every decision is logged
+		entry.Info("Authorization policy decision", fields...)
+		return decision, true
+	case !decision.Allowed:
+		entry.Warn("Authorization policy denied", fields...)
+		return decision, false
+	default:
+		entry.Debug("Authorization policy decision", fields...)
+		return decision, true
+	}
+}
+
+// Stage returns the REST stage of the policy, see Middleware.
+func (p *AuthzPolicy) Stage() Stage {
+	return NewStage("authz", p.Middleware)
+}
+
+// Middleware authorizes the REST requests with the rule of their route ("POST /say-hello"),
+// or the rule of the gRPC method of a transcoded route. A denied request is answered
+// 401 Unauthorized or 403 Forbidden. The gRPC call served in-process is not authorized again.
+func (p *AuthzPolicy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods := []string{r.Method + " " + r.URL.Path}
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil {
+				methods[0] = r.Method + " " + tmpl
+			}
+			if t, ok := route.GetHandler().(*transcoder); ok {
+				methods = append(methods, t.fullMethod)
+			}
+		}
+		token := strings.TrimPrefix(r.Header.Get(headerAuthorization), "Bearer ")
+		decision, ok := p.authorize(r.Context(), token, methods...)
+		if !ok {
+			code := http.StatusForbidden
+			if decision.Code == codes.Unauthenticated {
+				code = http.StatusUnauthorized
+			}
+			WriteStatus(w, r, code, status.New(decision.Code, "Authorization denied: "+decision.Reason))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authorizedContextKey{}, true)))
+	})
+}
+
+// UnaryServerInterceptor authorizes the unary calls with the rule of their method.
+func (p *AuthzPolicy) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := p.checkGRPC(ctx, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor authorizes the streams with the rule of their method, when they start.
+func (p *AuthzPolicy) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := p.checkGRPC(ss.Context(), info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+func (p *AuthzPolicy) checkGRPC(ctx context.Context, fullMethod string) error {
+	// The REST request of a transcoded call is already authorized by the stage,
+	// the health checks are served to the probes without credentials
+	if authorized, _ := ctx.Value(authorizedContextKey{}).(bool); authorized || isHealthMethod(fullMethod) {
+		return nil
+	}
+	var token string
+	md, _ := metadata.FromIncomingContext(ctx)
+	if auth := md.Get(headerAuthorization); len(auth) > 0 {
+		token = strings.TrimPrefix(auth[0], "Bearer ")
+	}
+	if decision, ok := p.authorize(ctx, token, fullMethod); !ok {
+		return status.Error(decision.Code, "Authorization denied: "+decision.Reason)
+	}
+	return nil
+}
+
+// peerServiceAccount returns the verified client certificate identity (mTLS),
+// or the ALTS peer service account of the caller.
+func peerServiceAccount(ctx context.Context) string {
+	if id, ok := PeerIdentityFromContext(ctx); ok {
+		return id
+	}
+	if info, err := alts.AuthInfoFromContext(ctx); err == nil {
+		return info.PeerServiceAccount()
+	}
+	return ""
+}
@@ -0,0 +1,154 @@
+package net
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/weeback/grpc-project-template/pkg/jwt"
+)
+
+func Test_AuthzPolicyEvaluate(t *testing.T) {
+	keyPair, _ := jwt.GenerateKeyPair()
+	writer, _ := jwt.SignWithClaims(keyPair.PrivateKey, nil, jwt.NewOption().SetScopes("hello:write"))
+	admin, _ := jwt.SignWithClaims(keyPair.PrivateKey, nil, jwt.NewOption().SetRoles("admin"))
+
+	policy, err := NewAuthzPolicy([]AuthzRule{
+		{Methods: []string{"*"}, Roles: []string{"admin"}},
+		{Methods: []string{"/hello.*"}, Scopes: []string{"hello:read"}},
+		{Methods: []string{"/hello.HelloService/*"}, Scopes: []string{"hello:write"}},
+		{Methods: []string{"/hello.HelloService/SayHello", "POST /say-hello"}, Public: true},
+	}, WithAuthzPublicKey(keyPair.PublicKey))
+	if err != nil {
+		t.Fatalf("NewAuthzPolicy err: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		methods  []string
+		token    string
+		wantRule string
+		wantCode codes.Code
+	}{
+		{name: "exact before prefix", methods: []string{"/hello.HelloService/SayHello"}, wantRule: "/hello.HelloService/SayHello", wantCode: codes.OK},
+		{name: "longest prefix", methods: []string{"/hello.HelloService/Other"}, token: writer, wantRule: "/hello.HelloService/*", wantCode: codes.OK},
+		{name: "longest prefix missing scope", methods: []string{"/hello.HelloService/Other"}, token: admin, wantRule: "/hello.HelloService/*", wantCode: codes.PermissionDenied},
+		{name: "shorter prefix", methods: []string{"/hello.OtherService/Get"}, token: writer, wantRule: "/hello.*", wantCode: codes.PermissionDenied},
+		{name: "catch-all", methods: []string{"/other.Service/Get"}, token: admin, wantRule: "*", wantCode: codes.OK},
+		{name: "route before its gRPC method", methods: []string{"POST /say-hello", "/hello.HelloService/Other"}, wantRule: "POST /say-hello", wantCode: codes.OK},
+		{name: "exact gRPC method of the route", methods: []string{"POST /v1/hello", "/hello.HelloService/SayHello"}, wantRule: "/hello.HelloService/SayHello", wantCode: codes.OK},
+		{name: "missing token", methods: []string{"/hello.HelloService/Other"}, wantRule: "/hello.HelloService/*", wantCode: codes.Unauthenticated},
+		{name: "invalid token", methods: []string{"/hello.HelloService/Other"}, token: "invalid", wantRule: "/hello.HelloService/*", wantCode: codes.Unauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision := policy.Evaluate(context.Background(), tt.token, tt.methods...)
+			if decision.Rule != tt.wantRule || decision.Code != tt.wantCode || decision.Allowed != (tt.wantCode == codes.OK) {
+				t.Fatalf("decision %+v, want rule %q code %v", decision, tt.wantRule, tt.wantCode)
+			}
+		})
+	}
+}
+
+func Test_AuthzPolicyDefault(t *testing.T) {
+	rules := []AuthzRule{{Methods: []string{"/hello.HelloService/SayHello"}, Public: true}}
+	deny, _ := NewAuthzPolicy(rules)
+	allow, _ := NewAuthzPolicy(rules, WithAuthzDefaultAllow())
+
+	if d := deny.Evaluate(context.Background(), "", "/hello.HelloService/Other"); d.Allowed || d.Code != codes.PermissionDenied {
+		t.Fatalf("default deny decision %+v", d)
+	}
+	if d := allow.Evaluate(context.Background(), "", "/hello.HelloService/Other"); !d.Allowed {
+		t.Fatalf("default allow decision %+v", d)
+	}
+}
+
+func Test_AuthzPolicyInterceptors(t *testing.T) {
+	deny, _ := NewAuthzPolicy(nil)
+	dryRun, _ := NewAuthzPolicy(nil, WithAuthzDryRun())
+	unary := func(ctx context.Context, req any) (any, error) { return "ok", nil }
+
+	tests := []struct {
+		name     string
+		policy   *AuthzPolicy
+		method   string
+		wantCode codes.Code
+	}{
+		{name: "denied", policy: deny, method: "/hello.HelloService/SayHello", wantCode: codes.PermissionDenied},
+		{name: "health bypass", policy: deny, method: "/grpc.health.v1.Health/Check", wantCode: codes.OK},
+		{name: "dry-run", policy: dryRun, method: "/hello.HelloService/SayHello", wantCode: codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.policy.UnaryServerInterceptor()(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: tt.method}, unary)
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("unary err = %v, want code %v", err, tt.wantCode)
+			}
+			err = tt.policy.StreamServerInterceptor()(nil, &testServerStream{ctx: context.Background()},
+				&grpc.StreamServerInfo{FullMethod: tt.method}, func(any, grpc.ServerStream) error { return nil })
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("stream err = %v, want code %v", err, tt.wantCode)
+			}
+		})
+	}
+
+	// The REST request is answered 403, or served in dry-run mode
+	for policy, wantCode := range map[*AuthzPolicy]int{deny: http.StatusForbidden, dryRun: http.StatusNoContent} {
+		router := mux.NewRouter()
+		Use(router, policy.Stage())
+		router.HandleFunc("/say-hello", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}).Methods(http.MethodPost)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/say-hello", nil))
+		if w.Code != wantCode {
+			t.Fatalf("dry run %v: status %d, want %d", policy.DryRun(), w.Code, wantCode)
+		}
+	}
+}
+
+func Test_AuthzPolicyKeyLookup(t *testing.T) {
+	const method = "/hello.HelloService/SayHello"
+	preShared, _ := jwt.GenerateKeyPair()
+	client, _ := jwt.GenerateKeyPair()
+	lookup := func(keyId string) (ed25519.PublicKey, error) {
+		if keyId == "device-1" {
+			return client.PublicKey, nil
+		}
+		return nil, errors.New("unknown key")
+	}
+	policy, _ := NewAuthzPolicy([]AuthzRule{{Methods: []string{method}, Scopes: []string{"hello:write"}}},
+		WithAuthzPublicKey(preShared.PublicKey), WithAuthzKeyLookup(lookup))
+
+	scopes := jwt.NewOption().SetScopes("hello:write")
+	signed, _ := jwt.SignRequest(client.PrivateKey, "device-1", method, nil, nil, scopes)
+	unknown, _ := jwt.SignRequest(client.PrivateKey, "device-2", method, nil, nil, scopes)
+	user, _ := jwt.SignWithClaims(preShared.PrivateKey, nil, scopes)
+	forged, _ := jwt.SignRequest(preShared.PrivateKey, "device-1", method, nil, nil, scopes)
+
+	tests := []struct {
+		name     string
+		token    string
+		wantCode codes.Code
+	}{
+		{name: "signed request", token: signed, wantCode: codes.OK},
+		{name: "JWT of the pre-shared key", token: user, wantCode: codes.OK},
+		{name: "unknown key id", token: unknown, wantCode: codes.Unauthenticated},
+		{name: "signed by another key", token: forged, wantCode: codes.Unauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if d := policy.Evaluate(context.Background(), tt.token, method); d.Code != tt.wantCode {
+				t.Fatalf("decision %+v, want code %v", d, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package net
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const (
+	// DefaultMaxBodyBytes is the default limit of a request body, as the default
+	// gRPC max receive message size.
+	DefaultMaxBodyBytes int64 = 4 << 20
+
+	contentTypeJSON      = "application/json"
+	contentTypeProtobuf  = "application/x-protobuf"
+	contentTypeForm      = "application/x-www-form-urlencoded"
+	contentTypeMultipart = "multipart/form-data"
+)
+
+// FieldError is the error of one field of the request.
+type FieldError struct {
+	Field       string `json:"field"`
+	Description string `json:"description"`
+}
+
+// BindError is returned by Bind, with the HTTP status to answer
+// (400, 413 or 415) and the errors of each field.
+type BindError struct {
+	Status  int          `json:"code"`
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+func (e *BindError) Error() string {
+	if len(e.Fields) == 0 {
+		return e.Message
+	}
+	parts := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		if f.Field == "" {
+			parts = append(parts, f.Description)
+		} else {
+			parts = append(parts, f.Field+": "+f.Description)
+		}
+	}
+	return e.Message + ": " + strings.Join(parts, "; ")
+}
+
+// BindOption configures Bind.
+type BindOption func(b *binder)
+
+type binder struct {
+	maxBodyBytes  int64
+	rejectUnknown bool
+}
+
+// WithMaxBodyBytes limits the size of the request body, default is DefaultMaxBodyBytes.
+func WithMaxBodyBytes(n int64) BindOption {
+	return func(b *binder) {
+		if n > 0 {
+			b.maxBodyBytes = n
+		}
+	}
+}
+
+// RejectUnknownFields fails the binding when the body, the form or the query params
+// have a field unknown to the message, they are ignored by default.
+func RejectUnknownFields() BindOption {
+	return func(b *binder) {
+		b.rejectUnknown = true
+	}
+}
+
+// Bind decodes the request into the proto message according to its Content-Type:
+// JSON (protojson), application/x-protobuf, form-urlencoded or multipart/form-data.
+// The query params, then the mux path variables, are merged into the message fields
+// (nested fields with dots, e.g. ?page.size=10), overriding the body values.
+// The error is a *BindError.
+//
+// Example usage:
+//
+//	var request hellopb.HelloRequest
+//	if err := net.Bind(r, &request, net.RejectUnknownFields()); err != nil {
+//		net.WriteBindError(w, err)
+//		return
+//	}
+func Bind(r *http.Request, msg proto.Message, opts ...BindOption) error {
+	b := binder{maxBodyBytes: DefaultMaxBodyBytes}
+	for _, opt := range opts {
+		opt(&b)
+	}
+	if err := b.bindBody(r, msg); err != nil {
+		return err
+	}
+
+	var fields []FieldError
+	for name, values := range r.URL.Query() {
+		fields = b.setField(fields, msg.ProtoReflect(), name, values)
+	}
+	for name, value := range mux.Vars(r) {
+		fields = b.setField(fields, msg.ProtoReflect(), name, []string{value})
+	}
+	if len(fields) > 0 {
+		return &BindError{Status: http.StatusBadRequest, Message: "invalid request parameters", Fields: fields}
+	}
+	return nil
+}
+
+func (b *binder) bindBody(r *http.Request, msg proto.Message) error {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	mediaType := contentTypeJSON
+	if ct := r.Header.Get(headerContentType); ct != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(ct); err != nil {
+			return &BindError{Status: http.StatusUnsupportedMediaType, Message: fmt.Sprintf("invalid content type %q", ct)}
+		}
+	}
+	r.Body = http.MaxBytesReader(nil, r.Body, b.maxBodyBytes)
+
+	switch {
+	case mediaType == contentTypeJSON || strings.HasSuffix(mediaType, "+json"):
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return bodyReadError(err)
+		}
+		if len(strings.TrimSpace(string(data))) == 0 {
+			return nil
+		}
+		if err := (protojson.UnmarshalOptions{DiscardUnknown: !b.rejectUnknown}).Unmarshal(data, msg); err != nil {
+			return &BindError{Status: http.StatusBadRequest, Message: "invalid JSON body",
+				Fields: []FieldError{{Description: err.Error()}}}
+		}
+	case mediaType == contentTypeProtobuf || mediaType == "application/protobuf":
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return bodyReadError(err)
+		}
+		if err := (proto.UnmarshalOptions{DiscardUnknown: !b.rejectUnknown}).Unmarshal(data, msg); err != nil {
+			return &BindError{Status: http.StatusBadRequest, Message: "invalid protobuf body",
+				Fields: []FieldError{{Description: err.Error()}}}
+		}
+	case mediaType == contentTypeForm:
+		if err := r.ParseForm(); err != nil {
+			return bodyReadError(err)
+		}
+		return b.bindForm(msg, r.PostForm, nil)
+	case mediaType == contentTypeMultipart:
+		if err := r.ParseMultipartForm(b.maxBodyBytes); err != nil {
+			return bodyReadError(err)
+		}
+		return b.bindForm(msg, r.MultipartForm.Value, r)
+	default:
+		return &BindError{Status: http.StatusUnsupportedMediaType, Message: fmt.Sprintf("unsupported content type %q", mediaType)}
+	}
+	return nil
+}
+
+// bindForm sets the fields from the form values, and the bytes fields from the uploaded files.
+func (b *binder) bindForm(msg proto.Message, values map[string][]string, r *http.Request) error {
+	var fields []FieldError
+	for name, vv := range values {
+		fields = b.setField(fields, msg.ProtoReflect(), name, vv)
+	}
+	if r != nil && r.MultipartForm != nil {
+		for name, files := range r.MultipartForm.File {
+			fd := findField(msg.ProtoReflect().Descriptor(), name)
+			if fd == nil || fd.Kind() != protoreflect.BytesKind || fd.IsList() {
+				if fd != nil || b.rejectUnknown {
+					fields = append(fields, FieldError{Field: name, Description: "unexpected file"})
+				}
+				continue
+			}
+			f, err := files[0].Open()
+			if err != nil {
+				fields = append(fields, FieldError{Field: name, Description: err.Error()})
+				continue
+			}
+			data, err := io.ReadAll(f)
+			_ = f.Close()
+			if err != nil {
+				fields = append(fields, FieldError{Field: name, Description: err.Error()})
+				continue
+			}
+			msg.ProtoReflect().Set(fd, protoreflect.ValueOfBytes(data))
+		}
+	}
+	if len(fields) > 0 {
+		return &BindError{Status: http.StatusBadRequest, Message: "invalid form", Fields: fields}
+	}
+	return nil
+}
+
+func (b *binder) setField(fields []FieldError, msg protoreflect.Message, name string, values []string) []FieldError {
+	err := setFieldPath(msg, strings.Split(name, "."), values)
+	if err == nil || (errors.Is(err, errUnknownField) && !b.rejectUnknown) {
+		return fields
+	}
+	return append(fields, FieldError{Field: name, Description: err.Error()})
+}
+
+func bodyReadError(err error) error {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return &BindError{Status: http.StatusRequestEntityTooLarge,
+			Message: fmt.Sprintf("request body exceeds %d bytes", maxErr.Limit)}
+	}
+	return &BindError{Status: http.StatusBadRequest, Message: fmt.Sprintf("failed to read request body: %v", err)}
+}
+
+// WriteBindError writes the error returned by Bind, with its status and field errors.
+func WriteBindError(w http.ResponseWriter, err error) {
+	var be *BindError
+	if !errors.As(err, &be) {
+		WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	body := map[string]interface{}{
+		"isError": true,
+		"code":    be.Status,
+		"message": be.Message,
+	}
+	if len(be.Fields) > 0 {
+		body["fields"] = be.Fields
+	}
+	w.Header().Set(headerContentType, "application/json; charset=UTF-8")
+	w.WriteHeader(be.Status)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,135 @@
+package net
+
+import (
+	"bytes"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// multipartBody returns the multipart body with the form values and one file per field.
+func multipartBody(t *testing.T, values, files map[string]string) (string, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for k, v := range values {
+		_ = mw.WriteField(k, v)
+	}
+	for k, v := range files {
+		fw, err := mw.CreateFormFile(k, k+".bin")
+		if err != nil {
+			t.Fatalf("CreateFormFile err: %v", err)
+		}
+		_, _ = fw.Write([]byte(v))
+	}
+	_ = mw.Close()
+	return buf.String(), mw.FormDataContentType()
+}
+
+func Test_Bind(t *testing.T) {
+	protoBody, _ := proto.Marshal(&descriptorpb.FieldDescriptorProto{Name: proto.String("id"), Number: proto.Int32(3)})
+	formBody, formType := multipartBody(t, map[string]string{"name": "id", "number": "3"}, nil)
+	badMultipart, badMultipartType := multipartBody(t, map[string]string{"number": "three"}, nil)
+
+	tests := []struct {
+		name        string
+		target      string
+		contentType string
+		body        string
+		opts        []BindOption
+		want        proto.Message
+		wantStatus  int
+	}{
+		{name: "JSON", target: "/fields", contentType: "application/json; charset=utf-8", body: `{"name":"id","number":3}`,
+			want: &descriptorpb.FieldDescriptorProto{Name: proto.String("id"), Number: proto.Int32(3)}},
+		{name: "JSON by default", target: "/fields", body: `{"name":"id"}`,
+			want: &descriptorpb.FieldDescriptorProto{Name: proto.String("id")}},
+		{name: "unknown JSON field ignored", target: "/fields", contentType: contentTypeJSON, body: `{"name":"id","other":1}`,
+			want: &descriptorpb.FieldDescriptorProto{Name: proto.String("id")}},
+		{name: "unknown JSON field rejected", target: "/fields", contentType: contentTypeJSON, body: `{"other":1}`,
+			opts: []BindOption{RejectUnknownFields()}, wantStatus: http.StatusBadRequest},
+		{name: "invalid JSON", target: "/fields", contentType: contentTypeJSON, body: `{"name":`, wantStatus: http.StatusBadRequest},
+		{name: "body too large", target: "/fields", contentType: contentTypeJSON, body: `{"name":"a long name"}`,
+			opts: []BindOption{WithMaxBodyBytes(8)}, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "protobuf", target: "/fields", contentType: contentTypeProtobuf, body: string(protoBody),
+			want: &descriptorpb.FieldDescriptorProto{Name: proto.String("id"), Number: proto.Int32(3)}},
+		{name: "invalid protobuf", target: "/fields", contentType: "application/protobuf", body: "\xff\xff", wantStatus: http.StatusBadRequest},
+		{name: "form", target: "/fields", contentType: contentTypeForm, body: "name=id&number=3&label=LABEL_REPEATED",
+			want: &descriptorpb.FieldDescriptorProto{Name: proto.String("id"), Number: proto.Int32(3),
+				Label: descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()}},
+		{name: "invalid form value", target: "/fields", contentType: contentTypeForm, body: "number=three", wantStatus: http.StatusBadRequest},
+		{name: "form too large", target: "/fields", contentType: contentTypeForm, body: "name=a-long-name",
+			opts: []BindOption{WithMaxBodyBytes(8)}, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "multipart", target: "/fields", contentType: formType, body: formBody,
+			want: &descriptorpb.FieldDescriptorProto{Name: proto.String("id"), Number: proto.Int32(3)}},
+		{name: "invalid multipart value", target: "/fields", contentType: badMultipartType, body: badMultipart, wantStatus: http.StatusBadRequest},
+		{name: "unsupported content type", target: "/fields", contentType: "text/plain", body: "id", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "invalid content type", target: "/fields", contentType: "application/", body: "id", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "query and path override the body", target: "/fields/path-name?number=4&json_name=q", contentType: contentTypeJSON,
+			body: `{"name":"id","number":3}`,
+			want: &descriptorpb.FieldDescriptorProto{Name: proto.String("path-name"), Number: proto.Int32(4), JsonName: proto.String("q")}},
+		{name: "invalid query value", target: "/fields?number=three", wantStatus: http.StatusBadRequest},
+		{name: "unknown query param rejected", target: "/fields?other=1", opts: []BindOption{RejectUnknownFields()}, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set(headerContentType, tt.contentType)
+			}
+			if name, ok := strings.CutPrefix(r.URL.Path, "/fields/"); ok {
+				r = mux.SetURLVars(r, map[string]string{"name": name})
+			}
+
+			got := &descriptorpb.FieldDescriptorProto{}
+			err := Bind(r, got, tt.opts...)
+			if tt.wantStatus != 0 {
+				var be *BindError
+				if !errors.As(err, &be) || be.Status != tt.wantStatus {
+					t.Fatalf("Bind err: %v, want status %d", err, tt.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Bind err: %v", err)
+			}
+			if !proto.Equal(got, tt.want) {
+				t.Fatalf("Bind message %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_BindMultipartFile(t *testing.T) {
+	body, contentType := multipartBody(t, nil, map[string]string{"value": "file content"})
+	r := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(body))
+	r.Header.Set(headerContentType, contentType)
+	got := &wrapperspb.BytesValue{}
+	if err := Bind(r, got); err != nil || string(got.GetValue()) != "file content" {
+		t.Fatalf("Bind file %q, err: %v", got.GetValue(), err)
+	}
+
+	// A file for a field which is not a bytes field
+	body, contentType = multipartBody(t, nil, map[string]string{"name": "file content"})
+	r = httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(body))
+	r.Header.Set(headerContentType, contentType)
+	if err := Bind(r, &descriptorpb.FieldDescriptorProto{}); err == nil {
+		t.Fatalf("file bound to a string field")
+	}
+}
+
+func Test_WriteBindError(t *testing.T) {
+	w := httptest.NewRecorder()
+	WriteBindError(w, &BindError{Status: http.StatusRequestEntityTooLarge, Message: "request body exceeds 8 bytes"})
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), `"message":"request body exceeds 8 bytes"`) {
+		t.Fatalf("response %d %s", w.Code, w.Body.String())
+	}
+}
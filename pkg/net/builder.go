@@ -0,0 +1,301 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	unixSocketPrefix = "unix:"
+
+	defaultReadHeaderTimeout = 5 * time.Second
+	defaultIdleTimeout       = 15 * time.Second
+	defaultRESTReadTimeout   = 5 * time.Second
+	defaultRESTWriteTimeout  = 10 * time.Second
+	defaultWebsocketTimeout  = 10 * time.Second
+)
+
+// ServerOption configures a Server built by NewServer.
+type ServerOption func(opt *serverOptions)
+
+type serverOptions struct {
+	addrs []string
+	tls   *TLSOption
+
+	readHeaderTimeout time.Duration
+	idleTimeout       time.Duration
+
+	restReadTimeout  time.Duration
+	restWriteTimeout time.Duration
+	grpcTimeout      time.Duration
+	websocketTimeout time.Duration
+
+	maxHeaderBytes       int
+	maxConcurrentStreams int
+}
+
+// WithAddrs sets the addresses to listen on simultaneously, default is ":8080".
+// A TCP address is "host:port" or ":port", a unix socket is "unix:/path/to/app.sock".
+func WithAddrs(addrs ...string) ServerOption {
+	return func(opt *serverOptions) {
+		if len(addrs) > 0 {
+			opt.addrs = addrs
+		}
+	}
+}
+
+// WithServerTLS serves TLS (and mTLS) on every TCP address, see HttpServerWithTLS.
+func WithServerTLS(tlsOpt TLSOption) ServerOption {
+	return func(opt *serverOptions) {
+		opt.tls = &tlsOpt
+	}
+}
+
+// WithRESTTimeout sets the read and write budgets of a REST request (default 5s / 10s).
+func WithRESTTimeout(read, write time.Duration) ServerOption {
+	return func(opt *serverOptions) {
+		opt.restReadTimeout, opt.restWriteTimeout = read, write
+	}
+}
+
+// WithGRPCTimeout sets the maximum duration of a gRPC call, including streams.
+// Zero (default) means no limit other than the deadline given by the client.
+func WithGRPCTimeout(d time.Duration) ServerOption {
+	return func(opt *serverOptions) {
+		opt.grpcTimeout = d
+	}
+}
+
+// WithWebsocketTimeout sets the budget of the websocket upgrade handshake (default 10s).
+// Once upgraded, the connection is kept alive by the hub ping/pong cycle only.
+func WithWebsocketTimeout(d time.Duration) ServerOption {
+	return func(opt *serverOptions) {
+		opt.websocketTimeout = d
+	}
+}
+
+// WithReadHeaderTimeout sets the time allowed to read the request headers (default 5s).
+func WithReadHeaderTimeout(d time.Duration) ServerOption {
+	return func(opt *serverOptions) {
+		opt.readHeaderTimeout = d
+	}
+}
+
+// WithIdleTimeout sets the time to keep an idle keep-alive connection open (default 15s).
+func WithIdleTimeout(d time.Duration) ServerOption {
+	return func(opt *serverOptions) {
+		opt.idleTimeout = d
+	}
+}
+
+// WithMaxHeaderBytes limits the size of the request headers, for HTTP/1 and HTTP/2.
+func WithMaxHeaderBytes(n int) ServerOption {
+	return func(opt *serverOptions) {
+		opt.maxHeaderBytes = n
+	}
+}
+
+// WithMaxConcurrentStreams limits the number of concurrent HTTP/2 streams (gRPC calls) per connection.
+func WithMaxConcurrentStreams(n int) ServerOption {
+	return func(opt *serverOptions) {
+		opt.maxConcurrentStreams = n
+	}
+}
+
+// NewServer builds a server for the handler (usually the result of MixHttp2), serving
+// HTTP/1.1 and HTTP/2 (h2c or TLS) with separate timeout budgets for REST routes,
+// gRPC calls and websocket connections, instead of the connection-wide timeouts of
+// HttpServerWithConfig that kill long-lived streams.
+//
+// Example usage:
+//
+//	srv, err := net.NewServer(mixed,
+//		net.WithAddrs(":8080", "unix:/tmp/app.sock"),
+//		net.WithRESTTimeout(5*time.Second, 10*time.Second),
+//		net.WithGRPCTimeout(5*time.Minute),
+//		net.WithMaxConcurrentStreams(250),
+//	)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	log.Fatal(srv.Lifecycle(net.WithGRPCServer(inst)).ListenAndServe())
+func NewServer(handler http.Handler, opts ...ServerOption) (*Server, error) {
+	opt := serverOptions{
+		addrs:             []string{":8080"},
+		readHeaderTimeout: defaultReadHeaderTimeout,
+		idleTimeout:       defaultIdleTimeout,
+		restReadTimeout:   defaultRESTReadTimeout,
+		restWriteTimeout:  defaultRESTWriteTimeout,
+		websocketTimeout:  defaultWebsocketTimeout,
+	}
+	for _, fn := range opts {
+		fn(&opt)
+	}
+
+	// The connections upgraded to h2c by MixHttp2 get the same HTTP/2 limits
+	if mixed, ok := handler.(*mixedHandler); ok {
+		mixed.h2s.MaxConcurrentStreams = uint32(opt.maxConcurrentStreams)
+		mixed.h2s.IdleTimeout = opt.idleTimeout
+	}
+	server := &http.Server{
+		Handler:           opt.budgetHandler(handler),
+		ReadHeaderTimeout: opt.readHeaderTimeout,
+		IdleTimeout:       opt.idleTimeout,
+		MaxHeaderBytes:    opt.maxHeaderBytes,
+		HTTP2: &http.HTTP2Config{
+			MaxConcurrentStreams: opt.maxConcurrentStreams,
+		},
+		Protocols: new(http.Protocols),
+	}
+	server.Protocols.SetHTTP1(true)
+	if opt.tls != nil {
+		tlsConfig, err := newTLSConfig(*opt.tls)
+		if err != nil {
+			return nil, err
+		}
+		server.TLSConfig = tlsConfig
+		server.Protocols.SetHTTP2(true)
+	} else {
+		// h2c with prior knowledge, as required by gRPC clients
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return &Server{server: server, addrs: opt.addrs, tls: opt.tls != nil}, nil
+}
+
+// Server serves one handler on several TCP addresses and unix sockets.
+type Server struct {
+	server *http.Server
+	addrs  []string
+	// tls is decided at build time, http.Server fills TLSConfig itself when serving HTTP/2
+	tls bool
+}
+
+// HTTPServer returns the underlying http.Server.
+func (s *Server) HTTPServer() *http.Server {
+	return s.server
+}
+
+// Lifecycle returns a lifecycle manager stopping the server gracefully on SIGINT/SIGTERM.
+func (s *Server) Lifecycle(opts ...LifecycleOption) *Lifecycle {
+	l := NewLifecycle(s.server, opts...)
+	l.listenAndServe = s.ListenAndServe
+	return l
+}
+
+// ListenAndServe listens on every address and serves until one of them fails
+// or the server is shut down. It always returns a non-nil error.
+func (s *Server) ListenAndServe() error {
+	listeners := make([]net.Listener, 0, len(s.addrs))
+	for _, addr := range s.addrs {
+		lis, err := listen(addr)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, lis)
+	}
+
+	log.Printf("Working directory: %s%s\n", GetWd(), string(filepath.Separator))
+	var (
+		wg   sync.WaitGroup
+		errC = make(chan error, len(listeners))
+	)
+	for _, lis := range listeners {
+		log.Printf("Serving on %s://%s\n", lis.Addr().Network(), lis.Addr().String())
+		wg.Add(1)
+		go func(lis net.Listener) {
+			defer wg.Done()
+			if s.tls && lis.Addr().Network() != "unix" {
+				errC <- s.server.ServeTLS(lis, "", "")
+			} else {
+				errC <- s.server.Serve(lis)
+			}
+		}(lis)
+	}
+
+	// The first error stops every listener
+	err := <-errC
+	if !errors.Is(err, http.ErrServerClosed) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = s.server.Shutdown(ctx)
+	}
+	wg.Wait()
+	return err
+}
+
+// Shutdown gracefully shuts down every listener, see http.Server.Shutdown.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+func listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, unixSocketPrefix); ok {
+		// Remove the socket left by a previous process
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to remove stale unix socket %s: %w", path, err)
+		}
+		return net.Listen("unix", path)
+	}
+	if strings.HasPrefix(addr, ":") {
+		addr = "0.0.0.0" + addr
+	}
+	return net.Listen("tcp", addr)
+}
+
+// budgetHandler applies the read/write deadlines of the request protocol,
+// per request (or per HTTP/2 stream) instead of per connection.
+func (opt *serverOptions) budgetHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var read, write time.Duration
+		switch {
+		case isWebsocketUpgrade(r):
+			read, write = opt.websocketTimeout, opt.websocketTimeout
+		case isGRPCRequest(r):
+			read, write = opt.grpcTimeout, opt.grpcTimeout
+		default:
+			read, write = opt.restReadTimeout, opt.restWriteTimeout
+		}
+
+		rc := http.NewResponseController(w)
+		if err := rc.SetReadDeadline(deadlineOf(read)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			getLogEntry().Debug("Failed to set read deadline", zap.Error(err))
+		}
+		if err := rc.SetWriteDeadline(deadlineOf(write)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			getLogEntry().Debug("Failed to set write deadline", zap.Error(err))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// deadlineOf returns the deadline of a budget, the zero time (no deadline) for a zero budget.
+func deadlineOf(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+// isGRPCRequest reports whether the request is a gRPC call, gRPC-Web calls included
+// since they are served over HTTP/1.1 as well.
+func isGRPCRequest(r *http.Request) bool {
+	return (r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get(headerContentType), "application/grpc")) ||
+		isGrpcWebRequest(r)
+}
+
+func isWebsocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
@@ -0,0 +1,43 @@
+package net
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_IsGRPCRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		protoMajor  int
+		contentType string
+		want        bool
+	}{
+		{name: "gRPC", protoMajor: 2, contentType: "application/grpc+proto", want: true},
+		{name: "gRPC over HTTP/1.1", protoMajor: 1, contentType: "application/grpc"},
+		{name: "gRPC-Web over HTTP/1.1", protoMajor: 1, contentType: "application/grpc-web+proto", want: true},
+		{name: "gRPC-Web text over HTTP/1.1", protoMajor: 1, contentType: "application/grpc-web-text", want: true},
+		{name: "REST", protoMajor: 2, contentType: "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/hello.HelloService/SayHello", nil)
+			r.ProtoMajor = tt.protoMajor
+			r.Header.Set(headerContentType, tt.contentType)
+			if got := isGRPCRequest(r); got != tt.want {
+				t.Fatalf("isGRPCRequest = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_NewServerMixHttp2(t *testing.T) {
+	mixed := MixHttp2(http.NotFoundHandler(), http.NotFoundHandler())
+	if _, err := NewServer(mixed, WithMaxConcurrentStreams(250)); err != nil {
+		t.Fatalf("NewServer err: %v", err)
+	}
+	// The h2c upgrades are limited like the other HTTP/2 connections
+	if got := mixed.(*mixedHandler).h2s.MaxConcurrentStreams; got != 250 {
+		t.Fatalf("h2c MaxConcurrentStreams = %d, want 250", got)
+	}
+}
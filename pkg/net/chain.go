@@ -0,0 +1,165 @@
+package net
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Stage is a named HTTP middleware. The middleware may answer the request itself
+// (e.g. 401, 429) and not call the next handler, which stops the chain.
+type Stage struct {
+	Name string
+	Func func(next http.Handler) http.Handler
+}
+
+// NewStage creates a named middleware stage.
+func NewStage(name string, fn func(next http.Handler) http.Handler) Stage {
+	return Stage{Name: name, Func: fn}
+}
+
+// Chain is an ordered list of stages, the first one is the outermost.
+type Chain []Stage
+
+// NewChain creates a chain of the stages, in order.
+func NewChain(stages ...Stage) Chain {
+	return append(Chain(nil), stages...)
+}
+
+// Append returns a new chain with the stages added at the end.
+func (c Chain) Append(stages ...Stage) Chain {
+	return append(append(Chain(nil), c...), stages...)
+}
+
+// Then wraps the handler with the stages of the chain.
+func (c Chain) Then(h http.Handler) http.Handler {
+	for i := len(c) - 1; i >= 0; i-- {
+		h = c[i].Func(h)
+	}
+	return h
+}
+
+// Names returns the names of the stages, in order.
+func (c Chain) Names() []string {
+	names := make([]string, 0, len(c))
+	for _, st := range c {
+		names = append(names, st.Name)
+	}
+	return names
+}
+
+// chainRegistry keeps the stages attached to routers and routes, for the route dump.
+// It lives for the whole process and is never pruned: the routers are built once at
+// startup, a router built again (e.g. by each test) keeps its entries after it is dropped.
+var chainRegistry = struct {
+	mu      sync.RWMutex
+	parents map[*mux.Router]*mux.Router
+	routers map[*mux.Router][]string
+	routes  map[*mux.Route]*attachedChain
+}{
+	parents: make(map[*mux.Router]*mux.Router),
+	routers: make(map[*mux.Router][]string),
+	routes:  make(map[*mux.Route]*attachedChain),
+}
+
+// attachedChain is the handler of a route before Attach, and the stages attached to it.
+type attachedChain struct {
+	handler http.Handler
+	chain   Chain
+}
+
+// Use attaches the stages to every route of the router (or subrouter),
+// they run once a route is matched, after the stages of the parent routers.
+func Use(ro *mux.Router, stages ...Stage) {
+	for _, st := range stages {
+		ro.Use(mux.MiddlewareFunc(st.Func))
+	}
+	chainRegistry.mu.Lock()
+	chainRegistry.routers[ro] = append(chainRegistry.routers[ro], Chain(stages).Names()...)
+	chainRegistry.mu.Unlock()
+}
+
+// Group creates a subrouter for the path prefix with its own stages.
+//
+// Example usage:
+//
+//	admin := net.Group(router, "/admin", net.NewStage("auth", requireAdmin))
+//	admin.HandleFunc("/users", listUsers).Methods(http.MethodGet)
+func Group(ro *mux.Router, prefix string, stages ...Stage) *mux.Router {
+	sub := ro.PathPrefix(prefix).Subrouter()
+	chainRegistry.mu.Lock()
+	chainRegistry.parents[sub] = ro
+	chainRegistry.mu.Unlock()
+	Use(sub, stages...)
+	return sub
+}
+
+// Attach wraps the handler of the route with the stages, they run after the
+// stages of its routers and of the previous Attach. The handler must be set before.
+//
+// Example usage:
+//
+//	net.Attach(router.HandleFunc("/say-hello", handler).Methods(http.MethodPost),
+//		net.NewStage("captcha", verifyCaptcha))
+func Attach(route *mux.Route, stages ...Stage) *mux.Route {
+	chainRegistry.mu.Lock()
+	defer chainRegistry.mu.Unlock()
+	attached := chainRegistry.routes[route]
+	if attached == nil {
+		attached = &attachedChain{handler: route.GetHandler()}
+		chainRegistry.routes[route] = attached
+	}
+	// The route handler is rebuilt, so the stages attached later run inside the previous ones
+	attached.chain = attached.chain.Append(stages...)
+	if attached.handler != nil {
+		route.Handler(attached.chain.Then(attached.handler))
+	}
+	return route
+}
+
+// effectiveChain returns the names of the stages run for a route of the router, in order.
+func effectiveChain(router *mux.Router, route *mux.Route) []string {
+	chainRegistry.mu.RLock()
+	defer chainRegistry.mu.RUnlock()
+
+	var routers []*mux.Router
+	for ro := router; ro != nil; ro = chainRegistry.parents[ro] {
+		routers = append([]*mux.Router{ro}, routers...)
+	}
+	var names []string
+	for _, ro := range routers {
+		names = append(names, chainRegistry.routers[ro]...)
+	}
+	if attached := chainRegistry.routes[route]; attached != nil {
+		names = append(names, attached.chain.Names()...)
+	}
+	return names
+}
+
+// formatChain formats the stages for the route dump, e.g. "cors > request-id > logger".
+func formatChain(names []string) string {
+	return strings.Join(names, " > ")
+}
+
+// writeTracker records whether a middleware function wrote the response.
+type writeTracker struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (wt *writeTracker) WriteHeader(code int) {
+	wt.wrote = true
+	wt.ResponseWriter.WriteHeader(code)
+}
+
+func (wt *writeTracker) Write(b []byte) (int, error) {
+	wt.wrote = true
+	return wt.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the original writer.
+func (wt *writeTracker) Unwrap() http.ResponseWriter {
+	return wt.ResponseWriter
+}
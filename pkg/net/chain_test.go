@@ -0,0 +1,93 @@
+package net
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// traceStages returns stages appending their name to the trace when they run.
+func traceStages(mu *sync.Mutex, trace *[]string, names ...string) []Stage {
+	stages := make([]Stage, 0, len(names))
+	for _, name := range names {
+		stages = append(stages, NewStage(name, func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				*trace = append(*trace, name)
+				mu.Unlock()
+				next.ServeHTTP(w, r)
+			})
+		}))
+	}
+	return stages
+}
+
+func Test_ChainOrder(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		trace []string
+	)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	router := mux.NewRouter()
+	Use(router, traceStages(&mu, &trace, "root-1", "root-2")...)
+	admin := Group(router, "/admin", traceStages(&mu, &trace, "admin")...)
+	Use(admin, traceStages(&mu, &trace, "admin-late")...)
+	users := Attach(admin.Handle("/users", ok).Methods(http.MethodGet), traceStages(&mu, &trace, "route-1", "route-2")...)
+	Attach(users, traceStages(&mu, &trace, "route-3")...)
+	health := router.Handle("/health", ok).Methods(http.MethodGet)
+
+	tests := []struct {
+		path   string
+		router *mux.Router
+		route  *mux.Route
+		want   []string
+	}{
+		{path: "/admin/users", router: admin, route: users,
+			want: []string{"root-1", "root-2", "admin", "admin-late", "route-1", "route-2", "route-3"}},
+		{path: "/health", router: router, route: health, want: []string{"root-1", "root-2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			trace = nil
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != http.StatusNoContent || strings.Join(trace, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("status %d, stages run %v, want %v", w.Code, trace, tt.want)
+			}
+			if got := effectiveChain(tt.router, tt.route); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("effective chain %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_ChainRouteDump(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	router := mux.NewRouter()
+	admin := Group(router, "/admin", NewStage("auth", func(h http.Handler) http.Handler { return h }))
+	Attach(admin.Handle("/users", ok).Methods(http.MethodGet),
+		NewStage("captcha", func(h http.Handler) http.Handler { return h }))
+
+	// The route dump is printed on the standard output
+	stdout := os.Stdout
+	rd, wr, _ := os.Pipe()
+	os.Stdout = wr
+	_ = Middleware(router, true)
+	os.Stdout = stdout
+	_ = wr.Close()
+	out, _ := io.ReadAll(rd)
+
+	want := "/admin/users                             access-log > cors > request-id > logger > recovery > auth > captcha"
+	if !strings.Contains(string(out), "[GET     ] "+want) {
+		t.Fatalf("route dump %q, want %q", out, want)
+	}
+}
@@ -0,0 +1,310 @@
+package net
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/alts"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+)
+
+const (
+	defaultClientCallTimeout = 10 * time.Second
+)
+
+// ClientTLSOption defines the files used to verify the server, and the client
+// certificate presented when the server requires mutual-TLS.
+type ClientTLSOption struct {
+	// CAFile is an optional PEM bundle verifying the server, default is the system roots.
+	CAFile string
+	// CertFile and KeyFile are the optional client certificate (mTLS).
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name verified in the server certificate.
+	ServerName string
+}
+
+// RetryPolicy is the retryPolicy of the gRPC service config, the calls failing with one
+// of the codes are retried with an exponential backoff.
+type RetryPolicy struct {
+	MaxAttempts       int
+	InitialBackoff    time.Duration
+	MaxBackoff        time.Duration
+	BackoffMultiplier float64
+	RetryableCodes    []codes.Code
+}
+
+// HedgingPolicy is the hedgingPolicy of the gRPC service config, a new attempt is sent
+// after each delay until one succeeds or fails with a code out of the non-fatal codes.
+// Only the idempotent methods should be hedged.
+type HedgingPolicy struct {
+	MaxAttempts   int
+	HedgingDelay  time.Duration
+	NonFatalCodes []codes.Code
+}
+
+// DefaultRetryPolicy retries the calls failing with Unavailable up to 4 attempts.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:       4,
+	InitialBackoff:    100 * time.Millisecond,
+	MaxBackoff:        2 * time.Second,
+	BackoffMultiplier: 2,
+	RetryableCodes:    []codes.Code{codes.Unavailable},
+}
+
+// ClientOption configures the gRPC client created by NewGRPCClient.
+type ClientOption func(c *clientConfig)
+
+type clientConfig struct {
+	creds       credentials.TransportCredentials
+	credsErr    error
+	dialOpts    []grpc.DialOption
+	retry       *RetryPolicy
+	hedging     *HedgingPolicy
+	token       TokenSource
+	callTimeout time.Duration
+}
+
+// WithClientALTS authenticates the server with ALTS (Google Cloud), the server must run
+// as one of the target service accounts when the list is not empty.
+func WithClientALTS(targetServiceAccounts []string, handshakerServiceAddress string) ClientOption {
+	return func(c *clientConfig) {
+		opts := alts.DefaultClientOptions()
+		opts.TargetServiceAccounts = targetServiceAccounts
+		if handshakerServiceAddress != "" {
+			opts.HandshakerServiceAddress = handshakerServiceAddress
+		}
+		c.creds = alts.NewClientCreds(opts)
+	}
+}
+
+// WithClientTLS verifies the server with TLS, see ClientTLSOption.
+func WithClientTLS(opt ClientTLSOption) ClientOption {
+	return func(c *clientConfig) {
+		c.creds, c.credsErr = newClientTLSCredentials(opt)
+	}
+}
+
+// WithClientInsecure connects in cleartext (h2c), for the local development and the
+// sidecars only. It is the default when no credentials are set.
+func WithClientInsecure() ClientOption {
+	return func(c *clientConfig) {
+		c.creds = insecure.NewCredentials()
+	}
+}
+
+// WithClientKeepalive pings the server after time without activity, and closes the
+// connection when the ping is not answered within timeout. The time must not be shorter
+// than the MinTime of the server enforcement policy.
+func WithClientKeepalive(time, timeout time.Duration) ClientOption {
+	return func(c *clientConfig) {
+		c.dialOpts = append(c.dialOpts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                time,
+			Timeout:             timeout,
+			PermitWithoutStream: true,
+		}))
+	}
+}
+
+// WithClientMessageSize limits the size of the messages received and sent, zero keeps the gRPC default.
+func WithClientMessageSize(maxRecv, maxSend int) ClientOption {
+	return func(c *clientConfig) {
+		var callOpts []grpc.CallOption
+		if maxRecv > 0 {
+			callOpts = append(callOpts, grpc.MaxCallRecvMsgSize(maxRecv))
+		}
+		if maxSend > 0 {
+			callOpts = append(callOpts, grpc.MaxCallSendMsgSize(maxSend))
+		}
+		c.dialOpts = append(c.dialOpts, grpc.WithDefaultCallOptions(callOpts...))
+	}
+}
+
+// WithClientConnectTimeout is the minimum time given to establish a connection.
+func WithClientConnectTimeout(timeout time.Duration) ClientOption {
+	return func(c *clientConfig) {
+		c.dialOpts = append(c.dialOpts, grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff:           backoff.DefaultConfig,
+			MinConnectTimeout: timeout,
+		}))
+	}
+}
+
+// WithClientRetry retries the failed calls of every method, see RetryPolicy.
+func WithClientRetry(policy RetryPolicy) ClientOption {
+	return func(c *clientConfig) {
+		c.retry, c.hedging = &policy, nil
+	}
+}
+
+// WithClientHedging hedges the calls of every method, see HedgingPolicy.
+// It replaces the retry policy, gRPC does not allow both.
+func WithClientHedging(policy HedgingPolicy) ClientOption {
+	return func(c *clientConfig) {
+		c.hedging, c.retry = &policy, nil
+	}
+}
+
+// WithClientToken sends the token of the source as the Bearer JWT of each call.
+func WithClientToken(source TokenSource) ClientOption {
+	return func(c *clientConfig) {
+		c.token = source
+	}
+}
+
+// WithClientCallTimeout is the deadline of the calls made with a context without
+// deadline, default is 10 seconds. The deadline of the context is always kept.
+func WithClientCallTimeout(timeout time.Duration) ClientOption {
+	return func(c *clientConfig) {
+		c.callTimeout = timeout
+	}
+}
+
+// WithClientDialOptions appends raw gRPC dial options.
+func WithClientDialOptions(opts ...grpc.DialOption) ClientOption {
+	return func(c *clientConfig) {
+		c.dialOpts = append(c.dialOpts, opts...)
+	}
+}
+
+// NewGRPCClient creates a client connection to a service built on this package. The calls
+// propagate the X-Request-Id, the Bearer JWT of the token source and the trace context of
+// the incoming request in the outgoing metadata, they are retried with DefaultRetryPolicy
+// unless another policy is set, and logged with the logger of the context.
+//
+// The connection is lazy, it is established by the first call. Close it on shutdown.
+//
+// Example usage:
+//
+//	conn, err := net.NewGRPCClient("hello.internal:443",
+//		net.WithClientTLS(net.ClientTLSOption{}),
+//		net.WithClientToken(net.ForwardAuthorization()))
+//	if err != nil {
+//		return err
+//	}
+//	defer conn.Close()
+//	client := hellopb.NewHelloServiceClient(conn)
+func NewGRPCClient(target string, opts ...ClientOption) (*grpc.ClientConn, error) {
+	c := &clientConfig{
+		callTimeout: defaultClientCallTimeout,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.credsErr != nil {
+		return nil, c.credsErr
+	}
+	if c.creds == nil {
+		c.creds = insecure.NewCredentials()
+	}
+	if c.retry == nil && c.hedging == nil {
+		policy := DefaultRetryPolicy
+		c.retry = &policy
+	}
+	serviceConfig, err := c.serviceConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	dialOpts := append([]grpc.DialOption{
+		grpc.WithTransportCredentials(c.creds),
+		grpc.WithDefaultServiceConfig(serviceConfig),
+		grpc.WithChainUnaryInterceptor(unaryClientInterceptor(c)),
+		grpc.WithChainStreamInterceptor(streamClientInterceptor(c)),
+	}, c.dialOpts...)
+
+	conn, err := grpc.NewClient(target, dialOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gRPC client of %s: %w", target, err)
+	}
+	return conn, nil
+}
+
+// serviceConfig returns the JSON service config applying the retry or hedging policy
+// to every method of the target.
+func (c *clientConfig) serviceConfig() (string, error) {
+	methodConfig := map[string]any{
+		"name": []map[string]string{{}},
+	}
+	switch {
+	case c.hedging != nil:
+		p := c.hedging
+		if p.MaxAttempts < 2 {
+			return "", fmt.Errorf("hedging policy requires at least 2 attempts")
+		}
+		methodConfig["hedgingPolicy"] = map[string]any{
+			"maxAttempts":         p.MaxAttempts,
+			"hedgingDelay":        durationJSON(p.HedgingDelay),
+			"nonFatalStatusCodes": codeNumbers(p.NonFatalCodes),
+		}
+	case c.retry != nil:
+		p := c.retry
+		if p.MaxAttempts < 2 || p.InitialBackoff <= 0 || p.MaxBackoff <= 0 ||
+			p.BackoffMultiplier <= 0 || len(p.RetryableCodes) == 0 {
+			return "", fmt.Errorf("retry policy requires at least 2 attempts, positive backoffs and retryable codes")
+		}
+		methodConfig["retryPolicy"] = map[string]any{
+			"maxAttempts":          p.MaxAttempts,
+			"initialBackoff":       durationJSON(p.InitialBackoff),
+			"maxBackoff":           durationJSON(p.MaxBackoff),
+			"backoffMultiplier":    p.BackoffMultiplier,
+			"retryableStatusCodes": codeNumbers(p.RetryableCodes),
+		}
+	}
+	b, err := json.Marshal(map[string]any{
+		"methodConfig": []any{methodConfig},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode gRPC service config: %w", err)
+	}
+	return string(b), nil
+}
+
+// durationJSON formats the duration as the JSON of google.protobuf.Duration ("0.1s").
+func durationJSON(d time.Duration) string {
+	return fmt.Sprintf("%gs", d.Seconds())
+}
+
+// codeNumbers returns the codes of the service config, as their numbers.
+func codeNumbers(list []codes.Code) []uint32 {
+	numbers := make([]uint32, 0, len(list))
+	for _, code := range list {
+		numbers = append(numbers, uint32(code))
+	}
+	return numbers
+}
+
+func newClientTLSCredentials(opt ClientTLSOption) (credentials.TransportCredentials, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: opt.ServerName,
+	}
+	if opt.CAFile != "" {
+		pem, err := os.ReadFile(opt.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA file %s", opt.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if opt.CertFile != "" || opt.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opt.CertFile, opt.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return credentials.NewTLS(cfg), nil
+}
@@ -0,0 +1,148 @@
+package net
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/weeback/grpc-project-template/pkg/jwt"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	// traceHeaders are the trace context headers (W3C and Google Cloud) propagated
+	// from the incoming request to the outgoing calls.
+	traceHeaders = []string{"traceparent", "tracestate", "x-cloud-trace-context", "grpc-trace-bin"}
+)
+
+// TokenSource returns the Bearer JWT of an outgoing call, req is nil for the streams.
+// An empty token sends no Authorization.
+type TokenSource func(ctx context.Context, fullMethod string, req any) (string, error)
+
+// StaticToken sends the same token with every call.
+func StaticToken(token string) TokenSource {
+	return func(context.Context, string, any) (string, error) {
+		return token, nil
+	}
+}
+
+// ForwardAuthorization sends the Bearer JWT of the incoming gRPC request, on behalf of its caller.
+func ForwardAuthorization() TokenSource {
+	return func(ctx context.Context, _ string, _ any) (string, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if auth := md.Get(headerAuthorization); len(auth) > 0 {
+			return strings.TrimPrefix(auth[0], "Bearer "), nil
+		}
+		return "", nil
+	}
+}
+
+// SignedRequestToken signs a token bound to each unary call with the key of the client,
+// see jwt.SignRequest. The streams are not signed. The retries of a call resend the same
+// token, whose nonce is rejected once verified: retry only the codes failing before the
+// authorization of the server (e.g. Unavailable).
+func SignedRequestToken(key interface{}, keyId string) TokenSource {
+	return func(_ context.Context, fullMethod string, req any) (string, error) {
+		msg, ok := req.(proto.Message)
+		if !ok {
+			return "", nil
+		}
+		body, err := proto.Marshal(msg)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal the request to sign: %w", err)
+		}
+		return jwt.SignRequest(key, keyId, fullMethod, body, nil)
+	}
+}
+
+func unaryClientInterceptor(c *clientConfig) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx, cancel := Budget(ctx, c.callTimeout)
+		defer cancel()
+
+		ctx, reqID, err := outgoingContext(ctx, c, method, req)
+		if err != nil {
+			return err
+		}
+		startTime := time.Now()
+		err = invoker(ctx, method, req, reply, cc, opts...)
+		logClientCall(ctx, cc, method, reqID, startTime, err)
+		return err
+	}
+}
+
+func streamClientInterceptor(c *clientConfig) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		// The streams live as long as their context, no call timeout is applied
+		ctx, reqID, err := outgoingContext(ctx, c, method, nil)
+		if err != nil {
+			return nil, err
+		}
+		startTime := time.Now()
+		stream, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			logClientCall(ctx, cc, method, reqID, startTime, err)
+		}
+		return stream, err
+	}
+}
+
+// outgoingContext adds the X-Request-Id, the Bearer JWT and the trace context to the
+// outgoing metadata, the values already set by the caller are kept.
+func outgoingContext(ctx context.Context, c *clientConfig, method string, req any) (context.Context, string, error) {
+	out, _ := metadata.FromOutgoingContext(ctx)
+	out = out.Copy()
+	in, _ := metadata.FromIncomingContext(ctx)
+
+	reqID := firstOf(out.Get(xApiRequestId))
+	if reqID == "" {
+		reqID = firstOf(in.Get(xApiRequestId))
+	}
+	if reqID == "" {
+		if id, ok := ctx.Value(jwt.ApiRequestIdKey).(string); ok && id != "" {
+			reqID = id
+		} else {
+			reqID = uuid.NewString()
+		}
+	}
+	out.Set(xApiRequestId, reqID)
+
+	for _, key := range traceHeaders {
+		if len(out.Get(key)) == 0 && len(in.Get(key)) > 0 {
+			out.Set(key, in.Get(key)...)
+		}
+	}
+
+	if c.token != nil && len(out.Get(headerAuthorization)) == 0 {
+		token, err := c.token(ctx, method, req)
+		if err != nil {
+			return ctx, reqID, status.Errorf(status.Code(err), "failed to get the token of %s: %v", method, err)
+		}
+		if token != "" {
+			out.Set(headerAuthorization, "Bearer "+token)
+		}
+	}
+	return metadata.NewOutgoingContext(ctx, out), reqID, nil
+}
+
+func logClientCall(ctx context.Context, cc *grpc.ClientConn, method, reqID string, startTime time.Time, err error) {
+	fields := []zap.Field{
+		zap.String("target", cc.Target()),
+		zap.String("method", method),
+		zap.String("req_id", reqID),
+		zap.Duration("duration", time.Since(startTime)),
+		zap.String("code", status.Code(err).String()),
+	}
+	if err != nil {
+		getLoggerFromContext(ctx).Warn("gRPC client call failed", append(fields, zap.Error(err))...)
+		return
+	}
+	getLoggerFromContext(ctx).Info("gRPC client call completed", fields...)
+}
@@ -0,0 +1,195 @@
+package net
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/weeback/grpc-project-template/pkg/jwt"
+)
+
+func Test_ClientServiceConfig(t *testing.T) {
+	hedging := HedgingPolicy{MaxAttempts: 3, HedgingDelay: 50 * time.Millisecond, NonFatalCodes: []codes.Code{codes.Unavailable}}
+
+	tests := []struct {
+		name       string
+		opts       []ClientOption
+		wantPolicy string
+		wantErr    bool
+	}{
+		{name: "default retry", wantPolicy: "retryPolicy"},
+		{name: "hedging replaces retry", opts: []ClientOption{WithClientRetry(DefaultRetryPolicy), WithClientHedging(hedging)}, wantPolicy: "hedgingPolicy"},
+		{name: "retry replaces hedging", opts: []ClientOption{WithClientHedging(hedging), WithClientRetry(DefaultRetryPolicy)}, wantPolicy: "retryPolicy"},
+		{name: "retry of one attempt", opts: []ClientOption{WithClientRetry(RetryPolicy{MaxAttempts: 1, InitialBackoff: time.Second,
+			MaxBackoff: time.Second, BackoffMultiplier: 2, RetryableCodes: []codes.Code{codes.Unavailable}})}, wantErr: true},
+		{name: "retry without codes", opts: []ClientOption{WithClientRetry(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second,
+			MaxBackoff: time.Second, BackoffMultiplier: 2})}, wantErr: true},
+		{name: "retry without backoff", opts: []ClientOption{WithClientRetry(RetryPolicy{MaxAttempts: 3,
+			BackoffMultiplier: 2, RetryableCodes: []codes.Code{codes.Unavailable}})}, wantErr: true},
+		{name: "hedging of one attempt", opts: []ClientOption{WithClientHedging(HedgingPolicy{MaxAttempts: 1})}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := NewGRPCClient("passthrough:///hello", tt.opts...)
+			if tt.wantErr {
+				if err == nil {
+					_ = conn.Close()
+					t.Fatalf("NewGRPCClient err: nil, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewGRPCClient err: %v", err)
+			}
+			_ = conn.Close()
+
+			c := &clientConfig{retry: &DefaultRetryPolicy}
+			for _, opt := range tt.opts {
+				opt(c)
+			}
+			sc, err := c.serviceConfig()
+			if err != nil {
+				t.Fatalf("serviceConfig err: %v", err)
+			}
+			var parsed struct {
+				MethodConfig []map[string]json.RawMessage `json:"methodConfig"`
+			}
+			if err := json.Unmarshal([]byte(sc), &parsed); err != nil || len(parsed.MethodConfig) != 1 {
+				t.Fatalf("service config %s, err: %v", sc, err)
+			}
+			// gRPC rejects a method config with both policies
+			mc := parsed.MethodConfig[0]
+			_, retry := mc["retryPolicy"]
+			_, hedged := mc["hedgingPolicy"]
+			if retry == hedged || mc[tt.wantPolicy] == nil {
+				t.Fatalf("service config %s, want only %s", sc, tt.wantPolicy)
+			}
+		})
+	}
+
+	// The durations are encoded as google.protobuf.Duration
+	c := &clientConfig{hedging: &hedging}
+	if sc, _ := c.serviceConfig(); sc != `{"methodConfig":[{"hedgingPolicy":{"hedgingDelay":"0.05s","maxAttempts":3,"nonFatalStatusCodes":[14]},"name":[{}]}]}` {
+		t.Fatalf("hedging service config %s", sc)
+	}
+}
+
+func Test_OutgoingContext(t *testing.T) {
+	const method = "/hello.HelloService/SayHello"
+	incoming := metadata.Pairs(xApiRequestId, "incoming-id", "traceparent", "incoming-trace", headerAuthorization, "Bearer incoming")
+
+	tests := []struct {
+		name      string
+		ctx       context.Context
+		token     TokenSource
+		wantReqID string
+		wantMD    map[string]string
+	}{
+		{name: "request id set by the caller",
+			ctx:       metadata.NewOutgoingContext(metadata.NewIncomingContext(context.Background(), incoming), metadata.Pairs(xApiRequestId, "outgoing-id")),
+			wantReqID: "outgoing-id", wantMD: map[string]string{"traceparent": "incoming-trace"}},
+		{name: "request id of the incoming call",
+			ctx:       context.WithValue(metadata.NewIncomingContext(context.Background(), incoming), jwt.ApiRequestIdKey, "context-id"),
+			wantReqID: "incoming-id"},
+		{name: "request id of the context",
+			ctx:       context.WithValue(context.Background(), jwt.ApiRequestIdKey, "context-id"),
+			wantReqID: "context-id"},
+		{name: "trace set by the caller",
+			ctx:    metadata.NewOutgoingContext(metadata.NewIncomingContext(context.Background(), incoming), metadata.Pairs("traceparent", "outgoing-trace")),
+			wantMD: map[string]string{"traceparent": "outgoing-trace"}},
+		{name: "token of the source", ctx: context.Background(), token: StaticToken("static"),
+			wantMD: map[string]string{headerAuthorization: "Bearer static"}},
+		{name: "authorization set by the caller",
+			ctx:   metadata.NewOutgoingContext(context.Background(), metadata.Pairs(headerAuthorization, "Bearer caller")),
+			token: StaticToken("static"), wantMD: map[string]string{headerAuthorization: "Bearer caller"}},
+		{name: "forwarded authorization", ctx: metadata.NewIncomingContext(context.Background(), incoming), token: ForwardAuthorization(),
+			wantMD: map[string]string{headerAuthorization: "Bearer incoming"}},
+		{name: "empty token", ctx: context.Background(), token: StaticToken(""),
+			wantMD: map[string]string{headerAuthorization: ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, reqID, err := outgoingContext(tt.ctx, &clientConfig{token: tt.token}, method, nil)
+			if err != nil {
+				t.Fatalf("outgoingContext err: %v", err)
+			}
+			md, _ := metadata.FromOutgoingContext(ctx)
+			if firstOf(md.Get(xApiRequestId)) != reqID || reqID == "" || (tt.wantReqID != "" && reqID != tt.wantReqID) {
+				t.Fatalf("request id %q, metadata %v, want %q", reqID, md, tt.wantReqID)
+			}
+			for k, want := range tt.wantMD {
+				if got := firstOf(md.Get(k)); got != want {
+					t.Fatalf("metadata %s = %q, want %q", k, got, want)
+				}
+			}
+		})
+	}
+
+	// A failing token source fails the call with its code
+	failing := func(context.Context, string, any) (string, error) {
+		return "", status.Error(codes.Unauthenticated, "no credentials")
+	}
+	if _, _, err := outgoingContext(context.Background(), &clientConfig{token: failing}, method, nil); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("outgoingContext err: %v", err)
+	}
+}
+
+func Test_GRPCClientRoundTrip(t *testing.T) {
+	lis := bufconn.Listen(1 << 20)
+	type call struct {
+		md       metadata.MD
+		deadline bool
+	}
+	received := make(chan call, 1)
+	inst := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		_, deadline := ctx.Deadline()
+		received <- call{md: md, deadline: deadline}
+		return handler(ctx, req)
+	}))
+	healthpb.RegisterHealthServer(inst, health.NewServer())
+	go func() { _ = inst.Serve(lis) }()
+	defer inst.Stop()
+
+	conn, err := NewGRPCClient("passthrough:///bufnet",
+		WithClientToken(StaticToken("static")),
+		WithClientDialOptions(grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		})))
+	if err != nil {
+		t.Fatalf("NewGRPCClient err: %v", err)
+	}
+	defer conn.Close()
+
+	// The client is called while serving an incoming request
+	ctx := metadata.NewIncomingContext(context.Background(),
+		metadata.Pairs(xApiRequestId, "incoming-id", "traceparent", "00-trace-span-01"))
+	if _, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatalf("Check err: %v", err)
+	}
+	got := <-received
+	want := map[string]string{
+		xApiRequestId:       "incoming-id",
+		"traceparent":       "00-trace-span-01",
+		headerAuthorization: "Bearer static",
+	}
+	for k, v := range want {
+		if value := firstOf(got.md.Get(k)); value != v {
+			t.Fatalf("server metadata %s = %q, want %q", k, value, v)
+		}
+	}
+	// The call timeout is the deadline of a context without one
+	if !got.deadline {
+		t.Fatalf("call without deadline")
+	}
+}
@@ -3,56 +3,275 @@ package net
 import (
 	"fmt"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
 )
 
-func Middleware(ro *mux.Router, enableCORS bool, middlewareFunc ...http.HandlerFunc) http.Handler {
-	// Define CORS options
-	corsHandler := func(h http.Handler) http.Handler {
-		if !enableCORS {
-			return h
-		}
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set(corsAllowOriginHeader, "*")
-			w.Header().Set(corsAllowMethodsHeader, "GET, POST, OPTIONS")
-			w.Header().Set(corsAllowHeadersHeader, "*")
-			w.Header().Set(corsMaxAgeHeader, "3600")
-			w.Header().Set(corsAllowCredentialsHeader, "true")
-			h.ServeHTTP(w, r)
-		})
+var (
+	defaultCORSMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions}
+	defaultCORSHeaders = []string{headerContentType, headerAuthorization, xApiRequestId, xApiClientId, xRequestTimeout, headerIdempotencyKey}
+	defaultCORSExposed = []string{xApiRequestId, xApiMoreError, xIdempotentReplayed}
+)
+
+// CORSOption defines a CORS policy.
+type CORSOption struct {
+	// AllowedOrigins are exact origins (https://app.example.com), "*" for any origin,
+	// or wildcard origins where * matches a part of the host (https://*.example.com).
+	AllowedOrigins []string
+	// AllowedOriginPatterns are regular expressions matched against the whole origin.
+	AllowedOriginPatterns []string
+	// AllowedMethods default is GET, POST, PUT, PATCH, DELETE, OPTIONS.
+	AllowedMethods []string
+	// AllowedHeaders default is Content-Type, Authorization, X-Request-Id, X-Client-Id, X-Request-Timeout, Idempotency-Key,
+	// "*" allows the headers requested by the preflight.
+	AllowedHeaders []string
+	// ExposedHeaders default is X-Request-Id, X-More-Error, Idempotent-Replayed.
+	ExposedHeaders []string
+	// AllowCredentials lets the browser send cookies and Authorization, the allowed
+	// origin is then echoed instead of "*" as required by browsers.
+	// It cannot be combined with the "*" origin, any site would act with the user credentials.
+	AllowCredentials bool
+	// MaxAge is the preflight cache duration, default is 1 hour.
+	MaxAge time.Duration
+}
+
+// CORSPolicy decides the CORS headers of a request, it is built by NewCORSPolicy.
+type CORSPolicy struct {
+	opt       CORSOption
+	anyOrigin bool
+	origins   map[string]bool
+	patterns  []*regexp.Regexp
+
+	mu     sync.RWMutex
+	routes map[*mux.Route]*CORSPolicy
+}
+
+// NewCORSPolicy compiles the CORS option.
+//
+// Example usage:
+//
+//	policy, err := net.NewCORSPolicy(net.CORSOption{
+//		AllowedOrigins:   []string{"https://app.example.com", "https://*.example.dev"},
+//		AllowCredentials: true,
+//	})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	handler := net.MiddlewareWithCORS(router, policy)
+func NewCORSPolicy(opt CORSOption) (*CORSPolicy, error) {
+	if len(opt.AllowedMethods) == 0 {
+		opt.AllowedMethods = defaultCORSMethods
 	}
-	// Apply the middleware functions
-	middlewareHandler := func(h http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Set the request-Id
-			if requestId := r.Header.Get(xApiRequestId); requestId == "" {
-				r.Header.Set(xApiRequestId, uuid.NewString())
+	if len(opt.AllowedHeaders) == 0 {
+		opt.AllowedHeaders = defaultCORSHeaders
+	}
+	if len(opt.ExposedHeaders) == 0 {
+		opt.ExposedHeaders = defaultCORSExposed
+	}
+	if opt.MaxAge <= 0 {
+		opt.MaxAge = time.Hour
+	}
+
+	p := &CORSPolicy{opt: opt, origins: make(map[string]bool)}
+	for _, origin := range opt.AllowedOrigins {
+		origin = strings.ToLower(strings.TrimSpace(origin))
+		switch {
+		case origin == "":
+		case origin == "*":
+			if opt.AllowCredentials {
+				return nil, fmt.Errorf("invalid CORS option: the \"*\" origin cannot allow credentials")
 			}
-			for _, Func := range middlewareFunc {
-				Func(w, r)
+			p.anyOrigin = true
+		case strings.Contains(origin, "*"):
+			// * matches one or more DNS labels (or a port), never a scheme or a path
+			expr := "^" + strings.ReplaceAll(regexp.QuoteMeta(origin), `\*`, `[a-z0-9.-]+`) + "$"
+			p.patterns = append(p.patterns, regexp.MustCompile(expr))
+		default:
+			p.origins[origin] = true
+		}
+	}
+	for _, expr := range opt.AllowedOriginPatterns {
+		// Anchored, a pattern never matches a prefix or a suffix of the origin
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid CORS origin pattern %q: %w", expr, err)
+		}
+		p.patterns = append(p.patterns, re)
+	}
+	return p, nil
+}
+
+// Override replaces the policy for the given route, e.g. a public endpoint
+// reachable from any origin.
+//
+// Example usage:
+//
+//	route := router.HandleFunc("/public", handler).Methods(http.MethodGet)
+//	if err := policy.Override(route, net.CORSOption{AllowedOrigins: []string{"*"}}); err != nil {
+//		log.Fatal(err)
+//	}
+func (p *CORSPolicy) Override(route *mux.Route, opt CORSOption) error {
+	rp, err := NewCORSPolicy(opt)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.routes == nil {
+		p.routes = make(map[*mux.Route]*CORSPolicy)
+	}
+	p.routes[route] = rp
+	return nil
+}
+
+// AllowOrigin reports whether the origin is allowed by the policy.
+func (p *CORSPolicy) AllowOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	if p.anyOrigin {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if p.origins[origin] {
+		return true
+	}
+	for _, re := range p.patterns {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// forRoute returns the policy of the route the request (or the preflighted request) matches.
+func (p *CORSPolicy) forRoute(ro *mux.Router, r *http.Request) *CORSPolicy {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.routes) == 0 || ro == nil {
+		return p
+	}
+	var match mux.RouteMatch
+	if ro.Match(r, &match) && match.Route != nil {
+		if rp, ok := p.routes[match.Route]; ok {
+			return rp
+		}
+	}
+	return p
+}
+
+// setOriginHeaders sets the headers shared by preflight and actual responses,
+// it reports whether the origin is allowed.
+func (p *CORSPolicy) setOriginHeaders(w http.ResponseWriter, origin string) bool {
+	w.Header().Add(corsVaryHeader, corsOriginHeader)
+	if !p.AllowOrigin(origin) {
+		return false
+	}
+	if p.anyOrigin {
+		w.Header().Set(corsAllowOriginHeader, "*")
+	} else {
+		w.Header().Set(corsAllowOriginHeader, origin)
+	}
+	if p.opt.AllowCredentials {
+		w.Header().Set(corsAllowCredentialsHeader, "true")
+	}
+	return true
+}
+
+func (p *CORSPolicy) allowMethod(method string) bool {
+	for _, m := range p.opt.AllowedMethods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// handler answers the preflight requests before the router method matching
+// and sets the CORS headers of the actual requests.
+func (p *CORSPolicy) handler(ro *mux.Router, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get(corsOriginHeader)
+		if origin == "" {
+			// Not a cross-origin request
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		method := r.Header.Get(corsRequestMethodHeader)
+		if r.Method != http.MethodOptions || method == "" {
+			if rp := p.forRoute(ro, r); rp.setOriginHeaders(w, origin) {
+				w.Header().Set(corsExposeHeadersHeader, strings.Join(rp.opt.ExposedHeaders, ", "))
 			}
 			h.ServeHTTP(w, r)
-		})
+			return
+		}
+
+		// Preflight: the policy is the one of the route of the preflighted method
+		target := r.Clone(r.Context())
+		target.Method = method
+		rp := p.forRoute(ro, target)
+		w.Header().Add(corsVaryHeader, corsRequestMethodHeader)
+		w.Header().Add(corsVaryHeader, corsRequestHeadersHeader)
+		if !rp.setOriginHeaders(w, origin) || !rp.allowMethod(method) {
+			getLoggerFromContext(r.Context()).Debug("CORS preflight rejected",
+				zap.String("origin", origin), zap.String("method", method), zap.String("path", r.URL.Path))
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set(corsAllowMethodsHeader, strings.Join(rp.opt.AllowedMethods, ", "))
+		if len(rp.opt.AllowedHeaders) == 1 && rp.opt.AllowedHeaders[0] == "*" {
+			if requested := r.Header.Get(corsRequestHeadersHeader); requested != "" {
+				w.Header().Set(corsAllowHeadersHeader, requested)
+			}
+		} else {
+			w.Header().Set(corsAllowHeadersHeader, strings.Join(rp.opt.AllowedHeaders, ", "))
+		}
+		w.Header().Set(corsMaxAgeHeader, strconv.Itoa(int(rp.opt.MaxAge.Seconds())))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// Middleware applies the access log, the request-id, the logger and, when enableCORS is set,
+// a CORS policy allowing any origin without credentials. Use MiddlewareWithCORS for a configured
+// policy, and Use, Group or Attach for the stages of the routers and routes.
+// The route dump lists the effective chain of stages of each route.
+func Middleware(ro *mux.Router, enableCORS bool, middlewareFunc ...http.HandlerFunc) http.Handler {
+	var policy *CORSPolicy
+	if enableCORS {
+		policy, _ = NewCORSPolicy(CORSOption{AllowedOrigins: []string{"*"}})
 	}
-	// Logger interceptor
-	loggerIntecepter := func(h http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Create logger with request context
-			reqLogger := getLogEntry().With(
-				zap.String("http_method", r.Method),
-				zap.String("http_path", r.URL.Path),
-				zap.String("req_id", r.Header.Get(xApiRequestId)),
-			)
-			// Use the context with the logger
-			rc := r.WithContext(setLoggerToContext(r.Context(), reqLogger))
-			h.ServeHTTP(w, rc)
-		})
+	return MiddlewareWithCORS(ro, policy, middlewareFunc...)
+}
+
+// MiddlewareWithCORS is Middleware with the given CORS policy, nil disables CORS.
+// The middleware functions are run in order after the logger, a function writing
+// the response (e.g. 401) stops the request.
+func MiddlewareWithCORS(ro *mux.Router, policy *CORSPolicy, middlewareFunc ...http.HandlerFunc) http.Handler {
+	// The stages run before the route matching, so that they also apply to
+	// the preflight and not-found requests, and before the stages of the routers.
+	chain := NewChain(
+		NewStage("request-id", requestIdStage),
+		NewStage("logger", loggerStage),
+		NewStage("recovery", RecoveryMiddleware),
+	)
+	if len(middlewareFunc) > 0 {
+		chain = chain.Append(NewStage("middleware-funcs", handlerFuncsStage(middlewareFunc)))
 	}
-	//
-	ro.Use(corsHandler, middlewareHandler, loggerIntecepter)
+	if policy != nil {
+		chain = append(Chain{NewStage("cors", func(h http.Handler) http.Handler {
+			return policy.handler(ro, h)
+		})}, chain...)
+	}
+	chain = append(Chain{NewStage("access-log", apiLoggerHandler)}, chain...)
 
 	// Walk through all the registered routes
 	err := ro.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
@@ -60,13 +279,14 @@ func Middleware(ro *mux.Router, enableCORS bool, middlewareFunc ...http.HandlerF
 		if err != nil {
 			return err
 		}
+		stages := formatChain(append(chain.Names(), effectiveChain(router, route)...))
 		methods, err := route.GetMethods()
 		if err != nil {
 			fmt.Printf("[%-8s] %s\n", "", pathTemplate)
 			return nil
 		}
 		for _, method := range methods {
-			fmt.Printf("[%-8s] %s\n", method, pathTemplate)
+			fmt.Printf("[%-8s] %-40s %s\n", method, pathTemplate, stages)
 		}
 		return nil
 	})
@@ -74,5 +294,46 @@ func Middleware(ro *mux.Router, enableCORS bool, middlewareFunc ...http.HandlerF
 		fmt.Println("Error walking routes: ", err)
 	}
 
-	return apiLoggerHandler(ro)
+	return chain.Then(ro)
+}
+
+// requestIdStage sets the request-Id when the client did not send one.
+func requestIdStage(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestId := r.Header.Get(xApiRequestId); requestId == "" {
+			r.Header.Set(xApiRequestId, uuid.NewString())
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// loggerStage sets the request logger to the context.
+func loggerStage(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Create logger with request context
+		reqLogger := getLogEntry().With(
+			zap.String("http_method", r.Method),
+			zap.String("http_path", r.URL.Path),
+			zap.String("req_id", r.Header.Get(xApiRequestId)),
+		)
+		// Use the context with the logger
+		rc := r.WithContext(setLoggerToContext(r.Context(), reqLogger))
+		h.ServeHTTP(w, rc)
+	})
+}
+
+// handlerFuncsStage runs the functions in order, the first one writing
+// the response stops the request.
+func handlerFuncsStage(funcs []http.HandlerFunc) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			wt := &writeTracker{ResponseWriter: w}
+			for _, Func := range funcs {
+				if Func(wt, r); wt.wrote {
+					return
+				}
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
 }
@@ -0,0 +1,44 @@
+package net
+
+import "testing"
+
+func Test_CORSPolicyAllowOrigin(t *testing.T) {
+	policy, err := NewCORSPolicy(CORSOption{
+		AllowedOrigins:        []string{"https://app.example.com", "https://*.example.dev"},
+		AllowedOriginPatterns: []string{`https://app\.example\.io`, `https://(admin|ops)\.example\.net`},
+		AllowCredentials:      true,
+	})
+	if err != nil {
+		t.Fatalf("NewCORSPolicy err: %v", err)
+	}
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{origin: "https://app.example.com", want: true},
+		{origin: "https://APP.example.com", want: true},
+		{origin: "https://preview.example.dev", want: true},
+		{origin: "https://example.dev"},
+		{origin: "https://evil.io/.example.dev"},
+		{origin: "https://app.example.io", want: true},
+		{origin: "https://ops.example.net", want: true},
+		// The patterns are matched against the whole origin
+		{origin: "https://app.example.io.evil.io"},
+		{origin: "https://evil.io?https://app.example.io"},
+		{origin: "https://admin.example.net.evil.io"},
+		{origin: "http://app.example.com"},
+		{origin: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			if got := policy.AllowOrigin(tt.origin); got != tt.want {
+				t.Fatalf("AllowOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := NewCORSPolicy(CORSOption{AllowedOriginPatterns: []string{"("}}); err == nil {
+		t.Fatalf("invalid pattern compiled")
+	}
+}
@@ -0,0 +1,287 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultRequestTimeout  = 10 * time.Second
+	defaultOutboundTimeout = 10 * time.Second
+)
+
+// DeadlineOption configures a DeadlinePolicy.
+type DeadlineOption func(p *DeadlinePolicy)
+
+// WithMethodDeadline sets the default deadline of a gRPC method ("/package.Service/Method")
+// or a REST route ("POST /say-hello", with the route path template). The streams have no
+// default deadline unless their method is set.
+func WithMethodDeadline(method string, d time.Duration) DeadlineOption {
+	return func(p *DeadlinePolicy) {
+		p.methods[method] = d
+	}
+}
+
+// WithMaxDeadline caps the timeouts asked by the clients (grpc-timeout, X-Request-Timeout),
+// zero means no cap.
+func WithMaxDeadline(d time.Duration) DeadlineOption {
+	return func(p *DeadlinePolicy) {
+		if d >= 0 {
+			p.max = d
+		}
+	}
+}
+
+// NewDeadlinePolicy creates the policy of the request deadlines: the timeout asked by the
+// client (grpc-timeout for gRPC, X-Request-Timeout for REST) is honored up to the max,
+// otherwise the default of the method (or the default timeout) applies. The handlers get
+// the deadline with their context, and pass it to the Mongo operations and outbound calls.
+//
+// Example usage:
+//
+//	deadlines := net.NewDeadlinePolicy(10*time.Second,
+//		net.WithMaxDeadline(time.Minute),
+//		net.WithMethodDeadline("/hello.HelloService/SayHello", 3*time.Second),
+//		net.WithMethodDeadline("POST /say-hello", 3*time.Second),
+//	)
+//	net.Use(router, deadlines.Stage())
+//	inst := grpc.NewServer(
+//		grpc.ChainUnaryInterceptor(deadlines.UnaryServerInterceptor()),
+//		grpc.ChainStreamInterceptor(deadlines.StreamServerInterceptor()),
+//	)
+func NewDeadlinePolicy(defaultTimeout time.Duration, opts ...DeadlineOption) *DeadlinePolicy {
+	p := &DeadlinePolicy{
+		timeout: defaultTimeout,
+		methods: make(map[string]time.Duration),
+	}
+	if p.timeout <= 0 {
+		p.timeout = defaultRequestTimeout
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// DeadlinePolicy sets the deadlines of the REST routes and the gRPC calls.
+type DeadlinePolicy struct {
+	timeout time.Duration
+	max     time.Duration
+	methods map[string]time.Duration
+}
+
+// methodTimeout returns the default timeout of the method, zero for a stream without its own.
+func (p *DeadlinePolicy) methodTimeout(method string, stream bool) time.Duration {
+	if d, ok := p.methods[method]; ok {
+		return d
+	}
+	if stream {
+		return 0
+	}
+	return p.timeout
+}
+
+// withDeadline returns the context with the timeout asked by the client (the deadline of the
+// context for gRPC, requested for REST) capped by the max, or the default of the method.
+func (p *DeadlinePolicy) withDeadline(ctx context.Context, requested, fallback time.Duration) (context.Context, context.CancelFunc) {
+	timeout := fallback
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	} else if requested > 0 {
+		timeout = requested
+	}
+	if p.max > 0 && timeout > p.max {
+		timeout = p.max
+	}
+	if timeout <= 0 {
+		// A stream without default deadline, or an already exceeded deadline of the context
+		return context.WithCancel(ctx)
+	}
+	// A shorter deadline of the context is kept
+	return context.WithTimeout(ctx, timeout)
+}
+
+// Stage returns the policy as a middleware stage, see Use and Attach.
+func (p *DeadlinePolicy) Stage() Stage {
+	return NewStage("deadline", p.Middleware)
+}
+
+// Middleware sets the deadline of the REST requests, a handler returning without reply
+// once the deadline is exceeded is answered 504 Gateway Timeout. The websocket upgrades
+// are not limited.
+func (p *DeadlinePolicy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isWebsocketUpgrade(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		method := r.Method + " " + r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil {
+				method = r.Method + " " + tmpl
+			}
+		}
+		requested, err := ParseRequestTimeout(r.Header.Get(xRequestTimeout))
+		if err != nil {
+			WriteStatus(w, r, http.StatusBadRequest, status.New(codes.InvalidArgument, err.Error()))
+			return
+		}
+
+		ctx, cancel := p.withDeadline(r.Context(), requested, p.methodTimeout(method, false))
+		defer cancel()
+		wt := &writeTracker{ResponseWriter: w}
+		next.ServeHTTP(wt, r.WithContext(ctx))
+
+		if !wt.wrote && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			getLoggerFromContext(ctx).Warn("Request deadline exceeded", zap.String("method", method))
+			WriteStatus(w, r, http.StatusGatewayTimeout, status.New(codes.DeadlineExceeded, "deadline exceeded"))
+		}
+	})
+}
+
+// UnaryServerInterceptor sets the deadline of the calls without grpc-timeout, the errors of
+// a handler returning once the deadline is exceeded become DEADLINE_EXCEEDED.
+func (p *DeadlinePolicy) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, cancel := p.withDeadline(ctx, 0, p.methodTimeout(info.FullMethod, false))
+		defer cancel()
+		resp, err := handler(ctx, req)
+		return resp, deadlineError(ctx, err)
+	}
+}
+
+// StreamServerInterceptor is UnaryServerInterceptor for the streams, only the methods
+// set by WithMethodDeadline have a default deadline.
+func (p *DeadlinePolicy) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, cancel := p.withDeadline(ss.Context(), 0, p.methodTimeout(info.FullMethod, true))
+		defer cancel()
+		err := handler(srv, &deadlineServerStream{ServerStream: ss, ctx: ctx})
+		return deadlineError(ctx, err)
+	}
+}
+
+type deadlineServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *deadlineServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// deadlineError converts the error of a handler which exceeded its deadline, e.g. the
+// context error returned by a Mongo operation, to DEADLINE_EXCEEDED. The gRPC statuses
+// other than UNKNOWN are kept.
+func deadlineError(ctx context.Context, err error) error {
+	if err == nil || !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	if st, ok := status.FromError(err); ok && st.Code() != codes.Unknown {
+		return err
+	}
+	return status.Error(codes.DeadlineExceeded, "deadline exceeded")
+}
+
+// ParseRequestTimeout parses the X-Request-Timeout header: a duration ("1.5s", "800ms")
+// or a number of seconds. An empty value is zero (no timeout asked).
+func ParseRequestTimeout(v string) (time.Duration, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		seconds, ne := strconv.ParseFloat(v, 64)
+		if ne != nil {
+			return 0, fmt.Errorf("invalid %s header %q", xRequestTimeout, v)
+		}
+		d = time.Duration(seconds * float64(time.Second))
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid %s header %q, must be positive", xRequestTimeout, v)
+	}
+	return d, nil
+}
+
+// Budget returns the context for an outbound call: the remaining budget of the request
+// when the context has a deadline, otherwise the fallback timeout.
+//
+// Example usage:
+//
+//	ctx, cancel := net.Budget(ctx, 10*time.Second)
+//	defer cancel()
+//	resp, err := client.Do(req.WithContext(ctx))
+func Budget(ctx context.Context, fallback time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || fallback <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, fallback)
+}
+
+// NewOutboundClient creates an HTTP client propagating the remaining budget of the request
+// context: the calls without deadline get the fallback timeout, and the remaining budget
+// is sent in the X-Request-Timeout header, so that a service built on this package stops in time.
+//
+// Example usage:
+//
+//	client := net.NewOutboundClient(nil, 10*time.Second)
+//	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, verifyURL, body)
+//	resp, err := client.Do(req)
+func NewOutboundClient(base http.RoundTripper, fallback time.Duration) *http.Client {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if fallback <= 0 {
+		fallback = defaultOutboundTimeout
+	}
+	return &http.Client{Transport: &budgetTransport{base: base, fallback: fallback}}
+}
+
+type budgetTransport struct {
+	base     http.RoundTripper
+	fallback time.Duration
+}
+
+func (t *budgetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := Budget(req.Context(), t.fallback)
+	deadline, _ := ctx.Deadline()
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		cancel()
+		return nil, fmt.Errorf("%s %s: %w", req.Method, req.URL.Redacted(), context.DeadlineExceeded)
+	}
+
+	out := req.Clone(ctx)
+	out.Header.Set(xRequestTimeout, strconv.FormatInt(max(remaining.Milliseconds(), 1), 10)+"ms")
+	resp, err := t.base.RoundTrip(out)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// The context is canceled once the body is read and closed
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
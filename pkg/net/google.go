@@ -4,12 +4,13 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
-	"fmt"
 	"net/http"
 	"slices"
 	"strings"
 	"time"
 
+	"github.com/weeback/grpc-project-template/pkg/logger"
+
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -59,21 +60,13 @@ func AllowServiceAccounts(inst *grpc.Server, expectedServiceAccounts []string) h
 	})
 }
 
-func StreamInterceptor() grpc.StreamServerInterceptor {
-	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
-		fmt.Printf("Stream started: %v\n", info.FullMethod)
-		if err := handler(srv, ss); err != nil {
-			fmt.Printf("Stream error: %v\n", err)
-			return err
-		}
-		fmt.Printf("Stream completed successfully\n")
-		return nil
-	}
-}
-
-// UnaryServerAuthInterceptor creates a server interceptor for attack middleware function to gRPC requests
+// UnaryServerAuthInterceptor creates a server interceptor for attack middleware function to gRPC requests,
+// the grpc.health.v1.Health probes are not authenticated.
 func UnaryServerAuthInterceptor(expectedServiceAccounts []string, authFunc func(fullMethod string, bodyHash string, jwtStr string) error) grpc.UnaryServerInterceptor {
 	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if isHealthMethod(info.FullMethod) {
+			return handler(ctx, req)
+		}
 		var (
 			startTime = time.Now()
 			reqID     string
@@ -112,7 +105,7 @@ func UnaryServerAuthInterceptor(expectedServiceAccounts []string, authFunc func(
 			zap.Bool("proto_marshaled", false),
 			zap.String("method", info.FullMethod),
 			zap.String("req_id", reqID),
-			zap.Any("metadata", md),
+			logger.Redact("metadata", md),
 		)
 		// Use the context with the logger
 		ctx = setLoggerToContext(ctx, reqLogger)
@@ -134,7 +127,7 @@ func UnaryServerAuthInterceptor(expectedServiceAccounts []string, authFunc func(
 			b, err := proto.Marshal(msg)
 			if err != nil {
 				reqLogger = reqLogger.With(
-					zap.Any("request", msg), // If the request is a proto message, log it
+					logger.Redact("request", msg), // If the request is a proto message, log it
 					zap.Errors("marshal_error", []error{err}),
 				)
 			} else {
@@ -143,31 +136,34 @@ func UnaryServerAuthInterceptor(expectedServiceAccounts []string, authFunc func(
 				reqLogger = reqLogger.With(
 					zap.Bool("proto_marshaled", true),
 					zap.String("sum", hex.EncodeToString(sum[:])),
-					zap.String("request", string(b)), // If the request is a proto message, log it
+					logger.Redact("request", msg), // If the request is a proto message, log it without its sensitive fields
 				)
 			}
 		} else {
 			// Otherwise, log the request as a generic interface
 			reqLogger = reqLogger.With(
-				zap.Any("request", req),
+				logger.Redact("request", req),
 				zap.Errors("proto_marshal_error", []error{status.Errorf(codes.Internal, "request is not a proto message")}),
 			)
 		}
 
-		if err := authFunc(info.FullMethod, bodyHash, jwtAuthStr); err != nil {
-			reqLogger.Error("Authorization failed",
-				zap.String("body_hash", bodyHash),
-				zap.String("jwt", jwtAuthStr),
-				zap.Error(err))
-			return nil, status.Errorf(codes.Unauthenticated, "Authorization failed: %v", err)
+		// The REST request of a transcoded call is already authorized by AuthStage
+		if authenticated, _ := ctx.Value(authenticatedContextKey{}).(bool); !authenticated {
+			if err := authFunc(info.FullMethod, bodyHash, jwtAuthStr); err != nil {
+				reqLogger.Error("Authorization failed",
+					zap.String("body_hash", bodyHash),
+					logger.JWT("jwt", jwtAuthStr),
+					zap.Error(err))
+				return nil, status.Errorf(codes.Unauthenticated, "Authorization failed: %v", err)
+			}
 		}
 
 		//
 		reqLogger.Debug("gRPC middleware interceptor", zap.Duration("duration", time.Since(startTime)))
 
 		reqLogger.Info("gRPC request started", zap.Time("start_time", startTime))
-		// Process the request
-		resp, err := handler(ctx, req)
+		// Process the request, the body hash is reused by the idempotency layer
+		resp, err := handler(context.WithValue(ctx, bodyHashContextKey{}, bodyHash), req)
 
 		// Get status code
 		statusCode := codes.OK
@@ -177,7 +173,7 @@ func UnaryServerAuthInterceptor(expectedServiceAccounts []string, authFunc func(
 
 		// Log completion
 		reqLogger.Info("gRPC request completed",
-			zap.Any("response", resp),
+			logger.Redact("response", resp),
 			zap.String("status", statusCode.String()),
 			zap.Duration("duration", time.Since(startTime)),
 			zap.Error(err),
@@ -210,7 +206,7 @@ func UnaryServerLoggingInterceptor() grpc.UnaryServerInterceptor {
 		// Log the start of the request
 		startTime := time.Now()
 		reqLogger.Info("gRPC request started",
-			zap.Any("request", req),
+			logger.Redact("request", req),
 			zap.Time("start_time", startTime),
 		)
 
@@ -225,7 +221,7 @@ func UnaryServerLoggingInterceptor() grpc.UnaryServerInterceptor {
 
 		// Log completion
 		reqLogger.Info("gRPC request completed",
-			zap.Any("response", resp),
+			logger.Redact("response", resp),
 			zap.String("status", statusCode.String()),
 			zap.Duration("duration", time.Since(startTime)),
 			zap.Error(err),
@@ -239,6 +235,16 @@ func clientAuthorizationCheck(ctx context.Context, expectedServiceAccounts []str
 	if len(expectedServiceAccounts) == 0 {
 		return nil // No service accounts to check against, allow all
 	}
+	// Mutual-TLS client, the certificate identity plays the role of the ALTS peer service account
+	if id, ok := PeerIdentityFromContext(ctx); ok {
+		getLoggerFromContext(ctx).Debug("mTLS AuthInfo", zap.String("peer", id))
+		for _, sa := range expectedServiceAccounts {
+			if strings.EqualFold(id, sa) {
+				return nil
+			}
+		}
+		return status.Errorf(codes.PermissionDenied, "Client %v is not authorized", id)
+	}
 	authInfo, err := alts.AuthInfoFromContext(ctx)
 	if err != nil {
 		return status.Errorf(codes.PermissionDenied, "The context is not an ALTS-compatible context: %v", err)
@@ -10,17 +10,40 @@ import (
 	"google.golang.org/grpc"
 )
 
-func MixHttp2(rest, gRPC http.Handler) http.Handler {
+// MixHttp2 serves gRPC and REST on the same port, over h2c (cleartext) or
+// TLS when the server is created by HttpServerWithTLS.
+// gRPC-Web calls (application/grpc-web and application/grpc-web-text, over HTTP/1.1
+// or HTTP/2) and their CORS preflight are translated to the gRPC server as well,
+// the optional CORS policy decides the origins allowed to call them (any by default).
+func MixHttp2(rest, gRPC http.Handler, cors ...*CORSPolicy) http.Handler {
+	grpcWeb := &grpcWebHandler{gRPC: gRPC}
+	if len(cors) > 0 && cors[0] != nil {
+		grpcWeb.allowOrigin = cors[0].AllowOrigin
+	}
 	// Trộn cả gRPC và REST mux
 	mainHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.ProtoMajor == 2 && strings.Contains(r.Header.Get(headerContentType), "application/grpc") {
+		// Expose the verified client certificate identity (mTLS) to the handlers
+		if id := ClientCertificateIdentity(r.TLS); id != "" {
+			r = r.WithContext(setPeerIdentityToContext(r.Context(), id))
+		}
+		if isGrpcWebRequest(r) || isGrpcWebPreflight(r) {
+			grpcWeb.serveHTTP(w, r)
+		} else if r.ProtoMajor == 2 && strings.Contains(r.Header.Get(headerContentType), "application/grpc") {
 			gRPC.ServeHTTP(w, r)
 		} else {
 			rest.ServeHTTP(w, r)
 		}
 	})
 
-	return h2c.NewHandler(mainHandler, &http2.Server{})
+	h2s := &http2.Server{}
+	return &mixedHandler{Handler: h2c.NewHandler(mainHandler, h2s), h2s: h2s}
+}
+
+// mixedHandler is the handler returned by MixHttp2. NewServer applies its HTTP/2
+// options to h2s, the server of the connections upgraded to h2c.
+type mixedHandler struct {
+	http.Handler
+	h2s *http2.Server
 }
 
 // Walk for gRPC only
@@ -0,0 +1,194 @@
+package net
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/weeback/grpc-project-template/pkg/logger"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// StreamServerAuthInterceptor creates a stream interceptor with the checks of UnaryServerAuthInterceptor.
+// When the stream starts, the service accounts (ALTS or mTLS) are checked and tokenFunc verifies the
+// JWT of the metadata, the stream fails before the handler runs. Then authFunc is called with the JWT
+// and the SHA256 of the first message received, before the handler gets it: the messages sent before
+// are authorized by tokenFunc only. The Watch streams of grpc.health.v1.Health are not authenticated.
+func StreamServerAuthInterceptor(expectedServiceAccounts []string,
+	tokenFunc func(fullMethod string, jwtStr string) error,
+	authFunc func(fullMethod string, bodyHash string, jwtStr string) error) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if isHealthMethod(info.FullMethod) {
+			return handler(srv, ss)
+		}
+		ls := newLoggingServerStream(ss, info)
+
+		// Check if the stream is authorized by service account
+		if err := clientAuthorizationCheck(ls.ctx, expectedServiceAccounts); err != nil {
+			ls.logger.Error("Client authorization check failed", zap.Error(err))
+			return err
+		}
+		// Check the JWT before the handler runs, it may work before its first message
+		if err := tokenFunc(info.FullMethod, ls.jwt); err != nil {
+			ls.logger.Error("Authorization failed", logger.JWT("jwt", ls.jwt), zap.Error(err))
+			return status.Errorf(codes.Unauthenticated, "Authorization failed: %v", err)
+		}
+		ls.authorize = func(bodyHash string) error {
+			if err := authFunc(info.FullMethod, bodyHash, ls.jwt); err != nil {
+				ls.logger.Error("Authorization failed",
+					zap.String("body_hash", bodyHash),
+					logger.JWT("jwt", ls.jwt),
+					zap.Error(err))
+				return status.Errorf(codes.Unauthenticated, "Authorization failed: %v", err)
+			}
+			return nil
+		}
+		return ls.serve(srv, handler)
+	}
+}
+
+// StreamInterceptor creates a stream interceptor logging the stream and its messages,
+// with the logger set to the stream context.
+func StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return newLoggingServerStream(ss, info).serve(srv, handler)
+	}
+}
+
+// loggingServerStream carries the context enriched with the request logger,
+// counts the messages and authorizes the body of the first message received.
+type loggingServerStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	logger *zap.Logger
+	jwt    string
+
+	authorize     func(bodyHash string) error
+	authorizeOnce sync.Once
+	authorizeErr  error
+
+	mu                   sync.Mutex
+	received, sent       int
+	recvBytes, sentBytes int
+}
+
+func newLoggingServerStream(ss grpc.ServerStream, info *grpc.StreamServerInfo) *loggingServerStream {
+	var (
+		ctx   = ss.Context()
+		reqID string
+		jwt   string
+	)
+	md, _ := metadata.FromIncomingContext(ctx)
+	if auth := md.Get(headerAuthorization); len(auth) > 0 {
+		jwt = strings.TrimPrefix(auth[0], "Bearer ")
+	}
+	if reqIDs := md.Get(xApiRequestId); len(reqIDs) > 0 {
+		reqID = reqIDs[0]
+	}
+
+	// Create logger with request context
+	reqLogger := getLogEntry().With(
+		zap.String("method", info.FullMethod),
+		zap.String("req_id", reqID),
+		zap.Bool("client_stream", info.IsClientStream),
+		zap.Bool("server_stream", info.IsServerStream),
+		logger.Redact("metadata", md),
+	)
+	return &loggingServerStream{
+		ServerStream: ss,
+		ctx:          setLoggerToContext(ctx, reqLogger),
+		logger:       reqLogger,
+		jwt:          jwt,
+	}
+}
+
+func (s *loggingServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *loggingServerStream) checkAuthorization(bodyHash string) error {
+	if s.authorize == nil {
+		return nil
+	}
+	s.authorizeOnce.Do(func() {
+		s.authorizeErr = s.authorize(bodyHash)
+	})
+	return s.authorizeErr
+}
+
+func (s *loggingServerStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	var (
+		size int
+		body []byte
+		err  error
+	)
+	if msg, ok := m.(proto.Message); ok {
+		if body, err = proto.Marshal(msg); err != nil {
+			// The body hash cannot be computed, the message is never authorized
+			return status.Errorf(codes.InvalidArgument, "failed to marshal message: %v", err)
+		}
+		size = len(body)
+	}
+	sum := sha256.Sum256(body)
+	if err := s.checkAuthorization(hex.EncodeToString(sum[:])); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.received++
+	s.recvBytes += size
+	count := s.received
+	s.mu.Unlock()
+	s.logger.Debug("gRPC stream message received", zap.Int("count", count), zap.Int("size", size))
+	return nil
+}
+
+func (s *loggingServerStream) SendMsg(m any) error {
+	size := 0
+	if msg, ok := m.(proto.Message); ok {
+		size = proto.Size(msg)
+	}
+	if err := s.ServerStream.SendMsg(m); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.sent++
+	s.sentBytes += size
+	count := s.sent
+	s.mu.Unlock()
+	s.logger.Debug("gRPC stream message sent", zap.Int("count", count), zap.Int("size", size))
+	return nil
+}
+
+func (s *loggingServerStream) serve(srv any, handler grpc.StreamHandler) error {
+	startTime := time.Now()
+	s.logger.Info("gRPC stream started", zap.Time("start_time", startTime))
+
+	err := handler(srv, s)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logger.Info("gRPC stream completed",
+		zap.String("status", status.Code(err).String()),
+		zap.Duration("duration", time.Since(startTime)),
+		zap.Int("messages_received", s.received),
+		zap.Int("messages_sent", s.sent),
+		zap.Int("bytes_received", s.recvBytes),
+		zap.Int("bytes_sent", s.sentBytes),
+		zap.Error(err),
+	)
+	return err
+}
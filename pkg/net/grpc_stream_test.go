@@ -0,0 +1,142 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/weeback/grpc-project-template/pkg/jwt"
+)
+
+// testServerStream is a ServerStream receiving the messages of recv.
+type testServerStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	recv []proto.Message
+	sent int
+}
+
+func (s *testServerStream) Context() context.Context { return s.ctx }
+
+func (s *testServerStream) SendMsg(any) error {
+	s.sent++
+	return nil
+}
+
+func (s *testServerStream) RecvMsg(m any) error {
+	if len(s.recv) == 0 {
+		return errors.New("EOF")
+	}
+	proto.Merge(m.(proto.Message), s.recv[0])
+	s.recv = s.recv[1:]
+	return nil
+}
+
+func Test_StreamServerAuthInterceptor(t *testing.T) {
+	const method = "/hello.HelloService/Chat"
+	first := wrapperspb.String("first")
+	firstBody, _ := proto.Marshal(first)
+	firstHash := jwt.BodyHash(firstBody)
+
+	var hashes []string
+	tokenFunc := func(fullMethod, jwtStr string) error {
+		if jwtStr != "good" {
+			return errors.New("invalid token")
+		}
+		return nil
+	}
+	authFunc := func(fullMethod, bodyHash, jwtStr string) error {
+		hashes = append(hashes, bodyHash)
+		if bodyHash != firstHash {
+			return errors.New("invalid body")
+		}
+		return nil
+	}
+	interceptor := StreamServerAuthInterceptor(nil, tokenFunc, authFunc)
+	info := &grpc.StreamServerInfo{FullMethod: method, IsClientStream: true, IsServerStream: true}
+
+	tests := []struct {
+		name     string
+		token    string
+		recv     []proto.Message
+		handler  func(ss grpc.ServerStream) error
+		wantCode codes.Code
+		wantRun  bool
+		wantSent int
+	}{
+		{
+			name:     "bad token never runs the handler",
+			token:    "bad",
+			handler:  func(ss grpc.ServerStream) error { return ss.SendMsg(first) },
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name:     "send before receive",
+			token:    "good",
+			recv:     []proto.Message{first},
+			handler:  func(ss grpc.ServerStream) error { return ss.SendMsg(first) },
+			wantCode: codes.OK,
+			wantRun:  true,
+			wantSent: 1,
+		},
+		{
+			name:  "first message is hashed",
+			token: "good",
+			recv:  []proto.Message{first, wrapperspb.String("second")},
+			handler: func(ss grpc.ServerStream) error {
+				for range 2 {
+					if err := ss.RecvMsg(&wrapperspb.StringValue{}); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			wantCode: codes.OK,
+			wantRun:  true,
+		},
+		{
+			name:     "first message with another body",
+			token:    "good",
+			recv:     []proto.Message{wrapperspb.String("other")},
+			handler:  func(ss grpc.ServerStream) error { return ss.RecvMsg(&wrapperspb.StringValue{}) },
+			wantCode: codes.Unauthenticated,
+			wantRun:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hashes = nil
+			ss := &testServerStream{
+				ctx:  metadata.NewIncomingContext(context.Background(), metadata.Pairs(headerAuthorization, "Bearer "+tt.token)),
+				recv: tt.recv,
+			}
+			ran := false
+			err := interceptor(nil, ss, info, func(_ any, stream grpc.ServerStream) error {
+				ran = true
+				return tt.handler(stream)
+			})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("err = %v, want code %v", err, tt.wantCode)
+			}
+			if ran != tt.wantRun || ss.sent != tt.wantSent {
+				t.Fatalf("handler ran %v sent %d, want %v and %d", ran, ss.sent, tt.wantRun, tt.wantSent)
+			}
+			// authFunc sees the first message only, never an empty hash
+			for _, h := range hashes {
+				if h == "" {
+					t.Fatalf("authFunc called with an empty hash")
+				}
+			}
+			if len(hashes) > 1 {
+				t.Fatalf("authFunc called %d times", len(hashes))
+			}
+		})
+	}
+}
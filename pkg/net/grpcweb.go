@@ -0,0 +1,293 @@
+package net
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	grpcWebContentType     = "application/grpc-web"
+	grpcWebTextContentType = "application/grpc-web-text"
+
+	// grpcWebTrailerFlag marks the frame carrying the trailers in the response body
+	grpcWebTrailerFlag byte = 0x80
+)
+
+var (
+	// grpcWebAllowHeaders are the request headers sent by gRPC-Web clients
+	grpcWebAllowHeaders = []string{"Content-Type", "X-Grpc-Web", "X-User-Agent", "Grpc-Timeout",
+		headerAuthorization, xApiRequestId, xApiClientId}
+	// grpcWebExposeHeaders are the response headers a browser must be allowed to read
+	grpcWebExposeHeaders = []string{"Grpc-Status", "Grpc-Message", "Grpc-Status-Details-Bin", xApiRequestId}
+)
+
+// isGrpcWebRequest reports whether the request is a gRPC-Web call (binary or text),
+// over HTTP/1.1 or HTTP/2.
+func isGrpcWebRequest(r *http.Request) bool {
+	return r.Method == http.MethodPost &&
+		strings.HasPrefix(r.Header.Get(headerContentType), grpcWebContentType)
+}
+
+// isGrpcWebPreflight reports whether the request is a CORS preflight of a gRPC-Web call.
+// gRPC-Web clients always send the X-Grpc-Web header.
+func isGrpcWebPreflight(r *http.Request) bool {
+	if r.Method != http.MethodOptions || r.Header.Get(corsRequestMethodHeader) == "" {
+		return false
+	}
+	for _, h := range strings.Split(r.Header.Get(corsRequestHeadersHeader), ",") {
+		if strings.EqualFold(strings.TrimSpace(h), "x-grpc-web") {
+			return true
+		}
+	}
+	return false
+}
+
+// grpcWebHandler translates gRPC-Web calls from browsers into native gRPC calls
+// served in-process by the gRPC server, so every registered service is reachable
+// with no extra handler code.
+type grpcWebHandler struct {
+	gRPC http.Handler
+	// allowOrigin reports whether the CORS origin is allowed, all origins by default
+	allowOrigin func(origin string) bool
+}
+
+func (h *grpcWebHandler) allowed(origin string) bool {
+	return h.allowOrigin == nil || h.allowOrigin(origin)
+}
+
+// serveHTTP handles either a preflight or a gRPC-Web call.
+func (h *grpcWebHandler) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get(corsOriginHeader)
+	if origin != "" && h.allowed(origin) {
+		w.Header().Set(corsAllowOriginHeader, origin)
+		w.Header().Add(corsVaryHeader, corsOriginHeader)
+		w.Header().Set(corsExposeHeadersHeader, strings.Join(grpcWebExposeHeaders, ", "))
+	}
+	if r.Method == http.MethodOptions {
+		if origin == "" || !h.allowed(origin) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set(corsAllowMethodsHeader, "POST, OPTIONS")
+		w.Header().Set(corsAllowHeadersHeader, strings.Join(grpcWebAllowHeaders, ", "))
+		w.Header().Set(corsMaxAgeHeader, "3600")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	contentType := r.Header.Get(headerContentType)
+	text := strings.HasPrefix(contentType, grpcWebTextContentType)
+
+	// Build the native gRPC request, the gRPC server requires HTTP/2
+	req := r.Clone(r.Context())
+	req.ProtoMajor, req.ProtoMinor, req.Proto = 2, 0, "HTTP/2.0"
+	req.Header.Set(headerContentType, grpcContentType(contentType))
+	req.Header.Del("Content-Length")
+	req.ContentLength = -1
+	if text {
+		req.Body = io.NopCloser(newGrpcWebTextReader(r.Body))
+	}
+
+	ww := &grpcWebResponseWriter{
+		w:           w,
+		header:      make(http.Header),
+		text:        text,
+		contentType: grpcWebContentType,
+	}
+	if text {
+		ww.contentType = grpcWebTextContentType
+	}
+	h.gRPC.ServeHTTP(ww, req)
+	if err := ww.finish(); err != nil {
+		getLoggerFromContext(r.Context()).Warn("Failed to write gRPC-Web trailers",
+			zap.String("path", r.URL.Path), zap.Error(err))
+	}
+}
+
+// grpcContentType maps a gRPC-Web content type to the native one,
+// keeping the codec suffix (e.g. application/grpc-web+proto -> application/grpc+proto).
+func grpcContentType(contentType string) string {
+	contentType = strings.TrimPrefix(contentType, grpcWebTextContentType)
+	contentType = strings.TrimPrefix(contentType, grpcWebContentType)
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return "application/grpc" + contentType
+}
+
+// grpcWebResponseWriter receives the native gRPC response and writes it with
+// the gRPC-Web framing: headers as HTTP headers, messages as they are (base64 for
+// the text mode), and trailers as the last length-prefixed frame of the body.
+type grpcWebResponseWriter struct {
+	w           http.ResponseWriter
+	header      http.Header
+	wroteHeader bool
+	text        bool
+	contentType string
+	pending     bytes.Buffer // text mode: data waiting for the next flush to be encoded
+}
+
+func (ww *grpcWebResponseWriter) Header() http.Header {
+	return ww.header
+}
+
+func (ww *grpcWebResponseWriter) WriteHeader(code int) {
+	if ww.wroteHeader {
+		return
+	}
+	ww.wroteHeader = true
+	dst := ww.w.Header()
+	for k, vv := range ww.header {
+		if k == "Trailer" || strings.HasPrefix(k, http.TrailerPrefix) {
+			continue
+		}
+		dst[k] = vv
+	}
+	dst.Set(headerContentType, ww.contentType)
+	ww.w.WriteHeader(code)
+}
+
+func (ww *grpcWebResponseWriter) Write(b []byte) (int, error) {
+	if !ww.wroteHeader {
+		ww.WriteHeader(http.StatusOK)
+	}
+	if ww.text {
+		// Encoded on flush, so a message (prefix and data) is one padded base64 chunk
+		return ww.pending.Write(b)
+	}
+	return ww.w.Write(b)
+}
+
+func (ww *grpcWebResponseWriter) Flush() {
+	if !ww.wroteHeader {
+		ww.WriteHeader(http.StatusOK)
+	}
+	if ww.text && ww.pending.Len() > 0 {
+		if _, err := ww.w.Write([]byte(base64.StdEncoding.EncodeToString(ww.pending.Bytes()))); err != nil {
+			return
+		}
+		ww.pending.Reset()
+	}
+	_ = http.NewResponseController(ww.w).Flush()
+}
+
+// finish writes the trailers frame once the gRPC handler returned.
+func (ww *grpcWebResponseWriter) finish() error {
+	trailers := make(http.Header)
+	for _, k := range ww.header.Values("Trailer") {
+		if vv := ww.header.Values(k); len(vv) > 0 {
+			trailers[http.CanonicalHeaderKey(k)] = vv
+		}
+	}
+	for k, vv := range ww.header {
+		if name, ok := strings.CutPrefix(k, http.TrailerPrefix); ok {
+			trailers[http.CanonicalHeaderKey(name)] = vv
+		}
+	}
+	// Trailers-only response (e.g. unimplemented method), status is in the headers
+	if trailers.Get("Grpc-Status") == "" {
+		if s := ww.header.Get("Grpc-Status"); s != "" {
+			trailers.Set("Grpc-Status", s)
+			trailers.Set("Grpc-Message", ww.header.Get("Grpc-Message"))
+		}
+	}
+
+	var payload bytes.Buffer
+	keys := make([]string, 0, len(trailers))
+	for k := range trailers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range trailers[k] {
+			if v == "" {
+				continue
+			}
+			_, _ = fmt.Fprintf(&payload, "%s: %s\r\n", strings.ToLower(k), v)
+		}
+	}
+	frame := make([]byte, 5, 5+payload.Len())
+	frame[0] = grpcWebTrailerFlag
+	binary.BigEndian.PutUint32(frame[1:], uint32(payload.Len()))
+	frame = append(frame, payload.Bytes()...)
+
+	if _, err := ww.Write(frame); err != nil {
+		return err
+	}
+	ww.Flush()
+	return nil
+}
+
+// grpcWebTextReader decodes a base64 request body, clients may send several
+// padded chunks one after the other.
+type grpcWebTextReader struct {
+	src     io.Reader
+	decoded bytes.Buffer
+	rest    []byte
+	eof     bool
+}
+
+func newGrpcWebTextReader(src io.Reader) *grpcWebTextReader {
+	return &grpcWebTextReader{src: src}
+}
+
+func (tr *grpcWebTextReader) Read(p []byte) (int, error) {
+	for tr.decoded.Len() == 0 && !tr.eof {
+		buf := make([]byte, 4096)
+		n, err := tr.src.Read(buf)
+		tr.rest = append(tr.rest, buf[:n]...)
+		if err == io.EOF {
+			tr.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+		// Decode every complete quantum of 4 characters, padding included
+		full := len(tr.rest) / 4 * 4
+		if tr.eof {
+			full = len(tr.rest)
+		}
+		if full > 0 {
+			out := make([]byte, base64.StdEncoding.DecodedLen(full))
+			m, err := decodeBase64Chunks(out, tr.rest[:full])
+			if err != nil {
+				return 0, err
+			}
+			tr.decoded.Write(out[:m])
+			tr.rest = tr.rest[full:]
+		}
+	}
+	if tr.decoded.Len() == 0 && tr.eof {
+		return 0, io.EOF
+	}
+	return tr.decoded.Read(p)
+}
+
+// decodeBase64Chunks decodes concatenated base64 chunks, each one may end with padding.
+func decodeBase64Chunks(dst, src []byte) (int, error) {
+	var n int
+	for len(src) > 0 {
+		end := len(src)
+		if i := bytes.IndexByte(src, '='); i >= 0 {
+			// The chunk ends after the padding characters
+			end = i
+			for end < len(src) && src[end] == '=' {
+				end++
+			}
+		}
+		m, err := base64.StdEncoding.Decode(dst[n:], src[:end])
+		if err != nil {
+			return n, fmt.Errorf("invalid gRPC-Web text body: %w", err)
+		}
+		n += m
+		src = src[end:]
+	}
+	return n, nil
+}
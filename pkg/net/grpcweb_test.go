@@ -0,0 +1,183 @@
+package net
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// grpcWebFrame returns the length-prefixed frame of the payload.
+func grpcWebFrame(flag byte, payload []byte) []byte {
+	frame := make([]byte, 5, 5+len(payload))
+	frame[0] = flag
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+// readGrpcWebFrames splits a gRPC-Web response body into its frames.
+func readGrpcWebFrames(t *testing.T, body []byte) (flags []byte, payloads [][]byte) {
+	t.Helper()
+	for len(body) > 0 {
+		if len(body) < 5 {
+			t.Fatalf("truncated frame %q", body)
+		}
+		n := int(binary.BigEndian.Uint32(body[1:5]))
+		if len(body) < 5+n {
+			t.Fatalf("truncated frame payload %q", body)
+		}
+		flags, payloads = append(flags, body[0]), append(payloads, body[5:5+n])
+		body = body[5+n:]
+	}
+	return flags, payloads
+}
+
+// newGrpcWebServer serves a gRPC server with the health service through MixHttp2, over HTTP/1.1.
+func newGrpcWebServer(t *testing.T, cors ...*CORSPolicy) *httptest.Server {
+	t.Helper()
+	inst := grpc.NewServer()
+	healthSrv := health.NewServer()
+	healthSrv.SetServingStatus("hello.HelloService", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(inst, healthSrv)
+	srv := httptest.NewServer(MixHttp2(http.NotFoundHandler(), inst, cors...))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func Test_GrpcWeb(t *testing.T) {
+	srv := newGrpcWebServer(t)
+
+	tests := []struct {
+		name        string
+		contentType string
+		service     string
+		wantStatus  string
+		wantMessage bool
+	}{
+		{name: "binary", contentType: "application/grpc-web+proto", service: "hello.HelloService", wantStatus: "0", wantMessage: true},
+		{name: "text", contentType: "application/grpc-web-text", service: "hello.HelloService", wantStatus: "0", wantMessage: true},
+		{name: "error status in the trailers", contentType: "application/grpc-web+proto", service: "unknown", wantStatus: "5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, _ := proto.Marshal(&healthpb.HealthCheckRequest{Service: tt.service})
+			body := grpcWebFrame(0, msg)
+			text := strings.HasPrefix(tt.contentType, grpcWebTextContentType)
+			if text {
+				body = []byte(base64.StdEncoding.EncodeToString(body))
+			}
+			r, _ := http.NewRequest(http.MethodPost, srv.URL+"/grpc.health.v1.Health/Check", bytes.NewReader(body))
+			r.Header.Set(headerContentType, tt.contentType)
+			r.Header.Set("X-Grpc-Web", "1")
+			resp, err := srv.Client().Do(r)
+			if err != nil {
+				t.Fatalf("request err: %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.ProtoMajor != 1 || resp.StatusCode != http.StatusOK {
+				t.Fatalf("response %s %d", resp.Proto, resp.StatusCode)
+			}
+			wantType := grpcWebContentType
+			if text {
+				wantType = grpcWebTextContentType
+			}
+			if got := resp.Header.Get(headerContentType); got != wantType {
+				t.Fatalf("content type %q, want %q", got, wantType)
+			}
+
+			raw, _ := io.ReadAll(resp.Body)
+			if text {
+				decoded := make([]byte, base64.StdEncoding.DecodedLen(len(raw)))
+				n, err := decodeBase64Chunks(decoded, raw)
+				if err != nil {
+					t.Fatalf("response body %q: %v", raw, err)
+				}
+				raw = decoded[:n]
+			}
+			flags, payloads := readGrpcWebFrames(t, raw)
+			last := len(flags) - 1
+			if last < 0 || flags[last] != grpcWebTrailerFlag {
+				t.Fatalf("frames %v, want the trailers last", flags)
+			}
+			if !strings.Contains(string(payloads[last]), "grpc-status: "+tt.wantStatus+"\r\n") {
+				t.Fatalf("trailers %q, want grpc-status %s", payloads[last], tt.wantStatus)
+			}
+			if !tt.wantMessage {
+				if last != 0 {
+					t.Fatalf("frames %v, want the trailers only", flags)
+				}
+				return
+			}
+			var reply healthpb.HealthCheckResponse
+			if last != 1 || flags[0] != 0 || proto.Unmarshal(payloads[0], &reply) != nil ||
+				reply.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+				t.Fatalf("frames %v, reply %v", flags, &reply)
+			}
+		})
+	}
+}
+
+func Test_GrpcWebPreflight(t *testing.T) {
+	policy, err := NewCORSPolicy(CORSOption{AllowedOrigins: []string{"https://app.example.com"}})
+	if err != nil {
+		t.Fatalf("NewCORSPolicy err: %v", err)
+	}
+	srv := newGrpcWebServer(t, policy)
+
+	tests := []struct {
+		name     string
+		origin   string
+		wantCode int
+	}{
+		{name: "allowed origin", origin: "https://app.example.com", wantCode: http.StatusNoContent},
+		{name: "denied origin", origin: "https://evil.example.org", wantCode: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodOptions, srv.URL+"/grpc.health.v1.Health/Check", nil)
+			r.Header.Set(corsOriginHeader, tt.origin)
+			r.Header.Set(corsRequestMethodHeader, http.MethodPost)
+			r.Header.Set(corsRequestHeadersHeader, "content-type, x-grpc-web")
+			resp, err := srv.Client().Do(r)
+			if err != nil {
+				t.Fatalf("request err: %v", err)
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+			if tt.wantCode != http.StatusNoContent {
+				if got := resp.Header.Get(corsAllowOriginHeader); got != "" {
+					t.Fatalf("denied origin allowed: %q", got)
+				}
+				return
+			}
+			if resp.Header.Get(corsAllowOriginHeader) != tt.origin ||
+				!strings.Contains(resp.Header.Get(corsAllowHeadersHeader), "X-Grpc-Web") ||
+				!strings.Contains(resp.Header.Get(corsExposeHeadersHeader), "Grpc-Status") {
+				t.Fatalf("preflight headers %v", resp.Header)
+			}
+		})
+	}
+}
+
+func Test_GrpcWebTextReader(t *testing.T) {
+	// Clients may send several padded chunks, read in pieces of any size
+	src := base64.StdEncoding.EncodeToString([]byte("a")) + base64.StdEncoding.EncodeToString([]byte("bcde"))
+	got, err := io.ReadAll(newGrpcWebTextReader(io.MultiReader(strings.NewReader(src[:3]), strings.NewReader(src[3:]))))
+	if err != nil || string(got) != "abcde" {
+		t.Fatalf("decoded %q, err: %v", got, err)
+	}
+	if _, err := io.ReadAll(newGrpcWebTextReader(strings.NewReader("not*base64"))); err == nil {
+		t.Fatalf("invalid body decoded")
+	}
+}
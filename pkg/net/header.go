@@ -17,8 +17,12 @@ const (
 	headerContentType   string = "Content-Type"
 	headerAuthorization string = "Authorization"
 
+	headerIdempotencyKey string = "Idempotency-Key"
+	xIdempotentReplayed  string = "Idempotent-Replayed"
+
 	xApiClientId       string = "X-Client-Id"
 	xApiRequestId      string = "X-Request-Id"
 	xApiMoreError      string = "X-More-Error"
 	xApiServiceAccount string = "X-Service-Account"
+	xRequestTimeout    string = "X-Request-Timeout"
 )
@@ -0,0 +1,277 @@
+package net
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+)
+
+const (
+	defaultHealthInterval = 15 * time.Second
+	defaultHealthTimeout  = 3 * time.Second
+)
+
+// HealthCheck probes a dependency, e.g. (*mongodb.Connection).PingPrimary.
+type HealthCheck func(ctx context.Context) error
+
+// HealthOption configures a HealthRegistry.
+type HealthOption func(r *HealthRegistry)
+
+// WithHealthInterval sets the delay between two probes of the dependencies.
+func WithHealthInterval(d time.Duration) HealthOption {
+	return func(r *HealthRegistry) {
+		if d > 0 {
+			r.interval = d
+		}
+	}
+}
+
+// WithHealthTimeout sets the deadline of each dependency check.
+func WithHealthTimeout(d time.Duration) HealthOption {
+	return func(r *HealthRegistry) {
+		if d > 0 {
+			r.timeout = d
+		}
+	}
+}
+
+type healthDependency struct {
+	name     string
+	check    HealthCheck
+	services []string // empty for every service
+}
+
+// NewHealthRegistry creates the registry of the dependency checks backing the
+// grpc.health.v1.Health service: a service is SERVING while the checks it depends
+// on pass, the server (empty service name) while the checks of every service pass.
+//
+// Example usage:
+//
+//	healthRegistry := net.NewHealthRegistry(net.WithHealthInterval(10 * time.Second))
+//	healthRegistry.Register("mongodb-primary", conn.PingPrimary)
+//	healthRegistry.Register("firebase", firebaseAdmin.Ping, "hello.HelloService")
+//	healthRegistry.Register("metric", monitoring.Ping, "hello.HelloService")
+//	...
+//	hellopb.RegisterHelloServiceServer(inst, handler)
+//	net.RegisterHealthAndReflection(inst, healthRegistry)
+//	go healthRegistry.Run(ctx)
+func NewHealthRegistry(opts ...HealthOption) *HealthRegistry {
+	r := &HealthRegistry{
+		server:   health.NewServer(),
+		interval: defaultHealthInterval,
+		timeout:  defaultHealthTimeout,
+		services: map[string]struct{}{"": {}},
+		results:  make(map[string]error),
+		done:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// HealthRegistry probes the dependencies and sets the serving status of the services.
+type HealthRegistry struct {
+	server            *health.Server
+	interval, timeout time.Duration
+
+	mu           sync.Mutex
+	dependencies []healthDependency
+	services     map[string]struct{}
+	results      map[string]error
+
+	done         chan struct{}
+	shutdownOnce sync.Once
+}
+
+// Register adds the check of a dependency of the services, or of every service when none is given.
+func (r *HealthRegistry) Register(name string, check HealthCheck, services ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dependencies = append(r.dependencies, healthDependency{name: name, check: check, services: services})
+	for _, svc := range services {
+		r.services[svc] = struct{}{}
+	}
+}
+
+// AddService declares a service reported by the Health service, see RegisterHealthAndReflection.
+func (r *HealthRegistry) AddService(services ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, svc := range services {
+		r.services[svc] = struct{}{}
+	}
+	r.updateLocked()
+}
+
+// CheckNow runs the checks concurrently, updates the serving status of the services,
+// and returns the error of each failed dependency.
+func (r *HealthRegistry) CheckNow(ctx context.Context) map[string]error {
+	r.mu.Lock()
+	dependencies := append([]healthDependency(nil), r.dependencies...)
+	r.mu.Unlock()
+
+	var (
+		wg      sync.WaitGroup
+		results = make([]error, len(dependencies))
+	)
+	for i, dep := range dependencies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, r.timeout)
+			defer cancel()
+			results[i] = dep.check(checkCtx)
+		}()
+	}
+	wg.Wait()
+
+	failed := make(map[string]error)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, dep := range dependencies {
+		prev, known := r.results[dep.name]
+		switch err := results[i]; {
+		case err != nil && (!known || prev == nil):
+			getLogEntry().Warn("Health check failed", zap.String("dependency", dep.name), zap.Error(err))
+		case err == nil && known && prev != nil:
+			getLogEntry().Info("Health check recovered", zap.String("dependency", dep.name))
+		}
+		r.results[dep.name] = results[i]
+		if results[i] != nil {
+			failed[dep.name] = results[i]
+		}
+	}
+	r.updateLocked()
+	return failed
+}
+
+// updateLocked sets the serving status of every service from the last check results.
+func (r *HealthRegistry) updateLocked() {
+	select {
+	case <-r.done:
+		return // every service stays NOT_SERVING after the shutdown
+	default:
+	}
+	notServing := make(map[string]bool)
+	for _, dep := range r.dependencies {
+		if r.results[dep.name] == nil {
+			continue
+		}
+		notServing[""] = true
+		if len(dep.services) == 0 {
+			for svc := range r.services {
+				notServing[svc] = true
+			}
+		}
+		for _, svc := range dep.services {
+			notServing[svc] = true
+		}
+	}
+	for svc := range r.services {
+		st := healthpb.HealthCheckResponse_SERVING
+		if notServing[svc] {
+			st = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+		r.server.SetServingStatus(svc, st)
+	}
+}
+
+// Run probes the dependencies every interval until the context is done or Shutdown is called.
+func (r *HealthRegistry) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		r.CheckNow(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Shutdown sets every service NOT_SERVING, so that the load balancers stop sending
+// new calls, and ends the Watch streams. It is called by the Lifecycle, see WithHealth.
+func (r *HealthRegistry) Shutdown() {
+	r.shutdownOnce.Do(func() {
+		r.server.Shutdown()
+		close(r.done)
+	})
+}
+
+// Services returns the services reported by the Health service, sorted.
+func (r *HealthRegistry) Services() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	services := make([]string, 0, len(r.services))
+	for svc := range r.services {
+		services = append(services, svc)
+	}
+	sort.Strings(services)
+	return services
+}
+
+// Check implements grpc.health.v1.Health.
+func (r *HealthRegistry) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	return r.server.Check(ctx, req)
+}
+
+// List implements grpc.health.v1.Health.
+func (r *HealthRegistry) List(ctx context.Context, req *healthpb.HealthListRequest) (*healthpb.HealthListResponse, error) {
+	return r.server.List(ctx, req)
+}
+
+// Watch implements grpc.health.v1.Health, the stream ends on Shutdown so that
+// it does not hold the drain of the in-flight calls.
+func (r *HealthRegistry) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-r.done:
+			// Let the NOT_SERVING status of the shutdown be sent first
+			time.Sleep(100 * time.Millisecond)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return r.server.Watch(req, &healthWatchStream{Health_WatchServer: stream, ctx: ctx})
+}
+
+type healthWatchStream struct {
+	healthpb.Health_WatchServer
+	ctx context.Context
+}
+
+func (s *healthWatchStream) Context() context.Context {
+	return s.ctx
+}
+
+// isHealthMethod reports whether the method belongs to grpc.health.v1.Health, whose
+// probes (kubelet, Cloud Run, load balancers) carry neither JWT nor service account.
+func isHealthMethod(fullMethod string) bool {
+	return strings.HasPrefix(fullMethod, "/"+healthpb.Health_ServiceDesc.ServiceName+"/")
+}
+
+// RegisterHealthAndReflection registers the grpc.health.v1.Health service backed by
+// the registry, and the server reflection (for grpcurl and the gRPC UIs). The services
+// already registered on the server are added to the registry, so it must be called
+// after them.
+func RegisterHealthAndReflection(inst *grpc.Server, registry *HealthRegistry) {
+	healthpb.RegisterHealthServer(inst, registry)
+	reflection.Register(inst)
+	for name := range inst.GetServiceInfo() {
+		registry.AddService(name)
+	}
+}
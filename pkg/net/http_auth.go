@@ -0,0 +1,69 @@
+package net
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/weeback/grpc-project-template/pkg/jwt"
+	"github.com/weeback/grpc-project-template/pkg/logger"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type authenticatedContextKey struct{}
+
+// AuthStage creates the REST stage of the authFunc of UnaryServerAuthInterceptor, called with
+// the method "POST /say-hello" (with the route path template), the hex SHA-256 of the raw body
+// (see jwt.BodyHash) and the JWT of the Authorization header. A failed authorization is answered
+// 401 Unauthorized.
+//
+// The gRPC call served in-process (transcoding) is not authorized again, its body hash would
+// be the one of the proto message instead of the raw body signed by the client.
+//
+// Example usage:
+//
+//	net.Use(router, net.AuthStage(auth.AuthFunc))
+func AuthStage(authFunc func(fullMethod string, bodyHash string, jwtStr string) error) Stage {
+	return NewStage("auth", func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			method := r.Method + " " + r.URL.Path
+			if route := mux.CurrentRoute(r); route != nil {
+				if tmpl, err := route.GetPathTemplate(); err == nil {
+					method = r.Method + " " + tmpl
+				}
+			}
+			jwtStr := strings.TrimPrefix(r.Header.Get(headerAuthorization), "Bearer ")
+
+			// The body is hashed whole, up to the default limit of the binders
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, DefaultMaxBodyBytes))
+			if maxErr := (*http.MaxBytesError)(nil); errors.As(err, &maxErr) {
+				WriteStatus(w, r, http.StatusRequestEntityTooLarge, status.New(codes.InvalidArgument, "request body too large"))
+				return
+			} else if err != nil {
+				WriteStatus(w, r, http.StatusBadRequest, status.New(codes.InvalidArgument, "failed to read the request body"))
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			bodyHash := jwt.BodyHash(body)
+
+			if err := authFunc(method, bodyHash, jwtStr); err != nil {
+				getLoggerFromContext(r.Context()).Error("Authorization failed",
+					zap.String("method", method),
+					zap.String("body_hash", bodyHash),
+					logger.JWT("jwt", jwtStr),
+					zap.Error(err))
+				WriteStatus(w, r, http.StatusUnauthorized, status.Newf(codes.Unauthenticated, "Authorization failed: %v", err))
+				return
+			}
+			ctx := context.WithValue(r.Context(), authenticatedContextKey{}, true)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, bodyHashContextKey{}, bodyHash)))
+		})
+	})
+}
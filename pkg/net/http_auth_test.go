@@ -0,0 +1,107 @@
+package net
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/weeback/grpc-project-template/pkg/jwt"
+)
+
+// testSignedRequests returns the authFunc verifying the requests signed by the key pair.
+func testSignedRequests(t *testing.T) (*jwt.KeyPair, func(fullMethod, bodyHash, jwtStr string) error) {
+	t.Helper()
+	kp, err := jwt.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair err: %v", err)
+	}
+	verifier := &jwt.RequestVerifier{PublicKey: func(string) (ed25519.PublicKey, error) {
+		return kp.PublicKey, nil
+	}}
+	return kp, func(fullMethod, bodyHash, jwtStr string) error {
+		_, err := verifier.Verify(context.Background(), fullMethod, bodyHash, jwtStr)
+		return err
+	}
+}
+
+func Test_AuthStage(t *testing.T) {
+	kp, authFunc := testSignedRequests(t)
+	router := mux.NewRouter()
+	Use(router, AuthStage(authFunc))
+	router.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods(http.MethodPost)
+
+	// The raw body is signed as sent, with its spacing
+	raw := `{ "value": "gopher" }`
+	protoBody, _ := proto.Marshal(wrapperspb.String("gopher"))
+	sign := func(method string, body []byte) string {
+		token, _ := jwt.SignRequest(kp.PrivateKey, "device-1", method, body, nil)
+		return token
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		token    string
+		wantCode int
+	}{
+		{name: "raw body hash", path: "/users/1", body: raw, token: sign("POST /users/{id}", []byte(raw)), wantCode: http.StatusNoContent},
+		{name: "proto hash on the REST path", path: "/users/1", body: raw, token: sign("POST /users/{id}", protoBody), wantCode: http.StatusUnauthorized},
+		{name: "path instead of the route template", path: "/users/1", body: raw, token: sign("POST /users/1", []byte(raw)), wantCode: http.StatusUnauthorized},
+		{name: "body changed", path: "/users/1", body: `{"value":"other"}`, token: sign("POST /users/{id}", []byte(raw)), wantCode: http.StatusUnauthorized},
+		{name: "no token", path: "/users/1", body: raw, wantCode: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			r.Header.Set(headerAuthorization, "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+		})
+	}
+}
+
+func Test_UnaryServerAuthInterceptorBodyHash(t *testing.T) {
+	const method = "/hello.HelloService/SayHello"
+	kp, authFunc := testSignedRequests(t)
+	interceptor := UnaryServerAuthInterceptor(nil, authFunc)
+	req := wrapperspb.String("gopher")
+	protoBody, _ := proto.Marshal(req)
+
+	tests := []struct {
+		name     string
+		body     []byte
+		wantCode codes.Code
+	}{
+		{name: "proto marshal hash", body: protoBody, wantCode: codes.OK},
+		{name: "JSON body hash on the gRPC path", body: []byte(`{"value":"gopher"}`), wantCode: codes.Unauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, _ := jwt.SignRequest(kp.PrivateKey, "device-1", method, tt.body, nil)
+			ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(headerAuthorization, "Bearer "+token))
+			_, err := interceptor(ctx, req, &grpc.UnaryServerInfo{FullMethod: method}, func(ctx context.Context, req any) (any, error) {
+				return req, nil
+			})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("err = %v, want code %v", err, tt.wantCode)
+			}
+		})
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
 )
 
 var (
@@ -42,13 +45,22 @@ func GetRawData(r *http.Request) ([]byte, error) {
 	return io.ReadAll(r.Body)
 }
 
+// ShouldBindJSON reads the body, up to DefaultMaxBodyBytes, and decodes it into v,
+// with protojson when v is a proto message. See Bind for the other content types.
 func ShouldBindJSON(r *http.Request, v interface{}) (raw []byte, err error) {
 
+	r.Body = http.MaxBytesReader(nil, r.Body, DefaultMaxBodyBytes)
 	raw, err = GetRawData(r)
 	if err != nil {
 		return nil, err
 	}
 
+	if msg, ok := v.(proto.Message); ok {
+		if err := protojson.Unmarshal(raw, msg); err != nil {
+			return raw, err
+		}
+		return raw, nil
+	}
 	if err := json.Unmarshal(raw, v); err != nil {
 		return raw, err
 	}
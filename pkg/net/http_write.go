@@ -3,12 +3,23 @@ package net
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/textproto"
+	"strconv"
+
+	common "github.com/weeback/grpc-project-template/pb/common"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
 )
 
 // WriteJSON writes the JSON representation of v to the http.ResponseWriter.
-// Payload body is JSON encoded of (v), and the Content-Type is set to application/json.
+// Payload body is JSON encoded of (v), with protojson when v is a proto message,
+// and the Content-Type is set to application/json. See Write for content negotiation.
 func WriteJSON(w http.ResponseWriter, httpStatus int, v interface{}) error {
 
 	// validate http status code
@@ -20,7 +31,7 @@ func WriteJSON(w http.ResponseWriter, httpStatus int, v interface{}) error {
 
 	// write the response
 	w.WriteHeader(httpStatus)
-	return json.NewEncoder(w).Encode(v)
+	return encodeJSON(w, v)
 }
 
 // WriteJSONbyError writes the JSON representation of v to the http.ResponseWriter.
@@ -41,9 +52,25 @@ func WriteJSONbyError(w http.ResponseWriter, httpStatus int, err error, v interf
 	}
 	// write the response
 	w.WriteHeader(httpStatus)
+	return encodeJSON(w, v)
+}
+
+// encodeJSON encodes v as JSON, proto messages are encoded with protojson
+// so that Any, int64, enums and oneofs follow the proto JSON mapping.
+func encodeJSON(w io.Writer, v interface{}) error {
+	if msg, ok := v.(proto.Message); ok {
+		b, err := protojson.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(b, '\n'))
+		return err
+	}
 	return json.NewEncoder(w).Encode(v)
 }
 
+// WriteError writes the error message with the HTTP status as code, see WriteStatus
+// for the errors of the services.
 func WriteError(w http.ResponseWriter, httpStatus int, err error) {
 
 	write := func() error {
@@ -58,7 +85,7 @@ func WriteError(w http.ResponseWriter, httpStatus int, err error) {
 		w.WriteHeader(httpStatus)
 		return json.NewEncoder(w).Encode(map[string]interface{}{
 			"isError": true,
-			"code":    111,
+			"code":    httpStatus,
 			"message": err.Error(),
 		})
 	}
@@ -68,6 +95,46 @@ func WriteError(w http.ResponseWriter, httpStatus int, err error) {
 	}
 }
 
+// WriteStatus writes a gRPC status as the error body of the services, a common.StandardResponse
+// with the error code of the google.rpc.ErrorInfo details (metadata "code"), or the HTTP
+// status without it, the message, and the google.rpc.Status as payload. The HTTP status
+// is mapped from the gRPC code when httpStatus is zero, and the google.rpc.RetryInfo
+// details set the Retry-After header.
+//
+// Example usage:
+//
+//	if err != nil {
+//		net.WriteStatus(w, r, 0, status.Convert(err))
+//		return
+//	}
+func WriteStatus(w http.ResponseWriter, r *http.Request, httpStatus int, st *status.Status) {
+	if httpStatus == 0 {
+		httpStatus = HTTPStatusFromCode(st.Code())
+	}
+	resp := &common.StandardResponse{
+		Code:    int32(httpStatus),
+		Message: st.Message(),
+	}
+	for _, d := range st.Details() {
+		switch detail := d.(type) {
+		case *errdetails.ErrorInfo:
+			if code, err := strconv.Atoi(detail.GetMetadata()["code"]); err == nil {
+				resp.Code = int32(code)
+			}
+		case *errdetails.RetryInfo:
+			w.Header().Set("Retry-After", retryAfterSeconds(detail.GetRetryDelay().AsDuration()))
+		}
+	}
+	if payload, err := anypb.New(st.Proto()); err == nil {
+		resp.Payload = payload
+	}
+
+	w.Header().Set(xApiMoreError, st.Message())
+	if err := Write(w, r, httpStatus, resp); err != nil {
+		WriteError(w, http.StatusInternalServerError, err)
+	}
+}
+
 func WriteBytes(w http.ResponseWriter, httpStatus int, data []byte) error {
 	// validate http status code
 	if http.StatusText(httpStatus) == "" {
@@ -0,0 +1,402 @@
+package net
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	defaultIdempotencyTTL  = 24 * time.Hour
+	defaultIdempotencyLock = 30 * time.Second
+	idempotencyPoll        = 100 * time.Millisecond
+
+	// maxIdempotencyKeyLength is the longest key accepted, a UUID is recommended
+	maxIdempotencyKeyLength = 255
+	// maxIdempotencyResponse is the largest REST reply stored, a larger one is not replayed
+	maxIdempotencyResponse = 1 << 20
+)
+
+type (
+	idempotencyContextKey struct{}
+	bodyHashContextKey    struct{}
+)
+
+// IdempotencyOption configures an Idempotency.
+type IdempotencyOption func(i *Idempotency)
+
+// WithIdempotencyTTL sets how long the responses are replayed, default is 24 hours.
+func WithIdempotencyTTL(d time.Duration) IdempotencyOption {
+	return func(i *Idempotency) {
+		if d > 0 {
+			i.ttl = d
+		}
+	}
+}
+
+// WithIdempotencyLock sets how long a request in progress holds its key, default is 30 seconds.
+// The duplicates wait for its response meanwhile, then a retry executes the request again.
+func WithIdempotencyLock(d time.Duration) IdempotencyOption {
+	return func(i *Idempotency) {
+		if d > 0 {
+			i.lock = d
+		}
+	}
+}
+
+// WithIdempotencyScope sets the functions identifying the caller owning the keys, the first
+// non-empty key is used, see WithRateKeys. Default is KeyByPeerServiceAccount then KeyByIP(0),
+// put a verified identity first, e.g. KeyByJWTUser.
+func WithIdempotencyScope(keys ...RateKeyFunc) IdempotencyOption {
+	return func(i *Idempotency) {
+		if len(keys) > 0 {
+			i.scope = keys
+		}
+	}
+}
+
+// NewIdempotency creates the idempotency layer of the mutating REST calls and the unary
+// gRPC calls carrying an Idempotency-Key header (metadata idempotency-key):
+//   - the first request is executed and its successful response stored with the key,
+//     the method and the SHA-256 of the body until the TTL;
+//   - a retry with the same key is answered with the stored response, with the header
+//     Idempotent-Replayed: true;
+//   - a key reused for another method or body is rejected with 422 (FAILED_PRECONDITION);
+//   - a duplicate received while the request is in progress waits for its response,
+//     or is rejected with 409 (ABORTED) when its deadline is exceeded first.
+//
+// A failed or panicking request releases its key, so that the retry executes it again.
+// Keys are scoped by the verified identity of the caller, see WithIdempotencyScope.
+//
+// Example usage:
+//
+//	store, err := net.NewMongoIdempotencyStore(ctx, conn)
+//	...
+//	idempotency := net.NewIdempotency(store, net.WithIdempotencyTTL(24*time.Hour),
+//		net.WithIdempotencyScope(net.KeyByJWTUser(keyPair.PublicKey), net.KeyByPeerServiceAccount()))
+//	net.Use(router, idempotency.Stage())
+//	inst := grpc.NewServer(grpc.ChainUnaryInterceptor(
+//		net.UnaryServerAuthInterceptor(serviceAccounts, authFunc),
+//		idempotency.UnaryServerInterceptor(),
+//	))
+func NewIdempotency(store IdempotencyStore, opts ...IdempotencyOption) *Idempotency {
+	i := &Idempotency{
+		store: store,
+		ttl:   defaultIdempotencyTTL,
+		lock:  defaultIdempotencyLock,
+		scope: []RateKeyFunc{KeyByPeerServiceAccount(), KeyByIP(0)},
+	}
+	for _, opt := range opts {
+		opt(i)
+	}
+	if i.store == nil {
+		i.store = NewMemoryIdempotencyStore()
+	}
+	return i
+}
+
+// Idempotency replays the response of the requests retried with the same Idempotency-Key.
+type Idempotency struct {
+	store IdempotencyStore
+	ttl   time.Duration
+	lock  time.Duration
+	scope []RateKeyFunc
+}
+
+// idempotencyRejection is the reason a request is not executed.
+type idempotencyRejection struct {
+	httpStatus int
+	st         *status.Status
+}
+
+var (
+	errIdempotencyKeyInvalid = &idempotencyRejection{http.StatusBadRequest,
+		status.New(codes.InvalidArgument, "invalid idempotency key, at most 255 characters")}
+	errIdempotencyKeyReused = &idempotencyRejection{http.StatusUnprocessableEntity,
+		status.New(codes.FailedPrecondition, "idempotency key already used for another request")}
+	errIdempotencyInProgress = &idempotencyRejection{http.StatusConflict,
+		status.New(codes.Aborted, "request with the same idempotency key in progress")}
+)
+
+// reserve reserves the key of the caller for the request, or returns the completed record
+// to replay. The store errors let the request execute without idempotency.
+func (i *Idempotency) reserve(ctx context.Context, caller *RateCaller, key, method, bodyHash string) (owned, replay *IdempotencyRecord, rejection *idempotencyRejection) {
+	if len(key) > maxIdempotencyKeyLength {
+		return nil, nil, errIdempotencyKeyInvalid
+	}
+	rec := IdempotencyRecord{
+		// The callers do not share their keys
+		Key:      callerKey(i.scope, caller) + "|" + key,
+		Method:   method,
+		BodyHash: bodyHash,
+		Owner:    uuid.NewString(),
+	}
+	for {
+		now := time.Now()
+		rec.LockedUntil, rec.ExpireAt = now.Add(i.lock), now.Add(i.ttl)
+		existing, err := i.store.Reserve(ctx, rec, now)
+		if err != nil {
+			getLoggerFromContext(ctx).Warn("Idempotency store failed, request executed",
+				zap.String("method", method), zap.Error(err))
+			return nil, nil, nil
+		}
+		switch {
+		case existing == nil:
+			return &rec, nil, nil
+		case existing.Method != method || existing.BodyHash != bodyHash:
+			getLoggerFromContext(ctx).Warn("Idempotency key reused for another request",
+				zap.String("method", method), zap.String("key_method", existing.Method))
+			return nil, nil, errIdempotencyKeyReused
+		case existing.Done:
+			return nil, existing, nil
+		}
+		// Wait for the response of the request in progress
+		select {
+		case <-ctx.Done():
+			return nil, nil, errIdempotencyInProgress
+		case <-time.After(idempotencyPoll):
+		}
+	}
+}
+
+// finish stores the response of the request, or releases the key when it is not stored.
+func (i *Idempotency) finish(ctx context.Context, rec *IdempotencyRecord, store bool) {
+	// The reply is sent, the record is written even if the request is canceled meanwhile
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	var err error
+	if store {
+		err = i.store.Complete(ctx, *rec)
+	} else {
+		err = i.store.Release(ctx, rec.Key, rec.Owner)
+	}
+	if err != nil {
+		getLoggerFromContext(ctx).Warn("Failed to save the idempotency key",
+			zap.String("method", rec.Method), zap.Bool("completed", store), zap.Error(err))
+	}
+}
+
+// Stage returns the layer as a middleware stage, see Use and Attach.
+func (i *Idempotency) Stage() Stage {
+	return NewStage("idempotency", i.Middleware)
+}
+
+// Middleware applies the idempotency to the POST, PUT, PATCH and DELETE requests with an
+// Idempotency-Key header, the 2xx replies up to 1 MB are stored.
+func (i *Idempotency) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(headerIdempotencyKey)
+		switch {
+		case key == "":
+			next.ServeHTTP(w, r)
+			return
+		case r.Method != http.MethodPost && r.Method != http.MethodPut &&
+			r.Method != http.MethodPatch && r.Method != http.MethodDelete:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The body is hashed whole, up to the default limit of the binders
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, DefaultMaxBodyBytes))
+		if maxErr := (*http.MaxBytesError)(nil); errors.As(err, &maxErr) {
+			WriteStatus(w, r, http.StatusRequestEntityTooLarge, status.New(codes.InvalidArgument, "request body too large"))
+			return
+		} else if err != nil {
+			WriteStatus(w, r, http.StatusBadRequest, status.New(codes.InvalidArgument, "failed to read the request body"))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		method := r.Method + " " + r.URL.Path
+
+		caller := &RateCaller{Context: r.Context(), RemoteAddr: r.RemoteAddr, header: r.Header.Get}
+		owned, replay, rejection := i.reserve(r.Context(), caller, key, method, hex.EncodeToString(sum[:]))
+		switch {
+		case rejection != nil:
+			WriteStatus(w, r, rejection.httpStatus, rejection.st)
+			return
+		case replay != nil:
+			getLoggerFromContext(r.Context()).Info("Idempotent request replayed", zap.String("method", method))
+			encoding, body, err := replayBody(r, replay)
+			if err != nil {
+				WriteStatus(w, r, 0, status.Newf(codes.Internal, "failed to replay the response: %v", err))
+				return
+			}
+			h := w.Header()
+			h.Set(headerContentType, replay.ContentType)
+			if encoding != "" {
+				h.Set("Content-Encoding", encoding)
+			}
+			for _, v := range replay.Vary {
+				h.Add(corsVaryHeader, v)
+			}
+			h.Set(xIdempotentReplayed, "true")
+			w.WriteHeader(replay.Status)
+			_, _ = w.Write(body)
+			return
+		case owned == nil:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		// The outer stages (e.g. CORS) add their Vary values again on replay
+		varyBefore := len(w.Header().Values(corsVaryHeader))
+		returned := false
+		defer func() {
+			// A panic releases the key, the handler may not have written its reply
+			stored := returned && rec.wroteHeader && rec.status >= 200 && rec.status < 300 && !rec.overflow
+			if stored {
+				owned.Status, owned.ContentType, owned.Response = rec.status, w.Header().Get(headerContentType), rec.body.Bytes()
+				owned.ContentEncoding = w.Header().Get("Content-Encoding")
+				if vary := w.Header().Values(corsVaryHeader); len(vary) > varyBefore {
+					owned.Vary = slices.Clone(vary[varyBefore:])
+				}
+			}
+			i.finish(r.Context(), owned, stored)
+		}()
+		// The gRPC call served in-process (transcoding) is not deduplicated twice
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), idempotencyContextKey{}, true)))
+		returned = true
+	})
+}
+
+// replayBody returns the stored REST body in the encoding negotiated by the retry,
+// which may not accept the compression of the first reply.
+func replayBody(r *http.Request, rec *IdempotencyRecord) (string, []byte, error) {
+	if rec.ContentEncoding == "" {
+		return "", rec.Response, nil
+	}
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+	if encoding == rec.ContentEncoding {
+		return encoding, rec.Response, nil
+	}
+	body, err := decompress(rec.ContentEncoding, rec.Response)
+	if err != nil || encoding == "" {
+		return "", body, err
+	}
+	if body, err = compress(encoding, body); err != nil {
+		return "", nil, err
+	}
+	return encoding, body, nil
+}
+
+// idempotencyRecorder writes the reply through and keeps a copy of it.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+	overflow    bool
+}
+
+func (rec *idempotencyRecorder) WriteHeader(code int) {
+	if !rec.wroteHeader {
+		rec.status, rec.wroteHeader = code, true
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.status, rec.wroteHeader = http.StatusOK, true
+	}
+	if !rec.overflow {
+		if rec.body.Len()+len(b) > maxIdempotencyResponse {
+			rec.overflow = true
+			rec.body.Reset()
+		} else {
+			rec.body.Write(b)
+		}
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the original writer.
+func (rec *idempotencyRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// UnaryServerInterceptor applies the idempotency to the unary calls with an idempotency-key
+// metadata, the successful responses are stored. It should follow the authentication, whose
+// body hash is reused.
+func (i *Idempotency) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if deduplicated, _ := ctx.Value(idempotencyContextKey{}).(bool); deduplicated {
+			return handler(ctx, req)
+		}
+		md, _ := metadata.FromIncomingContext(ctx)
+		keys := md.Get(headerIdempotencyKey)
+		if len(keys) == 0 || keys[0] == "" {
+			return handler(ctx, req)
+		}
+		owned, replay, rejection := i.reserve(ctx, grpcCaller(ctx), keys[0], info.FullMethod, bodyHashOf(ctx, req))
+		switch {
+		case rejection != nil:
+			return nil, rejection.st.Err()
+		case replay != nil:
+			var payload anypb.Any
+			if err := proto.Unmarshal(replay.Response, &payload); err != nil {
+				return nil, status.Error(codes.Internal, "failed to replay the idempotent response")
+			}
+			resp, err := payload.UnmarshalNew()
+			if err != nil {
+				return nil, status.Error(codes.Internal, "failed to replay the idempotent response")
+			}
+			getLoggerFromContext(ctx).Info("Idempotent request replayed", zap.String("method", info.FullMethod))
+			_ = grpc.SetHeader(ctx, metadata.Pairs(xIdempotentReplayed, "true"))
+			return resp, nil
+		case owned == nil:
+			return handler(ctx, req)
+		}
+
+		var response []byte
+		defer func() {
+			// A panic leaves response nil, the key is released
+			if response != nil {
+				owned.Status, owned.Response = int(codes.OK), response
+			}
+			i.finish(ctx, owned, response != nil)
+		}()
+		resp, err := handler(ctx, req)
+		if msg, ok := resp.(proto.Message); ok && err == nil {
+			if payload, e := anypb.New(msg); e == nil {
+				response, _ = proto.Marshal(payload)
+			}
+		}
+		return resp, err
+	}
+}
+
+// bodyHashOf returns the SHA-256 of the request set to the context by the authentication,
+// or computes it.
+func bodyHashOf(ctx context.Context, req interface{}) string {
+	if bodyHash, ok := ctx.Value(bodyHashContextKey{}).(string); ok && bodyHash != "" {
+		return bodyHash
+	}
+	msg, ok := req.(proto.Message)
+	if !ok {
+		return ""
+	}
+	b, err := proto.Marshal(msg)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,218 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/weeback/grpc-project-template/pkg/mongodb"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	defaultIdempotencyCollection = "idempotency_keys"
+	idempotencySweepInterval     = time.Minute
+)
+
+// IdempotencyRecord is the request of an idempotency key and, once completed, its response.
+type IdempotencyRecord struct {
+	Key      string `bson:"_id"`
+	Method   string `bson:"method"`
+	BodyHash string `bson:"bodyHash"`
+	// Owner is the call executing the request, until LockedUntil when it is not completed
+	Owner       string    `bson:"owner"`
+	LockedUntil time.Time `bson:"lockedUntil"`
+	Done        bool      `bson:"done"`
+	ExpireAt    time.Time `bson:"expireAt"`
+
+	// Status, ContentType and Response are the HTTP status, content type and body of a
+	// REST reply, or the gRPC code and the serialized Any of a gRPC response.
+	Status      int    `bson:"status,omitempty"`
+	ContentType string `bson:"contentType,omitempty"`
+	Response    []byte `bson:"response,omitempty"`
+	// ContentEncoding is the compression of the REST Response (see Write), and Vary
+	// the values the handler added to the Vary header.
+	ContentEncoding string   `bson:"contentEncoding,omitempty"`
+	Vary            []string `bson:"vary,omitempty"`
+}
+
+// IdempotencyStore keeps the idempotency records, see Idempotency.
+type IdempotencyStore interface {
+	// Reserve creates the record, or takes over the record of the same request whose lock
+	// expired. It returns nil once reserved, otherwise the record holding the key.
+	Reserve(ctx context.Context, rec IdempotencyRecord, now time.Time) (*IdempotencyRecord, error)
+	// Complete stores the response of the record reserved by its owner.
+	Complete(ctx context.Context, rec IdempotencyRecord) error
+	// Release deletes the record reserved by the owner and not completed, so that a retry executes again.
+	Release(ctx context.Context, key, owner string) error
+}
+
+// NewMemoryIdempotencyStore creates a store keeping the records in memory,
+// the keys are deduplicated per instance of the service.
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{records: make(map[string]IdempotencyRecord)}
+}
+
+// MemoryIdempotencyStore is the in-memory IdempotencyStore.
+type MemoryIdempotencyStore struct {
+	mu        sync.Mutex
+	records   map[string]IdempotencyRecord
+	lastSweep time.Time
+}
+
+func (s *MemoryIdempotencyStore) Reserve(_ context.Context, rec IdempotencyRecord, now time.Time) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+
+	if existing, ok := s.records[rec.Key]; ok && now.Before(existing.ExpireAt) {
+		if existing.Done || now.Before(existing.LockedUntil) ||
+			existing.Method != rec.Method || existing.BodyHash != rec.BodyHash {
+			return &existing, nil
+		}
+	}
+	s.records[rec.Key] = rec
+	return nil, nil
+}
+
+func (s *MemoryIdempotencyStore) Complete(_ context.Context, rec IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.records[rec.Key]; !ok || existing.Owner != rec.Owner {
+		return fmt.Errorf("idempotency key %s is not reserved by %s", rec.Key, rec.Owner)
+	}
+	rec.Done = true
+	s.records[rec.Key] = rec
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) Release(_ context.Context, key, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.records[key]; ok && existing.Owner == owner && !existing.Done {
+		delete(s.records, key)
+	}
+	return nil
+}
+
+// sweep removes the expired records, at most once per minute.
+func (s *MemoryIdempotencyStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < idempotencySweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for key, rec := range s.records {
+		if !now.Before(rec.ExpireAt) {
+			delete(s.records, key)
+		}
+	}
+}
+
+// NewMongoIdempotencyStore creates a store keeping the records in a MongoDB collection
+// (default "idempotency_keys"), shared by the instances of the service. The records
+// expire with a TTL index, created if missing.
+func NewMongoIdempotencyStore(ctx context.Context, conn *mongodb.Connection, collection ...string) (*MongoIdempotencyStore, error) {
+	s := &MongoIdempotencyStore{conn: conn, collection: defaultIdempotencyCollection}
+	if len(collection) > 0 && collection[0] != "" {
+		s.collection = collection[0]
+	}
+	err := conn.Write(ctx, func(db *mongo.Database) error {
+		_, err := db.Collection(s.collection).Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: "expireAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create idempotency TTL index: %w", err)
+	}
+	return s, nil
+}
+
+// MongoIdempotencyStore is the IdempotencyStore backed by MongoDB, the key is reserved by
+// the unique _id so that concurrent duplicates on several instances are serialized.
+type MongoIdempotencyStore struct {
+	conn       *mongodb.Connection
+	collection string
+}
+
+func (s *MongoIdempotencyStore) Reserve(ctx context.Context, rec IdempotencyRecord, now time.Time) (existing *IdempotencyRecord, err error) {
+	err = s.conn.Write(ctx, func(db *mongo.Database) error {
+		coll := db.Collection(s.collection)
+		// The record may expire or be released between the steps, the retry reserves it again
+		for attempt := 0; attempt < 2; attempt++ {
+			if _, err := coll.InsertOne(ctx, rec); err == nil {
+				existing = nil
+				return nil
+			} else if !mongo.IsDuplicateKeyError(err) {
+				return err
+			}
+
+			// Take over the same request whose owner did not complete in time, or expired
+			takeover := bson.D{
+				{Key: "_id", Value: rec.Key},
+				{Key: "$or", Value: bson.A{
+					bson.D{{Key: "expireAt", Value: bson.D{{Key: "$lte", Value: now}}}},
+					bson.D{
+						{Key: "done", Value: false},
+						{Key: "lockedUntil", Value: bson.D{{Key: "$lte", Value: now}}},
+						{Key: "method", Value: rec.Method},
+						{Key: "bodyHash", Value: rec.BodyHash},
+					},
+				}},
+			}
+			res, err := coll.ReplaceOne(ctx, takeover, rec)
+			if err != nil {
+				return err
+			}
+			if res.MatchedCount > 0 {
+				existing = nil
+				return nil
+			}
+
+			var found IdempotencyRecord
+			err = coll.FindOne(ctx, bson.D{{Key: "_id", Value: rec.Key}}).Decode(&found)
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			existing = &found
+			return nil
+		}
+		return fmt.Errorf("idempotency key %s could not be reserved", rec.Key)
+	})
+	return existing, err
+}
+
+func (s *MongoIdempotencyStore) Complete(ctx context.Context, rec IdempotencyRecord) error {
+	rec.Done = true
+	return s.conn.Write(ctx, func(db *mongo.Database) error {
+		res, err := db.Collection(s.collection).ReplaceOne(ctx,
+			bson.D{{Key: "_id", Value: rec.Key}, {Key: "owner", Value: rec.Owner}}, rec)
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 0 {
+			return fmt.Errorf("idempotency key %s is not reserved by %s", rec.Key, rec.Owner)
+		}
+		return nil
+	})
+}
+
+func (s *MongoIdempotencyStore) Release(ctx context.Context, key, owner string) error {
+	return s.conn.Write(ctx, func(db *mongo.Database) error {
+		_, err := db.Collection(s.collection).DeleteOne(ctx, bson.D{
+			{Key: "_id", Value: key},
+			{Key: "owner", Value: owner},
+			{Key: "done", Value: false},
+		})
+		return err
+	})
+}
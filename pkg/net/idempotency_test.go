@@ -0,0 +1,231 @@
+package net
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// idempotentRequest serves a POST with the Idempotency-Key header, a panic of the handler is recovered.
+func idempotentRequest(handler http.Handler, remoteAddr, key, body string) (w *httptest.ResponseRecorder, panicked bool) {
+	r := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body))
+	r.RemoteAddr = remoteAddr
+	r.Header.Set(headerIdempotencyKey, key)
+	w = httptest.NewRecorder()
+	defer func() {
+		panicked = recover() != nil
+	}()
+	handler.ServeHTTP(w, r)
+	return w, false
+}
+
+func Test_IdempotencyMiddleware(t *testing.T) {
+	var calls atomic.Int32
+	var fail atomic.Bool
+	idempotency := NewIdempotency(NewMemoryIdempotencyStore())
+	handler := idempotency.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		if fail.Load() {
+			panic("handler failed")
+		}
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set(headerContentType, "text/plain")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte{byte('0' + n)})
+	}))
+
+	t.Run("replay", func(t *testing.T) {
+		calls.Store(0)
+		first, _ := idempotentRequest(handler, "10.0.0.1:1", "replay", "a")
+		retry, _ := idempotentRequest(handler, "10.0.0.1:1", "replay", "a")
+		if calls.Load() != 1 {
+			t.Fatalf("handler called %d times", calls.Load())
+		}
+		if retry.Code != http.StatusCreated || retry.Body.String() != first.Body.String() ||
+			retry.Header().Get(xIdempotentReplayed) != "true" || retry.Header().Get(headerContentType) != "text/plain" {
+			t.Fatalf("retry %d %q %v, first %q", retry.Code, retry.Body.String(), retry.Header(), first.Body.String())
+		}
+	})
+
+	t.Run("reused with another body", func(t *testing.T) {
+		calls.Store(0)
+		_, _ = idempotentRequest(handler, "10.0.0.1:1", "reused", "a")
+		w, _ := idempotentRequest(handler, "10.0.0.1:1", "reused", "b")
+		if w.Code != http.StatusUnprocessableEntity || calls.Load() != 1 {
+			t.Fatalf("status %d, handler called %d times", w.Code, calls.Load())
+		}
+	})
+
+	t.Run("concurrent duplicates", func(t *testing.T) {
+		calls.Store(0)
+		var wg sync.WaitGroup
+		bodies := make([]string, 5)
+		for n := range bodies {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w, _ := idempotentRequest(handler, "10.0.0.1:1", "concurrent", "a")
+				if w.Code == http.StatusCreated {
+					bodies[n] = w.Body.String()
+				}
+			}()
+		}
+		wg.Wait()
+		if calls.Load() != 1 {
+			t.Fatalf("handler called %d times", calls.Load())
+		}
+		for _, body := range bodies {
+			if body != "1" {
+				t.Fatalf("replies %q, want the reply of the first request", bodies)
+			}
+		}
+	})
+
+	t.Run("panic releases the key", func(t *testing.T) {
+		calls.Store(0)
+		fail.Store(true)
+		if _, panicked := idempotentRequest(handler, "10.0.0.1:1", "panic", "a"); !panicked {
+			t.Fatalf("handler did not panic")
+		}
+		fail.Store(false)
+		w, _ := idempotentRequest(handler, "10.0.0.1:1", "panic", "a")
+		if w.Code != http.StatusCreated || w.Header().Get(xIdempotentReplayed) != "" || calls.Load() != 2 {
+			t.Fatalf("retry %d %v, handler called %d times", w.Code, w.Header(), calls.Load())
+		}
+	})
+
+	t.Run("scoped by caller", func(t *testing.T) {
+		calls.Store(0)
+		_, _ = idempotentRequest(handler, "10.0.0.1:1", "scoped", "a")
+		// Another caller uses the same key for another body
+		w, _ := idempotentRequest(handler, "10.0.0.2:1", "scoped", "b")
+		if w.Code != http.StatusCreated || calls.Load() != 2 {
+			t.Fatalf("status %d, handler called %d times", w.Code, calls.Load())
+		}
+		// X-Client-Id is not verified, it does not change the scope
+		r := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader("b"))
+		r.RemoteAddr = "10.0.0.1:1"
+		r.Header.Set(headerIdempotencyKey, "scoped")
+		r.Header.Set(xApiClientId, "someone-else")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		if rec.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("spoofed client id status %d", rec.Code)
+		}
+	})
+}
+
+func Test_IdempotencyMiddlewareCompressed(t *testing.T) {
+	var calls atomic.Int32
+	large := wrapperspb.String(strings.Repeat("gopher ", 512))
+	handler := NewIdempotency(NewMemoryIdempotencyStore()).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		_ = Write(w, r, http.StatusCreated, large)
+	}))
+	// A stage before the idempotency adds its own Vary value
+	handler = func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add(corsVaryHeader, corsOriginHeader)
+			next.ServeHTTP(w, r)
+		})
+	}(handler)
+	call := func(acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader("a"))
+		r.Header.Set(headerIdempotencyKey, "compressed")
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	first := call("br")
+	if first.Header().Get("Content-Encoding") != encodingBrotli {
+		t.Fatalf("first reply headers %v, want a brotli body", first.Header())
+	}
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		wantEncoding   string
+	}{
+		{name: "same encoding", acceptEncoding: "br, gzip", wantEncoding: encodingBrotli},
+		{name: "other encoding", acceptEncoding: "gzip", wantEncoding: encodingGzip},
+		{name: "no compression", acceptEncoding: "", wantEncoding: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := call(tt.acceptEncoding)
+			if w.Code != http.StatusCreated || w.Header().Get(xIdempotentReplayed) != "true" ||
+				w.Header().Get("Content-Encoding") != tt.wantEncoding {
+				t.Fatalf("replay %d %v", w.Code, w.Header())
+			}
+			if got := strings.Join(w.Header().Values(corsVaryHeader), ","); got != strings.Join(first.Header().Values(corsVaryHeader), ",") {
+				t.Fatalf("replay Vary %q, first %q", got, first.Header().Values(corsVaryHeader))
+			}
+			body := w.Body.Bytes()
+			if tt.wantEncoding != "" {
+				var err error
+				if body, err = decompress(tt.wantEncoding, body); err != nil {
+					t.Fatalf("decompress err: %v", err)
+				}
+			}
+			var reply wrapperspb.StringValue
+			if err := protojson.Unmarshal(body, &reply); err != nil || !proto.Equal(&reply, large) {
+				t.Fatalf("replayed body %q, err: %v", body, err)
+			}
+		})
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("handler called %d times", calls.Load())
+	}
+}
+
+func Test_IdempotencyUnaryServerInterceptor(t *testing.T) {
+	var calls atomic.Int32
+	interceptor := NewIdempotency(NewMemoryIdempotencyStore()).UnaryServerInterceptor()
+	info := &grpc.UnaryServerInfo{FullMethod: "/hello.HelloService/SayHello"}
+	handler := func(ctx context.Context, req any) (any, error) {
+		if calls.Add(1) == 1 {
+			panic("handler failed")
+		}
+		return wrapperspb.String("hello " + req.(*wrapperspb.StringValue).GetValue()), nil
+	}
+	call := func(value string) (resp any, err error) {
+		defer func() {
+			if recover() != nil {
+				err = status.Error(codes.Internal, "panic")
+			}
+		}()
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(headerIdempotencyKey, "grpc"))
+		return interceptor(ctx, wrapperspb.String(value), info, handler)
+	}
+
+	// The panic releases the key, the retry executes the call, the next one is replayed
+	if _, err := call("gopher"); status.Code(err) != codes.Internal {
+		t.Fatalf("first call err: %v", err)
+	}
+	for range 2 {
+		resp, err := call("gopher")
+		if err != nil || !proto.Equal(resp.(proto.Message), wrapperspb.String("hello gopher")) {
+			t.Fatalf("call: %v, %v", resp, err)
+		}
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("handler called %d times", calls.Load())
+	}
+	if _, err := call("other"); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("reused key err: %v", err)
+	}
+}
@@ -0,0 +1,299 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/weeback/grpc-project-template/pkg/logger"
+	"github.com/weeback/grpc-project-template/pkg/metric"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+const (
+	// defaultShutdownTimeout is a bit lower than the 10 seconds Cloud Run waits
+	// between SIGTERM and SIGKILL.
+	defaultShutdownTimeout = 8 * time.Second
+)
+
+// LifecycleOption configures a Lifecycle.
+type LifecycleOption func(l *Lifecycle)
+
+// WithGRPCServer lets the lifecycle drain and stop the gRPC server on shutdown.
+func WithGRPCServer(inst *grpc.Server) LifecycleOption {
+	return func(l *Lifecycle) {
+		l.grpc = inst
+	}
+}
+
+// WithHub lets the lifecycle close the websocket clients of the hub on shutdown.
+// If not set, the global hub used by UpgradeToWebSocket is closed when it exists.
+func WithHub(hub *Hub) LifecycleOption {
+	return func(l *Lifecycle) {
+		l.hub = hub
+	}
+}
+
+// WithHealth sets every service of the health registry NOT_SERVING when the shutdown
+// starts, so that the probes fail and the load balancers stop routing new calls.
+func WithHealth(registry *HealthRegistry) LifecycleOption {
+	return func(l *Lifecycle) {
+		l.health = registry
+	}
+}
+
+// WithMonitoring flushes the cached metrics of the monitoring client on shutdown.
+func WithMonitoring(m metric.Monitoring) LifecycleOption {
+	return func(l *Lifecycle) {
+		l.monitoring = m
+	}
+}
+
+// WithShutdownTimeout sets the deadline to drain in-flight requests and flush resources.
+func WithShutdownTimeout(d time.Duration) LifecycleOption {
+	return func(l *Lifecycle) {
+		if d > 0 {
+			l.shutdownTimeout = d
+		}
+	}
+}
+
+// WithSignals replaces the signals trapped to start the shutdown (default SIGINT, SIGTERM).
+func WithSignals(sig ...os.Signal) LifecycleOption {
+	return func(l *Lifecycle) {
+		if len(sig) > 0 {
+			l.signals = sig
+		}
+	}
+}
+
+// OnShutdown registers a function called after the servers are stopped,
+// e.g. to disconnect the database. Functions are called in registration order.
+func OnShutdown(fn func(ctx context.Context) error) LifecycleOption {
+	return func(l *Lifecycle) {
+		if fn != nil {
+			l.finalizers = append(l.finalizers, fn)
+		}
+	}
+}
+
+// NewLifecycle creates a lifecycle manager owning the given HTTP server.
+// The server handler is wrapped to keep track of in-flight requests (including
+// gRPC calls and websocket connections served through MixHttp2).
+//
+// Example usage:
+//
+//	server := net.HttpServerWithConfig(":8080", mixed)
+//	lc := net.NewLifecycle(server, net.WithGRPCServer(inst), net.WithShutdownTimeout(8*time.Second))
+//	if err := lc.ListenAndServe(); err != nil {
+//		log.Fatal(err)
+//	}
+func NewLifecycle(server *http.Server, opts ...LifecycleOption) *Lifecycle {
+	l := &Lifecycle{
+		server:          server,
+		shutdownTimeout: defaultShutdownTimeout,
+		signals:         []os.Signal{syscall.SIGINT, syscall.SIGTERM},
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	server.Handler = l.track(server.Handler)
+	return l
+}
+
+// Lifecycle owns the HTTP server, the gRPC server and the websocket hub,
+// and stops them gracefully when the process receives a termination signal.
+type Lifecycle struct {
+	server         *http.Server
+	listenAndServe func() error // set by Server.Lifecycle to listen on several addresses
+	grpc           *grpc.Server
+	hub            *Hub
+	health         *HealthRegistry
+	monitoring     metric.Monitoring
+	finalizers     []func(ctx context.Context) error
+
+	shutdownTimeout time.Duration
+	signals         []os.Signal
+
+	mu           sync.RWMutex
+	draining     bool
+	inflight     sync.WaitGroup
+	shutdownOnce sync.Once
+	shutdownErr  error
+}
+
+// track counts in-flight requests and rejects new ones once the shutdown started.
+// h2c connections are hijacked from the http.Server, so Shutdown alone does not wait for them.
+func (l *Lifecycle) track(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The read lock guarantees no request is added once the drain started
+		l.mu.RLock()
+		if l.draining {
+			l.mu.RUnlock()
+			rejectDraining(w, r)
+			return
+		}
+		l.inflight.Add(1)
+		l.mu.RUnlock()
+		defer l.inflight.Done()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// rejectDraining answers a request received during the shutdown,
+// with a trailers-only UNAVAILABLE status for gRPC or 503 for REST.
+func rejectDraining(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.Header.Get(headerContentType), "application/grpc") {
+		w.Header().Set(headerContentType, "application/grpc")
+		w.Header().Set("Grpc-Status", "14") // codes.Unavailable
+		w.Header().Set("Grpc-Message", "server is shutting down")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.Header().Set("Connection", "close")
+	WriteError(w, http.StatusServiceUnavailable, fmt.Errorf("server is shutting down"))
+}
+
+// ListenAndServe starts the HTTP server and blocks until it fails or one of the
+// trapped signals is received, then runs Shutdown within the configured deadline.
+// The server serves TLS when its TLSConfig is set (see HttpServerWithTLS).
+func (l *Lifecycle) ListenAndServe() error {
+	if l.listenAndServe != nil {
+		return l.serve(l.listenAndServe)
+	}
+	if l.server.TLSConfig != nil {
+		return l.serve(func() error {
+			return l.server.ListenAndServeTLS("", "")
+		})
+	}
+	return l.serve(l.server.ListenAndServe)
+}
+
+func (l *Lifecycle) serve(serveFunc func() error) error {
+	ctx, stop := signal.NotifyContext(context.Background(), l.signals...)
+	defer stop()
+
+	errC := make(chan error, 1)
+	go func() {
+		if err := serveFunc(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errC <- err
+		}
+		close(errC)
+	}()
+
+	select {
+	case err, ok := <-errC:
+		if ok {
+			return err
+		}
+		return nil
+	case <-ctx.Done():
+		getLogEntry().Info("Shutdown signal received, draining connections",
+			zap.Duration("timeout", l.shutdownTimeout))
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), l.shutdownTimeout)
+	defer cancel()
+	return l.Shutdown(shutdownCtx)
+}
+
+// Shutdown stops accepting new connections, closes the websocket clients,
+// drains in-flight HTTP requests and gRPC calls, then flushes the metrics,
+// the finalizers and the logger. It is safe to call more than once.
+func (l *Lifecycle) Shutdown(ctx context.Context) error {
+	l.shutdownOnce.Do(func() {
+		l.shutdownErr = l.shutdown(ctx)
+	})
+	return l.shutdownErr
+}
+
+func (l *Lifecycle) shutdown(ctx context.Context) (err error) {
+	var (
+		entry     = getLogEntry()
+		startTime = time.Now()
+	)
+	if l.health != nil {
+		l.health.Shutdown()
+	}
+	l.mu.Lock()
+	l.draining = true
+	l.mu.Unlock()
+
+	// Close listeners and idle connections, wait for active non-hijacked connections
+	if ne := l.server.Shutdown(ctx); ne != nil {
+		err = errors.Join(err, fmt.Errorf("http server shutdown: %w", ne))
+	}
+
+	// Websocket handlers return only when their client is gone
+	hub := l.hub
+	if hub == nil {
+		hub = hubInstance
+	}
+	if hub != nil {
+		if ne := hub.Shutdown(ctx); ne != nil {
+			err = errors.Join(err, ne)
+		}
+	}
+
+	// Wait for in-flight requests served over hijacked (h2c) connections
+	drained := make(chan struct{})
+	go func() {
+		l.inflight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = errors.Join(err, fmt.Errorf("in-flight requests not drained: %w", ctx.Err()))
+	}
+
+	// GracefulStop can only be called once no call is served through ServeHTTP,
+	// its handler transport does not support draining.
+	if l.grpc != nil {
+		select {
+		case <-drained:
+			stopped := make(chan struct{})
+			go func() {
+				l.grpc.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-ctx.Done():
+				l.grpc.Stop()
+			}
+		default:
+			l.grpc.Stop()
+		}
+	}
+
+	if l.monitoring != nil {
+		if ne := l.monitoring.Close(); ne != nil {
+			err = errors.Join(err, fmt.Errorf("monitoring close: %w", ne))
+		}
+	}
+	for _, fn := range l.finalizers {
+		if ne := fn(ctx); ne != nil {
+			err = errors.Join(err, ne)
+		}
+	}
+
+	if err != nil {
+		entry.Error("Server shutdown completed with errors",
+			zap.Duration("duration", time.Since(startTime)), zap.Error(err))
+	} else {
+		entry.Info("Server shutdown completed", zap.Duration("duration", time.Since(startTime)))
+	}
+	// Flush the logger at last, errors on stdout/stderr sync are not relevant
+	_ = logger.Sync()
+	return err
+}
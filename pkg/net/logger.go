@@ -88,7 +88,7 @@ func printLogApi(wc *ResponseWriter, r *http.Request, t time.Time) {
 		zap.String("hostname", hostname),
 		zap.String("remote_addr", r.RemoteAddr),
 		zap.String("method", r.Method),
-		zap.String("url", r.URL.String()),
+		zap.String("url", logger.RedactURL(r.URL)),
 		zap.String("status", wc.Status()),
 		zap.Int("status_code", wc.StatusCode()),
 		zap.String("duration", time.Since(t).String()),
@@ -0,0 +1,208 @@
+package net
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// minCompressSize is the body size under which compression is not worth it
+	minCompressSize = 1024
+
+	encodingBrotli = "br"
+	encodingGzip   = "gzip"
+)
+
+// WriteOption configures Write.
+type WriteOption func(o *writeOptions)
+
+type writeOptions struct {
+	json        protojson.MarshalOptions
+	compression bool
+}
+
+// UseProtoNames renders the proto fields with their original names (user_id)
+// instead of the lowerCamelCase JSON names (userId).
+func UseProtoNames() WriteOption {
+	return func(o *writeOptions) {
+		o.json.UseProtoNames = true
+	}
+}
+
+// EmitDefaults renders the proto fields with default values (0, "", false, empty lists).
+func EmitDefaults() WriteOption {
+	return func(o *writeOptions) {
+		o.json.EmitUnpopulated = true
+	}
+}
+
+// WithoutCompression disables the compression negotiated by Accept-Encoding.
+func WithoutCompression() WriteOption {
+	return func(o *writeOptions) {
+		o.compression = false
+	}
+}
+
+// Write writes v with the representation negotiated by the request: binary protobuf
+// when a proto message is written and Accept prefers application/x-protobuf, otherwise
+// JSON (protojson for proto messages, so Any, int64, enums and oneofs are canonical).
+// The body is compressed with brotli or gzip when accepted by Accept-Encoding.
+//
+// Example usage:
+//
+//	resp, err := h.service.SayHello(r.Context(), &request)
+//	...
+//	if err := net.Write(w, r, http.StatusOK, resp, net.EmitDefaults()); err != nil {
+//		getLoggerFromContext(r.Context()).Warn("Failed to write response", zap.Error(err))
+//	}
+func Write(w http.ResponseWriter, r *http.Request, httpStatus int, v interface{}, opts ...WriteOption) error {
+	// 499 (client closed request) has no status text but is valid
+	if httpStatus < 100 || httpStatus > 599 {
+		return fmt.Errorf("invalid http status code: %d", httpStatus)
+	}
+	o := writeOptions{compression: true}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var (
+		contentType string
+		data        []byte
+		err         error
+	)
+	msg, isProto := v.(proto.Message)
+	switch {
+	case isProto && acceptsProtobuf(r.Header.Get("Accept")):
+		contentType = contentTypeProtobuf
+		data, err = proto.Marshal(msg)
+	case isProto:
+		contentType = "application/json; charset=UTF-8"
+		data, err = o.json.Marshal(msg)
+	default:
+		contentType = "application/json; charset=UTF-8"
+		data, err = json.Marshal(v)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to marshal response: %w", err)
+	}
+
+	h := w.Header()
+	h.Set(headerContentType, contentType)
+	h.Add(corsVaryHeader, "Accept")
+	if o.compression {
+		h.Add(corsVaryHeader, "Accept-Encoding")
+		if encoding := negotiateEncoding(r.Header.Get("Accept-Encoding")); encoding != "" && len(data) >= minCompressSize {
+			if compressed, err := compress(encoding, data); err == nil {
+				data = compressed
+				h.Set("Content-Encoding", encoding)
+			}
+		}
+	}
+	h.Del("Content-Length")
+
+	w.WriteHeader(httpStatus)
+	_, err = w.Write(data)
+	return err
+}
+
+// acceptsProtobuf reports whether the Accept header prefers binary protobuf to JSON.
+func acceptsProtobuf(accept string) bool {
+	var protoQ, jsonQ float64
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, q := parseQuality(part)
+		switch mediaType {
+		case contentTypeProtobuf, "application/protobuf":
+			protoQ = max(protoQ, q)
+		case contentTypeJSON, "application/*", "*/*":
+			jsonQ = max(jsonQ, q)
+		}
+	}
+	return protoQ > 0 && protoQ > jsonQ
+}
+
+// negotiateEncoding returns the preferred encoding of Accept-Encoding, brotli
+// before gzip on equal quality, empty for no compression.
+func negotiateEncoding(acceptEncoding string) string {
+	var brQ, gzipQ, anyQ float64 = -1, -1, -1
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, q := parseQuality(part)
+		switch coding {
+		case encodingBrotli:
+			brQ = q
+		case encodingGzip, "x-gzip":
+			gzipQ = q
+		case "*":
+			anyQ = q
+		}
+	}
+	if brQ < 0 {
+		brQ = anyQ
+	}
+	if gzipQ < 0 {
+		gzipQ = anyQ
+	}
+	switch {
+	case brQ > 0 && brQ >= gzipQ:
+		return encodingBrotli
+	case gzipQ > 0:
+		return encodingGzip
+	}
+	return ""
+}
+
+// parseQuality parses an element of an Accept or Accept-Encoding header, e.g. "gzip;q=0.8".
+func parseQuality(part string) (string, float64) {
+	value, params, _ := strings.Cut(part, ";")
+	q := 1.0
+	for _, param := range strings.Split(params, ";") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+	}
+	return strings.ToLower(strings.TrimSpace(value)), q
+}
+
+func compress(encoding string, data []byte) ([]byte, error) {
+	var (
+		buf bytes.Buffer
+		zw  io.WriteCloser
+	)
+	if encoding == encodingBrotli {
+		zw = brotli.NewWriter(&buf)
+	} else {
+		zw = gzip.NewWriter(&buf)
+	}
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress decodes the data compressed by compress.
+func decompress(encoding string, data []byte) ([]byte, error) {
+	var zr io.Reader = brotli.NewReader(bytes.NewReader(data))
+	if encoding != encodingBrotli {
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		zr = gr
+	}
+	return io.ReadAll(zr)
+}
@@ -0,0 +1,70 @@
+package net
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/weeback/grpc-project-template/pkg/mongodb"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const defaultNonceCollection = "request_nonces"
+
+// NewMongoNonceStore creates a jwt.NonceStore keeping the nonces of the signed requests in a
+// MongoDB collection (default "request_nonces"), so that a request replayed on another instance
+// is rejected. The nonces expire with a TTL index, created if missing.
+func NewMongoNonceStore(ctx context.Context, conn *mongodb.Connection, collection ...string) (*MongoNonceStore, error) {
+	s := &MongoNonceStore{conn: conn, collection: defaultNonceCollection}
+	if len(collection) > 0 && collection[0] != "" {
+		s.collection = collection[0]
+	}
+	err := conn.Write(ctx, func(db *mongo.Database) error {
+		_, err := db.Collection(s.collection).Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: "expireAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create nonce TTL index: %w", err)
+	}
+	return s, nil
+}
+
+// MongoNonceStore is the jwt.NonceStore backed by MongoDB, a nonce is used once by the unique _id.
+type MongoNonceStore struct {
+	conn       *mongodb.Connection
+	collection string
+}
+
+func (s *MongoNonceStore) Use(ctx context.Context, keyId, nonce string, expireAt time.Time) (fresh bool, err error) {
+	err = s.conn.Write(ctx, func(db *mongo.Database) error {
+		_, err := db.Collection(s.collection).InsertOne(ctx, bson.D{
+			{Key: "_id", Value: keyId + "|" + nonce},
+			{Key: "expireAt", Value: expireAt},
+		})
+		switch {
+		case err == nil:
+			fresh = true
+			return nil
+		case mongo.IsDuplicateKeyError(err):
+			// The TTL monitor may not have removed an expired nonce yet
+			res, err := db.Collection(s.collection).UpdateOne(ctx, bson.D{
+				{Key: "_id", Value: keyId + "|" + nonce},
+				{Key: "expireAt", Value: bson.D{{Key: "$lte", Value: time.Now()}}},
+			}, bson.D{{Key: "$set", Value: bson.D{{Key: "expireAt", Value: expireAt}}}})
+			if err != nil {
+				return err
+			}
+			fresh = res.ModifiedCount > 0
+			return nil
+		default:
+			return err
+		}
+	})
+	return fresh, err
+}
@@ -0,0 +1,346 @@
+package net
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/weeback/grpc-project-template/pkg/jwt"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/alts"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+type rateLimitedContextKey struct{}
+
+// RateAlgorithm is the algorithm used to count the requests of a caller.
+type RateAlgorithm int
+
+const (
+	// TokenBucket allows bursts up to Burst requests, refilled at Requests per Window.
+	TokenBucket RateAlgorithm = iota
+	// SlidingWindow allows Requests per Window, the previous window counts prorated.
+	SlidingWindow
+)
+
+// RateLimit is the rate allowed to a caller, a zero Requests means no limit.
+type RateLimit struct {
+	Requests  int
+	Window    time.Duration
+	Burst     int // token bucket capacity, default is Requests
+	Algorithm RateAlgorithm
+}
+
+func (rl RateLimit) unlimited() bool {
+	return rl.Requests <= 0 || rl.Window <= 0
+}
+
+func (rl RateLimit) burst() int {
+	if rl.Burst > 0 {
+		return rl.Burst
+	}
+	return rl.Requests
+}
+
+// RateDecision is the result of a request counted by a store.
+type RateDecision struct {
+	Allowed bool
+	// RetryAfter is the delay before the next request is allowed, when not allowed
+	RetryAfter time.Duration
+}
+
+// RateLimitStore counts the requests of each key. It must be safe for concurrent use,
+// and shared by the instances of the service to enforce a global limit.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateDecision, error)
+}
+
+// RateCaller describes the caller of a REST request or a gRPC call, for the key functions.
+type RateCaller struct {
+	Context    context.Context
+	RemoteAddr string
+	header     func(key string) string
+}
+
+// Header returns the value of the request header (or gRPC metadata).
+func (c *RateCaller) Header(key string) string {
+	return c.header(key)
+}
+
+// RateKeyFunc returns the key identifying the caller, empty to fall back on the next function.
+type RateKeyFunc func(c *RateCaller) string
+
+// KeyByClientId identifies the caller by the X-Client-Id header. The header is set by the
+// client and not verified, a client changing it escapes its limit: use it only behind
+// a gateway which sets it, prefer KeyByJWTUser and KeyByPeerServiceAccount.
+func KeyByClientId() RateKeyFunc {
+	return func(c *RateCaller) string {
+		if id := c.Header(xApiClientId); id != "" {
+			return "client:" + id
+		}
+		return ""
+	}
+}
+
+// KeyByJWTUser identifies the caller by the user id of the bearer JWT, verified with pub.
+func KeyByJWTUser(pub ed25519.PublicKey) RateKeyFunc {
+	return func(c *RateCaller) string {
+		token := strings.TrimPrefix(c.Header(headerAuthorization), "Bearer ")
+		if token == "" {
+			return ""
+		}
+		claims, err := jwt.ParseClaims(pub, token)
+		if err != nil || claims.UserId == "" {
+			return ""
+		}
+		return "user:" + claims.UserId
+	}
+}
+
+// KeyByPeerServiceAccount identifies the caller by its ALTS peer service account,
+// or its verified client certificate identity (mTLS).
+func KeyByPeerServiceAccount() RateKeyFunc {
+	return func(c *RateCaller) string {
+		if id, ok := PeerIdentityFromContext(c.Context); ok {
+			return "sa:" + id
+		}
+		if info, err := alts.AuthInfoFromContext(c.Context); err == nil {
+			return "sa:" + info.PeerServiceAccount()
+		}
+		return ""
+	}
+}
+
+// KeyByIP identifies the caller by its IP address. The trusted proxies in front of the service
+// append the address of their peer to X-Forwarded-For, the client writes the entries before them:
+// the caller is the entry appended by the first trusted proxy, the trustedProxies-th from the right
+// (1 on Cloud Run, its front end appends the client address). Without trusted proxies, or when
+// X-Forwarded-For has fewer entries, the caller is the remote address of the connection.
+func KeyByIP(trustedProxies int) RateKeyFunc {
+	return func(c *RateCaller) string {
+		if ip := forwardedFor(c.Header("X-Forwarded-For"), trustedProxies); ip != "" {
+			return "ip:" + ip
+		}
+		if host, _, err := net.SplitHostPort(c.RemoteAddr); err == nil {
+			return "ip:" + host
+		}
+		if c.RemoteAddr != "" {
+			return "ip:" + c.RemoteAddr
+		}
+		return ""
+	}
+}
+
+// forwardedFor returns the address appended to X-Forwarded-For by the first of the trusted proxies.
+func forwardedFor(fwd string, trustedProxies int) string {
+	if fwd == "" || trustedProxies <= 0 {
+		return ""
+	}
+	entries := strings.Split(fwd, ",")
+	if len(entries) < trustedProxies {
+		return ""
+	}
+	return strings.TrimSpace(entries[len(entries)-trustedProxies])
+}
+
+// RateLimiterOption configures a RateLimiter.
+type RateLimiterOption func(l *RateLimiter)
+
+// WithRateStore sets the store counting the requests, default is in memory (per instance).
+func WithRateStore(store RateLimitStore) RateLimiterOption {
+	return func(l *RateLimiter) {
+		if store != nil {
+			l.store = store
+		}
+	}
+}
+
+// WithRateKeys sets the functions identifying the caller, the first non-empty key is used.
+// Default is the peer service account, then the remote address of the connection.
+// The keys must not be chosen by the caller, see KeyByClientId.
+func WithRateKeys(keys ...RateKeyFunc) RateLimiterOption {
+	return func(l *RateLimiter) {
+		if len(keys) > 0 {
+			l.keys = keys
+		}
+	}
+}
+
+// WithMethodLimit sets the limit of a gRPC method ("/package.Service/Method") or a REST
+// route ("POST /say-hello", with the route path template), counted apart from the default limit.
+func WithMethodLimit(method string, limit RateLimit) RateLimiterOption {
+	return func(l *RateLimiter) {
+		l.methods[method] = limit
+	}
+}
+
+// NewRateLimiter creates a rate limiter applying the default limit to every caller.
+//
+// Example usage:
+//
+//	limiter := net.NewRateLimiter(net.RateLimit{Requests: 100, Window: time.Minute},
+//		net.WithRateKeys(net.KeyByJWTUser(keyPair.PublicKey), net.KeyByPeerServiceAccount(), net.KeyByIP(1)),
+//		net.WithMethodLimit("/hello.HelloService/SayHello", net.RateLimit{
+//			Requests: 10, Window: time.Second, Algorithm: net.SlidingWindow}),
+//	)
+//	net.Use(router, limiter.Stage())
+//	inst := grpc.NewServer(
+//		grpc.ChainUnaryInterceptor(limiter.UnaryServerInterceptor()),
+//		grpc.ChainStreamInterceptor(limiter.StreamServerInterceptor()),
+//	)
+func NewRateLimiter(limit RateLimit, opts ...RateLimiterOption) *RateLimiter {
+	l := &RateLimiter{
+		limit:   limit,
+		methods: make(map[string]RateLimit),
+		keys:    []RateKeyFunc{KeyByPeerServiceAccount(), KeyByIP(0)},
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if l.store == nil {
+		l.store = NewMemoryRateLimitStore()
+	}
+	return l
+}
+
+// RateLimiter limits the request rate of each caller, for REST routes and gRPC calls.
+type RateLimiter struct {
+	store   RateLimitStore
+	keys    []RateKeyFunc
+	limit   RateLimit
+	methods map[string]RateLimit
+}
+
+// take counts the request of the caller, the store errors let the request pass.
+func (l *RateLimiter) take(caller *RateCaller, method string) RateDecision {
+	limit, bucket := l.limit, "*"
+	if ml, ok := l.methods[method]; ok {
+		limit, bucket = ml, method
+	}
+	if limit.unlimited() {
+		return RateDecision{Allowed: true}
+	}
+
+	key := callerKey(l.keys, caller)
+
+	decision, err := l.store.Take(caller.Context, key+"|"+bucket, limit, time.Now())
+	if err != nil {
+		getLoggerFromContext(caller.Context).Warn("Rate limit store failed, request allowed",
+			zap.String("key", key), zap.String("method", method), zap.Error(err))
+		return RateDecision{Allowed: true}
+	}
+	if !decision.Allowed {
+		getLoggerFromContext(caller.Context).Warn("Rate limit exceeded",
+			zap.String("key", key), zap.String("method", method),
+			zap.Duration("retry_after", decision.RetryAfter))
+	}
+	return decision
+}
+
+// Stage returns the limiter as a middleware stage, see Use and Attach.
+func (l *RateLimiter) Stage() Stage {
+	return NewStage("rate-limit", l.Middleware)
+}
+
+// Middleware answers 429 Too Many Requests with Retry-After to the callers over their limit.
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := r.Method + " " + r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil {
+				method = r.Method + " " + tmpl
+			}
+		}
+		caller := &RateCaller{Context: r.Context(), RemoteAddr: r.RemoteAddr, header: r.Header.Get}
+		if decision := l.take(caller, method); !decision.Allowed {
+			retryAfter := retryAfterSeconds(decision.RetryAfter)
+			w.Header().Set("Retry-After", retryAfter)
+			WriteError(w, http.StatusTooManyRequests, fmt.Errorf("rate limit exceeded, retry after %s seconds", retryAfter))
+			return
+		}
+		// The gRPC call served in-process (transcoding) is not counted twice
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), rateLimitedContextKey{}, true)))
+	})
+}
+
+// UnaryServerInterceptor rejects the calls over the limit with RESOURCE_EXHAUSTED.
+func (l *RateLimiter) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := l.checkGRPC(ctx, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor rejects the streams over the limit with RESOURCE_EXHAUSTED,
+// a stream counts as one request.
+func (l *RateLimiter) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := l.checkGRPC(ss.Context(), info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+func (l *RateLimiter) checkGRPC(ctx context.Context, fullMethod string) error {
+	if limited, _ := ctx.Value(rateLimitedContextKey{}).(bool); limited {
+		return nil
+	}
+	decision := l.take(grpcCaller(ctx), fullMethod)
+	if decision.Allowed {
+		return nil
+	}
+	_ = grpc.SetHeader(ctx, metadata.Pairs("retry-after", retryAfterSeconds(decision.RetryAfter)))
+	st, err := status.New(codes.ResourceExhausted, "rate limit exceeded").
+		WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(decision.RetryAfter)})
+	if err != nil {
+		return status.Error(codes.ResourceExhausted, "rate limit exceeded")
+	}
+	return st.Err()
+}
+
+// grpcCaller describes the caller of the gRPC call, by its metadata and peer.
+func grpcCaller(ctx context.Context) *RateCaller {
+	md, _ := metadata.FromIncomingContext(ctx)
+	caller := &RateCaller{Context: ctx, header: func(key string) string {
+		if vv := md.Get(key); len(vv) > 0 {
+			return vv[0]
+		}
+		return ""
+	}}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		caller.RemoteAddr = p.Addr.String()
+	}
+	return caller
+}
+
+// callerKey returns the key of the first function identifying the caller, "anonymous" if none.
+func callerKey(keys []RateKeyFunc, caller *RateCaller) string {
+	for _, fn := range keys {
+		if key := fn(caller); key != "" {
+			return key
+		}
+	}
+	return "anonymous"
+}
+
+// retryAfterSeconds formats the delay for the Retry-After header, at least one second.
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(d.Seconds()))))
+}
@@ -0,0 +1,229 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/weeback/grpc-project-template/pkg/mongodb"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	defaultRateLimitCollection = "rate_limits"
+	rateLimitSweepInterval     = time.Minute
+)
+
+// NewMemoryRateLimitStore creates a store counting the requests in memory,
+// the limits apply per instance of the service.
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{entries: make(map[string]*rateEntry)}
+}
+
+// MemoryRateLimitStore is the in-memory RateLimitStore.
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	entries   map[string]*rateEntry
+	lastSweep time.Time
+}
+
+type rateEntry struct {
+	// token bucket
+	tokens float64
+	last   time.Time
+	// sliding window
+	windowStart time.Time
+	curr, prev  int
+
+	expireAt time.Time
+}
+
+func (s *MemoryRateLimitStore) Take(_ context.Context, key string, limit RateLimit, now time.Time) (RateDecision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+
+	e, ok := s.entries[key]
+	if !ok {
+		e = &rateEntry{tokens: float64(limit.burst()), last: now}
+		s.entries[key] = e
+	}
+	e.expireAt = now.Add(2 * limit.Window)
+
+	if limit.Algorithm == SlidingWindow {
+		start := now.Truncate(limit.Window)
+		if !e.windowStart.Equal(start) {
+			if start.Sub(e.windowStart) == limit.Window {
+				e.prev = e.curr
+			} else {
+				e.prev = 0
+			}
+			e.curr, e.windowStart = 0, start
+		}
+		// The rejected requests are counted too, as by MongoRateLimitStore
+		e.curr++
+		return slidingWindowDecision(limit, e.prev, e.curr, now.Sub(start)), nil
+	}
+
+	rate := float64(limit.Requests) / float64(limit.Window)
+	e.tokens = math.Min(float64(limit.burst()), e.tokens+float64(now.Sub(e.last))*rate)
+	e.last = now
+	if e.tokens >= 1 {
+		e.tokens--
+		return RateDecision{Allowed: true}, nil
+	}
+	return RateDecision{RetryAfter: time.Duration((1 - e.tokens) / rate)}, nil
+}
+
+// sweep removes the expired entries, at most once per minute.
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for key, e := range s.entries {
+		if now.After(e.expireAt) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// slidingWindowDecision estimates the requests of the last window, the previous
+// window counts prorated to the part still in the sliding window.
+func slidingWindowDecision(limit RateLimit, prev, curr int, elapsed time.Duration) RateDecision {
+	window := float64(limit.Window)
+	estimate := float64(prev)*(1-float64(elapsed)/window) + float64(curr)
+	if estimate <= float64(limit.Requests) {
+		return RateDecision{Allowed: true}
+	}
+	// Wait until the prorated previous window leaves room for the request,
+	// or the end of the current window when the current one is full
+	retry := limit.Window - elapsed
+	if prev > 0 && curr <= limit.Requests {
+		wait := time.Duration(window*(1-float64(limit.Requests-curr)/float64(prev))) - elapsed
+		retry = min(max(wait, 0), retry)
+	}
+	return RateDecision{RetryAfter: retry}
+}
+
+// NewMongoRateLimitStore creates a store counting the requests in a MongoDB collection
+// (default "rate_limits"), shared by the instances of the service. The documents expire
+// with a TTL index, created if missing.
+func NewMongoRateLimitStore(ctx context.Context, conn *mongodb.Connection, collection ...string) (*MongoRateLimitStore, error) {
+	s := &MongoRateLimitStore{conn: conn, collection: defaultRateLimitCollection}
+	if len(collection) > 0 && collection[0] != "" {
+		s.collection = collection[0]
+	}
+	err := conn.Write(ctx, func(db *mongo.Database) error {
+		_, err := db.Collection(s.collection).Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: "expireAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create rate limit TTL index: %w", err)
+	}
+	return s, nil
+}
+
+// MongoRateLimitStore is the RateLimitStore backed by MongoDB, each request is counted
+// with an atomic update so that concurrent instances share the same limit.
+type MongoRateLimitStore struct {
+	conn       *mongodb.Connection
+	collection string
+}
+
+func (s *MongoRateLimitStore) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (decision RateDecision, err error) {
+	err = s.conn.Write(ctx, func(db *mongo.Database) error {
+		coll := db.Collection(s.collection)
+		// Two concurrent upserts of a new key may conflict, the retry updates the created document
+		for attempt := 0; attempt < 2; attempt++ {
+			if limit.Algorithm == SlidingWindow {
+				decision, err = s.slidingWindow(ctx, coll, key, limit, now)
+			} else {
+				decision, err = s.tokenBucket(ctx, coll, key, limit, now)
+			}
+			if !mongo.IsDuplicateKeyError(err) {
+				break
+			}
+		}
+		return err
+	})
+	return decision, err
+}
+
+func (s *MongoRateLimitStore) tokenBucket(ctx context.Context, coll *mongo.Collection, key string, limit RateLimit, now time.Time) (RateDecision, error) {
+	var (
+		capacity  = float64(limit.burst())
+		ratePerMs = float64(limit.Requests) / float64(limit.Window.Milliseconds())
+		nowMs     = now.UnixMilli()
+	)
+	// Refill the bucket since the last request, then take a token if available
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.D{
+			{Key: "tokens", Value: bson.D{{Key: "$min", Value: bson.A{capacity, bson.D{{Key: "$add", Value: bson.A{
+				bson.D{{Key: "$ifNull", Value: bson.A{"$tokens", capacity}}},
+				bson.D{{Key: "$multiply", Value: bson.A{ratePerMs, bson.D{{Key: "$max", Value: bson.A{0,
+					bson.D{{Key: "$subtract", Value: bson.A{nowMs, bson.D{{Key: "$ifNull", Value: bson.A{"$ts", nowMs}}}}}},
+				}}}}}},
+			}}}}}}},
+			{Key: "ts", Value: nowMs},
+		}}},
+		{{Key: "$set", Value: bson.D{{Key: "allowed", Value: bson.D{{Key: "$gte", Value: bson.A{"$tokens", 1}}}}}}},
+		{{Key: "$set", Value: bson.D{
+			{Key: "tokens", Value: bson.D{{Key: "$cond", Value: bson.A{"$allowed",
+				bson.D{{Key: "$subtract", Value: bson.A{"$tokens", 1}}}, "$tokens"}}}},
+			{Key: "expireAt", Value: now.Add(2 * limit.Window)},
+		}}},
+	}
+	var doc struct {
+		Tokens  float64 `bson:"tokens"`
+		Allowed bool    `bson:"allowed"`
+	}
+	err := coll.FindOneAndUpdate(ctx, bson.D{{Key: "_id", Value: key}}, update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&doc)
+	if err != nil {
+		return RateDecision{}, err
+	}
+	if doc.Allowed {
+		return RateDecision{Allowed: true}, nil
+	}
+	return RateDecision{RetryAfter: time.Duration((1-doc.Tokens)/ratePerMs) * time.Millisecond}, nil
+}
+
+func (s *MongoRateLimitStore) slidingWindow(ctx context.Context, coll *mongo.Collection, key string, limit RateLimit, now time.Time) (RateDecision, error) {
+	start := now.Truncate(limit.Window)
+	windowKey := func(t time.Time) string {
+		return fmt.Sprintf("%s|%d", key, t.UnixMilli())
+	}
+
+	var curr struct {
+		Count int `bson:"count"`
+	}
+	err := coll.FindOneAndUpdate(ctx, bson.D{{Key: "_id", Value: windowKey(start)}},
+		bson.D{
+			{Key: "$inc", Value: bson.D{{Key: "count", Value: 1}}},
+			{Key: "$set", Value: bson.D{{Key: "expireAt", Value: start.Add(2 * limit.Window)}}},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&curr)
+	if err != nil {
+		return RateDecision{}, err
+	}
+
+	var prev struct {
+		Count int `bson:"count"`
+	}
+	err = coll.FindOne(ctx, bson.D{{Key: "_id", Value: windowKey(start.Add(-limit.Window))}}).Decode(&prev)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return RateDecision{}, err
+	}
+	// The rejected requests are counted too, a caller retrying too early stays limited
+	return slidingWindowDecision(limit, prev.Count, curr.Count, now.Sub(start)), nil
+}
@@ -0,0 +1,167 @@
+package net
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/weeback/grpc-project-template/pkg/jwt"
+	"github.com/weeback/grpc-project-template/pkg/mongodb"
+)
+
+// testMongoConnection connects to the MongoDB of MONGODB_TEST_URI, the test is skipped without it.
+func testMongoConnection(t *testing.T) *mongodb.Connection {
+	t.Helper()
+	uri := os.Getenv("MONGODB_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGODB_TEST_URI not set")
+	}
+	conn, err := mongodb.NewConnection(context.Background(), uri)
+	if err != nil {
+		t.Fatalf("NewConnection err: %v", err)
+	}
+	return conn
+}
+
+func Test_KeyByIP(t *testing.T) {
+	tests := []struct {
+		name           string
+		forwardedFor   string
+		trustedProxies int
+		want           string
+	}{
+		{name: "no proxy", want: "ip:10.0.0.1"},
+		{name: "untrusted header", forwardedFor: "1.1.1.1", want: "ip:10.0.0.1"},
+		{name: "cloud run", forwardedFor: "203.0.113.7", trustedProxies: 1, want: "ip:203.0.113.7"},
+		{name: "spoofed entries", forwardedFor: "1.1.1.1, 2.2.2.2, 203.0.113.7", trustedProxies: 1, want: "ip:203.0.113.7"},
+		{name: "two proxies", forwardedFor: "1.1.1.1, 203.0.113.7, 10.1.0.2", trustedProxies: 2, want: "ip:203.0.113.7"},
+		{name: "fewer entries than proxies", forwardedFor: "203.0.113.7", trustedProxies: 2, want: "ip:10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caller := &RateCaller{RemoteAddr: "10.0.0.1:5555", header: func(key string) string {
+				if key == "X-Forwarded-For" {
+					return tt.forwardedFor
+				}
+				return ""
+			}}
+			if got := KeyByIP(tt.trustedProxies)(caller); got != tt.want {
+				t.Errorf("KeyByIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_KeyByJWTUser(t *testing.T) {
+	keyPair, _ := jwt.GenerateKeyPair()
+	other, _ := jwt.GenerateKeyPair()
+	valid, _ := jwt.SignWithClaims(keyPair.PrivateKey, nil, jwt.NewOption().SetUserId("alice"))
+	forged, _ := jwt.SignWithClaims(other.PrivateKey, nil, jwt.NewOption().SetUserId("alice"))
+
+	tests := []struct {
+		name          string
+		authorization string
+		want          string
+	}{
+		{name: "verified", authorization: "Bearer " + valid, want: "user:alice"},
+		{name: "forged", authorization: "Bearer " + forged, want: ""},
+		{name: "missing", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caller := &RateCaller{header: func(key string) string {
+				if key == headerAuthorization {
+					return tt.authorization
+				}
+				return ""
+			}}
+			if got := KeyByJWTUser(keyPair.PublicKey)(caller); got != tt.want {
+				t.Errorf("KeyByJWTUser() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_RateLimiterSpoofedClientId(t *testing.T) {
+	limiter := NewRateLimiter(RateLimit{Requests: 2, Window: time.Minute})
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// A new X-Client-Id and X-Forwarded-For on every request do not reset the limit
+	var codes []int
+	for _, id := range []string{"a", "b", "c"} {
+		r := httptest.NewRequest(http.MethodGet, "/hello", nil)
+		r.RemoteAddr = "10.0.0.1:5555"
+		r.Header.Set(xApiClientId, id)
+		r.Header.Set("X-Forwarded-For", id+".example")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		codes = append(codes, w.Code)
+	}
+	if codes[0] != http.StatusOK || codes[1] != http.StatusOK || codes[2] != http.StatusTooManyRequests {
+		t.Fatalf("status codes %v, want [200 200 429]", codes)
+	}
+}
+
+func Test_MemoryRateLimitStore(t *testing.T) {
+	testRateLimitStore(t, NewMemoryRateLimitStore())
+}
+
+func Test_MongoRateLimitStore(t *testing.T) {
+	conn := testMongoConnection(t)
+	store, err := NewMongoRateLimitStore(context.Background(), conn, "rate_limits_test")
+	if err != nil {
+		t.Fatalf("NewMongoRateLimitStore err: %v", err)
+	}
+	testRateLimitStore(t, store)
+}
+
+// testRateLimitStore checks the windows of the store, the stores must agree.
+func testRateLimitStore(t *testing.T, store RateLimitStore) {
+	ctx := context.Background()
+	start := time.Unix(1_700_000_000, 0)
+
+	t.Run("token bucket", func(t *testing.T) {
+		key := uuid.NewString()
+		limit := RateLimit{Requests: 2, Window: time.Second, Burst: 2}
+		for i, want := range []bool{true, true, false} {
+			d, err := store.Take(ctx, key, limit, start)
+			if err != nil || d.Allowed != want {
+				t.Fatalf("take %d: %+v, %v, want allowed %v", i, d, err, want)
+			}
+		}
+		// One token is refilled every 500ms, the rejected request took none
+		if d, _ := store.Take(ctx, key, limit, start.Add(400*time.Millisecond)); d.Allowed || d.RetryAfter <= 0 || d.RetryAfter > 500*time.Millisecond {
+			t.Fatalf("take before refill: %+v", d)
+		}
+		if d, _ := store.Take(ctx, key, limit, start.Add(500*time.Millisecond)); !d.Allowed {
+			t.Fatalf("take after refill: %+v", d)
+		}
+	})
+
+	t.Run("sliding window", func(t *testing.T) {
+		key := uuid.NewString()
+		limit := RateLimit{Requests: 3, Window: time.Second, Algorithm: SlidingWindow}
+		for i, want := range []bool{true, true, true, false, false} {
+			d, err := store.Take(ctx, key, limit, start.Add(time.Duration(i)*time.Millisecond))
+			if err != nil || d.Allowed != want {
+				t.Fatalf("take %d: %+v, %v, want allowed %v", i, d, err, want)
+			}
+			if !want && (d.RetryAfter <= 0 || d.RetryAfter > limit.Window) {
+				t.Fatalf("take %d: retry after %v", i, d.RetryAfter)
+			}
+		}
+		// The 5 requests of the previous window, rejected ones included, still count prorated
+		if d, _ := store.Take(ctx, key, limit, start.Add(1500*time.Millisecond)); d.Allowed {
+			t.Fatalf("take in the next window: %+v", d)
+		}
+		// Two windows later the previous window is empty
+		if d, _ := store.Take(ctx, key, limit, start.Add(3*time.Second)); !d.Allowed {
+			t.Fatalf("take two windows later: %+v", d)
+		}
+	})
+}
@@ -0,0 +1,165 @@
+package net
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/weeback/grpc-project-template/pkg/metric"
+
+	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// panicMetric is the metric incremented on each recovered panic, labelled by method
+	panicMetric = "panics"
+
+	panicKindGRPC      = "grpc"
+	panicKindHTTP      = "http"
+	panicKindWebsocket = "websocket"
+)
+
+var (
+	panicTableMu sync.RWMutex
+	panicTable   metric.Table
+)
+
+// SetPanicMetrics sets the metric table counting the recovered panics of the gRPC calls,
+// the HTTP routes and the websocket clients, nil disables the metric.
+//
+// Example usage:
+//
+//	mm, _ := metric.NewMonitoringMetric(projectID, credentialsJSON)
+//	net.SetPanicMetrics(mm.NewTable("recovery", map[string]string{"service": "hello"}))
+func SetPanicMetrics(tb metric.Table) {
+	panicTableMu.Lock()
+	defer panicTableMu.Unlock()
+	panicTable = tb
+}
+
+// reportPanic logs the recovered value with the stack trace, and increments the panic metric.
+func reportPanic(entry *zap.Logger, kind, method string, recovered any) {
+	entry.Error("Recovered from panic",
+		zap.String("kind", kind),
+		zap.String("method", method),
+		zap.String("panic", fmt.Sprint(recovered)),
+		zap.ByteString("stack", debug.Stack()))
+
+	panicTableMu.RLock()
+	tb := panicTable
+	panicTableMu.RUnlock()
+	if tb == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := tb.SendMetrics(ctx, kind+":"+method, map[string]*monitoringpb.TypedValue{
+			panicMetric: metric.Int64Point(1),
+		}); err != nil {
+			getLogEntry().Warn("Failed to send panic metric", zap.Error(err))
+		}
+	}()
+}
+
+// UnaryServerRecoveryInterceptor answers INTERNAL to the calls whose handler panics,
+// instead of crashing the process. It should be the first interceptor of the chain,
+// only preceded by the interceptor converting the errors sent to the clients.
+func UnaryServerRecoveryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				reportPanic(grpcPanicEntry(ctx), panicKindGRPC, info.FullMethod, recovered)
+				resp, err = nil, status.Error(codes.Internal, "internal error")
+			}
+		}()
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerRecoveryInterceptor is UnaryServerRecoveryInterceptor for the streams.
+func StreamServerRecoveryInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				reportPanic(grpcPanicEntry(ss.Context()), panicKindGRPC, info.FullMethod, recovered)
+				err = status.Error(codes.Internal, "internal error")
+			}
+		}()
+		return handler(srv, ss)
+	}
+}
+
+func grpcPanicEntry(ctx context.Context) *zap.Logger {
+	md, _ := metadata.FromIncomingContext(ctx)
+	entry := getLoggerFromContext(ctx)
+	if reqIDs := md.Get(xApiRequestId); len(reqIDs) > 0 {
+		entry = entry.With(zap.String("req_id", reqIDs[0]))
+	}
+	if clientIDs := md.Get(xApiClientId); len(clientIDs) > 0 {
+		entry = entry.With(zap.String("client_id", clientIDs[0]))
+	}
+	return entry
+}
+
+// RecoveryMiddleware answers 500 with the error body of WriteStatus to the requests
+// whose handler panics, instead of crashing the process. http.ErrAbortHandler is
+// panicked again, to abort the response as intended.
+func RecoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+			// The request logger of the logger stage carries the request id
+			entry := getLoggerFromContext(r.Context()).With(
+				zap.String("client_id", r.Header.Get(xApiClientId)))
+			reportPanic(entry, panicKindHTTP, r.Method+" "+r.URL.Path, recovered)
+			WriteStatus(w, r, http.StatusInternalServerError, status.New(codes.Internal, "internal error"))
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// guard runs fn for the client in the hub loop, a panic disconnects the client
+// and keeps the hub running for the other clients.
+func (h *Hub) guard(client *Client, op string, fn func()) {
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+		reportPanic(getLogEntry().With(zap.String("client_id", client.ID())), panicKindWebsocket, op, recovered)
+		delete(h.clients, client)
+		h.leaveRooms(client)
+		h.unindex(client)
+		if client.conn != nil {
+			_ = client.conn.Close()
+		}
+	}()
+	fn()
+}
+
+// recoverClient recovers a panic of a websocket pump of the client, which is disconnected.
+func (c *Client) recoverClient(pump string) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+	reportPanic(getLogEntry().With(zap.String("client_id", c.ID())), panicKindWebsocket, pump, recovered)
+	if c.conn != nil {
+		_ = c.conn.Close()
+	}
+}
@@ -0,0 +1,225 @@
+package net
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+const (
+	defaultCertReloadInterval = 10 * time.Second
+)
+
+type peerIdentityContextKey struct{}
+
+// TLSOption defines the certificate files used to serve TLS.
+type TLSOption struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile is an optional PEM bundle, when set mutual-TLS is enabled
+	// and client certificates are verified against it.
+	ClientCAFile string
+	// ClientAuth is the policy for client certificates when ClientCAFile is set,
+	// default is tls.RequireAndVerifyClientCert.
+	ClientAuth tls.ClientAuthType
+	// ReloadInterval is the minimum delay between two checks of the files
+	// modification time, default is 10 seconds.
+	ReloadInterval time.Duration
+}
+
+// HttpServerWithTLS creates an HTTP server like HttpServerWithConfig, serving TLS
+// with the given certificate files. HTTP/2 is negotiated via ALPN so gRPC and REST
+// still share the same port with MixHttp2. The certificates are reloaded when the
+// files change, without restarting the server.
+//
+// Use server.ListenAndServeTLS("", "") or a Lifecycle to start it.
+func HttpServerWithTLS(addr string, handler http.Handler, opt TLSOption) (*http.Server, error) {
+	tlsConfig, err := newTLSConfig(opt)
+	if err != nil {
+		return nil, err
+	}
+	server := HttpServerWithConfig(addr, handler)
+	server.TLSConfig = tlsConfig
+	if err := http2.ConfigureServer(server, &http2.Server{}); err != nil {
+		return nil, fmt.Errorf("failed to configure http2 server: %w", err)
+	}
+	return server, nil
+}
+
+// newTLSConfig returns a server TLS config resolving the certificates
+// (reloaded on change) for each client hello.
+func newTLSConfig(opt TLSOption) (*tls.Config, error) {
+	reloader, err := newCertReloader(opt)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		NextProtos:         []string{http2.NextProtoTLS, "http/1.1"},
+		GetConfigForClient: reloader.configForClient,
+	}, nil
+}
+
+func newCertReloader(opt TLSOption) (*certReloader, error) {
+	if opt.CertFile == "" || opt.KeyFile == "" {
+		return nil, fmt.Errorf("certificate and key files are required to serve TLS")
+	}
+	if opt.ReloadInterval <= 0 {
+		opt.ReloadInterval = defaultCertReloadInterval
+	}
+	if opt.ClientCAFile != "" && opt.ClientAuth == tls.NoClientCert {
+		opt.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	cr := &certReloader{opt: opt, modTime: make(map[string]time.Time)}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// certReloader keeps the current certificate and client CA pool,
+// and reloads them when the files modification time changes.
+type certReloader struct {
+	opt TLSOption
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTime   map[string]time.Time
+	lastCheck time.Time
+}
+
+func (cr *certReloader) files() []string {
+	if cr.opt.ClientCAFile != "" {
+		return []string{cr.opt.CertFile, cr.opt.KeyFile, cr.opt.ClientCAFile}
+	}
+	return []string{cr.opt.CertFile, cr.opt.KeyFile}
+}
+
+func (cr *certReloader) load() error {
+	modTime := make(map[string]time.Time)
+	for _, name := range cr.files() {
+		info, err := os.Stat(name)
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %w", name, err)
+		}
+		modTime[name] = info.ModTime()
+	}
+	cert, err := tls.LoadX509KeyPair(cr.opt.CertFile, cr.opt.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+	var pool *x509.CertPool
+	if cr.opt.ClientCAFile != "" {
+		pem, err := os.ReadFile(cr.opt.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA bundle: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no valid certificate found in client CA bundle %s", cr.opt.ClientCAFile)
+		}
+	}
+
+	cr.mu.Lock()
+	cr.cert, cr.clientCAs, cr.modTime = &cert, pool, modTime
+	cr.mu.Unlock()
+	return nil
+}
+
+// changed reports whether a file was modified since the last load,
+// at most once per reload interval.
+func (cr *certReloader) changed() bool {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if time.Since(cr.lastCheck) < cr.opt.ReloadInterval {
+		return false
+	}
+	cr.lastCheck = time.Now()
+	for _, name := range cr.files() {
+		info, err := os.Stat(name)
+		if err != nil {
+			// The file may be in the middle of a rotation, keep the current one
+			return false
+		}
+		if !info.ModTime().Equal(cr.modTime[name]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cr *certReloader) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	if cr.changed() {
+		if err := cr.load(); err != nil {
+			getLogEntry().Error("Failed to reload TLS certificates, keep serving the previous ones",
+				zap.String("cert_file", cr.opt.CertFile),
+				zap.Error(err))
+		} else {
+			getLogEntry().Info("TLS certificates reloaded", zap.String("cert_file", cr.opt.CertFile))
+		}
+	}
+
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{http2.NextProtoTLS, "http/1.1"},
+		Certificates: []tls.Certificate{*cr.cert},
+	}
+	if cr.clientCAs != nil {
+		cfg.ClientCAs = cr.clientCAs
+		cfg.ClientAuth = cr.opt.ClientAuth
+	}
+	return cfg, nil
+}
+
+// ClientCertificateIdentity returns the identity of the verified client certificate
+// of the connection: the first URI SAN (e.g. SPIFFE id), email SAN (e.g. service account),
+// DNS SAN, then the subject common name. It is empty when no certificate was verified.
+func ClientCertificateIdentity(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	leaf := state.VerifiedChains[0][0]
+	switch {
+	case len(leaf.URIs) > 0:
+		return leaf.URIs[0].String()
+	case len(leaf.EmailAddresses) > 0:
+		return leaf.EmailAddresses[0]
+	case len(leaf.DNSNames) > 0:
+		return leaf.DNSNames[0]
+	default:
+		return leaf.Subject.CommonName
+	}
+}
+
+// PeerIdentityFromContext returns the verified client certificate identity
+// for both HTTP handlers (served through MixHttp2) and gRPC interceptors.
+func PeerIdentityFromContext(ctx context.Context) (string, bool) {
+	if id, ok := ctx.Value(peerIdentityContextKey{}).(string); ok && id != "" {
+		return id, true
+	}
+	if p, ok := peer.FromContext(ctx); ok && p != nil {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			if id := ClientCertificateIdentity(&info.State); id != "" {
+				return id, true
+			}
+		}
+	}
+	return "", false
+}
+
+func setPeerIdentityToContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, peerIdentityContextKey{}, id)
+}
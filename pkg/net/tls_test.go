@@ -0,0 +1,191 @@
+package net
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// testCA issues the certificates of the TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate err: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the PEM certificate and key of the template, signed by the CA.
+func (ca *testCA) issue(t *testing.T, tmpl *x509.Certificate) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore, tmpl.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("CreateCertificate err: %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (ca *testCA) serverCert(t *testing.T, name string) (certPEM, keyPEM []byte) {
+	return ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		DNSNames:    []string{"localhost", name},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+}
+
+func writeFile(t *testing.T, name string, b []byte) {
+	t.Helper()
+	if err := os.WriteFile(name, b, 0o600); err != nil {
+		t.Fatalf("WriteFile err: %v", err)
+	}
+}
+
+func Test_CertReloader(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	certPEM, keyPEM := ca.serverCert(t, "first")
+	writeFile(t, certFile, certPEM)
+	writeFile(t, keyFile, keyPEM)
+
+	cfg, err := newTLSConfig(TLSOption{CertFile: certFile, KeyFile: keyFile, ReloadInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("newTLSConfig err: %v", err)
+	}
+	commonName := func() string {
+		t.Helper()
+		c, err := cfg.GetConfigForClient(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatalf("GetConfigForClient err: %v", err)
+		}
+		leaf, _ := x509.ParseCertificate(c.Certificates[0].Certificate[0])
+		return leaf.Subject.CommonName
+	}
+	if got := commonName(); got != "first" {
+		t.Fatalf("certificate %q, want first", got)
+	}
+
+	// A broken rotation keeps the previous certificate
+	writeFile(t, certFile, []byte("not a certificate"))
+	later := time.Now().Add(time.Minute)
+	_ = os.Chtimes(certFile, later, later)
+	time.Sleep(2 * time.Millisecond)
+	if got := commonName(); got != "first" {
+		t.Fatalf("certificate %q after a broken rotation, want first", got)
+	}
+
+	certPEM, keyPEM = ca.serverCert(t, "second")
+	writeFile(t, certFile, certPEM)
+	writeFile(t, keyFile, keyPEM)
+	later = later.Add(time.Minute)
+	_ = os.Chtimes(certFile, later, later)
+	_ = os.Chtimes(keyFile, later, later)
+	time.Sleep(2 * time.Millisecond)
+	if got := commonName(); got != "second" {
+		t.Fatalf("certificate %q after the rotation, want second", got)
+	}
+}
+
+func Test_PeerIdentityFromContext(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+	certPEM, keyPEM := ca.serverCert(t, "server")
+	writeFile(t, certFile, certPEM)
+	writeFile(t, keyFile, keyPEM)
+	writeFile(t, caFile, ca.pem)
+
+	clientPEM, clientKeyPEM := ca.issue(t, &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "caller"},
+		EmailAddresses: []string{"caller@project.iam.gserviceaccount.com"},
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	clientCert, err := tls.X509KeyPair(clientPEM, clientKeyPEM)
+	if err != nil {
+		t.Fatalf("X509KeyPair err: %v", err)
+	}
+
+	var state *tls.ConnectionState
+	rest := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state = r.TLS
+		id, _ := PeerIdentityFromContext(r.Context())
+		_, _ = io.WriteString(w, id)
+	})
+	srv := httptest.NewUnstartedServer(MixHttp2(rest, http.NotFoundHandler()))
+	if srv.TLS, err = newTLSConfig(TLSOption{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile}); err != nil {
+		t.Fatalf("newTLSConfig err: %v", err)
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(certs ...tls.Certificate) (string, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs: roots, ServerName: "localhost", Certificates: certs,
+		}}}
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b), nil
+	}
+
+	// The REST handlers get the identity of the client certificate
+	if id, err := get(clientCert); err != nil || id != "caller@project.iam.gserviceaccount.com" {
+		t.Fatalf("REST identity %q, err: %v", id, err)
+	}
+	// The gRPC interceptors get it from the peer
+	ctx := peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{State: *state}})
+	if id, ok := PeerIdentityFromContext(ctx); !ok || id != "caller@project.iam.gserviceaccount.com" {
+		t.Fatalf("gRPC identity %q, %v", id, ok)
+	}
+	if _, ok := PeerIdentityFromContext(context.Background()); ok {
+		t.Fatalf("identity without peer")
+	}
+	// The client certificate is required
+	if _, err := get(); err == nil {
+		t.Fatalf("request without client certificate succeeded")
+	}
+}
@@ -0,0 +1,549 @@
+package net
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+var errUnknownField = errors.New("unknown field")
+
+// headers of the REST request never forwarded as gRPC metadata
+var transcodeSkipHeaders = map[string]bool{
+	"Accept":            true,
+	"Accept-Encoding":   true,
+	"Connection":        true,
+	"Content-Length":    true,
+	"Content-Type":      true,
+	"Keep-Alive":        true,
+	"Te":                true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// Transcode exposes every unary method of the services registered on inst as a REST route
+// of the router: POST /{package.Service}/{Method} with the JSON (protojson) request message as
+// body, plus the routes declared by the google.api.http annotation of the method, if any.
+//
+// The call is served in-process by the gRPC server, so its interceptors (authentication,
+// logging, ...) apply as for a native gRPC call. A failed call is answered with the HTTP status
+// mapped from its gRPC code (see HTTPStatusFromCode) and the google.rpc.Status as JSON body.
+//
+// Example usage:
+//
+//	hellopb.RegisterHelloServiceServer(inst, handler)
+//	if err := net.Transcode(router, inst); err != nil {
+//		log.Fatal(err)
+//	}
+//	mixed := net.MixHttp2(net.Middleware(router, true), net.Walk(inst))
+func Transcode(ro *mux.Router, inst *grpc.Server) error {
+	for name, info := range inst.GetServiceInfo() {
+		desc, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(name))
+		if err != nil {
+			return fmt.Errorf("transcode: descriptor of service %s not found: %w", name, err)
+		}
+		sd, ok := desc.(protoreflect.ServiceDescriptor)
+		if !ok {
+			return fmt.Errorf("transcode: %s is not a service", name)
+		}
+		for _, mt := range info.Methods {
+			if mt.IsClientStream || mt.IsServerStream {
+				continue
+			}
+			md := sd.Methods().ByName(protoreflect.Name(mt.Name))
+			if md == nil {
+				return fmt.Errorf("transcode: method %s/%s not found", name, mt.Name)
+			}
+			if err := transcodeMethod(ro, inst, md); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func transcodeMethod(ro *mux.Router, inst http.Handler, md protoreflect.MethodDescriptor) error {
+	fullMethod := fmt.Sprintf("/%s/%s", md.Parent().FullName(), md.Name())
+	for _, m := range []protoreflect.MessageDescriptor{md.Input(), md.Output()} {
+		if _, err := protoregistry.GlobalTypes.FindMessageByName(m.FullName()); err != nil {
+			return fmt.Errorf("transcode: message type %s of %s not found: %w", m.FullName(), fullMethod, err)
+		}
+	}
+
+	// Default route, the body is the whole request message
+	ro.Handle(fullMethod, &transcoder{
+		inst:       inst,
+		method:     md,
+		fullMethod: fullMethod,
+		body:       "*",
+	}).Methods(http.MethodPost)
+
+	rule, ok := proto.GetExtension(md.Options(), annotations.E_Http).(*annotations.HttpRule)
+	if !ok || rule == nil {
+		return nil
+	}
+	for _, r := range append([]*annotations.HttpRule{rule}, rule.GetAdditionalBindings()...) {
+		verb, tmpl := httpRulePattern(r)
+		if tmpl == "" {
+			return fmt.Errorf("transcode: %s has an empty google.api.http pattern", fullMethod)
+		}
+		path, err := muxPathTemplate(tmpl)
+		if err != nil {
+			return fmt.Errorf("transcode: %s: %w", fullMethod, err)
+		}
+		ro.Handle(path, &transcoder{
+			inst:         inst,
+			method:       md,
+			fullMethod:   fullMethod,
+			body:         r.GetBody(),
+			responseBody: r.GetResponseBody(),
+		}).Methods(verb)
+	}
+	return nil
+}
+
+func httpRulePattern(r *annotations.HttpRule) (string, string) {
+	switch p := r.GetPattern().(type) {
+	case *annotations.HttpRule_Get:
+		return http.MethodGet, p.Get
+	case *annotations.HttpRule_Put:
+		return http.MethodPut, p.Put
+	case *annotations.HttpRule_Post:
+		return http.MethodPost, p.Post
+	case *annotations.HttpRule_Delete:
+		return http.MethodDelete, p.Delete
+	case *annotations.HttpRule_Patch:
+		return http.MethodPatch, p.Patch
+	case *annotations.HttpRule_Custom:
+		return strings.ToUpper(p.Custom.GetKind()), p.Custom.GetPath()
+	}
+	return "", ""
+}
+
+// muxPathTemplate converts a google.api.http path template to a mux path,
+// e.g. /v1/{name=shelves/*}/books/{book_id} -> /v1/{name:shelves/[^/]+}/books/{book_id}.
+func muxPathTemplate(tmpl string) (string, error) {
+	var (
+		sb   strings.Builder
+		wild int
+	)
+	for len(tmpl) > 0 {
+		i := strings.IndexByte(tmpl, '{')
+		if i < 0 {
+			sb.WriteString(wildcardSegments(tmpl, &wild))
+			break
+		}
+		sb.WriteString(wildcardSegments(tmpl[:i], &wild))
+		j := strings.IndexByte(tmpl[i:], '}')
+		if j < 0 {
+			return "", fmt.Errorf("unterminated variable in path template %q", tmpl)
+		}
+		field, pattern, ok := strings.Cut(tmpl[i+1:i+j], "=")
+		if !ok {
+			pattern = "*"
+		}
+		sb.WriteString("{" + field + ":" + segmentsRegexp(pattern) + "}")
+		tmpl = tmpl[i+j+1:]
+	}
+	return sb.String(), nil
+}
+
+// wildcardSegments replaces the * and ** segments outside a variable with anonymous mux variables.
+func wildcardSegments(s string, n *int) string {
+	parts := strings.Split(s, "/")
+	for k, p := range parts {
+		if p == "*" || p == "**" {
+			parts[k] = fmt.Sprintf("{_wildcard%d:%s}", *n, segmentsRegexp(p))
+			*n++
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+func segmentsRegexp(pattern string) string {
+	parts := strings.Split(pattern, "/")
+	for k, p := range parts {
+		switch p {
+		case "*":
+			parts[k] = "[^/]+"
+		case "**":
+			parts[k] = ".+"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// transcoder serves one REST binding of a unary gRPC method.
+type transcoder struct {
+	inst       http.Handler
+	method     protoreflect.MethodDescriptor
+	fullMethod string
+	// body is the google.api.http body: "*" for the whole message, a field name or empty
+	body string
+	// responseBody is the field of the response used as body, the whole message when empty
+	responseBody string
+}
+
+func (t *transcoder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	in, err := t.decodeRequest(r)
+	if err != nil {
+		// The body errors keep the status of Bind (413, 415)
+		var httpStatus int
+		var be *BindError
+		if errors.As(err, &be) {
+			httpStatus = be.Status
+		}
+		WriteStatus(w, r, httpStatus, status.New(codes.InvalidArgument, err.Error()))
+		return
+	}
+
+	out := dynamicMessage(t.method.Output())
+	if st := invokeInProcess(t.inst, r, t.fullMethod, in, out); st.Code() != codes.OK {
+		WriteStatus(w, r, 0, st)
+		return
+	}
+
+	var reply proto.Message = out
+	if t.responseBody != "" {
+		fd := findField(out.ProtoReflect().Descriptor(), t.responseBody)
+		if fd == nil || fd.Message() == nil {
+			WriteStatus(w, r, 0, status.Newf(codes.Internal, "invalid response body field %q", t.responseBody))
+			return
+		}
+		reply = out.ProtoReflect().Get(fd).Message().Interface()
+	}
+	if err := Write(w, r, http.StatusOK, reply); err != nil {
+		getLoggerFromContext(r.Context()).Warn("Failed to write transcoded response",
+			zap.String("method", t.fullMethod), zap.Error(err))
+	}
+}
+
+// decodeRequest builds the request message from the body, decoded as by Bind, then
+// sets the path variables and the query parameters on top.
+func (t *transcoder) decodeRequest(r *http.Request) (proto.Message, error) {
+	in := dynamicMessage(t.method.Input())
+	msg := in.ProtoReflect()
+
+	// Unknown body fields are rejected, as by the gRPC JSON decoding
+	b := binder{maxBodyBytes: DefaultMaxBodyBytes, rejectUnknown: true}
+	switch t.body {
+	case "":
+	case "*":
+		if err := b.bindBody(r, in); err != nil {
+			return nil, err
+		}
+	default:
+		fd := findField(msg.Descriptor(), t.body)
+		if fd == nil || fd.Message() == nil {
+			return nil, fmt.Errorf("invalid body field %q", t.body)
+		}
+		field := msg.NewField(fd).Message()
+		if err := b.bindBody(r, field.Interface()); err != nil {
+			return nil, err
+		}
+		if proto.Size(field.Interface()) > 0 {
+			msg.Set(fd, protoreflect.ValueOfMessage(field))
+		}
+	}
+
+	for name, value := range mux.Vars(r) {
+		if strings.HasPrefix(name, "_wildcard") {
+			continue
+		}
+		if err := setFieldPath(msg, strings.Split(name, "."), []string{value}); err != nil {
+			return nil, err
+		}
+	}
+	// Query parameters fill the fields not bound to the body
+	if t.body != "*" {
+		for name, values := range r.URL.Query() {
+			if err := setFieldPath(msg, strings.Split(name, "."), values); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return in, nil
+}
+
+func dynamicMessage(md protoreflect.MessageDescriptor) proto.Message {
+	if mt, err := protoregistry.GlobalTypes.FindMessageByName(md.FullName()); err == nil {
+		return mt.New().Interface()
+	}
+	return nil
+}
+
+// findField finds a field by its proto name or its JSON name.
+func findField(md protoreflect.MessageDescriptor, name string) protoreflect.FieldDescriptor {
+	if fd := md.Fields().ByName(protoreflect.Name(name)); fd != nil {
+		return fd
+	}
+	return md.Fields().ByJSONName(name)
+}
+
+// setFieldPath sets the (possibly nested) field at path from the string values.
+func setFieldPath(msg protoreflect.Message, path []string, values []string) error {
+	for i, name := range path {
+		fd := findField(msg.Descriptor(), name)
+		if fd == nil {
+			return fmt.Errorf("%w %q", errUnknownField, strings.Join(path[:i+1], "."))
+		}
+		if i < len(path)-1 {
+			if fd.Message() == nil || fd.IsList() || fd.IsMap() {
+				return fmt.Errorf("field %q is not a message", strings.Join(path[:i+1], "."))
+			}
+			msg = msg.Mutable(fd).Message()
+			continue
+		}
+
+		if fd.IsMap() || (fd.Message() != nil) {
+			return fmt.Errorf("field %q cannot be set from a string", strings.Join(path, "."))
+		}
+		if fd.IsList() {
+			list := msg.Mutable(fd).List()
+			for _, v := range values {
+				pv, err := parseScalar(fd, v)
+				if err != nil {
+					return err
+				}
+				list.Append(pv)
+			}
+			return nil
+		}
+		if len(values) == 0 {
+			return nil
+		}
+		pv, err := parseScalar(fd, values[len(values)-1])
+		if err != nil {
+			return err
+		}
+		msg.Set(fd, pv)
+	}
+	return nil
+}
+
+func parseScalar(fd protoreflect.FieldDescriptor, v string) (protoreflect.Value, error) {
+	var (
+		pv  protoreflect.Value
+		err error
+	)
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(v), nil
+	case protoreflect.BytesKind:
+		var b []byte
+		if b, err = base64.StdEncoding.DecodeString(v); err == nil {
+			pv = protoreflect.ValueOfBytes(b)
+		}
+	case protoreflect.BoolKind:
+		var b bool
+		if b, err = strconv.ParseBool(v); err == nil {
+			pv = protoreflect.ValueOfBool(b)
+		}
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByName(protoreflect.Name(v)); ev != nil {
+			return protoreflect.ValueOfEnum(ev.Number()), nil
+		}
+		var n int64
+		if n, err = strconv.ParseInt(v, 10, 32); err == nil {
+			pv = protoreflect.ValueOfEnum(protoreflect.EnumNumber(n))
+		}
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		var n int64
+		if n, err = strconv.ParseInt(v, 10, 32); err == nil {
+			pv = protoreflect.ValueOfInt32(int32(n))
+		}
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		var n int64
+		if n, err = strconv.ParseInt(v, 10, 64); err == nil {
+			pv = protoreflect.ValueOfInt64(n)
+		}
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		var n uint64
+		if n, err = strconv.ParseUint(v, 10, 32); err == nil {
+			pv = protoreflect.ValueOfUint32(uint32(n))
+		}
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		var n uint64
+		if n, err = strconv.ParseUint(v, 10, 64); err == nil {
+			pv = protoreflect.ValueOfUint64(n)
+		}
+	case protoreflect.FloatKind:
+		var f float64
+		if f, err = strconv.ParseFloat(v, 32); err == nil {
+			pv = protoreflect.ValueOfFloat32(float32(f))
+		}
+	case protoreflect.DoubleKind:
+		var f float64
+		if f, err = strconv.ParseFloat(v, 64); err == nil {
+			pv = protoreflect.ValueOfFloat64(f)
+		}
+	default:
+		return pv, fmt.Errorf("unsupported kind %s of field %q", fd.Kind(), fd.Name())
+	}
+	if err != nil {
+		return pv, fmt.Errorf("invalid value %q of field %q: %w", v, fd.Name(), err)
+	}
+	return pv, nil
+}
+
+// invokeInProcess serves the call with the gRPC server handler, as a native HTTP/2 gRPC
+// request built from the REST one (headers as metadata, deadline as grpc-timeout).
+func invokeInProcess(inst http.Handler, r *http.Request, fullMethod string, in, out proto.Message) *status.Status {
+	data, err := proto.Marshal(in)
+	if err != nil {
+		return status.Newf(codes.Internal, "failed to marshal request: %v", err)
+	}
+	frame := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+	frame = append(frame, data...)
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, fullMethod, bytes.NewReader(frame))
+	if err != nil {
+		return status.Newf(codes.Internal, "failed to build request: %v", err)
+	}
+	req.ProtoMajor, req.ProtoMinor, req.Proto = 2, 0, "HTTP/2.0"
+	req.RemoteAddr, req.TLS, req.Host = r.RemoteAddr, r.TLS, r.Host
+	for k, vv := range r.Header {
+		if !transcodeSkipHeaders[k] && !strings.HasPrefix(strings.ToLower(k), "grpc-") {
+			req.Header[k] = vv
+		}
+	}
+	req.Header.Set(headerContentType, "application/grpc+proto")
+	req.Header.Set("Te", "trailers")
+	if deadline, ok := r.Context().Deadline(); ok {
+		req.Header.Set("Grpc-Timeout", fmt.Sprintf("%dm", max(time.Until(deadline).Milliseconds(), 1)))
+	}
+
+	rec := &inProcessRecorder{header: make(http.Header)}
+	inst.ServeHTTP(rec, req)
+	return rec.result(out)
+}
+
+// inProcessRecorder buffers the response of the gRPC handler transport,
+// headers and trailers share the same map.
+type inProcessRecorder struct {
+	header http.Header
+	body   bytes.Buffer
+	code   int
+}
+
+func (rec *inProcessRecorder) Header() http.Header { return rec.header }
+
+func (rec *inProcessRecorder) Write(b []byte) (int, error) {
+	if rec.code == 0 {
+		rec.code = http.StatusOK
+	}
+	return rec.body.Write(b)
+}
+
+func (rec *inProcessRecorder) WriteHeader(code int) {
+	if rec.code == 0 {
+		rec.code = code
+	}
+}
+
+func (rec *inProcessRecorder) Flush() {}
+
+func (rec *inProcessRecorder) trailer(key string) string {
+	if v := rec.header.Get(key); v != "" {
+		return v
+	}
+	return rec.header.Get(http.TrailerPrefix + key)
+}
+
+// result decodes the status and the response message.
+func (rec *inProcessRecorder) result(out proto.Message) *status.Status {
+	if bin := rec.trailer("Grpc-Status-Details-Bin"); bin != "" {
+		if b, err := decodeBinHeader(bin); err == nil {
+			sp := new(spb.Status)
+			if proto.Unmarshal(b, sp) == nil {
+				return status.FromProto(sp)
+			}
+		}
+	}
+	code, err := strconv.Atoi(rec.trailer("Grpc-Status"))
+	if err != nil {
+		return status.Newf(codes.Internal, "missing grpc-status in response (http %d)", rec.code)
+	}
+	if codes.Code(code) != codes.OK {
+		msg := rec.trailer("Grpc-Message")
+		if unescaped, err := url.PathUnescape(msg); err == nil {
+			msg = unescaped
+		}
+		return status.New(codes.Code(code), msg)
+	}
+
+	frame := rec.body.Bytes()
+	if len(frame) < 5 {
+		return status.New(codes.Internal, "empty response message")
+	}
+	if frame[0]&1 == 1 {
+		return status.New(codes.Internal, "compressed response message is not supported")
+	}
+	size := binary.BigEndian.Uint32(frame[1:5])
+	if uint32(len(frame)-5) < size {
+		return status.New(codes.Internal, "truncated response message")
+	}
+	if err := proto.Unmarshal(frame[5:5+size], out); err != nil {
+		return status.Newf(codes.Internal, "failed to unmarshal response: %v", err)
+	}
+	return status.New(codes.OK, "")
+}
+
+// decodeBinHeader decodes a -bin metadata value, padded or not.
+func decodeBinHeader(v string) ([]byte, error) {
+	if len(v)%4 == 0 {
+		return base64.StdEncoding.DecodeString(v)
+	}
+	return base64.RawStdEncoding.DecodeString(v)
+}
+
+// HTTPStatusFromCode maps a gRPC status code to the HTTP status code of a REST reply.
+func HTTPStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499 // client closed request
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.FailedPrecondition:
+		return http.StatusBadRequest
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
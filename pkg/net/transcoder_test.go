@@ -0,0 +1,160 @@
+package net
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func Test_MuxPathTemplate(t *testing.T) {
+	tests := []struct {
+		tmpl    string
+		want    string
+		wantErr bool
+	}{
+		{tmpl: "/v1/hello", want: "/v1/hello"},
+		{tmpl: "/v1/users/{id}", want: "/v1/users/{id:[^/]+}"},
+		{tmpl: "/v1/{name=shelves/*}/books/{book_id}", want: "/v1/{name:shelves/[^/]+}/books/{book_id:[^/]+}"},
+		{tmpl: "/v1/{name=files/**}", want: "/v1/{name:files/.+}"},
+		{tmpl: "/v1/*/items/**", want: "/v1/{_wildcard0:[^/]+}/items/{_wildcard1:.+}"},
+		{tmpl: "/v1/{user.id}", want: "/v1/{user.id:[^/]+}"},
+		{tmpl: "/v1/{name", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tmpl, func(t *testing.T) {
+			got, err := muxPathTemplate(tt.tmpl)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Fatalf("muxPathTemplate = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func Test_SetFieldPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		values  []string
+		want    string
+		wantErr error
+	}{
+		{name: "string", path: "name", values: []string{"id"}, want: `{"name":"id"}`},
+		{name: "last value wins", path: "name", values: []string{"a", "b"}, want: `{"name":"b"}`},
+		{name: "integer", path: "number", values: []string{"3"}, want: `{"number":3}`},
+		{name: "enum name", path: "label", values: []string{"LABEL_REPEATED"}, want: `{"label":"LABEL_REPEATED"}`},
+		{name: "enum number", path: "label", values: []string{"3"}, want: `{"label":"LABEL_REPEATED"}`},
+		{name: "JSON name", path: "jsonName", values: []string{"id"}, want: `{"jsonName":"id"}`},
+		{name: "nested field", path: "options.deprecated", values: []string{"true"}, want: `{"options":{"deprecated":true}}`},
+		{name: "unknown field", path: "other", values: []string{"x"}, wantErr: errUnknownField},
+		{name: "unknown nested field", path: "options.other", values: []string{"x"}, wantErr: errUnknownField},
+		{name: "invalid integer", path: "number", values: []string{"three"}, wantErr: errAny},
+		{name: "message from a string", path: "options", values: []string{"x"}, wantErr: errAny},
+		{name: "scalar as a message", path: "name.value", values: []string{"x"}, wantErr: errAny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &descriptorpb.FieldDescriptorProto{}
+			err := setFieldPath(msg.ProtoReflect(), strings.Split(tt.path, "."), tt.values)
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("setFieldPath err: %v", err)
+			case tt.wantErr == errAny && err == nil:
+				t.Fatalf("setFieldPath err: nil, want an error")
+			case tt.wantErr != nil && tt.wantErr != errAny && !errors.Is(err, tt.wantErr):
+				t.Fatalf("setFieldPath err: %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if got := mustJSON(t, msg); got != tt.want {
+				t.Fatalf("message %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// The values of a repeated field are appended
+	msg := &descriptorpb.FileDescriptorProto{}
+	_ = setFieldPath(msg.ProtoReflect(), []string{"public_dependency"}, []string{"1"})
+	if err := setFieldPath(msg.ProtoReflect(), []string{"public_dependency"}, []string{"2", "3"}); err != nil {
+		t.Fatalf("setFieldPath err: %v", err)
+	}
+	if got := mustJSON(t, msg); got != `{"publicDependency":[1,2,3]}` {
+		t.Fatalf("repeated field %s", got)
+	}
+}
+
+// errAny matches any error.
+var errAny = errors.New("any error")
+
+// mustJSON returns the compact protojson of the message.
+func mustJSON(t *testing.T, msg proto.Message) string {
+	t.Helper()
+	b, err := protojson.Marshal(msg)
+	if err != nil {
+		t.Fatalf("protojson.Marshal err: %v", err)
+	}
+	return strings.Join(strings.Fields(string(b)), "")
+}
+
+func Test_Transcode(t *testing.T) {
+	inst := grpc.NewServer()
+	healthSrv := health.NewServer()
+	healthSrv.SetServingStatus("hello.HelloService", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(inst, healthSrv)
+
+	router := mux.NewRouter()
+	if err := Transcode(router, inst); err != nil {
+		t.Fatalf("Transcode err: %v", err)
+	}
+	// A GET binding of the method, the request field is a path variable
+	md := healthpb.File_grpc_health_v1_health_proto.Services().ByName("Health").Methods().ByName("Check")
+	path, _ := muxPathTemplate("/v1/health/{service}")
+	router.Handle(path, &transcoder{inst: inst, method: md, fullMethod: "/grpc.health.v1.Health/Check"}).
+		Methods(http.MethodGet)
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		wantCode    int
+		wantBody    string
+	}{
+		{name: "JSON body", method: http.MethodPost, path: "/grpc.health.v1.Health/Check",
+			body: `{"service":"hello.HelloService"}`, wantCode: http.StatusOK, wantBody: `"status":"SERVING"`},
+		{name: "path variable", method: http.MethodGet, path: "/v1/health/hello.HelloService",
+			wantCode: http.StatusOK, wantBody: `"status":"SERVING"`},
+		{name: "gRPC code mapped to HTTP", method: http.MethodPost, path: "/grpc.health.v1.Health/Check",
+			body: `{"service":"unknown"}`, wantCode: http.StatusNotFound},
+		{name: "unknown body field", method: http.MethodPost, path: "/grpc.health.v1.Health/Check",
+			body: `{"other":"x"}`, wantCode: http.StatusBadRequest},
+		{name: "unsupported content type", method: http.MethodPost, path: "/grpc.health.v1.Health/Check",
+			contentType: "text/plain", body: `service`, wantCode: http.StatusUnsupportedMediaType},
+		{name: "body too large", method: http.MethodPost, path: "/grpc.health.v1.Health/Check",
+			body: `{"service":"` + strings.Repeat("a", int(DefaultMaxBodyBytes)) + `"}`, wantCode: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set(headerContentType, tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != tt.wantCode || !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Fatalf("status %d %s, want %d %s", w.Code, w.Body.String(), tt.wantCode, tt.wantBody)
+			}
+		})
+	}
+}
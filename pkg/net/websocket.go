@@ -5,6 +5,8 @@ import (
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/weeback/grpc-project-template/pkg/jwt"
 )
 
 type MessageChannel interface {
@@ -13,9 +15,20 @@ type MessageChannel interface {
 	ID() string
 
 	// ChangeID changes the client's ID to a new value.
-	// If the provided ID is empty, it returns an error and keeps the current ID.
+	// If the provided ID is empty or taken by another connected client (ErrClientIDTaken),
+	// or bound to the claims of an authenticated client (ErrClientIDBound),
+	// it returns an error and keeps the current ID.
 	ChangeID(id string) error
 
+	// UserID returns the user bound to the connection, SetUserID binds it so that
+	// the messages sent to the user (HubChannel.SendToUser) reach the connection.
+	UserID() string
+	SetUserID(userID string) error
+
+	// Claims returns the claims of the token verified by an authenticated upgrade
+	// (UpgradeToWebSocketAuth), to authorize the messages. It is nil otherwise.
+	Claims() *jwt.MapClaims
+
 	// SendMessage sends a message to the WebSocket connection
 	SendMessage(message []byte) error
 
@@ -46,14 +59,34 @@ type HubChannel interface {
 	// It supports both text (1) and binary messages (2).
 	SendTo(receiveId string, messageType int, message []byte) error
 
+	// SendToUser sends a message to every connection of the user.
+	SendToUser(userID string, messageType int, message []byte) error
+
 	// BroadcastMessage sends a message to all connected clients
 	BroadcastMessage(message []byte) error
 
 	BroadcastBinary(b []byte) error
+
+	// Join adds the client identified by clientID to the room, Leave removes it.
+	// A client leaves all its rooms when it disconnects.
+	Join(clientID, room string) error
+	Leave(clientID, room string) error
+
+	// PublishToRoom sends a text message to the clients of the room only
+	PublishToRoom(room string, message []byte) error
+
+	PublishBinaryToRoom(room string, b []byte) error
+
+	// RoomMembers returns the ids of the clients of the room
+	RoomMembers(room string) ([]string, error)
+
+	// ClientRooms returns the rooms joined by the client
+	ClientRooms(clientID string) ([]string, error)
 }
 
 // UpgradeToWebSocket upgrades the HTTP connection to a WebSocket connection.
 // It uses the global hub connection to register the client.
+// It accepts any origin and any client, see UpgradeToWebSocketAuth for the authenticated upgrade.
 func UpgradeToWebSocket(w http.ResponseWriter, r *http.Request) (HubChannel, MessageChannel, error) {
 	// init globalHubConnection
 	hub, err := globalHubConnection()
@@ -95,6 +128,6 @@ func UpgradeToWebSocketCustom(hub *Hub, w http.ResponseWriter, r *http.Request)
 		return nil, nil, err
 	}
 	// Register client with hub
-	client := hub.registerClient(conn, fmt.Sprintf("CID-%s-%d", remoteAddr, time.Now().Unix()))
+	client := hub.registerClient(conn, fmt.Sprintf("CID-%s-%d", remoteAddr, time.Now().Unix()), nil)
 	return hub, client, nil
 }
@@ -0,0 +1,211 @@
+package net
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/weeback/grpc-project-template/pkg/jwt"
+	"github.com/weeback/grpc-project-template/pkg/logger"
+)
+
+const (
+	defaultWebSocketQueryToken  = "access_token"
+	defaultWebSocketSubprotocol = "bearer"
+)
+
+// ErrClientIDBound is returned by ChangeID and SetUserID on a client bound to the claims
+// of its token, see WebSocketAuth.
+var ErrClientIDBound = errors.New("client id bound to the token claims")
+
+// WebSocketAuthOption configures a WebSocketAuth.
+type WebSocketAuthOption func(a *WebSocketAuth)
+
+// WithWebSocketOrigins allows the browser origins, exact ("https://app.example.com"), "*" for any
+// origin, or wildcard subdomains ("https://*.example.dev"). Without origins, only the origin of
+// the host is allowed, as the default of gorilla/websocket.
+func WithWebSocketOrigins(origins ...string) WebSocketAuthOption {
+	return func(a *WebSocketAuth) {
+		a.origins.AllowedOrigins = append(a.origins.AllowedOrigins, origins...)
+	}
+}
+
+// WithWebSocketOriginPatterns allows the origins matching the regular expressions.
+func WithWebSocketOriginPatterns(patterns ...string) WebSocketAuthOption {
+	return func(a *WebSocketAuth) {
+		a.origins.AllowedOriginPatterns = append(a.origins.AllowedOriginPatterns, patterns...)
+	}
+}
+
+// WithWebSocketQueryToken reads the token from the query parameter name, default "access_token".
+// The parameter is redacted from the access log (see logger.AddRedactedKeys), but the proxies
+// and load balancers in front of the service may still log the URL with the token: prefer the
+// Sec-WebSocket-Protocol header, and disable the query parameter with an empty name.
+func WithWebSocketQueryToken(name string) WebSocketAuthOption {
+	return func(a *WebSocketAuth) {
+		a.queryToken = name
+	}
+}
+
+// WithWebSocketSubprotocol reads the token from the Sec-WebSocket-Protocol header, offered by
+// the browsers as `new WebSocket(url, ["bearer", token])`, default "bearer". The server selects
+// the subprotocol name, never the token. An empty name disables the header.
+func WithWebSocketSubprotocol(name string) WebSocketAuthOption {
+	return func(a *WebSocketAuth) {
+		a.subprotocol = name
+	}
+}
+
+// WebSocketAuth upgrades the connections of a verified JWT and an allowed origin only.
+// The client id is bound to the SessionId of the claims (the UserId without session),
+// the client user to the UserId, and the claims are exposed by MessageChannel.Claims.
+//
+// A session has one connection: the upgrade of an id already connected replaces the
+// previous connection, closed with a normal close frame, so that SendTo(sessionId)
+// reaches the latest one. SendToUser reaches every session of the user.
+type WebSocketAuth struct {
+	key         ed25519.PublicKey
+	origins     CORSOption
+	policy      *CORSPolicy
+	queryToken  string
+	subprotocol string
+	upgrader    websocket.Upgrader
+}
+
+// NewWebSocketAuth creates the authenticated upgrade verifying the tokens with the public key.
+//
+// Example usage:
+//
+//	keyPair, _ := jwt.KeyPairFromSecret(config.GetPreSharedKey())
+//	auth, err := net.NewWebSocketAuth(keyPair.PublicKey, net.WithWebSocketOrigins("https://app.example.com"))
+//	...
+//	func handler(w http.ResponseWriter, r *http.Request) {
+//		ch, mh, err := net.UpgradeToWebSocketAuth(auth, w, r)
+//		if err != nil {
+//			return // the request is already answered
+//		}
+//		claims := mh.Claims()
+//		...
+//	}
+func NewWebSocketAuth(key ed25519.PublicKey, opts ...WebSocketAuthOption) (*WebSocketAuth, error) {
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid websocket auth public key")
+	}
+	a := &WebSocketAuth{
+		key:         key,
+		queryToken:  defaultWebSocketQueryToken,
+		subprotocol: defaultWebSocketSubprotocol,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	if a.queryToken != "" {
+		logger.AddRedactedKeys(a.queryToken)
+	}
+	if len(a.origins.AllowedOrigins) > 0 || len(a.origins.AllowedOriginPatterns) > 0 {
+		policy, err := NewCORSPolicy(a.origins)
+		if err != nil {
+			return nil, fmt.Errorf("invalid websocket origins: %w", err)
+		}
+		a.policy = policy
+	}
+	a.upgrader = websocket.Upgrader{
+		ReadBufferSize:  upgrader.ReadBufferSize,
+		WriteBufferSize: upgrader.WriteBufferSize,
+	}
+	if a.policy != nil {
+		a.upgrader.CheckOrigin = a.checkOrigin
+	}
+	if a.subprotocol != "" {
+		a.upgrader.Subprotocols = []string{a.subprotocol}
+	}
+	return a, nil
+}
+
+// checkOrigin allows the requests without Origin, sent by the non-browser clients,
+// and the origins of the allow-list.
+func (a *WebSocketAuth) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get(headerOrigin)
+	return origin == "" || a.policy.AllowOrigin(origin)
+}
+
+// token returns the bearer token of the Authorization header, the Sec-WebSocket-Protocol
+// header or the query parameter, in that order.
+func (a *WebSocketAuth) token(r *http.Request) string {
+	if auth := r.Header.Get(headerAuthorization); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if a.subprotocol != "" {
+		protocols := websocket.Subprotocols(r)
+		for i, p := range protocols {
+			if p == a.subprotocol && i+1 < len(protocols) {
+				return protocols[i+1]
+			}
+		}
+	}
+	if a.queryToken != "" {
+		return r.URL.Query().Get(a.queryToken)
+	}
+	return ""
+}
+
+// Authenticate checks the origin and verifies the token of the upgrade request.
+// The status code is 403 PermissionDenied for an origin, 401 Unauthenticated for a token.
+func (a *WebSocketAuth) Authenticate(r *http.Request) (*jwt.MapClaims, *status.Status) {
+	if a.upgrader.CheckOrigin != nil && !a.upgrader.CheckOrigin(r) {
+		return nil, status.Newf(codes.PermissionDenied, "origin %s not allowed", r.Header.Get(headerOrigin))
+	}
+	token := a.token(r)
+	if token == "" {
+		return nil, status.New(codes.Unauthenticated, "missing bearer token")
+	}
+	claims, err := jwt.ParseClaims(a.key, token)
+	if err != nil {
+		return nil, status.Newf(codes.Unauthenticated, "invalid bearer token: %v", err)
+	}
+	if claims.UserId == "" && claims.SessionId == "" {
+		return nil, status.New(codes.Unauthenticated, "invalid bearer token: no user or session")
+	}
+	return claims, nil
+}
+
+// Upgrade authenticates the request and upgrades it to a WebSocket connection of the hub.
+// A rejected request is answered 401 Unauthorized or 403 Forbidden before the upgrade.
+func (a *WebSocketAuth) Upgrade(hub *Hub, w http.ResponseWriter, r *http.Request) (HubChannel, MessageChannel, error) {
+	claims, st := a.Authenticate(r)
+	if st != nil {
+		getLoggerFromContext(r.Context()).Warn("WebSocket upgrade rejected",
+			zap.String("remote_addr", r.RemoteAddr),
+			zap.String("origin", r.Header.Get(headerOrigin)),
+			zap.String("reason", st.Message()))
+		WriteStatus(w, r, 0, st)
+		return nil, nil, st.Err()
+	}
+	conn, err := a.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	id := claims.SessionId
+	if id == "" {
+		id = claims.UserId
+	}
+	client := hub.registerClient(conn, id, claims)
+	return hub, client, nil
+}
+
+// UpgradeToWebSocketAuth authenticates the request and upgrades it with the global hub,
+// see WebSocketAuth.Upgrade.
+func UpgradeToWebSocketAuth(auth *WebSocketAuth, w http.ResponseWriter, r *http.Request) (HubChannel, MessageChannel, error) {
+	hub, err := globalHubConnection()
+	if err != nil {
+		return nil, nil, err
+	}
+	return auth.Upgrade(hub, w, r)
+}
@@ -0,0 +1,134 @@
+package net
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/weeback/grpc-project-template/pkg/jwt"
+	"github.com/weeback/grpc-project-template/pkg/logger"
+)
+
+func Test_WebSocketAuth(t *testing.T) {
+	keyPair, err := jwt.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair err: %v", err)
+	}
+	auth, err := NewWebSocketAuth(keyPair.PublicKey, WithWebSocketOrigins("https://app.example.com"),
+		WithWebSocketOriginPatterns(`https://[a-z]+\.example\.io`))
+	if err != nil {
+		t.Fatalf("NewWebSocketAuth err: %v", err)
+	}
+	token, err := jwt.SignWithClaims(keyPair.PrivateKey, nil, jwt.NewOption().SetUserId("alice").SetSessionId("sess-1"))
+	if err != nil {
+		t.Fatalf("SignWithClaims err: %v", err)
+	}
+
+	hub := NewHub()
+	bound := make(chan MessageChannel, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, mh, err := auth.Upgrade(hub, w, r); err == nil {
+			bound <- mh
+		}
+	}))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	for name, tc := range map[string]struct {
+		url    string
+		header http.Header
+		status int
+	}{
+		"missing token":          {url: url, status: http.StatusUnauthorized},
+		"invalid token":          {url: url + "?access_token=invalid", status: http.StatusUnauthorized},
+		"denied origin":          {url: url + "?access_token=" + token, header: http.Header{"Origin": {"https://evil.example.com"}}, status: http.StatusForbidden},
+		"allowed origin pattern": {url: url + "?access_token=" + token, header: http.Header{"Origin": {"https://app.example.io"}}, status: http.StatusSwitchingProtocols},
+		"denied origin pattern":  {url: url + "?access_token=" + token, header: http.Header{"Origin": {"https://app.example.io.evil.com"}}, status: http.StatusForbidden},
+		"query token":            {url: url + "?access_token=" + token, status: http.StatusSwitchingProtocols},
+		"header token":           {url: url, header: http.Header{"Authorization": {"Bearer " + token}}, status: http.StatusSwitchingProtocols},
+		"protocol token":         {url: url, header: http.Header{"Origin": {"https://app.example.com"}, "Sec-WebSocket-Protocol": {"bearer, " + token}}, status: http.StatusSwitchingProtocols},
+	} {
+		conn, resp, err := websocket.DefaultDialer.Dial(tc.url, tc.header)
+		if resp == nil {
+			t.Fatalf("%s: dial err: %v", name, err)
+		}
+		if resp.StatusCode != tc.status {
+			t.Fatalf("%s: status %d, want %d", name, resp.StatusCode, tc.status)
+		}
+		if conn == nil {
+			continue
+		}
+		if name == "protocol token" && conn.Subprotocol() != "bearer" {
+			t.Fatalf("%s: subprotocol %q", name, conn.Subprotocol())
+		}
+		mh := <-bound
+		if mh.Claims() == nil || mh.Claims().UserId != "alice" || mh.UserID() != "alice" {
+			t.Fatalf("%s: claims not bound: %+v", name, mh.Claims())
+		}
+		if mh.ID() != "sess-1" {
+			t.Fatalf("%s: id %q not bound to the session", name, mh.ID())
+		}
+		if err := mh.ChangeID("mallory"); !errors.Is(err, ErrClientIDBound) {
+			t.Fatalf("%s: ChangeID err: %v", name, err)
+		}
+		if err := mh.SetUserID("mallory"); !errors.Is(err, ErrClientIDBound) {
+			t.Fatalf("%s: SetUserID err: %v", name, err)
+		}
+		_ = conn.Close()
+		_ = mh.Close()
+	}
+
+	// A second connection of the session replaces the first one
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	first, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("dial err: %v", err)
+	}
+	defer first.Close()
+	<-bound
+	second, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("dial err: %v", err)
+	}
+	defer second.Close()
+	if mh := <-bound; mh.ID() != "sess-1" {
+		t.Fatalf("replacing id %q, want sess-1", mh.ID())
+	}
+	_ = first.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := first.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("replaced connection read err: %v, want a normal close", err)
+	}
+	if err := hub.SendTo("sess-1", websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatalf("SendTo err: %v", err)
+	}
+	_ = second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, msg, err := second.ReadMessage(); err != nil || string(msg) != "hello" {
+		t.Fatalf("replacing connection message %q, err: %v", msg, err)
+	}
+}
+
+func Test_WebSocketQueryTokenRedacted(t *testing.T) {
+	keyPair, err := jwt.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair err: %v", err)
+	}
+	if _, err := NewWebSocketAuth(keyPair.PublicKey, WithWebSocketQueryToken("ws_token")); err != nil {
+		t.Fatalf("NewWebSocketAuth err: %v", err)
+	}
+	token, err := jwt.SignWithClaims(keyPair.PrivateKey, nil, jwt.NewOption().SetUserId("alice"))
+	if err != nil {
+		t.Fatalf("SignWithClaims err: %v", err)
+	}
+
+	// The URL as written to the access log
+	r := httptest.NewRequest(http.MethodGet, "/ws?access_token="+token+"&ws_token="+token+"&room=a", nil)
+	got := logger.RedactURL(r.URL)
+	if strings.Contains(got, token) || !strings.Contains(got, "room=a") {
+		t.Fatalf("logged URL %s", got)
+	}
+}
@@ -0,0 +1,201 @@
+package net
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	brokerDedupWindow   = time.Minute
+	brokerRetryInterval = time.Second
+)
+
+// BrokerKind is the audience of a message fanned out between the instances.
+type BrokerKind string
+
+const (
+	// BrokerBroadcast is delivered to every client.
+	BrokerBroadcast BrokerKind = "broadcast"
+	// BrokerRoom is delivered to the clients of the room Target.
+	BrokerRoom BrokerKind = "room"
+	// BrokerClient is delivered to the client of id Target.
+	BrokerClient BrokerKind = "client"
+	// BrokerUser is delivered to the connections of the user Target.
+	BrokerUser BrokerKind = "user"
+)
+
+// BrokerMessage is the envelope of a websocket message published to the hubs of the
+// other instances. ID de-duplicates the deliveries, Instance is the publishing hub.
+type BrokerMessage struct {
+	ID          string     `bson:"_id" json:"id"`
+	Instance    string     `bson:"instance" json:"instance"`
+	Kind        BrokerKind `bson:"kind" json:"kind"`
+	Target      string     `bson:"target,omitempty" json:"target,omitempty"`
+	MessageType int        `bson:"messageType" json:"messageType"`
+	Payload     []byte     `bson:"payload" json:"payload"`
+	CreatedAt   time.Time  `bson:"createdAt" json:"createdAt"`
+}
+
+// Broker fans out the messages of the hubs between the instances of the service. A message
+// may be delivered more than once, and to its publisher: the hubs drop the duplicates and
+// their own messages, already delivered to their clients.
+type Broker interface {
+	// Publish sends the message to the subscribers of every instance.
+	Publish(ctx context.Context, msg *BrokerMessage) error
+	// Subscribe calls handle with the messages published until ctx is done.
+	// It returns the error interrupting the subscription, the hub subscribes again.
+	Subscribe(ctx context.Context, handle func(msg *BrokerMessage)) error
+}
+
+// NewMemoryBroker creates a broker delivering the messages to the hubs of the process,
+// for the tests and the local development: share it between the hubs standing for instances.
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{subscribers: make(map[chan *BrokerMessage]struct{})}
+}
+
+// MemoryBroker is the in-memory Broker.
+type MemoryBroker struct {
+	mu          sync.RWMutex
+	subscribers map[chan *BrokerMessage]struct{}
+}
+
+func (b *MemoryBroker) Publish(ctx context.Context, msg *BrokerMessage) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for sub := range b.subscribers {
+		select {
+		case sub <- msg:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe(ctx context.Context, handle func(msg *BrokerMessage)) error {
+	sub := make(chan *BrokerMessage, 256)
+	b.mu.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.subscribers, sub)
+		b.mu.Unlock()
+	}()
+	for {
+		select {
+		case msg := <-sub:
+			handle(msg)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// publishBroker sends the message to the hubs of the other instances, if the hub has a broker.
+func (h *Hub) publishBroker(kind BrokerKind, target string, messageType int, message []byte) error {
+	if h.broker == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+	defer cancel()
+	err := h.broker.Publish(ctx, &BrokerMessage{
+		ID:          uuid.NewString(),
+		Instance:    h.instanceID,
+		Kind:        kind,
+		Target:      target,
+		MessageType: messageType,
+		Payload:     message,
+		CreatedAt:   time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish %s message to broker: %w", kind, err)
+	}
+	return nil
+}
+
+// subscribe delivers the messages of the other instances until ctx is done,
+// subscribing again when the broker interrupts the subscription.
+func (h *Hub) subscribe(ctx context.Context) {
+	for {
+		err := h.broker.Subscribe(ctx, h.deliverBroker)
+		if ctx.Err() != nil {
+			return
+		}
+		getLogEntry().Warn("Broker subscription interrupted",
+			zap.String("instance_id", h.instanceID), zap.Error(err))
+		select {
+		case <-time.After(brokerRetryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// deliverBroker delivers a message of another instance to the clients of this instance.
+// The messages of this instance were delivered when published, the duplicates are dropped.
+func (h *Hub) deliverBroker(msg *BrokerMessage) {
+	if msg.Instance == h.instanceID || !h.dedup.first(msg.ID) {
+		return
+	}
+	var err error
+	switch msg.Kind {
+	case BrokerBroadcast:
+		ch := h.broadcast
+		if msg.MessageType == websocket.BinaryMessage {
+			ch = h.broadcastBin
+		}
+		err = h.broadcastLocal(ch, msg.Payload)
+	case BrokerRoom:
+		err = h.publishLocal(roomMessage{room: msg.Target, messageType: msg.MessageType, message: msg.Payload})
+	case BrokerClient:
+		if client := h.clientByID(msg.Target); client != nil {
+			err = client.writeType(msg.MessageType, msg.Payload)
+		}
+	case BrokerUser:
+		err = h.sendToLocalUser(msg.Target, msg.MessageType, msg.Payload)
+	default:
+		err = fmt.Errorf("unknown message kind %q", msg.Kind)
+	}
+	if err != nil {
+		getLogEntry().Warn("Failed to deliver broker message",
+			zap.String("message_id", msg.ID),
+			zap.String("from_instance", msg.Instance),
+			zap.String("kind", string(msg.Kind)),
+			zap.String("target", msg.Target),
+			zap.Error(err))
+	}
+}
+
+// brokerDedup remembers the ids of the messages delivered during the window.
+type brokerDedup struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+// first reports whether the message id is delivered for the first time.
+func (d *brokerDedup) first(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	if now.Sub(d.lastSweep) >= brokerDedupWindow {
+		d.lastSweep = now
+		for k, at := range d.seen {
+			if now.Sub(at) > brokerDedupWindow {
+				delete(d.seen, k)
+			}
+		}
+	}
+	if _, ok := d.seen[id]; ok {
+		return false
+	}
+	d.seen[id] = now
+	return true
+}
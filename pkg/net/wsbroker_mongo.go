@@ -0,0 +1,117 @@
+package net
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/weeback/grpc-project-template/pkg/mongodb"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultBrokerCollection = "websocket_broker"
+	defaultBrokerTTL        = time.Minute
+)
+
+// NewMongoBroker creates a Broker publishing the messages in a MongoDB collection (default
+// "websocket_broker"), the hubs subscribe with a change stream: MongoDB must run as a replica
+// set. The messages expire with a TTL index, created if missing.
+//
+// Example usage:
+//
+//	broker, err := net.NewMongoBroker(ctx, databaseInter.Conn)
+//	hub := net.NewHub(net.WithBroker(broker))
+func NewMongoBroker(ctx context.Context, conn *mongodb.Connection, collection ...string) (*MongoBroker, error) {
+	b := &MongoBroker{conn: conn, collection: defaultBrokerCollection, ttl: defaultBrokerTTL}
+	if len(collection) > 0 && collection[0] != "" {
+		b.collection = collection[0]
+	}
+	err := conn.Write(ctx, func(db *mongo.Database) error {
+		_, err := db.Collection(b.collection).Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: "expireAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create broker TTL index: %w", err)
+	}
+	return b, nil
+}
+
+// MongoBroker is the Broker backed by a MongoDB change stream.
+type MongoBroker struct {
+	conn       *mongodb.Connection
+	collection string
+	ttl        time.Duration
+
+	// resumeToken resumes the change stream after an interruption, without losing messages
+	mu          sync.Mutex
+	resumeToken bson.Raw
+}
+
+type mongoBrokerDocument struct {
+	BrokerMessage `bson:",inline"`
+	ExpireAt      time.Time `bson:"expireAt"`
+}
+
+func (b *MongoBroker) Publish(ctx context.Context, msg *BrokerMessage) error {
+	return b.conn.Write(ctx, func(db *mongo.Database) error {
+		_, err := db.Collection(b.collection).InsertOne(ctx, mongoBrokerDocument{
+			BrokerMessage: *msg,
+			ExpireAt:      time.Now().Add(b.ttl),
+		})
+		return err
+	})
+}
+
+// Subscribe watches the inserts of the collection. It is called by one hub at a time.
+func (b *MongoBroker) Subscribe(ctx context.Context, handle func(msg *BrokerMessage)) error {
+	return b.conn.Write(ctx, func(db *mongo.Database) error {
+		opts := options.ChangeStream()
+		if token := b.lastResumeToken(); token != nil {
+			opts.SetResumeAfter(token)
+		}
+		pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.D{{Key: "operationType", Value: "insert"}}}}}
+		stream, err := db.Collection(b.collection).Watch(ctx, pipeline, opts)
+		if err != nil {
+			return fmt.Errorf("failed to watch broker collection: %w", err)
+		}
+		defer stream.Close(context.WithoutCancel(ctx))
+
+		for stream.Next(ctx) {
+			var event struct {
+				FullDocument BrokerMessage `bson:"fullDocument"`
+			}
+			if err := stream.Decode(&event); err != nil {
+				getLogEntry().Warn("Failed to decode broker message", zap.Error(err))
+			} else {
+				handle(&event.FullDocument)
+			}
+			b.setResumeToken(stream.ResumeToken())
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		return stream.Err()
+	})
+}
+
+// lastResumeToken returns the token of the last event handled, nil before the first one.
+func (b *MongoBroker) lastResumeToken() bson.Raw {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.resumeToken
+}
+
+func (b *MongoBroker) setResumeToken(token bson.Raw) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.resumeToken = token
+}
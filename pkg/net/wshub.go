@@ -1,15 +1,19 @@
 package net
 
 import (
-	"encoding/base64"
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
+
+	"github.com/weeback/grpc-project-template/pkg/jwt"
 )
 
 // WebSocket upgrader with basic configuration
@@ -24,18 +28,21 @@ var (
 		WriteBufferSize: 1024,
 	}
 
+	// ErrClientIDTaken is returned by ChangeID when another connected client has the id.
+	ErrClientIDTaken = errors.New("client id already taken")
+
 	hubInstance *Hub
 	hubOnce     = sync.Once{}
+	hubOptions  []HubOption
 
 	writeTimeout = 30 * time.Second
 	readTimeout  = 60 * time.Second
-	idleTimeout  = 120 * time.Second
 	pingCycle    = 54 * time.Second // Ping interval to keep the connection alive
 )
 
 func globalHubConnection() (*Hub, error) {
 	hubOnce.Do(func() {
-		hubInstance = NewHub()
+		hubInstance = NewHub(hubOptions...)
 	})
 	if hubInstance == nil {
 		return nil, fmt.Errorf("failed to create hub instance")
@@ -43,8 +50,48 @@ func globalHubConnection() (*Hub, error) {
 	return hubInstance, nil
 }
 
+// ConfigureGlobalHub sets the options of the global hub used by UpgradeToWebSocket,
+// before the first upgrade creates it.
+//
+// Example usage:
+//
+//	broker, err := net.NewMongoBroker(ctx, databaseInter.Conn)
+//	...
+//	if err := net.ConfigureGlobalHub(net.WithBroker(broker)); err != nil { ... }
+func ConfigureGlobalHub(opts ...HubOption) error {
+	configured := false
+	hubOnce.Do(func() {
+		hubInstance = NewHub(opts...)
+		configured = true
+	})
+	if !configured {
+		return fmt.Errorf("failed to configure hub: global hub already created")
+	}
+	return nil
+}
+
+// HubOption configures a Hub.
+type HubOption func(h *Hub)
+
+// WithBroker fans out the broadcasts, room publishes and direct messages of the hub to
+// the hubs of the other instances through the broker, see NewMemoryBroker and NewMongoBroker.
+func WithBroker(broker Broker) HubOption {
+	return func(h *Hub) {
+		h.broker = broker
+	}
+}
+
+// WithInstanceID sets the id of the instance in the broker messages, default is the hostname and pid.
+func WithInstanceID(id string) HubOption {
+	return func(h *Hub) {
+		if id != "" {
+			h.instanceID = id
+		}
+	}
+}
+
 // NewHub creates a new Hub
-func NewHub() *Hub {
+func NewHub(opts ...HubOption) *Hub {
 
 	// Initialize the hub with channels and client map
 	hub := &Hub{
@@ -52,23 +99,54 @@ func NewHub() *Hub {
 		broadcastBin: make(chan []byte, 256),
 		register:     make(chan *Client, 256),
 		unregister:   make(chan *Client, 256),
+		shutdown:     make(chan chan struct{}),
+		roomOps:      make(chan roomOp, 256),
+		roomcast:     make(chan roomMessage, 256),
 		clients:      make(map[*Client]bool),
+		byID:         make(map[string]*Client),
+		byUser:       make(map[string]map[*Client]struct{}),
+		rooms:        make(map[string]map[*Client]struct{}),
 		once:         sync.Once{}, // No pending clients initially
+		instanceID:   hostname,
+	}
+	for _, opt := range opts {
+		opt(hub)
 	}
 
 	// Start the hub in a goroutine
 	go hub.run()
+	if hub.broker != nil {
+		hub.dedup = &brokerDedup{seen: make(map[string]time.Time)}
+		ctx, cancel := context.WithCancel(context.Background())
+		hub.stopBroker = cancel
+		go hub.subscribe(ctx)
+	}
 	return hub
 }
 
-// Hub maintains the set of active clients and broadcasts messages to them
+// Hub maintains the set of active clients and broadcasts messages to them,
+// or to the clients of a room. The clients and rooms are owned by the hub loop,
+// the index by client id and user id is shared with the senders under mu.
 type Hub struct {
 	clients      map[*Client]bool
+	mu           sync.RWMutex
+	byID         map[string]*Client
+	byUser       map[string]map[*Client]struct{}
+	rooms        map[string]map[*Client]struct{}
 	broadcast    chan []byte
 	broadcastBin chan []byte
 	register     chan *Client
 	unregister   chan *Client
+	shutdown     chan chan struct{}
+	roomOps      chan roomOp
+	roomcast     chan roomMessage
 	once         sync.Once
+
+	// broker fans out the messages to the hubs of the other instances, nil for a single instance
+	broker     Broker
+	instanceID string
+	dedup      *brokerDedup
+	stopBroker context.CancelFunc
 }
 
 // Run starts the hub and handles client registration/unregistration and broadcasting
@@ -81,62 +159,110 @@ func (h *Hub) run() {
 			case client := <-h.register:
 				h.clients[client] = true
 				entry.Debug("Client connected",
-					zap.String("client_id", client.id), zap.Int("total_clients", len(h.clients)))
+					zap.String("client_id", client.ID()), zap.Int("total_clients", len(h.clients)))
 
 			case client := <-h.unregister:
+				// The rooms are left even if the client was dropped by a failed write
+				h.leaveRooms(client)
+				h.unindex(client)
 				if _, ok := h.clients[client]; ok {
-					delete(h.clients, client)
-					close(client.send)
-					close(client.recv)
+					h.guard(client, "unregister", func() {
+						delete(h.clients, client)
+						client.closeChannels()
+					})
 					entry.Debug("Client disconnected",
-						zap.String("client_id", client.id),
+						zap.String("client_id", client.ID()),
 						zap.Int("total_clients", len(h.clients)))
 				} else {
 					entry.Warn("Client not found in hub or already disconnected",
-						zap.String("client_id", client.id))
+						zap.String("client_id", client.ID()))
 				}
 
 			case message := <-h.broadcast:
 				// Broadcast message to all connected clients
 				for client := range h.clients {
-					if err := client.write(websocket.TextMessage, message); err != nil {
-						entry.Error("Error broadcast sending text message to client",
-							zap.String("client_id", client.id),
+					h.guard(client, "broadcast", func() {
+						if err := client.write(websocket.TextMessage, message); err != nil {
+							entry.Error("Error broadcast sending text message to client",
+								zap.String("client_id", client.ID()),
+								zap.Error(err))
+						}
+					})
+				}
+			case done := <-h.shutdown:
+				// Say goodbye to every client with a proper close frame
+				for client := range h.clients {
+					if err := client.closeWithFrame(websocket.CloseGoingAway, "server shutting down"); err != nil {
+						entry.Warn("Failed to send close frame to client",
+							zap.String("client_id", client.ID()),
 							zap.Error(err))
 					}
+					h.leaveRooms(client)
+					h.unindex(client)
+					h.guard(client, "shutdown", func() {
+						delete(h.clients, client)
+						client.closeChannels()
+					})
 				}
+				entry.Debug("Hub shutdown, all clients disconnected")
+				close(done)
+
+			case op := <-h.roomOps:
+				h.applyRoomOp(op)
+
+			case msg := <-h.roomcast:
+				// Publish message to the clients of the room only
+				h.publishRoom(msg)
+
 			case bin := <-h.broadcastBin:
 				// Broadcast binary message to all connected clients
 				for client := range h.clients {
-					if err := client.write(websocket.BinaryMessage, bin); err != nil {
-						entry.Error("Error broadcast sending binary message to client",
-							zap.String("client_id", client.id),
-							zap.Error(err))
-					}
+					h.guard(client, "broadcast", func() {
+						if err := client.write(websocket.BinaryMessage, bin); err != nil {
+							entry.Error("Error broadcast sending binary message to client",
+								zap.String("client_id", client.ID()),
+								zap.Error(err))
+						}
+					})
 				}
 			}
 		}
 	})
 }
 
-func (h *Hub) registerClient(conn *websocket.Conn, id string) *Client {
+// registerClient registers the connection, bound to the user of the claims if not nil.
+// The connection of claims takes over the id from the connection holding it, which is
+// closed, an id already taken without claims gets a unique suffix.
+func (h *Hub) registerClient(conn *websocket.Conn, id string, claims *jwt.MapClaims) *Client {
 
 	// Ensure the hub is initialized
 	// Create new client
 	client := &Client{
-		hub:  h,
-		conn: conn,
-		send: make(chan []byte, 256),
-		recv: make(chan []byte, 256),
-		id:   id,
+		hub:    h,
+		conn:   conn,
+		send:   make(chan []byte, 256),
+		recv:   make(chan []byte, 256),
+		rooms:  make(map[string]struct{}),
+		claims: claims,
 	}
 	// If id is empty, generate a unique ID
 	if id == "" {
-		client.id = fmt.Sprintf("client-%s-%d", conn.RemoteAddr().String(), time.Now().UnixNano())
+		id = fmt.Sprintf("client-%s-%d", conn.RemoteAddr().String(), time.Now().UnixNano())
 	}
+	client.id.Store(id)
 
-	// Register client with hub
+	// Index the client before the hub loop registers it, so that it can be sent to right away
+	replaced := h.index(client, claims != nil)
+	if claims != nil {
+		h.changeUserID(client, claims.UserId)
+	}
 	h.register <- client
+	if replaced != nil && replaced.conn != nil {
+		// Its read pump fails and unregisters it, the id stays with the new connection
+		getLogEntry().Info("Client replaced by a new connection", zap.String("client_id", id))
+		_ = replaced.closeWithFrame(websocket.CloseNormalClosure, "replaced by a new connection")
+		_ = replaced.conn.Close()
+	}
 
 	// Start goroutines for reading and writing
 	go client.writePump()
@@ -145,25 +271,71 @@ func (h *Hub) registerClient(conn *websocket.Conn, id string) *Client {
 	return client
 }
 
+// SendTo sends a message to the client of the id. With a broker, a client not connected
+// to this instance is looked up on the other instances, and no error tells it is missing.
 func (h *Hub) SendTo(receiveId string, messageType int, message []byte) error {
-	for client := range h.clients {
-		if client.id == receiveId {
-			switch messageType {
-			case websocket.TextMessage:
-				return client.SendMessage(message)
-			case websocket.BinaryMessage:
-				return client.SendBinaryMessage(message)
-			default:
-				return fmt.Errorf("unsupported message type: %d, please use websocket.TextMessage (1) or websocket.BinaryMessage (2)", messageType)
-			}
+	client := h.clientByID(receiveId)
+	if client == nil {
+		if h.broker != nil {
+			return h.publishBroker(BrokerClient, receiveId, messageType, message)
+		}
+		return fmt.Errorf("client %s not found", receiveId)
+	}
+	return client.writeType(messageType, message)
+}
+
+// SendToUser sends a message to every connection of the user, see Client.SetUserID.
+// With a broker, the connections of the user on the other instances receive it too.
+func (h *Hub) SendToUser(userID string, messageType int, message []byte) error {
+	var errs []error
+	if h.broker != nil {
+		if err := h.publishBroker(BrokerUser, userID, messageType, message); err != nil {
+			errs = append(errs, err)
+		}
+		if err := h.sendToLocalUser(userID, messageType, message); err != nil {
+			errs = append(errs, err)
 		}
+		return errors.Join(errs...)
 	}
-	return fmt.Errorf("client %s not found", receiveId)
+	clients := h.clientsOfUser(userID)
+	if len(clients) == 0 {
+		return fmt.Errorf("user %s not connected", userID)
+	}
+	return h.sendToLocalUser(userID, messageType, message)
 }
 
+// sendToLocalUser sends a message to the connections of the user on this instance.
+func (h *Hub) sendToLocalUser(userID string, messageType int, message []byte) error {
+	clients := h.clientsOfUser(userID)
+	var errs []error
+	for _, client := range clients {
+		if err := client.writeType(messageType, message); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// BroadcastMessage sends a text message to every client, on every instance with a broker.
 func (h *Hub) BroadcastMessage(message []byte) error {
+	if err := h.broadcastLocal(h.broadcast, message); err != nil {
+		return err
+	}
+	return h.publishBroker(BrokerBroadcast, "", websocket.TextMessage, message)
+}
+
+// BroadcastBinary sends a binary message to every client, on every instance with a broker.
+func (h *Hub) BroadcastBinary(b []byte) error {
+	if err := h.broadcastLocal(h.broadcastBin, b); err != nil {
+		return err
+	}
+	return h.publishBroker(BrokerBroadcast, "", websocket.BinaryMessage, b)
+}
+
+// broadcastLocal hands the message to the hub loop, for the clients of this instance.
+func (h *Hub) broadcastLocal(ch chan []byte, message []byte) error {
 	select {
-	case h.broadcast <- message:
+	case ch <- message:
 		return nil
 	case <-time.After(writeTimeout):
 		return fmt.Errorf("failed to broadcast message: write timeout")
@@ -173,15 +345,23 @@ func (h *Hub) BroadcastMessage(message []byte) error {
 	}
 }
 
-func (h *Hub) BroadcastBinary(b []byte) error {
+// Shutdown disconnects every client of the hub with a "going away" close frame.
+// It blocks until all clients are released or the context is done.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	if h.stopBroker != nil {
+		h.stopBroker()
+	}
+	done := make(chan struct{})
+	select {
+	case h.shutdown <- done:
+	case <-ctx.Done():
+		return fmt.Errorf("failed to shutdown hub: %w", ctx.Err())
+	}
 	select {
-	case h.broadcastBin <- b:
+	case <-done:
 		return nil
-	case <-time.After(writeTimeout):
-		return fmt.Errorf("failed to broadcast message: write timeout")
-	default:
-		// Notify hub to unregister the client
-		return fmt.Errorf("failed to broadcast message: closing connection")
+	case <-ctx.Done():
+		return fmt.Errorf("failed to shutdown hub: %w", ctx.Err())
 	}
 }
 
@@ -190,23 +370,62 @@ type Client struct {
 	conn       *websocket.Conn
 	send, recv chan []byte
 	hub        *Hub
-	id         string
+	id, userID atomic.Value        // string, changed under hub.mu
+	rooms      map[string]struct{} // owned by the hub loop
+
+	mu     sync.RWMutex // closed guards the sends on send and recv
+	closed bool
+
+	// claims of the authenticated upgrade, they bind the id and the user of the client
+	claims *jwt.MapClaims
 }
 
 func (c *Client) ID() string {
-	return c.id
+	id, _ := c.id.Load().(string)
+	return id
 }
 
+// ChangeID changes the id of the client, an id already taken by another connected
+// client is rejected with ErrClientIDTaken and the current id is kept.
 func (c *Client) ChangeID(id string) error {
 	// Change the client's ID
 	if id == "" {
-		return fmt.Errorf("invalid ID provided for client %s, keeping the current ID", c.id)
+		return fmt.Errorf("invalid ID provided for client %s, keeping the current ID", c.ID())
+	}
+	if c.claims != nil {
+		return ErrClientIDBound
+	}
+	if err := c.hub.changeID(c, id); err != nil {
+		return err
+	}
+	getLogEntry().Info("Client ID changed", zap.String("client_id", id))
+	return nil
+}
+
+// UserID returns the user of the connection, empty until SetUserID.
+func (c *Client) UserID() string {
+	userID, _ := c.userID.Load().(string)
+	return userID
+}
+
+// SetUserID binds the connection to a user, a user may have several connections.
+func (c *Client) SetUserID(userID string) error {
+	if c.claims != nil {
+		if userID == c.claims.UserId {
+			return nil
+		}
+		return ErrClientIDBound
 	}
-	c.id = id // Log the ID change
-	getLogEntry().Info("Client ID changed", zap.String("client_id", c.id))
+	c.hub.changeUserID(c, userID)
 	return nil
 }
 
+// Claims returns the claims of the token verified by the upgrade, nil for a client
+// upgraded without authentication.
+func (c *Client) Claims() *jwt.MapClaims {
+	return c.claims
+}
+
 func (c *Client) Close() error {
 	// Close the WebSocket connection and notify the hub
 	c.hub.unregister <- c
@@ -217,6 +436,16 @@ func (c *Client) Close() error {
 	return nil
 }
 
+// closeWithFrame writes a close control frame with the given code and reason.
+// WriteControl is safe to call concurrently with the write pump.
+func (c *Client) closeWithFrame(code int, reason string) error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason), time.Now().Add(writeTimeout))
+}
+
 func (c *Client) SendMessage(message []byte) error {
 	return c.write(websocket.TextMessage, message)
 }
@@ -225,10 +454,19 @@ func (c *Client) SendBinaryMessage(message []byte) error {
 	return c.write(websocket.BinaryMessage, message)
 }
 
+func (c *Client) writeType(messageType int, message []byte) error {
+	switch messageType {
+	case websocket.TextMessage, websocket.BinaryMessage:
+		return c.write(messageType, message)
+	default:
+		return fmt.Errorf("unsupported message type: %d, please use websocket.TextMessage (1) or websocket.BinaryMessage (2)", messageType)
+	}
+}
+
 func (c *Client) ReceiveMessage() ([]byte, error) {
 	message, ok := <-c.recv
 	if !ok {
-		return nil, fmt.Errorf("client %s disconnected", c.id)
+		return nil, fmt.Errorf("client %s disconnected", c.ID())
 	}
 	return message, nil
 }
@@ -247,15 +485,48 @@ func (c *Client) write(messageType int, data []byte) error {
 	default:
 		return fmt.Errorf("unsupported message type: %d", messageType)
 	}
+	// The senders of any goroutine check the channels are open, the hub loop closes them
+	c.mu.RLock()
+	if c.closed {
+		c.mu.RUnlock()
+		return fmt.Errorf("client %s disconnected", c.ID())
+	}
 	select {
 	case c.send <- message:
+		c.mu.RUnlock()
 		return nil
-	case <-time.After(writeTimeout):
-		return fmt.Errorf("failed to send message to client %s, connection timeout", c.id)
 	default:
-		// Notify hub to unregister the client
-		c.hub.unregister <- c
-		return fmt.Errorf("failed to send message to client %s, closing connection", c.id)
+		c.mu.RUnlock()
+	}
+	// Notify hub to unregister the client
+	c.hub.unregister <- c
+	return fmt.Errorf("failed to send message to client %s, closing connection", c.ID())
+}
+
+// deliver queues a received message for ReceiveMessage, it reports false when
+// the client is disconnected or its buffer is full.
+func (c *Client) deliver(message []byte) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return false
+	}
+	select {
+	case c.recv <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeChannels closes the send and receive channels once, in the hub loop.
+func (c *Client) closeChannels() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.send)
+		close(c.recv)
 	}
 }
 
@@ -265,6 +536,7 @@ func (c *Client) readPump() {
 		c.hub.unregister <- c
 		c.conn.Close()
 	}()
+	defer c.recoverClient("readPump")
 
 	entry := getLogEntry()
 
@@ -280,7 +552,7 @@ func (c *Client) readPump() {
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				entry.Error("WebSocket read error",
-					zap.String("client_id", c.id),
+					zap.String("client_id", c.ID()),
 					zap.Error(err))
 			}
 			break
@@ -288,20 +560,17 @@ func (c *Client) readPump() {
 
 		// Process received message
 		entry.Info("Received message from client",
-			zap.String("client_id", c.id),
-			zap.ByteString("message", message))
+			zap.String("client_id", c.ID()),
+			zap.Int("size", len(message)))
 
 		// Process the message (e.g., broadcast it to other clients)
 
-		select {
-		case c.recv <- message:
-		case <-time.After(idleTimeout):
-			entry.Warn("Client idle timeout, skip message",
-				zap.String("client_id", c.id),
-				zap.ByteString("message", message))
-		default:
-			close(c.recv)
-			delete(c.hub.clients, c)
+		if !c.deliver(message) {
+			// The application does not consume the messages, the client is unregistered
+			entry.Warn("Client receive buffer full or disconnected, closing connection",
+				zap.String("client_id", c.ID()),
+				zap.Int("size", len(message)))
+			return
 		}
 	}
 }
@@ -315,10 +584,11 @@ func (c *Client) writePump() {
 		ticker.Stop()
 		c.conn.Close()
 	}()
+	defer c.recoverClient("writePump")
 
 	for {
 		entry.Info("Writing to client",
-			zap.String("client_id", c.id))
+			zap.String("client_id", c.ID()))
 		select {
 		case message, ok := <-c.send:
 			if !ok {
@@ -328,7 +598,7 @@ func (c *Client) writePump() {
 			}
 			if len(message) == 0 {
 				entry.Warn("No message to send to client",
-					zap.String("client_id", c.id))
+					zap.String("client_id", c.ID()))
 				continue
 			}
 
@@ -347,8 +617,8 @@ func (c *Client) writePump() {
 					actualMessage = message[2:] // Remove the prefix
 				default:
 					entry.Warn("Unknown message type, treating as text",
-						zap.String("client_id", c.id),
-						zap.ByteString("message", message))
+						zap.String("client_id", c.ID()),
+						zap.Int("size", len(message)))
 					messageType = websocket.TextMessage
 					actualMessage = message[1:] // Remove the prefix
 				}
@@ -356,27 +626,114 @@ func (c *Client) writePump() {
 
 			if err := c.conn.WriteMessage(messageType, actualMessage); err != nil {
 				entry.Error("Failed to write message to client",
-					zap.String("client_id", c.id),
+					zap.String("client_id", c.ID()),
 					zap.Error(err))
 			}
 
-			// Log the message sent to the client
-			entry = entry.With(zap.String("client_id", c.id), zap.ByteString("message", actualMessage))
-			if messageType == websocket.BinaryMessage {
-				entry = entry.With(zap.String("message",
-					fmt.Sprintf("Binary message of length %d: %s", len(actualMessage), base64.StdEncoding.EncodeToString(actualMessage))))
-			}
-			// Process write message
-			entry.Info("Sent to client")
+			// Log the message sent to the client, its content may be sensitive
+			entry.Info("Sent to client",
+				zap.String("client_id", c.ID()),
+				zap.Bool("binary", messageType == websocket.BinaryMessage),
+				zap.Int("size", len(actualMessage)))
 
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				entry.Error("Failed to send ping to client",
-					zap.String("client_id", c.id),
+					zap.String("client_id", c.ID()),
 					zap.Error(err))
 				return
 			}
 		}
 	}
 }
+
+// index adds the client to the index. An id already taken gets a unique suffix, or with
+// replace is taken over: the client holding it is removed from the index and returned.
+func (h *Hub) index(client *Client, replace bool) (replaced *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	id := client.ID()
+	if other, taken := h.byID[id]; taken && replace {
+		h.removeUser(other)
+		replaced = other
+	} else if taken {
+		id = fmt.Sprintf("%s-%d", id, time.Now().UnixNano())
+		client.id.Store(id)
+	}
+	h.byID[id] = client
+	return replaced
+}
+
+// unindex removes the client from the index.
+func (h *Hub) unindex(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.byID[client.ID()] == client {
+		delete(h.byID, client.ID())
+	}
+	h.removeUser(client)
+}
+
+func (h *Hub) changeID(client *Client, id string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	current := client.ID()
+	if id == current {
+		return nil
+	}
+	if other, taken := h.byID[id]; taken && other != client {
+		return fmt.Errorf("%w: %s, keeping the current ID %s", ErrClientIDTaken, id, current)
+	}
+	if h.byID[current] == client {
+		delete(h.byID, current)
+		h.byID[id] = client
+	}
+	client.id.Store(id)
+	return nil
+}
+
+func (h *Hub) changeUserID(client *Client, userID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// A client unregistered is not indexed again
+	indexed := h.byID[client.ID()] == client
+	h.removeUser(client)
+	client.userID.Store(userID)
+	if userID == "" || !indexed {
+		return
+	}
+	clients, ok := h.byUser[userID]
+	if !ok {
+		clients = make(map[*Client]struct{})
+		h.byUser[userID] = clients
+	}
+	clients[client] = struct{}{}
+}
+
+// removeUser removes the client from the connections of its user, under h.mu.
+func (h *Hub) removeUser(client *Client) {
+	userID := client.UserID()
+	if clients, ok := h.byUser[userID]; ok {
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(h.byUser, userID)
+		}
+	}
+}
+
+func (h *Hub) clientByID(id string) *Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.byID[id]
+}
+
+func (h *Hub) clientsOfUser(userID string) []*Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	clients := make([]*Client, 0, len(h.byUser[userID]))
+	for client := range h.byUser[userID] {
+		clients = append(clients, client)
+	}
+	return clients
+}
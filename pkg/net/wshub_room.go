@@ -0,0 +1,202 @@
+package net
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+type roomOpKind int
+
+const (
+	roomJoin roomOpKind = iota
+	roomLeave
+	roomMembers
+	roomsOfClient
+)
+
+// roomOp is a change or a listing of the rooms, applied by the hub loop which owns them.
+type roomOp struct {
+	kind     roomOpKind
+	clientID string
+	room     string
+	reply    chan roomReply
+}
+
+type roomReply struct {
+	list []string
+	err  error
+}
+
+// roomMessage is a message published to the members of a room.
+type roomMessage struct {
+	room        string
+	messageType int
+	message     []byte
+}
+
+// Join adds the client to the room, the room is created by its first member.
+// A client joins a room once, joining again is not an error.
+func (h *Hub) Join(clientID, room string) error {
+	_, err := h.roomRequest(roomOp{kind: roomJoin, clientID: clientID, room: room})
+	return err
+}
+
+// Leave removes the client from the room, the room is deleted with its last member.
+func (h *Hub) Leave(clientID, room string) error {
+	_, err := h.roomRequest(roomOp{kind: roomLeave, clientID: clientID, room: room})
+	return err
+}
+
+// RoomMembers returns the ids of the clients of the room, sorted.
+func (h *Hub) RoomMembers(room string) ([]string, error) {
+	return h.roomRequest(roomOp{kind: roomMembers, room: room})
+}
+
+// ClientRooms returns the rooms joined by the client, sorted.
+func (h *Hub) ClientRooms(clientID string) ([]string, error) {
+	return h.roomRequest(roomOp{kind: roomsOfClient, clientID: clientID})
+}
+
+// PublishToRoom sends a text message to every client of the room, on every instance with a broker.
+func (h *Hub) PublishToRoom(room string, message []byte) error {
+	return h.publish(roomMessage{room: room, messageType: websocket.TextMessage, message: message})
+}
+
+// PublishBinaryToRoom sends a binary message to every client of the room, on every instance with a broker.
+func (h *Hub) PublishBinaryToRoom(room string, b []byte) error {
+	return h.publish(roomMessage{room: room, messageType: websocket.BinaryMessage, message: b})
+}
+
+func (h *Hub) publish(msg roomMessage) error {
+	if msg.room == "" {
+		return fmt.Errorf("failed to publish message: empty room")
+	}
+	if err := h.publishLocal(msg); err != nil {
+		return err
+	}
+	return h.publishBroker(BrokerRoom, msg.room, msg.messageType, msg.message)
+}
+
+// publishLocal hands the message to the hub loop, for the members of the room on this instance.
+func (h *Hub) publishLocal(msg roomMessage) error {
+	select {
+	case h.roomcast <- msg:
+		return nil
+	case <-time.After(writeTimeout):
+		return fmt.Errorf("failed to publish message to room %s: write timeout", msg.room)
+	}
+}
+
+// roomRequest sends the operation to the hub loop and waits for its reply.
+func (h *Hub) roomRequest(op roomOp) ([]string, error) {
+	if (op.kind != roomsOfClient && op.room == "") || (op.kind != roomMembers && op.clientID == "") {
+		return nil, fmt.Errorf("invalid room %q or client %q", op.room, op.clientID)
+	}
+	op.reply = make(chan roomReply, 1)
+	select {
+	case h.roomOps <- op:
+	case <-time.After(writeTimeout):
+		return nil, fmt.Errorf("failed to update room %s: hub timeout", op.room)
+	}
+	select {
+	case reply := <-op.reply:
+		return reply.list, reply.err
+	case <-time.After(writeTimeout):
+		return nil, fmt.Errorf("failed to update room %s: hub timeout", op.room)
+	}
+}
+
+// applyRoomOp runs in the hub loop.
+func (h *Hub) applyRoomOp(op roomOp) {
+	var reply roomReply
+	switch op.kind {
+	case roomMembers:
+		for client := range h.rooms[op.room] {
+			reply.list = append(reply.list, client.ID())
+		}
+		sort.Strings(reply.list)
+	case roomsOfClient:
+		client := h.lookup(op.clientID)
+		if client == nil {
+			reply.err = fmt.Errorf("client %s not found", op.clientID)
+			break
+		}
+		for room := range client.rooms {
+			reply.list = append(reply.list, room)
+		}
+		sort.Strings(reply.list)
+	case roomJoin:
+		client := h.lookup(op.clientID)
+		if client == nil {
+			reply.err = fmt.Errorf("client %s not found", op.clientID)
+			break
+		}
+		members, ok := h.rooms[op.room]
+		if !ok {
+			members = make(map[*Client]struct{})
+			h.rooms[op.room] = members
+		}
+		members[client] = struct{}{}
+		client.rooms[op.room] = struct{}{}
+		getLogEntry().Debug("Client joined room",
+			zap.String("client_id", client.ID()),
+			zap.String("room", op.room),
+			zap.Int("total_members", len(members)))
+	case roomLeave:
+		client := h.lookup(op.clientID)
+		if client == nil {
+			reply.err = fmt.Errorf("client %s not found", op.clientID)
+			break
+		}
+		h.leaveRoom(client, op.room)
+	}
+	op.reply <- reply
+}
+
+// leaveRoom removes the client from the room, in the hub loop.
+func (h *Hub) leaveRoom(client *Client, room string) {
+	delete(client.rooms, room)
+	members, ok := h.rooms[room]
+	if !ok {
+		return
+	}
+	delete(members, client)
+	if len(members) == 0 {
+		delete(h.rooms, room)
+	}
+	getLogEntry().Debug("Client left room",
+		zap.String("client_id", client.ID()),
+		zap.String("room", room),
+		zap.Int("total_members", len(members)))
+}
+
+// leaveRooms removes the disconnected client from all its rooms, in the hub loop.
+func (h *Hub) leaveRooms(client *Client) {
+	for room := range client.rooms {
+		h.leaveRoom(client, room)
+	}
+}
+
+// publishRoom writes the message to the members of the room, in the hub loop.
+func (h *Hub) publishRoom(msg roomMessage) {
+	for client := range h.rooms[msg.room] {
+		h.guard(client, "publish", func() {
+			if err := client.write(msg.messageType, msg.message); err != nil {
+				getLogEntry().Error("Error publishing message to client",
+					zap.String("client_id", client.ID()),
+					zap.String("room", msg.room),
+					zap.Error(err))
+			}
+		})
+	}
+}
+
+// lookup returns the connected client of the id, in the hub loop. The clients are
+// indexed by the upgrade, before the loop registers them.
+func (h *Hub) lookup(clientID string) *Client {
+	return h.clientByID(clientID)
+}
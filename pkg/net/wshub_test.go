@@ -0,0 +1,268 @@
+package net
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newIndexedClients indexes n clients without connection, as registerClient does.
+func newIndexedClients(h *Hub, n int) []*Client {
+	clients := make([]*Client, n)
+	for i := range clients {
+		c := &Client{
+			hub:   h,
+			send:  make(chan []byte, 256),
+			recv:  make(chan []byte, 256),
+			rooms: make(map[string]struct{}),
+		}
+		c.id.Store(fmt.Sprintf("client-%d", i))
+		h.index(c, false)
+		clients[i] = c
+	}
+	return clients
+}
+
+func Test_HubChangeID(t *testing.T) {
+	h := NewHub()
+	clients := newIndexedClients(h, 2)
+
+	if err := clients[0].ChangeID("client-1"); !errors.Is(err, ErrClientIDTaken) {
+		t.Fatalf("ChangeID to a taken id err: %v", err)
+	}
+	if got := clients[0].ID(); got != "client-0" {
+		t.Fatalf("ChangeID rejected, id: %s", got)
+	}
+	if err := clients[0].ChangeID("alice-phone"); err != nil {
+		t.Fatalf("ChangeID err: %v", err)
+	}
+	if h.clientByID("alice-phone") != clients[0] || h.clientByID("client-0") != nil {
+		t.Fatalf("index not updated by ChangeID")
+	}
+
+	_ = clients[0].SetUserID("alice")
+	_ = clients[1].SetUserID("alice")
+	if err := h.SendToUser("alice", websocket.TextMessage, []byte("hi")); err != nil {
+		t.Fatalf("SendToUser err: %v", err)
+	}
+	for _, c := range clients {
+		if len(c.send) != 1 {
+			t.Fatalf("SendToUser did not reach %s", c.ID())
+		}
+	}
+
+	h.unindex(clients[0])
+	if h.clientByID("alice-phone") != nil || len(h.clientsOfUser("alice")) != 1 {
+		t.Fatalf("client not removed from the index")
+	}
+}
+
+// waitFor polls the condition until it holds, the test fails after a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func Test_HubRooms(t *testing.T) {
+	h := NewHub()
+	clients := newIndexedClients(h, 3)
+	for _, c := range clients {
+		h.register <- c
+	}
+
+	for _, join := range [][2]string{{"client-0", "lobby"}, {"client-1", "lobby"}, {"client-1", "lobby"}, {"client-1", "games"}, {"client-2", "games"}} {
+		if err := h.Join(join[0], join[1]); err != nil {
+			t.Fatalf("Join %v err: %v", join, err)
+		}
+	}
+	if err := h.Join("unknown", "lobby"); err == nil {
+		t.Fatalf("Join of an unknown client succeeded")
+	}
+	if members, _ := h.RoomMembers("lobby"); fmt.Sprint(members) != "[client-0 client-1]" {
+		t.Fatalf("RoomMembers lobby: %v", members)
+	}
+	if rooms, _ := h.ClientRooms("client-1"); fmt.Sprint(rooms) != "[games lobby]" {
+		t.Fatalf("ClientRooms client-1: %v", rooms)
+	}
+
+	if err := h.PublishToRoom("lobby", []byte("hello lobby")); err != nil {
+		t.Fatalf("PublishToRoom err: %v", err)
+	}
+	for _, c := range clients[:2] {
+		select {
+		case message := <-c.send:
+			if string(message[2:]) != "hello lobby" {
+				t.Fatalf("%s got %q", c.ID(), message[2:])
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s did not get the room message", c.ID())
+		}
+	}
+	// The room messages are written in the hub loop, a listing runs after them
+	_, _ = h.RoomMembers("lobby")
+	if len(clients[2].send) != 0 {
+		t.Fatalf("client-2 got a message of a room it did not join")
+	}
+
+	if err := h.Leave("client-1", "lobby"); err != nil {
+		t.Fatalf("Leave err: %v", err)
+	}
+	if members, _ := h.RoomMembers("lobby"); fmt.Sprint(members) != "[client-0]" {
+		t.Fatalf("RoomMembers lobby after Leave: %v", members)
+	}
+	if rooms, _ := h.ClientRooms("client-1"); fmt.Sprint(rooms) != "[games]" {
+		t.Fatalf("ClientRooms client-1 after Leave: %v", rooms)
+	}
+
+	// A disconnected client leaves its rooms, the empty rooms are deleted
+	h.unregister <- clients[0]
+	h.unregister <- clients[2]
+	waitFor(t, "the rooms of the disconnected clients", func() bool {
+		lobby, _ := h.RoomMembers("lobby")
+		games, _ := h.RoomMembers("games")
+		return len(lobby) == 0 && fmt.Sprint(games) == "[client-1]"
+	})
+	if _, err := h.ClientRooms("client-0"); err == nil {
+		t.Fatalf("ClientRooms of a disconnected client succeeded")
+	}
+	// The reply of the listing orders the read of the rooms after the hub loop changed them
+	_, _ = h.RoomMembers("games")
+	if len(h.rooms) != 1 {
+		t.Fatalf("%d rooms left, want the games room only", len(h.rooms))
+	}
+}
+
+func Test_HubConcurrentSendTo(t *testing.T) {
+	h := NewHub()
+	clients := newIndexedClients(h, 64)
+
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_ = c.ChangeID(fmt.Sprintf("renamed-%d", i))
+		}()
+		go func() {
+			defer wg.Done()
+			_ = h.SendTo(fmt.Sprintf("client-%d", i), websocket.TextMessage, []byte("hi"))
+			_ = h.SendTo(fmt.Sprintf("renamed-%d", i), websocket.TextMessage, []byte("hi"))
+		}()
+	}
+	wg.Wait()
+}
+
+// Benchmark_HubSendTo shows the cost of a send by id does not depend on the number of connections.
+func Benchmark_HubSendTo(b *testing.B) {
+	message := []byte(`{"type":"message","content":"hello"}`)
+	for _, n := range []int{1_000, 10_000, 50_000} {
+		h := NewHub()
+		clients := newIndexedClients(h, n)
+
+		b.Run(fmt.Sprintf("clients=%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				c := clients[i%n]
+				if err := h.SendTo(c.ID(), websocket.TextMessage, message); err != nil {
+					b.Fatal(err)
+				}
+				<-c.send
+			}
+		})
+
+		b.Run(fmt.Sprintf("clients=%d/parallel", n), func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if h.clientByID(clients[n/2].ID()) == nil {
+						b.Fatal("client not found")
+					}
+				}
+			})
+		})
+	}
+}
+
+func Test_HubBroker(t *testing.T) {
+	broker := NewMemoryBroker()
+	h1 := NewHub(WithBroker(broker), WithInstanceID("instance-1"))
+	h2 := NewHub(WithBroker(broker), WithInstanceID("instance-2"))
+	defer h1.stopBroker()
+	defer h2.stopBroker()
+
+	c1 := newIndexedClients(h1, 1)[0]
+	c2 := newIndexedClients(h2, 1)[0]
+	if err := c2.ChangeID("remote"); err != nil {
+		t.Fatalf("ChangeID err: %v", err)
+	}
+	_ = c2.SetUserID("bob")
+	h1.register <- c1
+	h2.register <- c2
+	if err := h2.Join("remote", "lobby"); err != nil {
+		t.Fatalf("Join err: %v", err)
+	}
+	// Wait for both subscriptions, the memory broker drops nothing once subscribed
+	waitFor(t, "the broker subscriptions", func() bool {
+		broker.mu.RLock()
+		defer broker.mu.RUnlock()
+		return len(broker.subscribers) == 2
+	})
+
+	for _, send := range []func() error{
+		func() error { return h1.BroadcastMessage([]byte("all")) },
+		func() error { return h1.PublishToRoom("lobby", []byte("room")) },
+		func() error { return h1.SendTo("remote", websocket.TextMessage, []byte("direct")) },
+		func() error { return h1.SendToUser("bob", websocket.TextMessage, []byte("user")) },
+	} {
+		if err := send(); err != nil {
+			t.Fatalf("send err: %v", err)
+		}
+	}
+	// The hub loop and the direct writes do not keep the order between the kinds
+	got := make(map[string]bool)
+	for range 4 {
+		select {
+		case message := <-c2.send:
+			got[string(message[2:])] = true
+		case <-time.After(time.Second):
+			t.Fatalf("remote client got only %v", got)
+		}
+	}
+	for _, want := range []string{"all", "room", "direct", "user"} {
+		if !got[want] {
+			t.Fatalf("remote client did not get %q, got %v", want, got)
+		}
+	}
+	// The broadcast reaches the local client once, its own echo is dropped
+	select {
+	case message := <-c1.send:
+		if string(message[2:]) != "all" {
+			t.Fatalf("local client got %q", message[2:])
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("local client did not get the broadcast")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(c1.send) != 0 {
+		t.Fatalf("local client got %d duplicate messages", len(c1.send))
+	}
+
+	// A message delivered twice by the broker is delivered once
+	dup := &BrokerMessage{ID: "dup", Instance: "instance-1", Kind: BrokerClient, Target: "remote",
+		MessageType: websocket.TextMessage, Payload: []byte("once")}
+	h2.deliverBroker(dup)
+	h2.deliverBroker(dup)
+	if len(c2.send) != 1 {
+		t.Fatalf("duplicate delivered, %d messages", len(c2.send))
+	}
+}
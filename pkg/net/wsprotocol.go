@@ -0,0 +1,413 @@
+package net
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// EnvelopeVersion is the version of the websocket envelope, an envelope without version is of
+// the current version.
+const EnvelopeVersion = 1
+
+// The types reserved by the protocol, the replies carry the id of the request as correlation id.
+const (
+	// EnvelopeResponse carries the result of a request.
+	EnvelopeResponse = "response"
+	// EnvelopeAck acknowledges a request without result.
+	EnvelopeAck = "ack"
+	// EnvelopeError carries the error of a request, or of an invalid message.
+	EnvelopeError = "error"
+)
+
+const (
+	defaultWSRouterTimeout     = 30 * time.Second
+	defaultWSRouterConcurrency = 32
+)
+
+// Envelope is a message of the websocket protocol, sent as a JSON text message:
+//
+//	{"v":1,"type":"chat.send","id":"8c5e...","payload":{"content":"hello"}}
+//
+// The payload is JSON, or the JSON mapping of a protobuf Any ({"@type":"type.googleapis.com/...",...}).
+type Envelope struct {
+	Version       int             `json:"v"`
+	Type          string          `json:"type"`
+	ID            string          `json:"id,omitempty"`
+	CorrelationID string          `json:"correlationId,omitempty"`
+	Payload       json.RawMessage `json:"payload,omitempty"`
+	Error         *EnvelopeStatus `json:"error,omitempty"`
+	Timestamp     time.Time       `json:"ts"`
+}
+
+// EnvelopeStatus is the error of an error frame, with the gRPC code of the error.
+type EnvelopeStatus struct {
+	Code    codes.Code `json:"code"`
+	Status  string     `json:"status"`
+	Message string     `json:"message"`
+}
+
+// NewEnvelope creates an envelope of the type, with a new id. The payload is marshaled as
+// a protobuf Any for a proto.Message, kept for a json.RawMessage, marshaled to JSON otherwise.
+func NewEnvelope(msgType string, payload any) (*Envelope, error) {
+	raw, err := marshalPayload(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s payload: %w", msgType, err)
+	}
+	return &Envelope{
+		Version:   EnvelopeVersion,
+		Type:      msgType,
+		ID:        uuid.NewString(),
+		Payload:   raw,
+		Timestamp: time.Now(),
+	}, nil
+}
+
+// MarshalEnvelope returns the text message of a new envelope, to broadcast or publish to a room.
+func MarshalEnvelope(msgType string, payload any) ([]byte, error) {
+	env, err := NewEnvelope(msgType, payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(env)
+}
+
+func marshalPayload(payload any) (json.RawMessage, error) {
+	switch p := payload.(type) {
+	case nil:
+		return nil, nil
+	case json.RawMessage:
+		return p, nil
+	case proto.Message:
+		a, err := anypb.New(p)
+		if err != nil {
+			return nil, err
+		}
+		return protojson.Marshal(a)
+	default:
+		return json.Marshal(p)
+	}
+}
+
+// Decode unmarshals the payload into v, a proto.Message from a protobuf Any or from its
+// JSON mapping, any other value from JSON.
+func (e *Envelope) Decode(v any) error {
+	if len(e.Payload) == 0 {
+		return fmt.Errorf("empty %s payload", e.Type)
+	}
+	if m, ok := v.(proto.Message); ok {
+		var a anypb.Any
+		if err := protojson.Unmarshal(e.Payload, &a); err == nil {
+			return a.UnmarshalTo(m)
+		}
+		return protojson.Unmarshal(e.Payload, m)
+	}
+	return json.Unmarshal(e.Payload, v)
+}
+
+// Err returns the status error of an error frame, nil for the other envelopes.
+func (e *Envelope) Err() error {
+	if e.Type != EnvelopeError {
+		return nil
+	}
+	if e.Error == nil {
+		return status.Error(codes.Unknown, "error frame without status")
+	}
+	return status.Error(e.Error.Code, e.Error.Message)
+}
+
+// reply creates the response, ack or error frame of the request.
+func (e *Envelope) reply(result any, err error) (*Envelope, error) {
+	var (
+		env *Envelope
+		me  error
+	)
+	switch {
+	case err != nil:
+		st := status.Convert(err)
+		env, me = NewEnvelope(EnvelopeError, nil)
+		if me == nil {
+			env.Error = &EnvelopeStatus{Code: st.Code(), Status: st.Code().String(), Message: st.Message()}
+		}
+	case result != nil:
+		env, me = NewEnvelope(EnvelopeResponse, result)
+	default:
+		env, me = NewEnvelope(EnvelopeAck, nil)
+	}
+	if me != nil {
+		return nil, me
+	}
+	env.CorrelationID = e.ID
+	return env, nil
+}
+
+// WSHandlerFunc handles the envelopes of a type received from the client. The result is sent
+// back as a response, an error as an error frame with its gRPC code (status.Error), and
+// no result as an acknowledgement. Nothing is sent back for an envelope without id.
+type WSHandlerFunc func(ctx context.Context, client MessageChannel, msg *Envelope) (any, error)
+
+// WSRouterOption configures a WSRouter.
+type WSRouterOption func(rt *WSRouter)
+
+// WithWSRouterTimeout sets the deadline of the handlers, and of the requests to the clients
+// without deadline, default 30 seconds.
+func WithWSRouterTimeout(d time.Duration) WSRouterOption {
+	return func(rt *WSRouter) {
+		if d > 0 {
+			rt.timeout = d
+		}
+	}
+}
+
+// WithWSRouterConcurrency sets how many handlers of a client run at the same time, default 32.
+// An envelope received while the client has as many handlers running is answered with a
+// RESOURCE_EXHAUSTED error, the replies to the requests of the server are always read.
+func WithWSRouterConcurrency(n int) WSRouterOption {
+	return func(rt *WSRouter) {
+		if n > 0 {
+			rt.concurrency = n
+		}
+	}
+}
+
+// NewWSRouter creates the router of the websocket envelopes to their handlers.
+//
+// Example usage:
+//
+//	router := net.NewWSRouter()
+//	router.Handle("chat.send", func(ctx context.Context, client net.MessageChannel, msg *net.Envelope) (any, error) {
+//		var req struct{ Content string `json:"content"` }
+//		if err := msg.Decode(&req); err != nil {
+//			return nil, status.Error(codes.InvalidArgument, err.Error())
+//		}
+//		...
+//		return nil, nil // acknowledged
+//	})
+//
+//	func handler(w http.ResponseWriter, r *http.Request) {
+//		_, mh, err := net.UpgradeToWebSocket(w, r)
+//		...
+//		_ = router.Serve(r.Context(), mh)
+//	}
+func NewWSRouter(opts ...WSRouterOption) *WSRouter {
+	rt := &WSRouter{
+		handlers:    make(map[string]WSHandlerFunc),
+		pending:     make(map[string]*wsPending),
+		timeout:     defaultWSRouterTimeout,
+		concurrency: defaultWSRouterConcurrency,
+	}
+	for _, opt := range opts {
+		opt(rt)
+	}
+	return rt
+}
+
+// WSRouter dispatches the envelopes received from the clients to the handlers of their type,
+// and the replies of the clients to the requests waiting for them.
+type WSRouter struct {
+	mu          sync.RWMutex
+	handlers    map[string]WSHandlerFunc
+	pending     map[string]*wsPending
+	timeout     time.Duration
+	concurrency int
+}
+
+// wsPending is a request to a client waiting for its reply.
+type wsPending struct {
+	client MessageChannel
+	reply  chan *Envelope
+}
+
+// Handle registers the handler of the type, replacing the previous one.
+func (rt *WSRouter) Handle(msgType string, handler WSHandlerFunc) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.handlers[msgType] = handler
+}
+
+// Serve reads the envelopes of the client until its connection is closed or ctx is done.
+// The handlers run concurrently, one goroutine per envelope up to the concurrency of the
+// router, so that they can wait for a reply of the client (Request).
+func (rt *WSRouter) Serve(ctx context.Context, client MessageChannel) error {
+	// The reads never wait for a handler, they carry the replies the handlers may wait for
+	inflight := make(chan struct{}, rt.concurrency)
+	for {
+		message, err := client.ReceiveMessage()
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var env Envelope
+		if err := json.Unmarshal(message, &env); err != nil || env.Type == "" {
+			rt.sendError(ctx, client, &env, status.Error(codes.InvalidArgument, "invalid envelope"))
+			continue
+		}
+		if env.Version == 0 {
+			env.Version = EnvelopeVersion
+		}
+		if env.Version != EnvelopeVersion {
+			rt.sendError(ctx, client, &env, status.Errorf(codes.FailedPrecondition,
+				"unsupported envelope version %d, want %d", env.Version, EnvelopeVersion))
+			continue
+		}
+		if env.CorrelationID != "" && rt.resolve(client, &env) {
+			continue
+		}
+
+		switch env.Type {
+		case EnvelopeResponse, EnvelopeAck, EnvelopeError:
+			// The reply of a request which timed out
+			getLoggerFromContext(ctx).Debug("Dropped websocket reply without request",
+				zap.String("client_id", client.ID()),
+				zap.String("type", env.Type),
+				zap.String("correlation_id", env.CorrelationID))
+			continue
+		}
+
+		rt.mu.RLock()
+		handler, ok := rt.handlers[env.Type]
+		rt.mu.RUnlock()
+		if !ok {
+			rt.sendError(ctx, client, &env, status.Errorf(codes.Unimplemented, "unknown message type %s", env.Type))
+			continue
+		}
+		select {
+		case inflight <- struct{}{}:
+		default:
+			rt.sendError(ctx, client, &env, status.Errorf(codes.ResourceExhausted,
+				"too many messages in progress, at most %d", rt.concurrency))
+			continue
+		}
+		go rt.dispatch(ctx, client, &env, handler, func() { <-inflight })
+	}
+}
+
+// dispatch runs the handler of the envelope and sends its reply, release is called when the handler returns.
+func (rt *WSRouter) dispatch(ctx context.Context, client MessageChannel, env *Envelope, handler WSHandlerFunc, release func()) {
+	ctx, cancel := context.WithTimeout(ctx, rt.timeout)
+	defer cancel()
+
+	var (
+		result any
+		err    error
+	)
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				reportPanic(getLoggerFromContext(ctx).With(zap.String("client_id", client.ID())),
+					panicKindWebsocket, env.Type, r)
+				err = status.Error(codes.Internal, "internal error")
+			}
+		}()
+		result, err = handler(ctx, client, env)
+	}()
+	release()
+	if err == nil && ctx.Err() != nil {
+		err = status.FromContextError(ctx.Err()).Err()
+	}
+	if env.ID == "" {
+		if err != nil {
+			getLoggerFromContext(ctx).Warn("Websocket handler failed",
+				zap.String("client_id", client.ID()),
+				zap.String("type", env.Type),
+				zap.Error(err))
+		}
+		return
+	}
+	reply, me := env.reply(result, err)
+	if me != nil {
+		reply, _ = env.reply(nil, status.Errorf(codes.Internal, "failed to marshal response: %v", me))
+	}
+	rt.send(ctx, client, reply)
+}
+
+// sendError sends the error frame of an invalid envelope.
+func (rt *WSRouter) sendError(ctx context.Context, client MessageChannel, env *Envelope, err error) {
+	reply, _ := env.reply(nil, err)
+	rt.send(ctx, client, reply)
+}
+
+func (rt *WSRouter) send(ctx context.Context, client MessageChannel, env *Envelope) {
+	if err := SendEnvelope(client, env); err != nil {
+		getLoggerFromContext(ctx).Warn("Failed to send websocket envelope",
+			zap.String("client_id", client.ID()),
+			zap.String("type", env.Type),
+			zap.Error(err))
+	}
+}
+
+// SendEnvelope sends the envelope to the client.
+func SendEnvelope(client MessageChannel, env *Envelope) error {
+	b, err := json.Marshal(env)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s envelope: %w", env.Type, err)
+	}
+	return client.SendMessage(b)
+}
+
+// Request sends an envelope of the type to the client and waits for its response or its
+// acknowledgement, until ctx is done or the timeout of the router. An error frame of the client
+// is returned as its status error. The client is served by Serve, which reads the reply.
+func (rt *WSRouter) Request(ctx context.Context, client MessageChannel, msgType string, payload any) (*Envelope, error) {
+	env, err := NewEnvelope(msgType, payload)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rt.timeout)
+		defer cancel()
+	}
+
+	p := &wsPending{client: client, reply: make(chan *Envelope, 1)}
+	rt.mu.Lock()
+	rt.pending[env.ID] = p
+	rt.mu.Unlock()
+	defer func() {
+		rt.mu.Lock()
+		delete(rt.pending, env.ID)
+		rt.mu.Unlock()
+	}()
+
+	if err := SendEnvelope(client, env); err != nil {
+		return nil, err
+	}
+	select {
+	case reply := <-p.reply:
+		if err := reply.Err(); err != nil {
+			return nil, err
+		}
+		return reply, nil
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// resolve delivers the reply to the request of the client it correlates, if any.
+func (rt *WSRouter) resolve(client MessageChannel, env *Envelope) bool {
+	rt.mu.RLock()
+	p, ok := rt.pending[env.CorrelationID]
+	rt.mu.RUnlock()
+	if !ok || p.client != client {
+		return false
+	}
+	select {
+	case p.reply <- env:
+	default:
+		// A reply was already delivered
+	}
+	return true
+}
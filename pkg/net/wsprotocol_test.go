@@ -0,0 +1,197 @@
+package net
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func Test_WSRouter(t *testing.T) {
+	router := NewWSRouter(WithWSRouterTimeout(time.Second))
+	router.Handle("echo", func(ctx context.Context, client MessageChannel, msg *Envelope) (any, error) {
+		var in wrapperspb.StringValue
+		if err := msg.Decode(&in); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		return wrapperspb.String(strings.ToUpper(in.GetValue())), nil
+	})
+	router.Handle("notify", func(ctx context.Context, client MessageChannel, msg *Envelope) (any, error) {
+		return nil, nil
+	})
+	router.Handle("missing", func(ctx context.Context, client MessageChannel, msg *Envelope) (any, error) {
+		return nil, status.Error(codes.NotFound, "nothing here")
+	})
+	router.Handle("ask", func(ctx context.Context, client MessageChannel, msg *Envelope) (any, error) {
+		// The client answers the server request while the handler waits
+		reply, err := router.Request(ctx, client, "question", map[string]string{"q": "name?"})
+		if err != nil {
+			return nil, err
+		}
+		return json.RawMessage(reply.Payload), nil
+	})
+
+	hub := NewHub()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, mh, err := UpgradeToWebSocketCustom(hub, w, r)
+		if err != nil {
+			return
+		}
+		_ = router.Serve(r.Context(), mh)
+		_ = mh.Close()
+	}))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial err: %v", err)
+	}
+	defer conn.Close()
+
+	// roundTrip sends the envelope and returns the reply correlated to it,
+	// answering the server requests on the way
+	roundTrip := func(raw []byte, id string) *Envelope {
+		t.Helper()
+		if err := conn.WriteMessage(websocket.TextMessage, raw); err != nil {
+			t.Fatalf("write err: %v", err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			var env Envelope
+			if err := conn.ReadJSON(&env); err != nil {
+				t.Fatalf("read err: %v", err)
+			}
+			if env.Type == "question" {
+				answer, _ := NewEnvelope(EnvelopeResponse, map[string]string{"a": "gopher"})
+				answer.CorrelationID = env.ID
+				_ = conn.WriteJSON(answer)
+				continue
+			}
+			if env.CorrelationID == id {
+				return &env
+			}
+		}
+	}
+	request := func(msgType string, payload any) *Envelope {
+		t.Helper()
+		env, err := NewEnvelope(msgType, payload)
+		if err != nil {
+			t.Fatalf("NewEnvelope err: %v", err)
+		}
+		raw, _ := json.Marshal(env)
+		return roundTrip(raw, env.ID)
+	}
+
+	reply := request("echo", wrapperspb.String("hello"))
+	var out wrapperspb.StringValue
+	if reply.Type != EnvelopeResponse || reply.Decode(&out) != nil || out.GetValue() != "HELLO" {
+		t.Fatalf("echo reply: %+v", reply)
+	}
+	if reply = request("notify", nil); reply.Type != EnvelopeAck {
+		t.Fatalf("notify reply: %+v", reply)
+	}
+	if reply = request("missing", nil); status.Code(reply.Err()) != codes.NotFound {
+		t.Fatalf("missing reply: %+v", reply)
+	}
+	if reply = request("unknown", nil); status.Code(reply.Err()) != codes.Unimplemented {
+		t.Fatalf("unknown reply: %+v", reply)
+	}
+	if reply = roundTrip([]byte(`{"v":2,"type":"echo","id":"v2"}`), "v2"); status.Code(reply.Err()) != codes.FailedPrecondition {
+		t.Fatalf("version reply: %+v", reply)
+	}
+	if reply = roundTrip([]byte(`not json`), ""); status.Code(reply.Err()) != codes.InvalidArgument {
+		t.Fatalf("invalid reply: %+v", reply)
+	}
+	reply = request("ask", nil)
+	var answer map[string]string
+	if reply.Type != EnvelopeResponse || reply.Decode(&answer) != nil || answer["a"] != "gopher" {
+		t.Fatalf("ask reply: %+v", reply)
+	}
+}
+
+func Test_WSRouterRequestTimeout(t *testing.T) {
+	hub := NewHub()
+	client := newIndexedClients(hub, 1)[0]
+	router := NewWSRouter(WithWSRouterTimeout(50 * time.Millisecond))
+
+	// Nobody serves the client, the request is not answered
+	_, err := router.Request(context.Background(), client, "question", nil)
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("Request err: %v", err)
+	}
+	if len(router.pending) != 0 {
+		t.Fatalf("pending request not removed")
+	}
+}
+
+func Test_WSRouterConcurrency(t *testing.T) {
+	release := make(chan struct{})
+	router := NewWSRouter(WithWSRouterTimeout(time.Second), WithWSRouterConcurrency(1))
+	router.Handle("block", func(ctx context.Context, client MessageChannel, msg *Envelope) (any, error) {
+		<-release
+		return nil, nil
+	})
+	router.Handle("panic", func(ctx context.Context, client MessageChannel, msg *Envelope) (any, error) {
+		panic("handler failed")
+	})
+
+	hub := NewHub()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, mh, err := UpgradeToWebSocketCustom(hub, w, r)
+		if err != nil {
+			return
+		}
+		_ = router.Serve(r.Context(), mh)
+		_ = mh.Close()
+	}))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial err: %v", err)
+	}
+	defer conn.Close()
+
+	send := func(msgType string) *Envelope {
+		t.Helper()
+		env, _ := NewEnvelope(msgType, nil)
+		if err := conn.WriteJSON(env); err != nil {
+			t.Fatalf("write err: %v", err)
+		}
+		return env
+	}
+	read := func() *Envelope {
+		t.Helper()
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var env Envelope
+		if err := conn.ReadJSON(&env); err != nil {
+			t.Fatalf("read err: %v", err)
+		}
+		return &env
+	}
+
+	// The second envelope is rejected while the first handler runs
+	first := send("block")
+	second := send("block")
+	if reply := read(); reply.CorrelationID != second.ID || status.Code(reply.Err()) != codes.ResourceExhausted {
+		t.Fatalf("second reply: %+v", reply)
+	}
+	close(release)
+	if reply := read(); reply.CorrelationID != first.ID || reply.Type != EnvelopeAck {
+		t.Fatalf("first reply: %+v", reply)
+	}
+
+	// A panic is answered INTERNAL, and releases its slot
+	for range 2 {
+		env := send("panic")
+		if reply := read(); reply.CorrelationID != env.ID || status.Code(reply.Err()) != codes.Internal {
+			t.Fatalf("panic reply: %+v", reply)
+		}
+	}
+}